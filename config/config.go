@@ -4,16 +4,70 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
+	"time"
 )
 
 type Config struct {
 	Raptor struct {
-		Host      string `yaml:"host"`
-		Port      int    `yaml:"port"`
-		Directory string `yaml:"directory"`
-		MaxConn   int    `yaml:"max_connection"`
-		Auth      string `yaml:"auth"`
+		Host        string `yaml:"host"`
+		Port        int    `yaml:"port"`
+		Directory   string `yaml:"directory"`
+		Engine      string `yaml:"engine"`
+		MaxConn     int    `yaml:"max_connection"`
+		Auth        string `yaml:"auth"`
+		PubSubLimit int    `yaml:"pubsub_limit"`
+
+		NotifyKeyspaceEvents string `yaml:"notify_keyspace_events"`
+		LazyFreeLazyUserDel  bool   `yaml:"lazyfree_lazy_user_del"`
+		DBFilename           string `yaml:"dbfilename"`
+		AppendFsync          string `yaml:"appendfsync"` // always, everysec or no
+		CoalesceWrites       bool   `yaml:"coalesce_writes"`
+
+		ReplicaOf       string `yaml:"replicaof"`
+		MasterAuth      string `yaml:"masterauth"`
+		ReplicaReadOnly bool   `yaml:"replica_read_only"`
+		ReplBacklogSize int    `yaml:"repl_backlog_size"`
+
+		RaftID        string   `yaml:"raft_id"`
+		RaftAddr      string   `yaml:"raft_addr"`
+		RaftDir       string   `yaml:"raft_dir"`
+		RaftBootstrap []string `yaml:"raft_bootstrap"`
+		RaftImport    bool     `yaml:"raft_import"`
+
+		ClusterEnabled    bool   `yaml:"cluster_enabled"`
+		ClusterConfigFile string `yaml:"cluster_config_file"`
 	} `yaml:"raptor"`
+
+	Storage Storage `yaml:"storage"`
+}
+
+// Storage tunes the badger engine, the settings left out, or zero, keeping
+// the defaults of badger. Sizes are in bytes.
+type Storage struct {
+	SyncWrites       bool   `yaml:"sync_writes"`
+	MemTableSize     int64  `yaml:"memtable_size"`
+	BlockCacheSize   int64  `yaml:"block_cache_size"`
+	IndexCacheSize   int64  `yaml:"index_cache_size"`
+	ValueThreshold   int64  `yaml:"value_threshold"`
+	Compression      string `yaml:"compression"` // none, snappy or zstd
+	ZSTDLevel        int    `yaml:"zstd_level"`
+	NumCompactors    int    `yaml:"num_compactors"`
+	InMemory         bool   `yaml:"in_memory"`
+	LogLevel         string `yaml:"log_level"` // debug, info, warning or error
+	ValueLogFileSize int64  `yaml:"value_log_file_size"`
+
+	// the master key of encryption at rest, 16, 24 or 32 bytes for
+	// AES-128, 192 or 256, read from a file or an environment variable
+	EncryptionKeyFile             string        `yaml:"encryption_key_file"`
+	EncryptionKeyEnv              string        `yaml:"encryption_key_env"`
+	EncryptionKeyRotationDuration time.Duration `yaml:"encryption_key_rotation_duration"`
+
+	// the value log GC runs every GCInterval, negative to never run it,
+	// rewriting the files with at least GCDiscardRatio of them stale, but
+	// not in the daily GCQuietHours, local time, like "08:00-20:00"
+	GCInterval     time.Duration `yaml:"gc_interval"`
+	GCDiscardRatio float64       `yaml:"gc_discard_ratio"`
+	GCQuietHours   string        `yaml:"gc_quiet_hours"`
 }
 
 func LoadConfig(path string) (*Config, error) {
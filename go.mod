@@ -4,7 +4,10 @@ go 1.21.1
 
 require (
 	github.com/dgraph-io/badger/v4 v4.2.0
+	github.com/tidwall/btree v1.1.0
+	github.com/tidwall/match v1.1.1
 	github.com/tidwall/redcon v1.6.2
+	go.etcd.io/bbolt v1.3.9
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -21,8 +24,6 @@ require (
 	github.com/klauspost/compress v1.12.3 // indirect
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/tidwall/btree v1.1.0 // indirect
-	github.com/tidwall/match v1.1.1 // indirect
 	go.opencensus.io v0.22.5 // indirect
 	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/qichengzx/raptor/config"
 	"github.com/qichengzx/raptor/server"
+	"log"
+	"os"
 )
 
 func main() {
@@ -11,6 +15,100 @@ func main() {
 		panic(err)
 	}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-rdb":
+			importRDB(conf, os.Args[2:])
+			return
+		case "backup":
+			backup(conf, os.Args[2:])
+			return
+		case "load-backup":
+			loadBackup(conf, os.Args[2:])
+			return
+		case "rekey":
+			rekey(conf, os.Args[2:])
+			return
+		}
+	}
+
 	svr := server.New(conf)
 	svr.Run()
 }
+
+// importRDB runs `raptor import-rdb [-db n] [-skip-lists] <file>`
+func importRDB(conf *config.Config, args []string) {
+	fs := flag.NewFlagSet("import-rdb", flag.ExitOnError)
+	db := fs.Int("db", 0, "Redis database to import")
+	skipLists := fs.Bool("skip-lists", false, "skip the lists, which are not supported, instead of failing")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: raptor import-rdb [-db n] [-skip-lists] <file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := server.ImportRDB(conf, fs.Arg(0), *db, *skipLists); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// backup runs `raptor backup [-since version] <file>`
+func backup(conf *config.Config, args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	since := fs.Uint64("since", 0, "version returned by the previous backup, for an incremental one")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: raptor backup [-since version] <file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := server.Backup(conf, fs.Arg(0), *since); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadBackup runs `raptor load-backup <file>...`
+func loadBackup(conf *config.Config, args []string) {
+	fs := flag.NewFlagSet("load-backup", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: raptor load-backup <full backup> [incremental backup...]")
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := server.LoadBackup(conf, fs.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// rekey runs `raptor rekey [-new-key-file path | -new-key-env name]`
+func rekey(conf *config.Config, args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	file := fs.String("new-key-file", "", "file holding the new encryption key")
+	env := fs.String("new-key-env", "", "environment variable holding the new encryption key")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: raptor rekey [-new-key-file path | -new-key-env name]")
+		fmt.Fprintln(fs.Output(), "the current key is the one of config.yaml, if any")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := server.Rekey(conf, *file, *env); err != nil {
+		log.Fatal(err)
+	}
+}
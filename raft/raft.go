@@ -0,0 +1,1356 @@
+// Package raft replicates a log of commands over a group of nodes with the
+// Raft consensus algorithm: leader election, log replication, snapshots and
+// membership changes of one server at a time.
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader      = errors.New("raft: not the leader")
+	ErrLeadershipLost = errors.New("raft: leadership lost before the entry was applied")
+	ErrTimeout        = errors.New("raft: timed out")
+	ErrShutdown       = errors.New("raft: node is shut down")
+	ErrConfigPending  = errors.New("raft: a membership change is in progress")
+	ErrUnknownServer  = errors.New("raft: no such server")
+	ErrServerExists   = errors.New("raft: server already a member")
+	errSnapshotTooOld = errors.New("raft: snapshot older than the log")
+	errImportAlone    = errors.New("raft: importing a state takes a bootstrap of the node alone")
+)
+
+const (
+	defaultHeartbeatInterval = 100 * time.Millisecond
+	defaultElectionTimeout   = time.Second
+	defaultSnapshotThreshold = 8192
+	defaultSnapshotChunkSize = 1 << 20
+
+	// maxAppendEntries is the most entries sent in one AppendEntries
+	maxAppendEntries = 256
+)
+
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+type EntryType uint8
+
+const (
+	EntryCommand EntryType = iota
+	// EntryNoop is appended by a new leader, to commit the entries of the
+	// previous terms
+	EntryNoop
+	// EntryConfig holds a gob encoded Configuration
+	EntryConfig
+)
+
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// Server is a member of the group. Client is the address clients reach it
+// at, for redirects.
+type Server struct {
+	ID     string
+	Addr   string
+	Client string
+}
+
+type Configuration struct {
+	Servers []Server
+}
+
+func (c Configuration) server(id string) (Server, bool) {
+	for _, s := range c.Servers {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Server{}, false
+}
+
+func (c Configuration) clone() Configuration {
+	return Configuration{Servers: append([]Server(nil), c.Servers...)}
+}
+
+func encodeConfiguration(c Configuration) []byte {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(c)
+	return buf.Bytes()
+}
+
+func decodeConfiguration(data []byte) Configuration {
+	var c Configuration
+	gob.NewDecoder(bytes.NewReader(data)).Decode(&c)
+	return c
+}
+
+// FSM is the state machine the committed commands are applied to.
+type FSM interface {
+	// Apply applies a command, in the order of the log. What it returns is
+	// handed to Propose on the leader.
+	Apply(e *Entry) interface{}
+	// Snapshot writes the state, as of the last entry applied.
+	Snapshot(w io.Writer) error
+	// Restore replaces the state with a snapshot.
+	Restore(r io.Reader) error
+}
+
+type Config struct {
+	ID        string
+	Addr      string
+	Dir       string // where the log, the vote and snapshots are kept, "" for memory
+	Transport Transport
+	FSM       FSM
+
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	// SnapshotThreshold is the number of entries applied after which the
+	// log is compacted into a snapshot
+	SnapshotThreshold uint64
+	// SnapshotChunkSize is the most bytes of a snapshot sent to a follower
+	// in one InstallSnapshot
+	SnapshotChunkSize int
+
+	// Bootstrap is the first configuration of a new group, taken when the
+	// log is empty. Nodes joining an existing group leave it empty.
+	Bootstrap []Server
+	// Import writes the state a new group starts from, taken as its first
+	// snapshot instead of an empty state. The group is bootstrapped with the
+	// node alone then, the others joining it with AddServer.
+	Import func(w io.Writer) error
+}
+
+// Status describes a node, as returned by Node.Status.
+type Status struct {
+	ID            string
+	Role          Role
+	Term          uint64
+	Leader        Server
+	CommitIndex   uint64
+	LastApplied   uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+	Configuration Configuration
+}
+
+type VoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendResponse struct {
+	Term    uint64
+	Success bool
+	// ConflictIndex is where the leader should resume from on failure
+	ConflictIndex uint64
+}
+
+// SnapshotRequest carries a chunk of a snapshot, Data being its bytes from
+// Offset on, Done telling the last one.
+type SnapshotRequest struct {
+	Term          uint64
+	LeaderID      string
+	LastIndex     uint64
+	LastTerm      uint64
+	Configuration Configuration
+	Offset        int64
+	Data          []byte
+	Done          bool
+}
+
+type SnapshotResponse struct {
+	Term uint64
+	// Offset is how much of the snapshot the follower has, where the
+	// leader resumes from
+	Offset int64
+	// Installed is set once the follower has the state of the snapshot
+	Installed bool
+}
+
+type applyResult struct {
+	value interface{}
+	err   error
+}
+
+type waiter struct {
+	term uint64
+	ch   chan applyResult
+}
+
+// peer is the replication of the leader to a follower.
+type peer struct {
+	server  Server
+	trigger chan struct{}
+	stop    chan struct{}
+	contact time.Time
+
+	// the snapshot being sent, and where to send it from
+	snapshot       snapshotMeta
+	snapshotOffset int64
+}
+
+// Node is a member of a raft group.
+type Node struct {
+	conf  Config
+	trans Transport
+	fsm   FSM
+	st    *storage
+
+	mu       sync.Mutex
+	role     Role
+	term     uint64
+	votedFor string
+	leader   string
+
+	// log[0] stands for the last snapshot, with its index and term
+	log         []Entry
+	snapConfig  Configuration
+	config      Configuration
+	configIndex uint64
+	commitIndex uint64
+	lastApplied uint64
+
+	lastContact     time.Time
+	electionTimeout time.Duration
+	votes           int
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	peers      map[string]*peer
+	readyIndex uint64
+
+	waiters map[uint64]waiter
+	applied *sync.Cond
+	stopped chan struct{}
+	closed  bool
+
+	// applyMu is held while the state machine changes
+	applyMu sync.Mutex
+}
+
+// New starts a node, restoring its state from conf.Dir.
+func New(conf Config) (*Node, error) {
+	if conf.HeartbeatInterval == 0 {
+		conf.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if conf.ElectionTimeout == 0 {
+		conf.ElectionTimeout = defaultElectionTimeout
+	}
+	if conf.SnapshotThreshold == 0 {
+		conf.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if conf.SnapshotChunkSize == 0 {
+		conf.SnapshotChunkSize = defaultSnapshotChunkSize
+	}
+	if conf.Import != nil && (len(conf.Bootstrap) != 1 || conf.Bootstrap[0].ID != conf.ID) {
+		return nil, errImportAlone
+	}
+
+	st, err := openStorage(conf.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		conf:        conf,
+		trans:       conf.Transport,
+		fsm:         conf.FSM,
+		st:          st,
+		log:         []Entry{{}},
+		lastContact: time.Now(),
+		waiters:     make(map[uint64]waiter),
+		peers:       make(map[string]*peer),
+		stopped:     make(chan struct{}),
+	}
+	n.applied = sync.NewCond(&n.mu)
+	n.resetElectionTimeout()
+
+	if err := n.restore(); err != nil {
+		st.close()
+		return nil, err
+	}
+
+	go n.tick()
+	go n.applyCommitted()
+
+	return n, nil
+}
+
+// restore loads the vote, the last snapshot and the log.
+func (n *Node) restore() error {
+	hs, err := n.st.loadState()
+	if err != nil {
+		return err
+	}
+	n.term, n.votedFor = hs.Term, hs.VotedFor
+
+	meta, err := n.st.loadSnapshotMeta()
+	switch err {
+	case nil:
+		r, err := n.st.openSnapshot()
+		if err != nil {
+			return err
+		}
+		err = n.fsm.Restore(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		n.log[0] = Entry{Index: meta.Index, Term: meta.Term}
+		n.snapConfig = meta.Configuration
+		n.commitIndex, n.lastApplied = meta.Index, meta.Index
+	case errNoSnapshot:
+	default:
+		return err
+	}
+
+	entries, err := n.st.loadLog()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Index > n.log[0].Index {
+			n.log = append(n.log, e)
+		}
+	}
+
+	if n.lastIndex() == 0 && n.conf.Import != nil {
+		// the state machine holds the state imported already
+		var meta = snapshotMeta{Index: 1, Term: 1, Configuration: Configuration{Servers: n.conf.Bootstrap}}
+		if err := n.st.saveSnapshot(meta, n.conf.Import); err != nil {
+			return err
+		}
+		n.log[0] = Entry{Index: meta.Index, Term: meta.Term}
+		n.snapConfig = meta.Configuration
+		n.commitIndex, n.lastApplied = meta.Index, meta.Index
+		n.term = 1
+		if err := n.persistState(); err != nil {
+			return err
+		}
+	} else if n.lastIndex() == 0 && len(n.conf.Bootstrap) > 0 {
+		var e = Entry{
+			Index: 1,
+			Term:  1,
+			Type:  EntryConfig,
+			Data:  encodeConfiguration(Configuration{Servers: n.conf.Bootstrap}),
+		}
+		if err := n.st.appendLog([]Entry{e}); err != nil {
+			return err
+		}
+		n.log = append(n.log, e)
+		if n.term < 1 {
+			n.term = 1
+			if err := n.persistState(); err != nil {
+				return err
+			}
+		}
+	}
+	n.updateConfig()
+
+	return nil
+}
+
+// Shutdown stops the node, which can't be used anymore.
+func (n *Node) Shutdown() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.stopped)
+	n.stopPeers()
+	n.failWaiters(ErrShutdown, 0)
+	n.applied.Broadcast()
+	n.mu.Unlock()
+
+	// wait for the entry being applied
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	return n.st.close()
+}
+
+// Status returns the state of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var leader, _ = n.config.server(n.leader)
+	return Status{
+		ID:            n.conf.ID,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        leader,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastIndex:     n.lastIndex(),
+		SnapshotIndex: n.log[0].Index,
+		Configuration: n.config.clone(),
+	}
+}
+
+// Leader returns the leader as far as the node knows, false when unknown.
+func (n *Node) Leader() (Server, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.leader == "" {
+		return Server{}, false
+	}
+	return n.config.server(n.leader)
+}
+
+// Propose appends a command to the log and returns what the state machine
+// returned once it is committed and applied.
+func (n *Node) Propose(data []byte, timeout time.Duration) (interface{}, error) {
+	return n.propose(EntryCommand, data, timeout)
+}
+
+// WaitReady blocks until the leader has applied the entries of the previous
+// terms, so that its state machine is up to date.
+func (n *Node) WaitReady(timeout time.Duration) error {
+	var deadline = time.Now().Add(timeout)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		if n.closed {
+			return ErrShutdown
+		}
+		if n.role != Leader {
+			return ErrNotLeader
+		}
+		if n.lastApplied >= n.readyIndex {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+
+		// woken up by every entry applied, and checked again at times in
+		// case none comes
+		timer := time.AfterFunc(n.conf.HeartbeatInterval, n.applied.Broadcast)
+		n.applied.Wait()
+		timer.Stop()
+	}
+}
+
+// Barrier returns once the entries appended before it are applied.
+func (n *Node) Barrier(timeout time.Duration) error {
+	_, err := n.propose(EntryNoop, nil, timeout)
+	return err
+}
+
+// AddServer makes s a member of the group.
+func (n *Node) AddServer(s Server, timeout time.Duration) error {
+	n.mu.Lock()
+	if _, ok := n.config.server(s.ID); ok {
+		n.mu.Unlock()
+		return ErrServerExists
+	}
+	var c = n.config.clone()
+	c.Servers = append(c.Servers, s)
+	n.mu.Unlock()
+
+	_, err := n.propose(EntryConfig, encodeConfiguration(c), timeout)
+	return err
+}
+
+// RemoveServer removes the server id from the group.
+func (n *Node) RemoveServer(id string, timeout time.Duration) error {
+	n.mu.Lock()
+	if _, ok := n.config.server(id); !ok {
+		n.mu.Unlock()
+		return ErrUnknownServer
+	}
+	var c Configuration
+	for _, s := range n.config.Servers {
+		if s.ID != id {
+			c.Servers = append(c.Servers, s)
+		}
+	}
+	n.mu.Unlock()
+
+	_, err := n.propose(EntryConfig, encodeConfiguration(c), timeout)
+	return err
+}
+
+func (n *Node) propose(typ EntryType, data []byte, timeout time.Duration) (interface{}, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrShutdown
+	}
+	if n.role != Leader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	// one membership change at a time, each one effective once appended
+	if typ == EntryConfig && n.configIndex > n.commitIndex {
+		n.mu.Unlock()
+		return nil, ErrConfigPending
+	}
+
+	var e = Entry{Index: n.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	if err := n.st.appendLog([]Entry{e}); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	n.log = append(n.log, e)
+	if typ == EntryConfig {
+		n.updateConfig()
+		n.startPeers()
+	}
+
+	var w = waiter{term: n.term, ch: make(chan applyResult, 1)}
+	n.waiters[e.Index] = w
+	n.triggerPeers()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-w.ch:
+		return res.value, res.err
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-n.stopped:
+		return nil, ErrShutdown
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, false when it is not in
+// the log.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	var first = n.log[0].Index
+	if index < first || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-first].Term, true
+}
+
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index-n.log[0].Index]
+}
+
+func (n *Node) persistState() error {
+	return n.st.saveState(hardState{Term: n.term, VotedFor: n.votedFor})
+}
+
+func (n *Node) resetElectionTimeout() {
+	var t = n.conf.ElectionTimeout
+	n.electionTimeout = t + time.Duration(rand.Int63n(int64(t)))
+}
+
+// updateConfig takes the last configuration of the log, the one of the
+// snapshot when there is none.
+func (n *Node) updateConfig() {
+	for i := len(n.log) - 1; i > 0; i-- {
+		if n.log[i].Type == EntryConfig {
+			n.config = decodeConfiguration(n.log[i].Data)
+			n.configIndex = n.log[i].Index
+			return
+		}
+	}
+	n.config = n.snapConfig.clone()
+	n.configIndex = n.log[0].Index
+}
+
+// configAt returns the configuration as of index.
+func (n *Node) configAt(index uint64) Configuration {
+	for i := int(index - n.log[0].Index); i > 0; i-- {
+		if n.log[i].Type == EntryConfig {
+			return decodeConfiguration(n.log[i].Data)
+		}
+	}
+	return n.snapConfig.clone()
+}
+
+func (n *Node) isMember() bool {
+	_, ok := n.config.server(n.conf.ID)
+	return ok
+}
+
+func (n *Node) quorum() int {
+	return len(n.config.Servers)/2 + 1
+}
+
+// becomeFollower steps down to follower of term.
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.persistState(); err != nil {
+			log.Printf("raft: saving the state: %v", err)
+		}
+	}
+	if n.role == Leader {
+		n.stopPeers()
+		n.failWaiters(ErrLeadershipLost, n.commitIndex)
+	}
+	if n.role != Follower {
+		log.Printf("raft: %s is follower in term %d", n.conf.ID, n.term)
+	}
+	n.role = Follower
+}
+
+// failWaiters fails the proposals past index, the ones committed already
+// get their result once applied.
+func (n *Node) failWaiters(err error, index uint64) {
+	for i, w := range n.waiters {
+		if i > index {
+			w.ch <- applyResult{err: err}
+			delete(n.waiters, i)
+		}
+	}
+}
+
+// tick starts elections when the leader goes quiet, and has the leader step
+// down when it can't reach a quorum.
+func (n *Node) tick() {
+	var ticker = time.NewTicker(n.conf.HeartbeatInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		switch n.role {
+		case Leader:
+			n.checkQuorum()
+		default:
+			if time.Since(n.lastContact) >= n.electionTimeout && n.isMember() {
+				n.startElection()
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) checkQuorum() {
+	var contacts = 0
+	if n.isMember() {
+		contacts++
+	}
+	for id, p := range n.peers {
+		if _, ok := n.config.server(id); ok && time.Since(p.contact) < n.conf.ElectionTimeout {
+			contacts++
+		}
+	}
+	if contacts < n.quorum() {
+		log.Printf("raft: %s lost contact with a quorum", n.conf.ID)
+		n.leader = ""
+		n.becomeFollower(n.term)
+		n.lastContact = time.Now()
+	}
+}
+
+func (n *Node) startElection() {
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.conf.ID
+	n.leader = ""
+	n.votes = 1
+	n.lastContact = time.Now()
+	n.resetElectionTimeout()
+	if err := n.persistState(); err != nil {
+		log.Printf("raft: saving the state: %v", err)
+		return
+	}
+	log.Printf("raft: %s starts an election in term %d", n.conf.ID, n.term)
+
+	if n.votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	var req = &VoteRequest{
+		Term:         n.term,
+		CandidateID:  n.conf.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, s := range n.config.Servers {
+		if s.ID == n.conf.ID {
+			continue
+		}
+		go n.requestVote(s, req)
+	}
+}
+
+func (n *Node) requestVote(s Server, req *VoteRequest) {
+	resp, err := n.trans.RequestVote(s.Addr, req)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return
+	}
+	if n.role != Candidate || n.term != req.Term || !resp.Granted {
+		return
+	}
+
+	n.votes++
+	if n.votes >= n.quorum() {
+		n.becomeLeader()
+	}
+}
+
+func (n *Node) becomeLeader() {
+	log.Printf("raft: %s is leader in term %d", n.conf.ID, n.term)
+	n.role = Leader
+	n.leader = n.conf.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+
+	// committing an entry of its own term commits the ones before
+	var e = Entry{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop}
+	if err := n.st.appendLog([]Entry{e}); err != nil {
+		log.Printf("raft: appending to the log: %v", err)
+		n.becomeFollower(n.term)
+		return
+	}
+	n.log = append(n.log, e)
+	n.readyIndex = e.Index
+
+	n.startPeers()
+	n.triggerPeers()
+	n.advanceCommit()
+}
+
+// startPeers starts replicating to the members, and stops replicating to
+// the servers removed.
+func (n *Node) startPeers() {
+	for id, p := range n.peers {
+		if _, ok := n.config.server(id); !ok {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+	for _, s := range n.config.Servers {
+		if s.ID == n.conf.ID || n.peers[s.ID] != nil {
+			continue
+		}
+		var p = &peer{
+			server:  s,
+			trigger: make(chan struct{}, 1),
+			stop:    make(chan struct{}),
+			contact: time.Now(),
+		}
+		n.peers[s.ID] = p
+		n.nextIndex[s.ID] = n.lastIndex() + 1
+		n.matchIndex[s.ID] = 0
+		go n.replicate(p, n.term)
+	}
+}
+
+func (n *Node) stopPeers() {
+	for id, p := range n.peers {
+		close(p.stop)
+		delete(n.peers, id)
+	}
+}
+
+func (n *Node) triggerPeers() {
+	for _, p := range n.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends the entries, or heartbeats, to a follower for as long as
+// the node leads in term.
+func (n *Node) replicate(p *peer, term uint64) {
+	var ticker = time.NewTicker(n.conf.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-n.stopped:
+			return
+		case <-p.trigger:
+		case <-ticker.C:
+		}
+
+		for n.sendAppend(p, term) {
+		}
+	}
+}
+
+// sendAppend sends the follower what it misses, it returns true when there
+// is more to send right away.
+func (n *Node) sendAppend(p *peer, term uint64) bool {
+	n.mu.Lock()
+	if n.role != Leader || n.term != term {
+		n.mu.Unlock()
+		return false
+	}
+
+	var next = n.nextIndex[p.server.ID]
+	if next <= n.log[0].Index {
+		n.mu.Unlock()
+		return n.sendSnapshot(p, term)
+	}
+
+	var (
+		prev        = next - 1
+		prevTerm, _ = n.termAt(prev)
+		last        = n.lastIndex()
+	)
+	if last-prev > maxAppendEntries {
+		last = prev + maxAppendEntries
+	}
+	var req = &AppendRequest{
+		Term:         term,
+		LeaderID:     n.conf.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  prevTerm,
+		Entries:      append([]Entry(nil), n.log[prev+1-n.log[0].Index:last+1-n.log[0].Index]...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	resp, err := n.trans.AppendEntries(p.server.Addr, req)
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.term {
+		n.leader = ""
+		n.becomeFollower(resp.Term)
+		return false
+	}
+	if n.role != Leader || n.term != term {
+		return false
+	}
+	p.contact = time.Now()
+
+	if !resp.Success {
+		var next = resp.ConflictIndex
+		if next == 0 || next > req.PrevLogIndex {
+			next = req.PrevLogIndex
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[p.server.ID] = next
+		return true
+	}
+
+	var match = req.PrevLogIndex + uint64(len(req.Entries))
+	if match > n.matchIndex[p.server.ID] {
+		n.matchIndex[p.server.ID] = match
+	}
+	n.nextIndex[p.server.ID] = match + 1
+	n.advanceCommit()
+
+	return match < n.lastIndex()
+}
+
+// sendSnapshot sends the next chunk of the last snapshot to a follower
+// missing entries that are compacted already, resuming from what the
+// follower has of it.
+func (n *Node) sendSnapshot(p *peer, term uint64) bool {
+	n.applyMu.Lock()
+	meta, err := n.st.loadSnapshotMeta()
+	var (
+		data []byte
+		off  int64
+		done bool
+	)
+	if err == nil {
+		if !meta.same(p.snapshot) {
+			p.snapshot, p.snapshotOffset = *meta, 0
+		}
+		off = p.snapshotOffset
+		data, done, err = n.readSnapshotChunk(off)
+	}
+	n.applyMu.Unlock()
+	if err != nil {
+		log.Printf("raft: reading the snapshot for %s: %v", p.server.ID, err)
+		return false
+	}
+
+	resp, err := n.trans.InstallSnapshot(p.server.Addr, &SnapshotRequest{
+		Term:          term,
+		LeaderID:      n.conf.ID,
+		LastIndex:     meta.Index,
+		LastTerm:      meta.Term,
+		Configuration: meta.Configuration,
+		Offset:        off,
+		Data:          data,
+		Done:          done,
+	})
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.term {
+		n.leader = ""
+		n.becomeFollower(resp.Term)
+		return false
+	}
+	if n.role != Leader || n.term != term {
+		return false
+	}
+	p.contact = time.Now()
+
+	if !resp.Installed {
+		// on with the next chunk right away, or from where the follower is
+		// at the next heartbeat
+		p.snapshotOffset = resp.Offset
+		return resp.Offset > off
+	}
+	p.snapshot, p.snapshotOffset = snapshotMeta{}, 0
+	if meta.Index > n.matchIndex[p.server.ID] {
+		n.matchIndex[p.server.ID] = meta.Index
+	}
+	n.nextIndex[p.server.ID] = meta.Index + 1
+
+	return true
+}
+
+// readSnapshotChunk reads the chunk of the last snapshot at off, telling
+// whether it is the last one. applyMu is held.
+func (n *Node) readSnapshotChunk(off int64) ([]byte, bool, error) {
+	r, err := n.st.openSnapshot()
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, false, err
+	}
+	if off > size {
+		off = size
+	}
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+
+	var chunk = size - off
+	if chunk > int64(n.conf.SnapshotChunkSize) {
+		chunk = int64(n.conf.SnapshotChunkSize)
+	}
+	var data = make([]byte, chunk)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, false, err
+	}
+
+	return data, off+chunk == size, nil
+}
+
+// advanceCommit commits the entries of the term stored on a quorum.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+
+		var count = 0
+		for _, s := range n.config.Servers {
+			if s.ID == n.conf.ID || n.matchIndex[s.ID] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applied.Broadcast()
+			n.triggerPeers()
+			break
+		}
+	}
+
+	// a leader removed from the group leads until its removal commits
+	if n.role == Leader && !n.isMember() && n.commitIndex >= n.configIndex {
+		log.Printf("raft: %s left the group", n.conf.ID)
+		n.leader = ""
+		n.becomeFollower(n.term)
+	}
+}
+
+// applyCommitted applies the committed entries to the state machine, in
+// order, and takes a snapshot every SnapshotThreshold entries.
+func (n *Node) applyCommitted() {
+	for {
+		n.applyMu.Lock()
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex && !n.closed {
+			n.mu.Unlock()
+			n.applyMu.Unlock()
+
+			n.mu.Lock()
+			for n.lastApplied >= n.commitIndex && !n.closed {
+				n.applied.Wait()
+			}
+			n.mu.Unlock()
+
+			n.applyMu.Lock()
+			n.mu.Lock()
+		}
+		if n.closed {
+			n.mu.Unlock()
+			n.applyMu.Unlock()
+			return
+		}
+
+		var entries = append([]Entry(nil), n.log[n.lastApplied+1-n.log[0].Index:n.commitIndex+1-n.log[0].Index]...)
+		n.mu.Unlock()
+
+		for i := range entries {
+			var e = &entries[i]
+			var value interface{}
+			if e.Type == EntryCommand {
+				value = n.fsm.Apply(e)
+			}
+
+			n.mu.Lock()
+			n.lastApplied = e.Index
+			if w, ok := n.waiters[e.Index]; ok {
+				delete(n.waiters, e.Index)
+				if w.term == e.Term {
+					w.ch <- applyResult{value: value}
+				} else {
+					w.ch <- applyResult{err: ErrLeadershipLost}
+				}
+			}
+			n.applied.Broadcast()
+			n.mu.Unlock()
+		}
+
+		n.maybeSnapshot()
+		n.applyMu.Unlock()
+	}
+}
+
+// maybeSnapshot compacts the log once enough entries are applied, applyMu
+// being held.
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	var index = n.lastApplied
+	if index-n.log[0].Index < n.conf.SnapshotThreshold {
+		n.mu.Unlock()
+		return
+	}
+	term, _ := n.termAt(index)
+	var meta = snapshotMeta{Index: index, Term: term, Configuration: n.configAt(index)}
+	n.mu.Unlock()
+
+	if err := n.takeSnapshot(meta); err != nil {
+		log.Printf("raft: snapshot at %d: %v", index, err)
+	}
+}
+
+// Snapshot compacts the log into a snapshot of the state machine now.
+func (n *Node) Snapshot() error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	var index = n.lastApplied
+	if index == n.log[0].Index {
+		n.mu.Unlock()
+		return nil
+	}
+	term, _ := n.termAt(index)
+	var meta = snapshotMeta{Index: index, Term: term, Configuration: n.configAt(index)}
+	n.mu.Unlock()
+
+	return n.takeSnapshot(meta)
+}
+
+func (n *Node) takeSnapshot(meta snapshotMeta) error {
+	var start = time.Now()
+	if err := n.st.saveSnapshot(meta, n.fsm.Snapshot); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if meta.Index <= n.log[0].Index {
+		return errSnapshotTooOld
+	}
+	n.log = append([]Entry{{Index: meta.Index, Term: meta.Term}}, n.log[meta.Index+1-n.log[0].Index:]...)
+	n.snapConfig = meta.Configuration
+	if err := n.st.rewriteLog(n.log[1:]); err != nil {
+		return err
+	}
+
+	log.Printf("raft: snapshot at %d taken in %s", meta.Index, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// HandleVote serves RequestVote.
+func (n *Node) HandleVote(req *VoteRequest) *VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return &VoteResponse{Term: n.term}
+	}
+	// a follower hearing from its leader ignores the candidates, such as
+	// servers removed from the group
+	if n.leader != "" && n.role != Candidate && time.Since(n.lastContact) < n.conf.ElectionTimeout {
+		return &VoteResponse{Term: n.term}
+	}
+	if req.Term > n.term {
+		n.leader = ""
+		n.becomeFollower(req.Term)
+	}
+
+	var upToDate = req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor != "" && n.votedFor != req.CandidateID) || !upToDate {
+		return &VoteResponse{Term: n.term}
+	}
+
+	n.votedFor = req.CandidateID
+	if err := n.persistState(); err != nil {
+		log.Printf("raft: saving the state: %v", err)
+		return &VoteResponse{Term: n.term}
+	}
+	n.lastContact = time.Now()
+
+	return &VoteResponse{Term: n.term, Granted: true}
+}
+
+// HandleAppend serves AppendEntries.
+func (n *Node) HandleAppend(req *AppendRequest) *AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return &AppendResponse{Term: n.term}
+	}
+	if req.Term > n.term || n.role != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader = req.LeaderID
+	n.lastContact = time.Now()
+
+	// entries compacted here are committed, hence the same
+	var (
+		first   = n.log[0].Index
+		entries = req.Entries
+		prev    = req.PrevLogIndex
+	)
+	if prev < first {
+		var skip = first - prev
+		if uint64(len(entries)) < skip {
+			return &AppendResponse{Term: n.term, ConflictIndex: first + 1}
+		}
+		entries = entries[skip:]
+		prev = first
+	}
+
+	if prev > n.lastIndex() {
+		return &AppendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	if term, _ := n.termAt(prev); prev > first && term != req.PrevLogTerm {
+		// skip the whole conflicting term
+		var conflict = prev
+		for conflict > first+1 {
+			if t, _ := n.termAt(conflict - 1); t != term {
+				break
+			}
+			conflict--
+		}
+		return &AppendResponse{Term: n.term, ConflictIndex: conflict}
+	}
+
+	var (
+		truncated bool
+		appended  []Entry
+	)
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if term, _ := n.termAt(e.Index); term == e.Term {
+				continue
+			}
+			n.log = n.log[:e.Index-first]
+			truncated = true
+		}
+		appended = entries[i:]
+		break
+	}
+	n.log = append(n.log, appended...)
+
+	var err error
+	if truncated {
+		err = n.st.rewriteLog(n.log[1:])
+	} else if len(appended) > 0 {
+		err = n.st.appendLog(appended)
+	}
+	if err != nil {
+		log.Printf("raft: writing the log: %v", err)
+		return &AppendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	if truncated || len(appended) > 0 {
+		n.updateConfig()
+	}
+
+	var lastNew = prev + uint64(len(entries))
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = req.LeaderCommit
+		if lastNew < n.commitIndex {
+			n.commitIndex = lastNew
+		}
+		n.applied.Broadcast()
+	}
+
+	return &AppendResponse{Term: n.term, Success: true}
+}
+
+// HandleSnapshot serves InstallSnapshot, keeping the chunks aside until the
+// last one comes, and restoring the state machine from the snapshot then.
+func (n *Node) HandleSnapshot(req *SnapshotRequest) *SnapshotResponse {
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.term}
+	}
+	if req.Term > n.term || n.role != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader = req.LeaderID
+	n.lastContact = time.Now()
+	n.mu.Unlock()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	var (
+		term   = n.term
+		old    = req.LastIndex <= n.lastApplied
+		closed = n.closed
+	)
+	n.mu.Unlock()
+	if old || closed {
+		return &SnapshotResponse{Term: term, Installed: old}
+	}
+
+	var meta = snapshotMeta{Index: req.LastIndex, Term: req.LastTerm, Configuration: req.Configuration}
+	size, err := n.st.partialSize(meta)
+	if err == nil && req.Offset != size {
+		// the leader resumes from what is here
+		return &SnapshotResponse{Term: term, Offset: size}
+	}
+	if err == nil {
+		size, err = n.st.writePartial(meta, req.Offset, req.Data)
+	}
+	if err != nil {
+		log.Printf("raft: receiving the snapshot at %d: %v", req.LastIndex, err)
+		return &SnapshotResponse{Term: term, Offset: req.Offset}
+	}
+	if !req.Done {
+		return &SnapshotResponse{Term: term, Offset: size}
+	}
+
+	err = n.st.installPartial(meta)
+	if err == nil {
+		var r io.ReadCloser
+		if r, err = n.st.openSnapshot(); err == nil {
+			err = n.fsm.Restore(r)
+			r.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("raft: installing the snapshot at %d: %v", req.LastIndex, err)
+		return &SnapshotResponse{Term: term}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if t, ok := n.termAt(req.LastIndex); ok && t == req.LastTerm {
+		n.log = append([]Entry{{Index: req.LastIndex, Term: req.LastTerm}}, n.log[req.LastIndex+1-n.log[0].Index:]...)
+	} else {
+		n.log = []Entry{{Index: req.LastIndex, Term: req.LastTerm}}
+	}
+	n.snapConfig = req.Configuration
+	n.updateConfig()
+	if n.commitIndex < req.LastIndex {
+		n.commitIndex = req.LastIndex
+	}
+	n.lastApplied = req.LastIndex
+	if err := n.st.rewriteLog(n.log[1:]); err != nil {
+		log.Printf("raft: writing the log: %v", err)
+	}
+	log.Printf("raft: %s installed the snapshot at %d", n.conf.ID, req.LastIndex)
+
+	return &SnapshotResponse{Term: n.term, Installed: true}
+}
@@ -0,0 +1,420 @@
+package raft
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kvFSM applies "key=value" commands to a map.
+type kvFSM struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func newKVFSM() *kvFSM {
+	return &kvFSM{m: make(map[string]string)}
+}
+
+func (f *kvFSM) Apply(e *Entry) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	kv := strings.SplitN(string(e.Data), "=", 2)
+	f.m[kv[0]] = kv[1]
+	return len(f.m)
+}
+
+func (f *kvFSM) Snapshot(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return gob.NewEncoder(w).Encode(f.m)
+}
+
+func (f *kvFSM) Restore(r io.Reader) error {
+	var m map[string]string
+	if err := gob.NewDecoder(r).Decode(&m); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.m = m
+	return nil
+}
+
+func (f *kvFSM) get(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.m[key]
+}
+
+// testChunkSize has the snapshots sent in many chunks.
+const testChunkSize = 64
+
+type testCluster struct {
+	t     *testing.T
+	nw    *InmemNetwork
+	nodes map[string]*Node
+	fsms  map[string]*kvFSM
+}
+
+func newTestCluster(t *testing.T, n int, threshold uint64) *testCluster {
+	c := &testCluster{t: t, nw: NewInmemNetwork(), nodes: map[string]*Node{}, fsms: map[string]*kvFSM{}}
+
+	var servers []Server
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("n%d", i)
+		servers = append(servers, Server{ID: id, Addr: id, Client: id + ":6380"})
+	}
+	for _, s := range servers {
+		c.start(s.ID, servers, threshold)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Shutdown()
+		}
+	})
+
+	return c
+}
+
+func (c *testCluster) start(id string, bootstrap []Server, threshold uint64) *Node {
+	fsm := newKVFSM()
+	node, err := New(Config{
+		ID:                id,
+		Addr:              id,
+		Transport:         c.nw.Transport(id),
+		FSM:               fsm,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   100 * time.Millisecond,
+		SnapshotThreshold: threshold,
+		SnapshotChunkSize: testChunkSize,
+		Bootstrap:         bootstrap,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nw.Register(id, node)
+	c.nodes[id] = node
+	c.fsms[id] = fsm
+
+	return node
+}
+
+// leader waits for a single leader among the nodes connected.
+func (c *testCluster) leader(except ...string) *Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+	nodes:
+		for id, node := range c.nodes {
+			for _, e := range except {
+				if id == e {
+					continue nodes
+				}
+			}
+			if node.Status().Role == Leader {
+				leaders = append(leaders, node)
+			}
+		}
+		if len(leaders) == 1 && leaders[0].WaitReady(time.Second) == nil {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+// waitFor waits for key to be value on the given nodes.
+func (c *testCluster) waitFor(key, value string, ids ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for c.fsms[id].get(key) != value {
+			if time.Now().After(deadline) {
+				c.t.Fatalf("%s: %s = %q, want %q", id, key, c.fsms[id].get(key), value)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestElectionAndPropose(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+
+	res, err := leader.Propose([]byte("a=1"), time.Second)
+	if err != nil || res != 1 {
+		t.Fatalf("propose = %v %v", res, err)
+	}
+	c.waitFor("a", "1", "n1", "n2", "n3")
+
+	for id, node := range c.nodes {
+		if node == leader {
+			continue
+		}
+		if _, err := node.Propose([]byte("b=1"), time.Second); err != ErrNotLeader {
+			t.Errorf("%s: propose on a follower = %v", id, err)
+		}
+		if s, ok := node.Leader(); !ok || s.ID != leader.Status().ID {
+			t.Errorf("%s: leader = %v %v", id, s, ok)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	old := c.leader()
+	oldID := old.Status().ID
+	if _, err := old.Propose([]byte("a=1"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c.nw.Disconnect(oldID)
+	leader := c.leader(oldID)
+	if _, err := leader.Propose([]byte("a=2"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the old leader can't commit on its own
+	if _, err := old.Propose([]byte("a=3"), 200*time.Millisecond); err == nil {
+		t.Fatal("propose on a partitioned leader succeeded")
+	}
+
+	c.nw.Reconnect(oldID)
+	c.waitFor("a", "2", "n1", "n2", "n3")
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	c := newTestCluster(t, 3, 16)
+	leader := c.leader()
+
+	var lagging string
+	for id, node := range c.nodes {
+		if node != leader {
+			lagging = id
+			break
+		}
+	}
+	c.nw.Disconnect(lagging)
+	for i := 0; i < 100; i++ {
+		if _, err := leader.Propose([]byte(fmt.Sprintf("k%d=%d", i, i)), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := leader.Status(); st.SnapshotIndex == 0 {
+		t.Fatalf("no snapshot taken: %+v", st)
+	}
+
+	c.nw.Reconnect(lagging)
+	c.waitFor("k99", "99", lagging)
+	c.waitFor("k0", "0", lagging)
+}
+
+func TestMembership(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	if _, err := leader.Propose([]byte("a=1"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c.start("n4", nil, 0)
+	if err := leader.AddServer(Server{ID: "n4", Addr: "n4"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFor("a", "1", "n4")
+	if err := leader.AddServer(Server{ID: "n4", Addr: "n4"}, time.Second); err != ErrServerExists {
+		t.Fatalf("adding twice = %v", err)
+	}
+
+	// removing the leader has it step down once committed
+	leaderID := leader.Status().ID
+	if err := leader.RemoveServer(leaderID, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	next := c.leader(leaderID)
+	if got := len(next.Status().Configuration.Servers); got != 3 {
+		t.Fatalf("%d servers after the removal", got)
+	}
+	if _, err := next.Propose([]byte("b=2"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for id := range c.nodes {
+		if id != leaderID {
+			c.waitFor("b", "2", id)
+		}
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir := t.TempDir()
+	nw := NewInmemNetwork()
+	servers := []Server{{ID: "n1", Addr: "n1"}}
+
+	start := func() (*Node, *kvFSM) {
+		fsm := newKVFSM()
+		node, err := New(Config{
+			ID:                "n1",
+			Addr:              "n1",
+			Dir:               dir,
+			Transport:         nw.Transport("n1"),
+			FSM:               fsm,
+			HeartbeatInterval: 10 * time.Millisecond,
+			ElectionTimeout:   50 * time.Millisecond,
+			SnapshotThreshold: 8,
+			Bootstrap:         servers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nw.Register("n1", node)
+		return node, fsm
+	}
+
+	node, _ := start()
+	for node.WaitReady(time.Second) != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := node.Propose([]byte(fmt.Sprintf("k%d=%d", i, i)), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	term := node.Status().Term
+	node.Shutdown()
+
+	node, fsm := start()
+	defer node.Shutdown()
+	for node.WaitReady(time.Second) != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := node.Status(); st.Term <= term || st.SnapshotIndex == 0 {
+		t.Fatalf("after restart %+v, term was %d", st, term)
+	}
+	for i := 0; i < 20; i++ {
+		if got := fsm.get(fmt.Sprintf("k%d", i)); got != fmt.Sprint(i) {
+			t.Fatalf("k%d = %q", i, got)
+		}
+	}
+}
+
+func TestSnapshotResume(t *testing.T) {
+	dir := t.TempDir()
+	nw := NewInmemNetwork()
+	start := func() (*Node, *kvFSM) {
+		fsm := newKVFSM()
+		node, err := New(Config{ID: "n2", Addr: "n2", Dir: dir, Transport: nw.Transport("n2"), FSM: fsm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node, fsm
+	}
+
+	var (
+		src  = newKVFSM()
+		data strings.Builder
+	)
+	for i := 0; i < 50; i++ {
+		src.m[fmt.Sprintf("k%d", i)] = fmt.Sprint(i)
+	}
+	if err := src.Snapshot(&data); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		snap = []byte(data.String())
+		conf = Configuration{Servers: []Server{{ID: "n1", Addr: "n1"}, {ID: "n2", Addr: "n2"}}}
+		req  = func(off, end int64) *SnapshotRequest {
+			return &SnapshotRequest{
+				Term: 2, LeaderID: "n1", LastIndex: 10, LastTerm: 2, Configuration: conf,
+				Offset: off, Data: snap[off:end], Done: end == int64(len(snap)),
+			}
+		}
+	)
+
+	node, _ := start()
+	if resp := node.HandleSnapshot(req(0, 100)); resp.Offset != 100 || resp.Installed {
+		t.Fatalf("first chunk: %+v", resp)
+	}
+	// a chunk past what is received is refused with where to resume from
+	if resp := node.HandleSnapshot(req(200, 300)); resp.Offset != 100 {
+		t.Fatalf("chunk past the end: %+v", resp)
+	}
+	node.Shutdown()
+
+	// and so is a new leader starting over, after a restart as well
+	node, fsm := start()
+	defer node.Shutdown()
+	if resp := node.HandleSnapshot(req(0, 50)); resp.Offset != 100 {
+		t.Fatalf("starting over: %+v", resp)
+	}
+	if resp := node.HandleSnapshot(req(100, int64(len(snap)))); !resp.Installed {
+		t.Fatalf("last chunk: %+v", resp)
+	}
+	for i := 0; i < 50; i++ {
+		if got := fsm.get(fmt.Sprintf("k%d", i)); got != fmt.Sprint(i) {
+			t.Fatalf("k%d = %q", i, got)
+		}
+	}
+	if st := node.Status(); st.SnapshotIndex != 10 || st.LastApplied != 10 || len(st.Configuration.Servers) != 2 {
+		t.Fatalf("after the install %+v", st)
+	}
+	if has, err := HasState(dir); err != nil || !has {
+		t.Fatalf("HasState after the install = %v %v", has, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		nw  = NewInmemNetwork()
+		fsm = newKVFSM()
+	)
+	fsm.m["a"] = "1"
+	conf := Config{
+		ID:                "n1",
+		Addr:              "n1",
+		Dir:               dir,
+		Transport:         nw.Transport("n1"),
+		FSM:               fsm,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   50 * time.Millisecond,
+		SnapshotChunkSize: testChunkSize,
+		Bootstrap:         []Server{{ID: "n1", Addr: "n1"}, {ID: "n2", Addr: "n2"}},
+		Import:            fsm.Snapshot,
+	}
+	if _, err := New(conf); err != errImportAlone {
+		t.Fatalf("importing into a group of two = %v", err)
+	}
+
+	conf.Bootstrap = conf.Bootstrap[:1]
+	node, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Shutdown()
+	nw.Register("n1", node)
+	if has, err := HasState(dir); err != nil || !has {
+		t.Fatalf("HasState after the import = %v %v", has, err)
+	}
+	for node.WaitReady(time.Second) != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a node joining gets the state imported
+	c := &testCluster{t: t, nw: nw, nodes: map[string]*Node{}, fsms: map[string]*kvFSM{}}
+	defer c.start("n2", nil, 0).Shutdown()
+	if err := node.AddServer(Server{ID: "n2", Addr: "n2"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.Propose([]byte("b=2"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFor("a", "1", "n2")
+	c.waitFor("b", "2", "n2")
+}
@@ -0,0 +1,455 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFile        = "state"
+	logFile          = "log"
+	snapshotMetaFile = "snapshot.meta"
+	snapshotDataFile = "snapshot.data"
+	// a snapshot being received from the leader, and its meta
+	partialDataFile = "snapshot.partial"
+	partialMetaFile = "snapshot.partial.meta"
+
+	// a record of the log file is crc32, length of the rest, index, term,
+	// type and data
+	recordHeaderSize = 4 + 4 + 8 + 8 + 1
+)
+
+var errNoSnapshot = errors.New("raft: no snapshot")
+
+// hardState is what a node must remember of the terms across restarts.
+type hardState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// snapshotMeta describes the last snapshot, the state after applying the
+// entries up to Index.
+type snapshotMeta struct {
+	Index         uint64
+	Term          uint64
+	Configuration Configuration
+}
+
+// storage keeps the state of a node that outlives it: the term and vote,
+// the log and the last snapshot, in dir. With no dir it lives in memory and
+// goes away with the node.
+type storage struct {
+	dir string
+	log *os.File
+
+	// in memory only
+	state    hardState
+	entries  []Entry
+	snapMeta *snapshotMeta
+	snapData []byte
+	partMeta *snapshotMeta
+	partData []byte
+}
+
+func openStorage(dir string) (*storage, error) {
+	var s = &storage{dir: dir}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+
+	return s, nil
+}
+
+// HasState tells whether dir holds the state of a node: a vote, a log or a
+// snapshot, the state machine being rebuilt from it by New.
+func HasState(dir string) (bool, error) {
+	if dir == "" {
+		return false, nil
+	}
+
+	for _, name := range []string{stateFile, logFile, snapshotMetaFile} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if fi.Size() > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *storage) close() error {
+	if s.log != nil {
+		return s.log.Close()
+	}
+	return nil
+}
+
+func (s *storage) loadState() (hardState, error) {
+	if s.dir == "" {
+		return s.state, nil
+	}
+
+	var st hardState
+	err := readGob(filepath.Join(s.dir, stateFile), &st)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return st, err
+}
+
+func (s *storage) saveState(st hardState) error {
+	if s.dir == "" {
+		s.state = st
+		return nil
+	}
+
+	return writeGob(filepath.Join(s.dir, stateFile), st)
+}
+
+// loadLog reads the entries of the log file, dropping a torn record left
+// by a crash at its end.
+func (s *storage) loadLog() ([]Entry, error) {
+	if s.dir == "" {
+		return append([]Entry(nil), s.entries...), nil
+	}
+
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var (
+		rd      = bufio.NewReader(s.log)
+		entries []Entry
+		valid   int64
+		header  = make([]byte, 8)
+	)
+	for {
+		if _, err := io.ReadFull(rd, header); err != nil {
+			break
+		}
+		var (
+			sum = binary.BigEndian.Uint32(header[0:4])
+			n   = binary.BigEndian.Uint32(header[4:8])
+		)
+		if n < recordHeaderSize-8 {
+			break
+		}
+		var body = make([]byte, n)
+		if _, err := io.ReadFull(rd, body); err != nil || crc32.ChecksumIEEE(body) != sum {
+			break
+		}
+
+		entries = append(entries, Entry{
+			Index: binary.BigEndian.Uint64(body[0:8]),
+			Term:  binary.BigEndian.Uint64(body[8:16]),
+			Type:  EntryType(body[16]),
+			Data:  body[17:],
+		})
+		valid += int64(8 + n)
+	}
+
+	if err := s.log.Truncate(valid); err != nil {
+		return nil, err
+	}
+	_, err := s.log.Seek(valid, io.SeekStart)
+
+	return entries, err
+}
+
+func appendRecord(b []byte, e Entry) []byte {
+	var (
+		start = len(b)
+		n     = recordHeaderSize - 8 + len(e.Data)
+	)
+	b = append(b, make([]byte, 8)...)
+	b = binary.BigEndian.AppendUint64(b, e.Index)
+	b = binary.BigEndian.AppendUint64(b, e.Term)
+	b = append(b, byte(e.Type))
+	b = append(b, e.Data...)
+	binary.BigEndian.PutUint32(b[start:], crc32.ChecksumIEEE(b[start+8:]))
+	binary.BigEndian.PutUint32(b[start+4:], uint32(n))
+
+	return b
+}
+
+// appendLog adds entries at the end of the log, on disk once it returns.
+func (s *storage) appendLog(entries []Entry) error {
+	if s.dir == "" {
+		s.entries = append(s.entries, entries...)
+		return nil
+	}
+
+	var b []byte
+	for _, e := range entries {
+		b = appendRecord(b, e)
+	}
+	if _, err := s.log.Write(b); err != nil {
+		return err
+	}
+
+	return s.log.Sync()
+}
+
+// rewriteLog replaces the log with entries, after a conflict or a snapshot.
+func (s *storage) rewriteLog(entries []Entry) error {
+	if s.dir == "" {
+		s.entries = append([]Entry(nil), entries...)
+		return nil
+	}
+
+	var b []byte
+	for _, e := range entries {
+		b = appendRecord(b, e)
+	}
+	path := filepath.Join(s.dir, logFile)
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return err
+	}
+	s.log.Close()
+	s.log = f
+
+	return nil
+}
+
+func (s *storage) loadSnapshotMeta() (*snapshotMeta, error) {
+	if s.dir == "" {
+		if s.snapMeta == nil {
+			return nil, errNoSnapshot
+		}
+		return s.snapMeta, nil
+	}
+
+	var meta snapshotMeta
+	err := readGob(filepath.Join(s.dir, snapshotMetaFile), &meta)
+	if os.IsNotExist(err) {
+		return nil, errNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// memSnapshot is the data of a snapshot kept in memory.
+type memSnapshot struct {
+	*bytes.Reader
+}
+
+func (memSnapshot) Close() error { return nil }
+
+// openSnapshot returns the data of the last snapshot.
+func (s *storage) openSnapshot() (io.ReadSeekCloser, error) {
+	if s.dir == "" {
+		if s.snapMeta == nil {
+			return nil, errNoSnapshot
+		}
+		return memSnapshot{bytes.NewReader(s.snapData)}, nil
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, snapshotDataFile))
+	if os.IsNotExist(err) {
+		return nil, errNoSnapshot
+	}
+
+	return f, err
+}
+
+// saveSnapshot stores a snapshot written by fn, replacing the previous one.
+func (s *storage) saveSnapshot(meta snapshotMeta, fn func(w io.Writer) error) error {
+	if s.dir == "" {
+		var buf bytes.Buffer
+		if err := fn(&buf); err != nil {
+			return err
+		}
+		s.snapMeta, s.snapData = &meta, buf.Bytes()
+		return nil
+	}
+
+	err := writeFileAtomic(filepath.Join(s.dir, snapshotDataFile), fn)
+	if err != nil {
+		return err
+	}
+
+	return writeGob(filepath.Join(s.dir, snapshotMetaFile), meta)
+}
+
+// partialSize returns how much of the snapshot meta is received already,
+// 0 when the snapshot being received, if any, is another one.
+func (s *storage) partialSize(meta snapshotMeta) (int64, error) {
+	if s.dir == "" {
+		if s.partMeta == nil || !meta.same(*s.partMeta) {
+			return 0, nil
+		}
+		return int64(len(s.partData)), nil
+	}
+
+	var part snapshotMeta
+	err := readGob(filepath.Join(s.dir, partialMetaFile), &part)
+	if os.IsNotExist(err) || (err == nil && !meta.same(part)) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(filepath.Join(s.dir, partialDataFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// writePartial writes a chunk of the snapshot meta at off, the size of what
+// is received of it already, or 0 to start it over. It returns the size
+// received once the chunk is on disk.
+func (s *storage) writePartial(meta snapshotMeta, off int64, data []byte) (int64, error) {
+	if s.dir == "" {
+		if off == 0 {
+			s.partMeta, s.partData = &meta, nil
+		}
+		s.partData = append(s.partData, data...)
+		return int64(len(s.partData)), nil
+	}
+
+	var (
+		path  = filepath.Join(s.dir, partialDataFile)
+		flags = os.O_WRONLY | os.O_APPEND
+	)
+	if off == 0 {
+		// the meta goes first, so that a partial file is never taken for
+		// another snapshot
+		os.Remove(path)
+		if err := writeGob(filepath.Join(s.dir, partialMetaFile), meta); err != nil {
+			return 0, err
+		}
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// installPartial makes the snapshot meta, received in full, the last
+// snapshot.
+func (s *storage) installPartial(meta snapshotMeta) error {
+	if s.dir == "" {
+		s.snapMeta, s.snapData = &meta, s.partData
+		s.partMeta, s.partData = nil, nil
+		return nil
+	}
+
+	err := os.Rename(filepath.Join(s.dir, partialDataFile), filepath.Join(s.dir, snapshotDataFile))
+	if err != nil {
+		return err
+	}
+	if err := writeGob(filepath.Join(s.dir, snapshotMetaFile), meta); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(s.dir, partialMetaFile))
+}
+
+// same tells whether m and o describe the same snapshot.
+func (m snapshotMeta) same(o snapshotMeta) bool {
+	return m.Index == o.Index && m.Term == o.Term
+}
+
+func readGob(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewDecoder(f).Decode(v)
+}
+
+func writeGob(path string, v interface{}) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(v)
+	})
+}
+
+// writeFileAtomic writes path with fn through a temporary file, so that path
+// either holds the previous content or the complete new one.
+func writeFileAtomic(path string, fn func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	w := bufio.NewWriterSize(f, 1<<20)
+	err = fn(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
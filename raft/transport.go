@@ -0,0 +1,279 @@
+package raft
+
+import (
+	"encoding/gob"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrUnreachable = errors.New("raft: node unreachable")
+
+// Transport carries the RPCs of a node to the node listening at addr.
+type Transport interface {
+	RequestVote(addr string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(addr string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(addr string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// Handler serves the RPCs received by a node, *Node implements it.
+type Handler interface {
+	HandleVote(req *VoteRequest) *VoteResponse
+	HandleAppend(req *AppendRequest) *AppendResponse
+	HandleSnapshot(req *SnapshotRequest) *SnapshotResponse
+}
+
+// InmemNetwork connects the nodes of a process without going through the
+// network, for tests. Nodes can be cut off to simulate failures.
+type InmemNetwork struct {
+	mu       sync.Mutex
+	handlers map[string]Handler
+	down     map[string]bool
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		handlers: make(map[string]Handler),
+		down:     make(map[string]bool),
+	}
+}
+
+// Register makes h receive the RPCs sent to addr.
+func (nw *InmemNetwork) Register(addr string, h Handler) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	nw.handlers[addr] = h
+}
+
+// Disconnect cuts addr off, its RPCs and the ones sent to it fail.
+func (nw *InmemNetwork) Disconnect(addr string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	nw.down[addr] = true
+}
+
+func (nw *InmemNetwork) Reconnect(addr string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	delete(nw.down, addr)
+}
+
+// Transport returns the transport of the node at addr.
+func (nw *InmemNetwork) Transport(addr string) Transport {
+	return &inmemTransport{nw: nw, from: addr}
+}
+
+func (nw *InmemNetwork) handler(from, to string) (Handler, error) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	h, ok := nw.handlers[to]
+	if !ok || nw.down[from] || nw.down[to] {
+		return nil, ErrUnreachable
+	}
+	return h, nil
+}
+
+type inmemTransport struct {
+	nw   *InmemNetwork
+	from string
+}
+
+func (t *inmemTransport) RequestVote(addr string, req *VoteRequest) (*VoteResponse, error) {
+	h, err := t.nw.handler(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	return h.HandleVote(req), nil
+}
+
+func (t *inmemTransport) AppendEntries(addr string, req *AppendRequest) (*AppendResponse, error) {
+	h, err := t.nw.handler(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	return h.HandleAppend(req), nil
+}
+
+func (t *inmemTransport) InstallSnapshot(addr string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	h, err := t.nw.handler(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	return h.HandleSnapshot(req), nil
+}
+
+// rpcRequest and rpcResponse are the messages of the TCP transport, one of
+// the fields being set.
+type rpcRequest struct {
+	Vote     *VoteRequest
+	Append   *AppendRequest
+	Snapshot *SnapshotRequest
+}
+
+type rpcResponse struct {
+	Vote     *VoteResponse
+	Append   *AppendResponse
+	Snapshot *SnapshotResponse
+}
+
+// TCPTransport sends the RPCs as gob messages over TCP, keeping a connection
+// to every node it talks to.
+type TCPTransport struct {
+	ln      net.Listener
+	timeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*tcpConn
+}
+
+type tcpConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+// NewTCPTransport listens on addr, RPCs taking longer than timeout fail.
+func NewTCPTransport(addr string, timeout time.Duration) (*TCPTransport, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TCPTransport{
+		ln:      ln,
+		timeout: timeout,
+		conns:   make(map[string]*tcpConn),
+	}, nil
+}
+
+// Serve hands the RPCs received to h, until Close.
+func (t *TCPTransport) Serve(h Handler) {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		go t.serveConn(conn, h)
+	}
+}
+
+func (t *TCPTransport) serveConn(conn net.Conn, h Handler) {
+	defer conn.Close()
+
+	var (
+		dec = gob.NewDecoder(conn)
+		enc = gob.NewEncoder(conn)
+	)
+	for {
+		var req rpcRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		var resp rpcResponse
+		switch {
+		case req.Vote != nil:
+			resp.Vote = h.HandleVote(req.Vote)
+		case req.Append != nil:
+			resp.Append = h.HandleAppend(req.Append)
+		case req.Snapshot != nil:
+			resp.Snapshot = h.HandleSnapshot(req.Snapshot)
+		default:
+			return
+		}
+		if err := enc.Encode(&resp); err != nil {
+			return
+		}
+	}
+}
+
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	for addr, c := range t.conns {
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		c.mu.Unlock()
+		delete(t.conns, addr)
+	}
+	t.mu.Unlock()
+
+	return t.ln.Close()
+}
+
+func (t *TCPTransport) call(addr string, req *rpcRequest) (*rpcResponse, error) {
+	t.mu.Lock()
+	c, ok := t.conns[addr]
+	if !ok {
+		c = &tcpConn{}
+		t.conns[addr] = c
+	}
+	t.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", addr, t.timeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.enc, c.dec = conn, gob.NewEncoder(conn), gob.NewDecoder(conn)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(t.timeout))
+	var resp rpcResponse
+	err := c.enc.Encode(req)
+	if err == nil {
+		err = c.dec.Decode(&resp)
+	}
+	if err != nil {
+		// the stream is out of step, start over on the next call
+		c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (t *TCPTransport) RequestVote(addr string, req *VoteRequest) (*VoteResponse, error) {
+	resp, err := t.call(addr, &rpcRequest{Vote: req})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Vote == nil {
+		return nil, ErrUnreachable
+	}
+	return resp.Vote, nil
+}
+
+func (t *TCPTransport) AppendEntries(addr string, req *AppendRequest) (*AppendResponse, error) {
+	resp, err := t.call(addr, &rpcRequest{Append: req})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Append == nil {
+		return nil, ErrUnreachable
+	}
+	return resp.Append, nil
+}
+
+func (t *TCPTransport) InstallSnapshot(addr string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	resp, err := t.call(addr, &rpcRequest{Snapshot: req})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Snapshot == nil {
+		return nil, ErrUnreachable
+	}
+	return resp.Snapshot, nil
+}
@@ -1,12 +1,41 @@
 package raptor
 
 import (
+	"bytes"
+	"errors"
 	"github.com/qichengzx/raptor/config"
 	"github.com/qichengzx/raptor/storage"
+	_ "github.com/qichengzx/raptor/storage/badger"
+	_ "github.com/qichengzx/raptor/storage/bolt"
+	_ "github.com/qichengzx/raptor/storage/memory"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// Ops of the journal, each one followed by its arguments. Expirations are
+// unix times in seconds, zero for none, so that replaying an op later gives
+// the same result.
+const (
+	OpSet      = "set"      // key value expireAt
+	OpMSet     = "mset"     // key value [key value ...]
+	OpMSetAt   = "msetat"   // key value expireAt [key value expireAt ...]
+	OpDel      = "del"      // key [key ...]
+	OpRename   = "rename"   // key newkey
+	OpFlushDB  = "flushdb"  //
+	OpExpireAt = "expireat" // key expireAt
+	OpPersist  = "persist"  // key
+)
+
+var ErrOp = errors.New("ERR invalid journal op")
+
+// Raptor is the store as seen by the commands. Writes go through it one at a
+// time and, once applied, are handed to the journal in the same order.
 type Raptor struct {
 	storage.DB
+
+	mu      sync.Mutex
+	journal func(op [][]byte, applied bool)
 }
 
 func New(conf *config.Config) (*Raptor, error) {
@@ -21,3 +50,314 @@ func New(conf *config.Config) (*Raptor, error) {
 func (r *Raptor) Close() error {
 	return r.DB.Close()
 }
+
+// SetJournal makes fn receive the op of every write from now on, applied
+// telling the ops replayed by Apply. fn is called with the writes blocked,
+// it must not write to the store.
+func (r *Raptor) SetJournal(fn func(op [][]byte, applied bool)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.journal = fn
+}
+
+// ViewPinned calls fn with a point-in-time view of the store like View. pin
+// is called with the writes blocked once the view is taken, so the journal
+// holds exactly the writes missing from the view from then on.
+func (r *Raptor) ViewPinned(pin func(), fn func(snap storage.Reader) error) error {
+	r.mu.Lock()
+	var locked = true
+	defer func() {
+		if locked {
+			r.mu.Unlock()
+		}
+	}()
+
+	return r.DB.View(func(snap storage.Reader) error {
+		pin()
+		r.mu.Unlock()
+		locked = false
+
+		return fn(snap)
+	})
+}
+
+func (r *Raptor) record(name string, args ...[]byte) {
+	if r.journal != nil {
+		r.journal(append([][]byte{[]byte(name)}, args...), false)
+	}
+}
+
+func (r *Raptor) Set(key, value []byte, ttl int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.Set(key, value, ttl)
+	if err == nil && r.journal != nil {
+		var at int64
+		if ttl > 0 {
+			at = expireAt(ttl)
+		}
+		r.record(OpSet, key, value, formatInt(at))
+	}
+
+	return err
+}
+
+func (r *Raptor) MSet(keys, values [][]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.MSet(keys, values)
+	if err == nil && r.journal != nil {
+		r.record(OpMSet, interleave(keys, values)...)
+	}
+
+	return err
+}
+
+func (r *Raptor) MSetNX(keys, values [][]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.MSetNX(keys, values)
+	if err == nil && r.journal != nil {
+		r.record(OpMSet, interleave(keys, values)...)
+	}
+
+	return err
+}
+
+func (r *Raptor) MSetTTL(keys, values [][]byte, ttls []int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.MSetTTL(keys, values, ttls)
+	if err == nil && r.journal != nil {
+		var args = make([][]byte, 0, len(keys)*3)
+		for i, key := range keys {
+			var at int64
+			if ttls[i] > 0 {
+				at = expireAt(ttls[i])
+			}
+			args = append(args, key, values[i], formatInt(at))
+		}
+		r.record(OpMSetAt, args...)
+	}
+
+	return err
+}
+
+// WriteBatch makes the writes of entries in one batch, passed on to the
+// journal as the sets followed by the deletes, the order of the keys
+// mattering not as each one is written once.
+func (r *Raptor) WriteBatch(entries []storage.Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.WriteBatch(entries)
+	if err == nil && r.journal != nil {
+		var set, del [][]byte
+		for _, e := range entries {
+			if e.Delete {
+				del = append(del, e.Key)
+				continue
+			}
+			set = append(set, e.Key, e.Value, formatInt(int64(e.ExpiresAt)))
+		}
+		if len(set) > 0 {
+			r.record(OpMSetAt, set...)
+		}
+		if len(del) > 0 {
+			r.record(OpDel, del...)
+		}
+	}
+
+	return err
+}
+
+func (r *Raptor) Del(keys [][]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.Del(keys)
+	if err == nil && r.journal != nil && len(keys) > 0 {
+		r.record(OpDel, keys...)
+	}
+
+	return err
+}
+
+func (r *Raptor) Rename(key, newkey []byte, nx bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.Rename(key, newkey, nx)
+	if err == nil && r.journal != nil {
+		r.record(OpRename, key, newkey)
+	}
+
+	return err
+}
+
+func (r *Raptor) FlushDB() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.FlushDB()
+	if err == nil && r.journal != nil {
+		r.record(OpFlushDB)
+	}
+
+	return err
+}
+
+func (r *Raptor) Expire(key []byte, seconds int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.Expire(key, seconds)
+	if err == nil && r.journal != nil {
+		r.record(OpExpireAt, key, formatInt(expireAt(seconds)))
+	}
+
+	return err
+}
+
+func (r *Raptor) Persist(key []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.DB.Persist(key)
+	if err == nil && r.journal != nil {
+		r.record(OpPersist, key)
+	}
+
+	return err
+}
+
+// Apply replays an op of the journal of another store, and passes it on to
+// the journal of this one as is.
+func (r *Raptor) Apply(op [][]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(op) == 0 {
+		return ErrOp
+	}
+
+	var (
+		name = string(bytes.ToLower(op[0]))
+		args = op[1:]
+		now  = time.Now().Unix()
+		err  error
+	)
+	switch name {
+	case OpSet:
+		if len(args) != 3 {
+			return ErrOp
+		}
+		args = [][]byte{args[0], args[1], args[2]}
+		fallthrough
+	case OpMSetAt:
+		if len(args) == 0 || len(args)%3 != 0 {
+			return ErrOp
+		}
+		var keys, values, expired [][]byte
+		var ttls []int
+		for i := 0; i < len(args); i += 3 {
+			at, perr := strconv.ParseInt(string(args[i+2]), 10, 64)
+			if perr != nil {
+				return ErrOp
+			}
+			if at > 0 && at <= now {
+				expired = append(expired, args[i])
+				continue
+			}
+			var ttl int
+			if at > 0 {
+				ttl = int(at - now)
+			}
+			keys = append(keys, args[i])
+			values = append(values, args[i+1])
+			ttls = append(ttls, ttl)
+		}
+		if len(keys) > 0 {
+			err = r.DB.MSetTTL(keys, values, ttls)
+		}
+		if err == nil && len(expired) > 0 {
+			err = r.DB.Del(expired)
+		}
+	case OpMSet:
+		if len(args) == 0 || len(args)%2 != 0 {
+			return ErrOp
+		}
+		var keys, values [][]byte
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+			values = append(values, args[i+1])
+		}
+		err = r.DB.MSet(keys, values)
+	case OpDel:
+		if len(args) == 0 {
+			return ErrOp
+		}
+		err = r.DB.Del(args)
+	case OpRename:
+		if len(args) != 2 {
+			return ErrOp
+		}
+		// the key may have expired here already
+		if _, gerr := r.DB.Get(args[0]); gerr == nil {
+			err = r.DB.Rename(args[0], args[1], false)
+		}
+	case OpFlushDB:
+		err = r.DB.FlushDB()
+	case OpExpireAt:
+		if len(args) != 2 {
+			return ErrOp
+		}
+		at, perr := strconv.ParseInt(string(args[1]), 10, 64)
+		if perr != nil {
+			return ErrOp
+		}
+		if at <= now {
+			err = r.DB.Del(args[:1])
+		} else if _, gerr := r.DB.Get(args[0]); gerr == nil {
+			err = r.DB.Expire(args[0], int(at-now))
+		}
+	case OpPersist:
+		if len(args) != 1 {
+			return ErrOp
+		}
+		// fails when there is nothing to persist, which is fine
+		r.DB.Persist(args[0])
+	default:
+		return ErrOp
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.journal != nil {
+		r.journal(op, true)
+	}
+	return nil
+}
+
+func expireAt(seconds int) int64 {
+	return time.Now().Unix() + int64(seconds)
+}
+
+func formatInt(n int64) []byte {
+	return strconv.AppendInt(nil, n, 10)
+}
+
+func interleave(keys, values [][]byte) [][]byte {
+	var args = make([][]byte, 0, len(keys)*2)
+	for i, key := range keys {
+		args = append(args, key, values[i])
+	}
+
+	return args
+}
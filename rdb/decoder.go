@@ -0,0 +1,703 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Decoder reads a database file.
+type Decoder struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode calls fn for every key of the file, in the order they are stored.
+func (d *Decoder) Decode(fn func(e *Entry) error) error {
+	header, err := d.read(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return ErrFormat
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > MaxVersion {
+		return ErrVersion
+	}
+
+	var (
+		db       int
+		expireAt int64
+	)
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opEOF:
+			if version < 5 {
+				return nil
+			}
+			var crc = d.crc
+			sum, err := d.read(8)
+			if err != nil {
+				return err
+			}
+			if v := binary.LittleEndian.Uint64(sum); v != 0 && v != crc {
+				return ErrChecksum
+			}
+			return nil
+		case opSelectDB:
+			n, err := d.readLen()
+			if err != nil {
+				return err
+			}
+			db = int(n)
+		case opResizeDB:
+			if _, err = d.readLen(); err == nil {
+				_, err = d.readLen()
+			}
+		case opAux:
+			if _, err = d.readString(); err == nil {
+				_, err = d.readString()
+			}
+		case opExpireTime:
+			var b []byte
+			if b, err = d.read(4); err == nil {
+				expireAt = int64(binary.LittleEndian.Uint32(b)) * 1000
+			}
+		case opExpireTimeMs:
+			var b []byte
+			if b, err = d.read(8); err == nil {
+				expireAt = int64(binary.LittleEndian.Uint64(b))
+			}
+		case opIdle:
+			_, err = d.readLen()
+		case opFreq:
+			_, err = d.read(1)
+		case opSlotInfo:
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = d.readLen()
+			}
+		case opFunction2:
+			_, err = d.readString()
+		case opModuleAux, opFunctionPreGA:
+			return ErrUnsupported
+		default:
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			obj, err := d.readObject(op)
+			if err != nil {
+				return err
+			}
+			err = fn(&Entry{DB: db, Key: key, Object: obj, ExpireAt: expireAt})
+			if err != nil {
+				return err
+			}
+			expireAt = 0
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DecodeDump parses a DUMP payload after checking its version and checksum.
+func DecodeDump(payload []byte) (*Object, error) {
+	if len(payload) < 11 {
+		return nil, ErrFormat
+	}
+
+	var (
+		body    = payload[:len(payload)-10]
+		footer  = payload[len(payload)-10:]
+		version = binary.LittleEndian.Uint16(footer)
+	)
+	if version > MaxVersion {
+		return nil, ErrVersion
+	}
+	if CRC64(0, payload[:len(payload)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return nil, ErrChecksum
+	}
+
+	var d = &Decoder{r: bufio.NewReader(bytes.NewReader(body[1:]))}
+	obj, err := d.readObject(body[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = d.r.ReadByte(); err != io.EOF {
+		return nil, ErrFormat
+	}
+
+	return obj, nil
+}
+
+func (d *Decoder) readObject(t byte) (*Object, error) {
+	switch t {
+	case TypeString:
+		v, err := d.readString()
+		return &Object{Kind: KindString, Value: v}, err
+	case TypeList, TypeSet:
+		members, err := d.readStrings(1)
+		if t == TypeList {
+			return &Object{Kind: KindList, Members: members}, err
+		}
+		return &Object{Kind: KindSet, Members: members}, err
+	case TypeZSet, TypeZSet2:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		var obj = &Object{Kind: KindZSet}
+		for i := uint64(0); i < n; i++ {
+			m, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if t == TypeZSet {
+				score, err = d.readDouble()
+			} else {
+				var b []byte
+				b, err = d.read(8)
+				if err == nil {
+					score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			obj.Members = append(obj.Members, m)
+			obj.Scores = append(obj.Scores, score)
+		}
+		return obj, nil
+	case TypeHash:
+		elems, err := d.readStrings(2)
+		if err != nil {
+			return nil, err
+		}
+		return hashObject(elems)
+	case TypeListQuicklist, TypeListQuicklist2:
+		return d.readQuicklist(t)
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return d.readStream(t)
+	case TypeHashZipmap, TypeListZiplist, TypeSetIntset, TypeZSetZiplist, TypeHashZiplist,
+		TypeHashListpack, TypeZSetListpack, TypeSetListpack:
+		b, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return decodeCompact(t, b)
+	}
+
+	return nil, ErrUnsupported
+}
+
+// decodeCompact decodes the objects serialized as a single blob, in the
+// encoding Redis used in memory.
+func decodeCompact(t byte, b []byte) (*Object, error) {
+	var (
+		elems [][]byte
+		err   error
+	)
+	switch t {
+	case TypeHashZipmap:
+		elems, err = zipmapDecode(b)
+	case TypeSetIntset:
+		elems, err = intsetDecode(b)
+	case TypeListZiplist, TypeZSetZiplist, TypeHashZiplist:
+		elems, err = ziplistDecode(b)
+	default:
+		elems, err = listpackDecode(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case TypeListZiplist:
+		return &Object{Kind: KindList, Members: elems}, nil
+	case TypeSetIntset, TypeSetListpack:
+		return &Object{Kind: KindSet, Members: elems}, nil
+	case TypeZSetZiplist, TypeZSetListpack:
+		if len(elems)%2 != 0 {
+			return nil, ErrFormat
+		}
+		var obj = &Object{Kind: KindZSet}
+		for i := 0; i < len(elems); i += 2 {
+			score, err := strconv.ParseFloat(string(elems[i+1]), 64)
+			if err != nil {
+				return nil, ErrFormat
+			}
+			obj.Members = append(obj.Members, elems[i])
+			obj.Scores = append(obj.Scores, score)
+		}
+		return obj, nil
+	}
+
+	return hashObject(elems)
+}
+
+func hashObject(elems [][]byte) (*Object, error) {
+	if len(elems)%2 != 0 {
+		return nil, ErrFormat
+	}
+
+	var obj = &Object{Kind: KindHash}
+	for i := 0; i < len(elems); i += 2 {
+		obj.Members = append(obj.Members, elems[i])
+		obj.Values = append(obj.Values, elems[i+1])
+	}
+
+	return obj, nil
+}
+
+// readQuicklist reads a list stored as a sequence of ziplists, or of
+// listpacks and plain elements since Redis 7.
+func (d *Decoder) readQuicklist(t byte) (*Object, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+
+	var obj = &Object{Kind: KindList}
+	for i := uint64(0); i < n; i++ {
+		var container uint64 = 2
+		if t == TypeListQuicklist2 {
+			if container, err = d.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		b, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		var elems [][]byte
+		switch {
+		case container == 1:
+			elems = [][]byte{b}
+		case t == TypeListQuicklist:
+			elems, err = ziplistDecode(b)
+		default:
+			elems, err = listpackDecode(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+		obj.Members = append(obj.Members, elems...)
+	}
+
+	return obj, nil
+}
+
+func (d *Decoder) readStream(t byte) (*Object, error) {
+	var s = &Stream{}
+	nodes, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		key, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, ErrFormat
+		}
+		lp, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := streamNodeDecode(streamIDFromBytes(key), lp)
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = append(s.Entries, entries...)
+	}
+
+	// length, last ID, and since Redis 7 the first ID, the max deleted ID
+	// and the number of entries ever added
+	var fields = 3
+	if t != TypeStreamListpacks {
+		fields += 5
+	}
+	meta, err := d.readLens(fields)
+	if err != nil {
+		return nil, err
+	}
+	s.LastID = StreamID{Ms: meta[1], Seq: meta[2]}
+
+	groups, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		var g StreamGroup
+		if g.Name, err = d.readString(); err != nil {
+			return nil, err
+		}
+		fields = 2
+		if t != TypeStreamListpacks {
+			// entries read
+			fields++
+		}
+		ids, err := d.readLens(fields)
+		if err != nil {
+			return nil, err
+		}
+		g.LastID = StreamID{Ms: ids[0], Seq: ids[1]}
+
+		pending, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		var index = make(map[StreamID]int, pending)
+		for j := uint64(0); j < pending; j++ {
+			b, err := d.read(24)
+			if err != nil {
+				return nil, err
+			}
+			cnt, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			p := StreamPending{
+				ID:            streamIDFromBytes(b[:16]),
+				DeliveryTime:  int64(binary.LittleEndian.Uint64(b[16:])),
+				DeliveryCount: cnt,
+			}
+			index[p.ID] = len(g.Pending)
+			g.Pending = append(g.Pending, p)
+		}
+
+		consumers, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			var c StreamConsumer
+			if c.Name, err = d.readString(); err != nil {
+				return nil, err
+			}
+			var size = 8
+			if t == TypeStreamListpacks3 {
+				// active time
+				size += 8
+			}
+			b, err := d.read(size)
+			if err != nil {
+				return nil, err
+			}
+			c.SeenTime = int64(binary.LittleEndian.Uint64(b))
+
+			n, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			for k := uint64(0); k < n; k++ {
+				b, err := d.read(16)
+				if err != nil {
+					return nil, err
+				}
+				pos, ok := index[streamIDFromBytes(b)]
+				if !ok {
+					return nil, ErrFormat
+				}
+				g.Pending[pos].Consumer = c.Name
+			}
+			g.Consumers = append(g.Consumers, c)
+		}
+		s.Groups = append(s.Groups, g)
+	}
+
+	return &Object{Kind: KindStream, Stream: s}, nil
+}
+
+// streamNodeDecode returns the entries of a stream listpack, the deleted
+// ones excluded.
+func streamNodeDecode(master StreamID, lp []byte) ([]StreamEntry, error) {
+	elems, err := listpackDecode(lp)
+	if err != nil {
+		return nil, err
+	}
+
+	var p = 0
+	next := func() (int64, bool) {
+		if p >= len(elems) {
+			return 0, false
+		}
+		v, err := strconv.ParseInt(string(elems[p]), 10, 64)
+		p++
+		return v, err == nil
+	}
+
+	// master entry: count, deleted, fields, terminator
+	if _, ok := next(); !ok {
+		return nil, ErrFormat
+	}
+	if _, ok := next(); !ok {
+		return nil, ErrFormat
+	}
+	n, ok := next()
+	if !ok || n < 0 || p+int(n)+1 > len(elems) {
+		return nil, ErrFormat
+	}
+	var masterFields = elems[p : p+int(n)]
+	p += int(n) + 1
+
+	var entries []StreamEntry
+	for p < len(elems) {
+		flags, ok1 := next()
+		ms, ok2 := next()
+		seq, ok3 := next()
+		if !ok1 || !ok2 || !ok3 {
+			return nil, ErrFormat
+		}
+
+		var e = StreamEntry{ID: StreamID{Ms: master.Ms + uint64(ms), Seq: master.Seq + uint64(seq)}}
+		if flags&streamFlagSame != 0 {
+			if p+len(masterFields) > len(elems) {
+				return nil, ErrFormat
+			}
+			for i, f := range masterFields {
+				e.Fields = append(e.Fields, f, elems[p+i])
+			}
+			p += len(masterFields)
+		} else {
+			n, ok := next()
+			if !ok || n < 0 || p+2*int(n) > len(elems) {
+				return nil, ErrFormat
+			}
+			e.Fields = append(e.Fields, elems[p:p+2*int(n)]...)
+			p += 2 * int(n)
+		}
+
+		// lp-count
+		if _, ok := next(); !ok {
+			return nil, ErrFormat
+		}
+		if flags&streamFlagDelete == 0 {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, nil
+}
+
+func streamIDFromBytes(b []byte) StreamID {
+	return StreamID{Ms: binary.BigEndian.Uint64(b), Seq: binary.BigEndian.Uint64(b[8:])}
+}
+
+func (d *Decoder) read(n int) ([]byte, error) {
+	var b = make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, formatError(err)
+	}
+	d.crc = CRC64(d.crc, b)
+
+	return b, nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+
+	return b[0], nil
+}
+
+// readLenEnc reads a length, or the special encoding of a string when
+// encoded is set.
+func (d *Decoder) readLenEnc() (uint64, bool, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch c >> 6 {
+	case len6Bit:
+		return uint64(c & 0x3f), false, nil
+	case len14Bit:
+		b, err := d.readByte()
+		return uint64(c&0x3f)<<8 | uint64(b), false, err
+	case lenEncVal:
+		return uint64(c & 0x3f), true, nil
+	}
+
+	switch c {
+	case len32Bit:
+		b, err := d.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), false, nil
+	case len64Bit:
+		b, err := d.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(b), false, nil
+	}
+
+	return 0, false, ErrFormat
+}
+
+func (d *Decoder) readLen() (uint64, error) {
+	n, encoded, err := d.readLenEnc()
+	if err == nil && encoded {
+		err = ErrFormat
+	}
+
+	return n, err
+}
+
+func (d *Decoder) readLens(n int) ([]uint64, error) {
+	var lens = make([]uint64, n)
+	for i := range lens {
+		l, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		lens[i] = l
+	}
+
+	return lens, nil
+}
+
+func (d *Decoder) readString() ([]byte, error) {
+	n, encoded, err := d.readLenEnc()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return d.readN(n)
+	}
+
+	var b []byte
+	switch n {
+	case encInt8:
+		if b, err = d.read(1); err == nil {
+			return []byte(strconv.Itoa(int(int8(b[0])))), nil
+		}
+	case encInt16:
+		if b, err = d.read(2); err == nil {
+			return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b))))), nil
+		}
+	case encInt32:
+		if b, err = d.read(4); err == nil {
+			return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b))))), nil
+		}
+	case encLZF:
+		clen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		l, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if l > math.MaxInt32 {
+			return nil, ErrFormat
+		}
+		if b, err = d.readN(clen); err == nil {
+			return lzfDecompress(b, int(l))
+		}
+		return nil, err
+	default:
+		err = ErrFormat
+	}
+
+	return nil, err
+}
+
+// readN reads n bytes, growing the buffer as data comes so that a corrupt
+// length fails on a short read rather than on a huge allocation.
+func (d *Decoder) readN(n uint64) ([]byte, error) {
+	const chunk = 1 << 20
+	if n <= chunk {
+		return d.read(int(n))
+	}
+
+	var b []byte
+	for n > 0 {
+		size := uint64(chunk)
+		if n < size {
+			size = n
+		}
+		p, err := d.read(int(size))
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, p...)
+		n -= size
+	}
+
+	return b, nil
+}
+
+func (d *Decoder) readStrings(per int) ([][]byte, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+
+	var elems [][]byte
+	for i := uint64(0); i < n*uint64(per); i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, s)
+	}
+
+	return elems, nil
+}
+
+// readDouble reads a score in the text format of the first sorted set type.
+func (d *Decoder) readDouble() (float64, error) {
+	l, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch l {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := d.read(int(l))
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, ErrFormat
+	}
+
+	return v, nil
+}
+
+func formatError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrFormat
+	}
+
+	return err
+}
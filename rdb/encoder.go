@@ -0,0 +1,266 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Encoder writes a database file: a header, keys grouped by database and a
+// footer holding the checksum of everything before it.
+type Encoder struct {
+	w   io.Writer
+	crc uint64
+	buf []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) WriteHeader() error {
+	return e.write([]byte("REDIS" + leftPad(strconv.Itoa(Version), 4)))
+}
+
+// WriteAux writes an auxiliary field, such as the version of the server that
+// produced the file.
+func (e *Encoder) WriteAux(key, value string) error {
+	e.buf = append(e.buf[:0], opAux)
+	e.buf = appendString(e.buf, []byte(key))
+	e.buf = appendString(e.buf, []byte(value))
+
+	return e.write(e.buf)
+}
+
+// WriteDB starts the keys of database index, size and expires are hints of
+// the number of keys and of keys with an expiration that follow.
+func (e *Encoder) WriteDB(index int, size, expires uint64) error {
+	e.buf = append(e.buf[:0], opSelectDB)
+	e.buf = appendLen(e.buf, uint64(index))
+	e.buf = append(e.buf, opResizeDB)
+	e.buf = appendLen(e.buf, size)
+	e.buf = appendLen(e.buf, expires)
+
+	return e.write(e.buf)
+}
+
+// WriteObject writes key and its value, expireAt is a unix time in
+// milliseconds or zero.
+func (e *Encoder) WriteObject(key []byte, obj *Object, expireAt int64) error {
+	e.buf = e.buf[:0]
+	if expireAt > 0 {
+		e.buf = append(e.buf, opExpireTimeMs)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, uint64(expireAt))
+	}
+	e.buf = append(e.buf, objectType(obj))
+	e.buf = appendString(e.buf, key)
+	e.buf = appendObject(e.buf, obj)
+
+	return e.write(e.buf)
+}
+
+// WriteFooter ends the file with its checksum.
+func (e *Encoder) WriteFooter() error {
+	if err := e.write([]byte{opEOF}); err != nil {
+		return err
+	}
+
+	return e.write(binary.LittleEndian.AppendUint64(nil, e.crc))
+}
+
+func (e *Encoder) write(p []byte) error {
+	e.crc = CRC64(e.crc, p)
+	_, err := e.w.Write(p)
+
+	return err
+}
+
+// EncodeDump serializes obj the way DUMP does: its type and value, followed
+// by the RDB version and a checksum.
+func EncodeDump(obj *Object) []byte {
+	var buf = []byte{objectType(obj)}
+	buf = appendObject(buf, obj)
+	buf = binary.LittleEndian.AppendUint16(buf, Version)
+
+	return binary.LittleEndian.AppendUint64(buf, CRC64(0, buf))
+}
+
+func objectType(obj *Object) byte {
+	switch obj.Kind {
+	case KindList:
+		return TypeList
+	case KindSet:
+		return TypeSet
+	case KindZSet:
+		return TypeZSet2
+	case KindHash:
+		return TypeHash
+	case KindStream:
+		return TypeStreamListpacks
+	}
+	return TypeString
+}
+
+func appendObject(buf []byte, obj *Object) []byte {
+	switch obj.Kind {
+	case KindString:
+		return appendString(buf, obj.Value)
+	case KindList, KindSet:
+		buf = appendLen(buf, uint64(len(obj.Members)))
+		for _, m := range obj.Members {
+			buf = appendString(buf, m)
+		}
+	case KindZSet:
+		buf = appendLen(buf, uint64(len(obj.Members)))
+		for i, m := range obj.Members {
+			buf = appendString(buf, m)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(obj.Scores[i]))
+		}
+	case KindHash:
+		buf = appendLen(buf, uint64(len(obj.Members)))
+		for i, f := range obj.Members {
+			buf = appendString(buf, f)
+			buf = appendString(buf, obj.Values[i])
+		}
+	case KindStream:
+		buf = appendStream(buf, obj.Stream)
+	}
+
+	return buf
+}
+
+// appendStream writes a stream the way Redis 5 does: its entries in nodes of
+// up to streamNodeMax entries, each one a listpack keyed by the ID of its
+// first entry, then the consumer groups.
+func appendStream(buf []byte, s *Stream) []byte {
+	var nodes = (len(s.Entries) + streamNodeMax - 1) / streamNodeMax
+	buf = appendLen(buf, uint64(nodes))
+	for i := 0; i < len(s.Entries); i += streamNodeMax {
+		end := i + streamNodeMax
+		if end > len(s.Entries) {
+			end = len(s.Entries)
+		}
+		master := s.Entries[i].ID
+		buf = appendString(buf, streamIDBytes(master))
+		buf = appendString(buf, streamNode(master, s.Entries[i:end]))
+	}
+
+	buf = appendLen(buf, uint64(len(s.Entries)))
+	buf = appendLen(buf, s.LastID.Ms)
+	buf = appendLen(buf, s.LastID.Seq)
+
+	buf = appendLen(buf, uint64(len(s.Groups)))
+	for _, g := range s.Groups {
+		buf = appendString(buf, g.Name)
+		buf = appendLen(buf, g.LastID.Ms)
+		buf = appendLen(buf, g.LastID.Seq)
+
+		buf = appendLen(buf, uint64(len(g.Pending)))
+		for _, p := range g.Pending {
+			buf = append(buf, streamIDBytes(p.ID)...)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(p.DeliveryTime))
+			buf = appendLen(buf, p.DeliveryCount)
+		}
+
+		buf = appendLen(buf, uint64(len(g.Consumers)))
+		for _, c := range g.Consumers {
+			buf = appendString(buf, c.Name)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(c.SeenTime))
+
+			var pending []StreamID
+			for _, p := range g.Pending {
+				if bytes.Equal(p.Consumer, c.Name) {
+					pending = append(pending, p.ID)
+				}
+			}
+			buf = appendLen(buf, uint64(len(pending)))
+			for _, id := range pending {
+				buf = append(buf, streamIDBytes(id)...)
+			}
+		}
+	}
+
+	return buf
+}
+
+// streamNode encodes entries as a stream listpack: a master entry holding
+// the field names of the first entry, then the entries, whose IDs are stored
+// relative to master and whose field names are omitted when they are the
+// master ones.
+func streamNode(master StreamID, entries []StreamEntry) []byte {
+	var (
+		lp           listpack
+		masterFields [][]byte
+	)
+	for i := 0; i < len(entries[0].Fields); i += 2 {
+		masterFields = append(masterFields, entries[0].Fields[i])
+	}
+
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0)
+	lp.appendInt(int64(len(masterFields)))
+	for _, f := range masterFields {
+		lp.appendString(f)
+	}
+	lp.appendInt(0)
+
+	for _, e := range entries {
+		var same = len(e.Fields) == 2*len(masterFields)
+		for i := 0; same && i < len(masterFields); i++ {
+			same = bytes.Equal(e.Fields[2*i], masterFields[i])
+		}
+
+		var n = len(e.Fields) / 2
+		if same {
+			lp.appendInt(streamFlagSame)
+		} else {
+			lp.appendInt(0)
+		}
+		lp.appendInt(int64(e.ID.Ms - master.Ms))
+		lp.appendInt(int64(e.ID.Seq - master.Seq))
+		if same {
+			for i := 1; i < len(e.Fields); i += 2 {
+				lp.appendString(e.Fields[i])
+			}
+			lp.appendInt(int64(n + 3))
+		} else {
+			lp.appendInt(int64(n))
+			for _, f := range e.Fields {
+				lp.appendString(f)
+			}
+			lp.appendInt(int64(2*n + 4))
+		}
+	}
+
+	return lp.bytes()
+}
+
+func streamIDBytes(id StreamID) []byte {
+	var b = binary.BigEndian.AppendUint64(nil, id.Ms)
+	return binary.BigEndian.AppendUint64(b, id.Seq)
+}
+
+func appendLen(buf []byte, l uint64) []byte {
+	switch {
+	case l < 1<<6:
+		return append(buf, byte(l))
+	case l < 1<<14:
+		return append(buf, byte(l>>8)|len14Bit<<6, byte(l))
+	case l <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, len32Bit), uint32(l))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, len64Bit), l)
+}
+
+func appendString(buf []byte, s []byte) []byte {
+	return append(appendLen(buf, uint64(len(s))), s...)
+}
+
+func leftPad(s string, n int) string {
+	for len(s) < n {
+		s = "0" + s
+	}
+	return s
+}
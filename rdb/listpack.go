@@ -0,0 +1,444 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// listpack builds the compact encoding Redis uses for small collections and
+// stream nodes.
+type listpack struct {
+	buf []byte
+	n   int
+}
+
+func (lp *listpack) appendString(s []byte) {
+	var start = len(lp.buf)
+	switch l := len(s); {
+	case l < 64:
+		lp.buf = append(lp.buf, 0x80|byte(l))
+	case l < 4096:
+		lp.buf = append(lp.buf, 0xe0|byte(l>>8), byte(l))
+	default:
+		lp.buf = append(lp.buf, 0xf0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(l))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+func (lp *listpack) appendInt(v int64) {
+	var start = len(lp.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.buf = append(lp.buf, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & 0x1fff
+		lp.buf = append(lp.buf, 0xc0|byte(u>>8), byte(u))
+	case v >= -32768 && v <= 32767:
+		lp.buf = append(lp.buf, 0xf1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(v))
+	case v >= -8388608 && v <= 8388607:
+		u := uint32(v)
+		lp.buf = append(lp.buf, 0xf2, byte(u), byte(u>>8), byte(u>>16))
+	case v >= -2147483648 && v <= 2147483647:
+		lp.buf = append(lp.buf, 0xf3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(v))
+	default:
+		lp.buf = append(lp.buf, 0xf4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(v))
+	}
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+// appendBacklen writes the size of the previous element, 7 bits per byte,
+// so that the listpack can be walked backwards.
+func (lp *listpack) appendBacklen(l int) {
+	switch {
+	case l <= 127:
+		lp.buf = append(lp.buf, byte(l))
+	case l < 16383:
+		lp.buf = append(lp.buf, byte(l>>7), byte(l&127)|128)
+	case l < 2097151:
+		lp.buf = append(lp.buf, byte(l>>14), byte((l>>7)&127)|128, byte(l&127)|128)
+	case l < 268435455:
+		lp.buf = append(lp.buf, byte(l>>21), byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	default:
+		lp.buf = append(lp.buf, byte(l>>28), byte((l>>21)&127)|128, byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	}
+	lp.n++
+}
+
+func (lp *listpack) bytes() []byte {
+	var (
+		size = 6 + len(lp.buf) + 1
+		out  = make([]byte, 0, size)
+		n    = lp.n
+	)
+	if n > 65535 {
+		n = 65535
+	}
+	out = binary.LittleEndian.AppendUint32(out, uint32(size))
+	out = binary.LittleEndian.AppendUint16(out, uint16(n))
+	out = append(out, lp.buf...)
+
+	return append(out, 0xff)
+}
+
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// listpackDecode returns the elements of a listpack, integers formatted in
+// base 10.
+func listpackDecode(b []byte) ([][]byte, error) {
+	if len(b) < 7 || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, ErrFormat
+	}
+
+	var (
+		elems [][]byte
+		p     = 6
+	)
+	for {
+		if p >= len(b) {
+			return nil, ErrFormat
+		}
+		var (
+			c     = b[p]
+			start = p
+			ival  int64
+			str   []byte
+			isStr bool
+		)
+		need := func(n int) bool { return p+n <= len(b) }
+		switch {
+		case c == 0xff:
+			return elems, nil
+		case c&0x80 == 0:
+			ival = int64(c)
+			p++
+		case c&0xc0 == 0x80:
+			l := int(c & 0x3f)
+			if !need(1 + l) {
+				return nil, ErrFormat
+			}
+			str, isStr = b[p+1:p+1+l], true
+			p += 1 + l
+		case c&0xe0 == 0xc0:
+			if !need(2) {
+				return nil, ErrFormat
+			}
+			u := int64(c&0x1f)<<8 | int64(b[p+1])
+			if u >= 1<<12 {
+				u -= 1 << 13
+			}
+			ival = u
+			p += 2
+		case c&0xf0 == 0xe0:
+			if !need(2) {
+				return nil, ErrFormat
+			}
+			l := int(c&0x0f)<<8 | int(b[p+1])
+			if !need(2 + l) {
+				return nil, ErrFormat
+			}
+			str, isStr = b[p+2:p+2+l], true
+			p += 2 + l
+		case c == 0xf0:
+			if !need(5) {
+				return nil, ErrFormat
+			}
+			l := int(binary.LittleEndian.Uint32(b[p+1:]))
+			if l < 0 || !need(5+l) {
+				return nil, ErrFormat
+			}
+			str, isStr = b[p+5:p+5+l], true
+			p += 5 + l
+		case c == 0xf1:
+			if !need(3) {
+				return nil, ErrFormat
+			}
+			ival = int64(int16(binary.LittleEndian.Uint16(b[p+1:])))
+			p += 3
+		case c == 0xf2:
+			if !need(4) {
+				return nil, ErrFormat
+			}
+			ival = int64(int32(uint32(b[p+1])<<8|uint32(b[p+2])<<16|uint32(b[p+3])<<24) >> 8)
+			p += 4
+		case c == 0xf3:
+			if !need(5) {
+				return nil, ErrFormat
+			}
+			ival = int64(int32(binary.LittleEndian.Uint32(b[p+1:])))
+			p += 5
+		case c == 0xf4:
+			if !need(9) {
+				return nil, ErrFormat
+			}
+			ival = int64(binary.LittleEndian.Uint64(b[p+1:]))
+			p += 9
+		default:
+			return nil, ErrFormat
+		}
+		p += backlenSize(p - start)
+
+		if isStr {
+			elems = append(elems, str)
+		} else {
+			elems = append(elems, []byte(strconv.FormatInt(ival, 10)))
+		}
+	}
+}
+
+// ziplistDecode returns the elements of a ziplist, the encoding listpacks
+// replaced in Redis 7.
+func ziplistDecode(b []byte) ([][]byte, error) {
+	if len(b) < 11 || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, ErrFormat
+	}
+
+	var (
+		elems [][]byte
+		p     = 10
+	)
+	need := func(n int) bool { return p+n <= len(b) }
+	for {
+		if !need(1) {
+			return nil, ErrFormat
+		}
+		if b[p] == 0xff {
+			return elems, nil
+		}
+
+		// previous entry length
+		if b[p] == 0xfe {
+			p += 5
+		} else {
+			p++
+		}
+		if !need(1) {
+			return nil, ErrFormat
+		}
+
+		var (
+			c    = b[p]
+			ival int64
+		)
+		switch {
+		case c>>6 == 0:
+			l := int(c & 0x3f)
+			if !need(1 + l) {
+				return nil, ErrFormat
+			}
+			elems = append(elems, b[p+1:p+1+l])
+			p += 1 + l
+			continue
+		case c>>6 == 1:
+			if !need(2) {
+				return nil, ErrFormat
+			}
+			l := int(c&0x3f)<<8 | int(b[p+1])
+			if !need(2 + l) {
+				return nil, ErrFormat
+			}
+			elems = append(elems, b[p+2:p+2+l])
+			p += 2 + l
+			continue
+		case c == 0x80:
+			if !need(5) {
+				return nil, ErrFormat
+			}
+			l := int(binary.BigEndian.Uint32(b[p+1:]))
+			if l < 0 || !need(5+l) {
+				return nil, ErrFormat
+			}
+			elems = append(elems, b[p+5:p+5+l])
+			p += 5 + l
+			continue
+		case c == 0xc0:
+			if !need(3) {
+				return nil, ErrFormat
+			}
+			ival = int64(int16(binary.LittleEndian.Uint16(b[p+1:])))
+			p += 3
+		case c == 0xd0:
+			if !need(5) {
+				return nil, ErrFormat
+			}
+			ival = int64(int32(binary.LittleEndian.Uint32(b[p+1:])))
+			p += 5
+		case c == 0xe0:
+			if !need(9) {
+				return nil, ErrFormat
+			}
+			ival = int64(binary.LittleEndian.Uint64(b[p+1:]))
+			p += 9
+		case c == 0xf0:
+			if !need(4) {
+				return nil, ErrFormat
+			}
+			ival = int64(int32(uint32(b[p+1])<<8|uint32(b[p+2])<<16|uint32(b[p+3])<<24) >> 8)
+			p += 4
+		case c == 0xfe:
+			if !need(2) {
+				return nil, ErrFormat
+			}
+			ival = int64(int8(b[p+1]))
+			p += 2
+		case c >= 0xf1 && c <= 0xfd:
+			ival = int64(c&0x0f) - 1
+			p++
+		default:
+			return nil, ErrFormat
+		}
+		elems = append(elems, []byte(strconv.FormatInt(ival, 10)))
+	}
+}
+
+// intsetDecode returns the members of an intset, formatted in base 10.
+func intsetDecode(b []byte) ([][]byte, error) {
+	if len(b) < 8 {
+		return nil, ErrFormat
+	}
+
+	var (
+		enc = int(binary.LittleEndian.Uint32(b))
+		n   = int(binary.LittleEndian.Uint32(b[4:]))
+	)
+	if (enc != 2 && enc != 4 && enc != 8) || n < 0 || len(b) != 8+n*enc {
+		return nil, ErrFormat
+	}
+
+	var members = make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		var (
+			p = b[8+i*enc:]
+			v int64
+		)
+		switch enc {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		default:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		members = append(members, []byte(strconv.FormatInt(v, 10)))
+	}
+
+	return members, nil
+}
+
+// zipmapDecode returns the fields and values of a zipmap, the encoding of
+// small hashes before Redis 2.6.
+func zipmapDecode(b []byte) ([][]byte, error) {
+	var (
+		elems [][]byte
+		p     = 1
+	)
+	readLen := func() (int, bool) {
+		if p >= len(b) {
+			return 0, false
+		}
+		switch c := b[p]; {
+		case c < 254:
+			p++
+			return int(c), true
+		case c == 254 && p+5 <= len(b):
+			l := int(binary.LittleEndian.Uint32(b[p+1:]))
+			p += 5
+			return l, l >= 0
+		}
+		return 0, false
+	}
+
+	for {
+		if p >= len(b) {
+			return nil, ErrFormat
+		}
+		if b[p] == 0xff {
+			if len(elems)%2 != 0 {
+				return nil, ErrFormat
+			}
+			return elems, nil
+		}
+
+		l, ok := readLen()
+		if !ok || p+l > len(b) {
+			return nil, ErrFormat
+		}
+		elems = append(elems, b[p:p+l])
+		p += l
+
+		l, ok = readLen()
+		if !ok || p+1+l > len(b) {
+			return nil, ErrFormat
+		}
+		free := int(b[p])
+		p++
+		elems = append(elems, b[p:p+l])
+		p += l + free
+	}
+}
+
+// lzfDecompress expands the LZF compressed strings Redis writes when
+// rdbcompression is enabled.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	var (
+		out = make([]byte, 0, size)
+		p   = 0
+	)
+	for p < len(in) {
+		ctrl := int(in[p])
+		p++
+		if ctrl < 32 {
+			// literal run
+			ctrl++
+			if p+ctrl > len(in) || len(out)+ctrl > size {
+				return nil, ErrFormat
+			}
+			out = append(out, in[p:p+ctrl]...)
+			p += ctrl
+			continue
+		}
+
+		// back reference
+		l := ctrl >> 5
+		if l == 7 {
+			if p >= len(in) {
+				return nil, ErrFormat
+			}
+			l += int(in[p])
+			p++
+		}
+		if p >= len(in) {
+			return nil, ErrFormat
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[p]) - 1
+		p++
+		l += 2
+		if ref < 0 || len(out)+l > size {
+			return nil, ErrFormat
+		}
+		for i := 0; i < l; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != size {
+		return nil, ErrFormat
+	}
+
+	return out, nil
+}
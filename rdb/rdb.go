@@ -0,0 +1,186 @@
+// Package rdb reads and writes the Redis RDB serialization format, used for
+// DUMP/RESTORE payloads as well as for whole database files.
+package rdb
+
+import (
+	"errors"
+)
+
+// Version is the RDB version written by raptor. Every encoding it produces is
+// understood by Redis 5.0 and later.
+const Version = 9
+
+// MaxVersion is the most recent RDB version that can be read.
+const MaxVersion = 12
+
+// value types
+const (
+	TypeString            = 0
+	TypeList              = 1
+	TypeSet               = 2
+	TypeZSet              = 3
+	TypeHash              = 4
+	TypeZSet2             = 5
+	TypeModulePreGA       = 6
+	TypeModule2           = 7
+	TypeHashZipmap        = 9
+	TypeListZiplist       = 10
+	TypeSetIntset         = 11
+	TypeZSetZiplist       = 12
+	TypeHashZiplist       = 13
+	TypeListQuicklist     = 14
+	TypeStreamListpacks   = 15
+	TypeHashListpack      = 16
+	TypeZSetListpack      = 17
+	TypeListQuicklist2    = 18
+	TypeStreamListpacks2  = 19
+	TypeSetListpack       = 20
+	TypeStreamListpacks3  = 21
+	TypeHashMetadataPreGA = 22
+)
+
+// opcodes of a database file
+const (
+	opSlotInfo      = 244
+	opFunction2     = 245
+	opFunctionPreGA = 246
+	opModuleAux     = 247
+	opIdle          = 248
+	opFreq          = 249
+	opAux           = 250
+	opResizeDB      = 251
+	opExpireTimeMs  = 252
+	opExpireTime    = 253
+	opSelectDB      = 254
+	opEOF           = 255
+)
+
+// length encodings, the two high bits of the first byte, and the special
+// encodings of strings
+const (
+	len6Bit   = 0
+	len14Bit  = 1
+	lenEncVal = 3
+	len32Bit  = 0x80
+	len64Bit  = 0x81
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+const (
+	// streamNodeMax is the number of entries per listpack, the default of
+	// stream-node-max-entries
+	streamNodeMax = 100
+
+	streamFlagDelete = 1
+	streamFlagSame   = 2
+)
+
+var (
+	ErrChecksum    = errors.New("rdb: wrong checksum")
+	ErrVersion     = errors.New("rdb: unsupported version")
+	ErrFormat      = errors.New("rdb: bad data format")
+	ErrUnsupported = errors.New("rdb: unsupported value type")
+)
+
+// Kind is the type of an object, whatever the encoding it was stored with.
+type Kind byte
+
+const (
+	KindString Kind = iota
+	KindList
+	KindSet
+	KindZSet
+	KindHash
+	KindStream
+)
+
+// Object is a decoded value. Value holds strings, Members the elements of
+// lists, sets and sorted sets and the fields of hashes, with the hash values
+// in Values and the scores in Scores.
+type Object struct {
+	Kind    Kind
+	Value   []byte
+	Members [][]byte
+	Values  [][]byte
+	Scores  []float64
+	Stream  *Stream
+}
+
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+// Stream holds the entries of a stream in ID order, along with its consumer
+// groups.
+type Stream struct {
+	Entries []StreamEntry
+	LastID  StreamID
+	Groups  []StreamGroup
+}
+
+type StreamGroup struct {
+	Name      []byte
+	LastID    StreamID
+	Pending   []StreamPending
+	Consumers []StreamConsumer
+}
+
+// StreamPending is an entry delivered to Consumer and not acknowledged yet,
+// DeliveryTime is a unix time in milliseconds.
+type StreamPending struct {
+	ID            StreamID
+	Consumer      []byte
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+type StreamConsumer struct {
+	Name     []byte
+	SeenTime int64
+}
+
+// Entry is a key read from a database file. ExpireAt is a unix time in
+// milliseconds, zero for keys without expiration.
+type Entry struct {
+	DB       int
+	Key      []byte
+	Object   *Object
+	ExpireAt int64
+}
+
+// crcTable is the reflected table of the Jones polynomial, the CRC64 variant
+// used by Redis: no initial or final inversion, unlike hash/crc64.
+var crcTable = func() *[256]uint64 {
+	const poly = 0x95ac9329ac4bc9b5
+	var t [256]uint64
+	for i := range t {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}()
+
+// CRC64 updates crc with p.
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crcTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
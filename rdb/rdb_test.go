@@ -0,0 +1,110 @@
+package rdb
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestCRC64(t *testing.T) {
+	if crc := CRC64(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("crc64 = %x", crc)
+	}
+}
+
+func TestDecodeRedisDump(t *testing.T) {
+	// DUMP of the integer 10 by Redis 7
+	obj, err := DecodeDump([]byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Kind != KindString || string(obj.Value) != "10" {
+		t.Fatalf("got %+v", obj)
+	}
+
+	_, err = DecodeDump([]byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbc"))
+	if err != ErrChecksum {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	objs := []*Object{
+		{Kind: KindString, Value: []byte("hello")},
+		{Kind: KindSet, Members: [][]byte{[]byte("a"), []byte("b")}},
+		{Kind: KindZSet, Members: [][]byte{[]byte("a"), []byte("b")}, Scores: []float64{1.5, -2}},
+		{Kind: KindHash, Members: [][]byte{[]byte("f")}, Values: [][]byte{bytes.Repeat([]byte("v"), 5000)}},
+		{Kind: KindStream, Stream: &Stream{
+			Entries: []StreamEntry{
+				{ID: StreamID{Ms: 1, Seq: 5}, Fields: [][]byte{[]byte("a"), []byte("1")}},
+				{ID: StreamID{Ms: 2, Seq: 0}, Fields: [][]byte{[]byte("a"), []byte("-300")}},
+				{ID: StreamID{Ms: 3, Seq: 1}, Fields: [][]byte{[]byte("b"), []byte("2"), []byte("c"), []byte("3")}},
+			},
+			LastID: StreamID{Ms: 3, Seq: 1},
+			Groups: []StreamGroup{{
+				Name:      []byte("g"),
+				LastID:    StreamID{Ms: 2},
+				Pending:   []StreamPending{{ID: StreamID{Ms: 1, Seq: 5}, Consumer: []byte("c"), DeliveryTime: 1000, DeliveryCount: 2}},
+				Consumers: []StreamConsumer{{Name: []byte("c"), SeenTime: 1000}},
+			}},
+		}},
+	}
+
+	for _, obj := range objs {
+		got, err := DecodeDump(EncodeDump(obj))
+		if err != nil {
+			t.Fatalf("kind %d: %v", obj.Kind, err)
+		}
+		if !reflect.DeepEqual(got, obj) {
+			t.Fatalf("kind %d: got %+v, want %+v", obj.Kind, got, obj)
+		}
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.WriteHeader()
+	e.WriteAux("redis-ver", "7.0.0")
+	e.WriteDB(0, 2, 1)
+	e.WriteObject([]byte("k1"), &Object{Kind: KindString, Value: []byte("v")}, 0)
+	e.WriteObject([]byte("k2"), &Object{Kind: KindString, Value: []byte("w")}, 1700000000000)
+	if err := e.WriteFooter(); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []*Entry
+	err := NewDecoder(&buf).Decode(func(e *Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[1].Key) != "k2" || entries[1].ExpireAt != 1700000000000 || entries[0].ExpireAt != 0 {
+		t.Fatalf("got %+v", entries)
+	}
+}
+
+func TestListpack(t *testing.T) {
+	var (
+		lp   listpack
+		ints = []int64{0, 127, 128, -1, 4095, -4096, 32767, -32768, 8388607, -8388608, 1 << 31, -1 << 40}
+		want [][]byte
+	)
+	for _, v := range ints {
+		lp.appendInt(v)
+		want = append(want, []byte(strconv.FormatInt(v, 10)))
+	}
+	lp.appendString(bytes.Repeat([]byte("x"), 70))
+	want = append(want, bytes.Repeat([]byte("x"), 70))
+
+	got, err := listpackDecode(lp.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q", got)
+	}
+}
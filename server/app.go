@@ -17,8 +17,22 @@ import (
 type App struct {
 	conf   *config.Config
 	db     *raptor.Raptor
-	mu *sync.Mutex
+	mu     *sync.Mutex
 	authed map[string]struct{}
+	pubsub *pubSub
+
+	waiters     *keyWaiters
+	notifyFlags int32
+	expires     *expireWatcher
+	lazyfree    *lazyFree
+	locks       *keyLocks
+	access      *accessTracker
+	saver       *rdbSaver
+	fsync       *appendFsync
+	coalesce    int32
+	repl        *replication
+	raft        *raftMode
+	cluster     *cluster
 
 	infoServer  infoServer
 	infoClients struct {
@@ -27,6 +41,8 @@ type App struct {
 	infoStat struct {
 		totalConnectionsReceived int32
 		totalCommandsProcessed   int32
+		coalescedBatches         int64
+		coalescedCommands        int64
 	}
 }
 
@@ -45,12 +61,30 @@ func New(conf *config.Config) *App {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = migrateZSets(db); err != nil {
+		log.Fatal(err)
+	}
 
-	return &App{
+	notifyFlags, err := parseNotifyFlags(conf.Raptor.NotifyKeyspaceEvents)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := &App{
 		conf:   conf,
 		db:     db,
-		mu: &sync.Mutex{},
+		mu:     &sync.Mutex{},
 		authed: make(map[string]struct{}),
+		pubsub: newPubSub(conf.Raptor.PubSubLimit),
+
+		waiters:     newKeyWaiters(),
+		notifyFlags: int32(notifyFlags),
+		expires:     newExpireWatcher(),
+		lazyfree:    newLazyFree(conf.Raptor.LazyFreeLazyUserDel),
+		locks:       newKeyLocks(),
+		access:      newAccessTracker(),
+		saver:       newRDBSaver(conf.Raptor.DBFilename),
+		repl:        newReplication(conf.Raptor.ReplicaReadOnly, conf.Raptor.MasterAuth, conf.Raptor.ReplBacklogSize),
 		infoServer: infoServer{
 			os:              runtime.GOOS,
 			processID:       os.Getpid(),
@@ -60,11 +94,61 @@ func New(conf *config.Config) *App {
 			uptimeInDays:    0,
 		},
 	}
+	db.SetJournal(app.repl.feedOp)
+
+	app.setCoalesceWrites(conf.Raptor.CoalesceWrites)
+	app.fsync, err = newAppendFsync(conf.Raptor.AppendFsync)
+	if err != nil {
+		log.Fatalf("appendfsync: %v", err)
+	}
+
+	if conf.Raptor.RaftID != "" {
+		if conf.Raptor.ReplicaOf != "" {
+			log.Fatal("replicaof and raft_id can't be set together")
+		}
+		app.raft, err = newRaftMode(app)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if conf.Raptor.ClusterEnabled {
+		if app.raft != nil {
+			log.Fatal("cluster_enabled and raft_id can't be set together")
+		}
+		app.cluster, err = newCluster(conf.Raptor.ClusterConfigFile, conf.Raptor.Host, conf.Raptor.Port)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db.SetJournal(func(op [][]byte, applied bool) {
+			app.repl.feedOp(op, applied)
+			app.cluster.keys.update(db, op)
+		})
+		if err = app.cluster.keys.build(db); err != nil {
+			log.Fatalf("cluster: indexing the keys by slot: %v", err)
+		}
+	}
+
+	return app
 }
 
 func (app *App) Run() {
 	addr := fmt.Sprintf("%s:%d", app.conf.Raptor.Host, app.conf.Raptor.Port)
 	log.Printf("started server at :%d", app.conf.Raptor.Port)
+	if app.notifyEnabled(notifyExpired) {
+		go app.seedExpires()
+	}
+	go app.runExpireWatcher()
+	go app.lazyfree.run(app.db)
+	go app.fsync.run(app.db)
+	go app.repl.run()
+	if app.conf.Raptor.ReplicaOf != "" {
+		host, port, err := parseReplicaOf(app.conf.Raptor.ReplicaOf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.repl.replicaOf(app, host, port)
+	}
 	err := redcon.ListenAndServe(addr,
 		app.onCommand(),
 		app.onAccept(),
@@ -77,46 +161,116 @@ func (app *App) Run() {
 
 func (app *App) onCommand() func(conn redcon.Conn, cmd redcon.Command) {
 	return func(conn redcon.Conn, cmd redcon.Command) {
-		todo := strings.TrimSpace(strings.ToLower(string(cmd.Args[0])))
+		if !app.coalescing(cmd) || !app.coalescing(firstCommand(conn.PeekPipeline())) {
+			app.exec(conn, app.db, cmd)
+			return
+		}
 
-		switch todo {
-		case "quit":
-			app.infoClients.connections--
-			conn.WriteString(RespOK)
-			conn.Close()
-		case "auth":
-			if len(cmd.Args) != 2 {
-				conn.WriteError(fmt.Sprintf(ErrWrongArgs, todo))
-				return
+		var cmds = append([]redcon.Command{cmd}, conn.ReadPipeline()...)
+		for len(cmds) > 0 {
+			var n = 0
+			for n < len(cmds) && n < coalesceMaxBatch && app.coalescing(cmds[n]) {
+				n++
 			}
-
-			if app.auth(conn, string(cmd.Args[1])) {
-				conn.WriteString(RespOK)
-			} else {
-				conn.WriteError(ErrPassword)
+			if n < 2 {
+				app.exec(conn, app.db, cmds[0])
+				cmds = cmds[1:]
+				continue
 			}
-		case "info":
+			app.execBatch(conn, cmds[:n])
+			cmds = cmds[n:]
+		}
+	}
+}
 
-		default:
-			atomic.AddInt32(&app.infoStat.totalCommandsProcessed, 1)
-			if !app.authCheck(conn) {
-				conn.WriteError(ErrNoAuth)
-				return
-			}
-			f, ok := commands[todo]
-			if !ok {
-				conn.WriteError(fmt.Sprintf(ErrCmd, string(cmd.Args[0])))
-				return
-			}
+// exec runs cmd on the store db.
+func (app *App) exec(conn redcon.Conn, db *raptor.Raptor, cmd redcon.Command) {
+	app.execHeld(conn, db, cmd, nil)
+}
+
+// execHeld runs cmd on db, the store or the overlay of a batch, holding the
+// side effects of its writes in effects if not nil.
+func (app *App) execHeld(conn redcon.Conn, db *raptor.Raptor, cmd redcon.Command, effects *[]func()) {
+	todo := strings.TrimSpace(strings.ToLower(string(cmd.Args[0])))
+
+	switch todo {
+	case "quit":
+		app.infoClients.connections--
+		conn.WriteString(RespOK)
+		conn.Close()
+	case "auth":
+		if len(cmd.Args) != 2 {
+			conn.WriteError(fmt.Sprintf(ErrWrongArgs, todo))
+			return
+		}
+
+		if app.auth(conn, string(cmd.Args[1])) {
+			conn.WriteString(RespOK)
+		} else {
+			conn.WriteError(ErrPassword)
+		}
+	default:
+		atomic.AddInt32(&app.infoStat.totalCommandsProcessed, 1)
+		if !app.authCheck(conn) {
+			conn.WriteError(ErrNoAuth)
+			return
+		}
+		f, ok := commands[todo]
+		if !ok {
+			conn.WriteError(fmt.Sprintf(ErrCmd, string(cmd.Args[0])))
+			return
+		}
+
+		if app.cluster != nil && !app.cluster.route(app, conn, todo, cmd.Args) {
+			return
+		}
+
+		if writeCommands[todo] && app.repl.rejectsWrites() {
+			conn.WriteError(ErrReadOnly)
+			return
+		}
+
+		app.lazyfree.wait(cmd.Args[1:])
+		app.access.touchKeys(todo, cmd.Args)
+		var locked []string
+		if writeCommands[todo] && db == app.db && !keyLockSkip[todo] {
+			locked = app.locks.lock(commandKeys(todo, cmd.Args))
+		}
+
+		ctx := Context{
+			Conn: conn,
+			app:  app,
+			db:   db,
+			cmd:  todo,
+			args: cmd.Args,
+
+			effects: effects,
+		}
+		// with always, the reply is held until the write is synced
+		var held *heldReply
+		if writeCommands[todo] && db == app.db && app.fsync.getPolicy() == fsyncAlways {
+			held = &heldReply{Conn: conn}
+			ctx.Conn = held
+		}
+		if app.raft != nil && writeCommands[todo] {
+			app.raft.exec(ctx, f)
+		} else {
+			f(ctx)
+		}
+		app.locks.unlock(locked)
+		if !writeCommands[todo] || db != app.db {
+			return
+		}
 
-			f(Context{
-				Conn: conn,
-				db:   app.db,
-				cmd:  todo,
-				args: cmd.Args,
-			})
+		seq := app.fsync.wrote(conn.RemoteAddr())
+		if held == nil {
+			return
+		}
+		if err := app.fsync.wait(app.db, seq, 0); err != nil {
+			conn.WriteError(fmt.Sprintf(ErrFsync, err))
 			return
 		}
+		conn.WriteRaw(held.buf)
 	}
 }
 
@@ -133,6 +287,10 @@ func (app *App) onClose() func(conn redcon.Conn, err error) {
 	return func(conn redcon.Conn, err error) {
 		log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
 		atomic.AddInt32(&app.infoClients.connections, -1)
+		app.fsync.dropConn(conn.RemoteAddr())
+		if app.cluster != nil {
+			app.cluster.dropConn(conn.RemoteAddr())
+		}
 	}
 }
 
@@ -141,6 +299,9 @@ func (app *App) GetDB() *raptor.Raptor {
 }
 
 func (app *App) authCheck(conn redcon.Conn) bool {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
 	if _, ok := app.authed[conn.RemoteAddr()]; ok {
 		return true
 	}
@@ -159,5 +320,9 @@ func (app *App) auth(conn redcon.Conn, auth string) bool {
 }
 
 func (app *App) Close() error {
+	if app.raft != nil {
+		app.raft.close()
+	}
+	app.fsync.close()
 	return app.db.Close()
 }
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/raptor"
+	"github.com/qichengzx/raptor/storage"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	cmdBackup = "backup"
+)
+
+var errBackupNotEmpty = errors.New("the data directory must be empty to load a backup")
+
+// backupCommandFunc implements BACKUP path [SINCE version]. It writes the
+// entries changed since version, or all of them, to path and replies with
+// the version to pass to the next incremental backup.
+func backupCommandFunc(ctx Context) {
+	if len(ctx.args) != 2 && len(ctx.args) != 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var since uint64
+	if len(ctx.args) == 4 {
+		if strings.ToLower(string(ctx.args[2])) != "since" {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		v, err := strconv.ParseUint(string(ctx.args[3]), 10, 64)
+		if err != nil {
+			ctx.Conn.WriteError(ErrValue)
+			return
+		}
+		since = v
+	}
+
+	next, err := writeBackup(ctx.db, string(ctx.args[1]), since)
+	if err != nil {
+		ctx.Conn.WriteError("ERR " + err.Error())
+		return
+	}
+
+	ctx.Conn.WriteUint64(next)
+}
+
+func writeBackup(db storage.DB, path string, since uint64) (uint64, error) {
+	var next uint64
+	err := writeFileAtomic(path, func(w io.Writer) (err error) {
+		next, err = db.Backup(w, since)
+		return err
+	})
+
+	return next, err
+}
+
+// Backup writes a backup of the store to path, see BACKUP. It is meant to
+// run while the server is stopped, as badger locks its directory.
+func Backup(conf *config.Config, path string, since uint64) error {
+	store, err := raptor.New(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	next, err := writeBackup(store, path, since)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("backup: written to %s, next incremental backup since %d", path, next)
+	return nil
+}
+
+// LoadBackup restores backups into an empty data directory, a full backup
+// first and then the incremental ones in the order they were taken.
+func LoadBackup(conf *config.Config, paths []string) error {
+	entries, err := os.ReadDir(conf.Raptor.Directory)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return errBackupNotEmpty
+	}
+
+	store, err := raptor.New(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = store.Load(bufio.NewReaderSize(f, 1<<20))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		log.Printf("load-backup: %s loaded", path)
+	}
+
+	return nil
+}
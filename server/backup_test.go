@@ -0,0 +1,60 @@
+package server
+
+import (
+	"github.com/qichengzx/raptor/config"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBackupLoad(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		conf config.Config
+	)
+	conf.Raptor.Directory = t.TempDir()
+	conf.Raptor.Engine = "badger"
+	conf.Raptor.Auth = "pass"
+	app := New(&conf)
+	defer app.Close()
+	c := newTestClient(t, app)
+
+	var backup = func(name string, args ...string) string {
+		t.Helper()
+		reply := c.do(append([]string{"backup", filepath.Join(dir, name)}, args...)...)
+		version := strings.TrimSuffix(strings.TrimPrefix(reply, ":"), "\r\n")
+		if _, err := strconv.ParseUint(version, 10, 64); err != nil {
+			t.Fatalf("backup %s = %q", name, reply)
+		}
+		return version
+	}
+
+	c.must("+OK\r\n", "mset", "a", "1", "b", "2")
+	c.must("+OK\r\n", "hmset", "h", "f", "v")
+	version := backup("full")
+	c.must("+OK\r\n", "set", "c", "3")
+	c.must("+OK\r\n", "set", "b", "22")
+	c.must(":1\r\n", "del", "a")
+	backup("incr", "since", version)
+
+	// the incremental backup goes on top of the full one
+	var loaded config.Config
+	loaded.Raptor.Directory = t.TempDir()
+	loaded.Raptor.Engine = "badger"
+	loaded.Raptor.Auth = "pass"
+	if err := LoadBackup(&loaded, []string{filepath.Join(dir, "full"), filepath.Join(dir, "incr")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadBackup(&loaded, []string{filepath.Join(dir, "full")}); err != errBackupNotEmpty {
+		t.Fatalf("loading into a store in use = %v", err)
+	}
+
+	app2 := New(&loaded)
+	defer app2.Close()
+	c = newTestClient(t, app2)
+	c.must("$-1\r\n", "get", "a")
+	c.must("$2\r\n22\r\n", "get", "b")
+	c.must("$1\r\n3\r\n", "get", "c")
+	c.must("$1\r\nv\r\n", "hget", "h", "f")
+}
@@ -0,0 +1,682 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+const (
+	cmdSetBit     = "setbit"
+	cmdGetBit     = "getbit"
+	cmdBitCount   = "bitcount"
+	cmdBitPos     = "bitpos"
+	cmdBitOp      = "bitop"
+	cmdBitField   = "bitfield"
+	cmdBitFieldRO = "bitfield_ro"
+)
+
+// bitmapMaxOffset is the last addressable bit of a 512MB string.
+const bitmapMaxOffset = 512*1024*1024*8 - 1
+
+const (
+	bitfieldGet = iota
+	bitfieldSet
+	bitfieldIncrBy
+)
+
+const (
+	bitfieldWrap = iota
+	bitfieldSat
+	bitfieldFail
+)
+
+type bitfieldOp struct {
+	op       int
+	signed   bool
+	bits     uint
+	offset   int64
+	value    int64
+	overflow int
+}
+
+func setbitCommandFunc(ctx Context) {
+	if len(ctx.args) != 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	offset, err := parseBitOffset(ctx.args[2], false, 1)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	on := string(ctx.args[3])
+	if on != "0" && on != "1" {
+		ctx.Conn.WriteError(ErrBitValue)
+		return
+	}
+
+	val, err := typeBitmapGet(ctx, ctx.args[1])
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	val = bitmapGrow(val, offset)
+	old := bitmapGetBit(val, offset)
+	bitmapSetBit(val, offset, on == "1")
+
+	err = setKeepTTL(ctx, ctx.args[1], append(typeString, val...))
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyString, "setbit", ctx.args[1])
+	ctx.Conn.WriteInt(old)
+}
+
+func getbitCommandFunc(ctx Context) {
+	if len(ctx.args) != 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	offset, err := parseBitOffset(ctx.args[2], false, 1)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	val, err := typeBitmapGet(ctx, ctx.args[1])
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.Conn.WriteInt(bitmapGetBit(val, offset))
+}
+
+func bitcountCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+	if len(ctx.args) == 3 || len(ctx.args) > 5 {
+		ctx.Conn.WriteError(ErrSyntax)
+		return
+	}
+
+	val, err := typeBitmapGet(ctx, ctx.args[1])
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var start, end = int64(0), int64(len(val))*8 - 1
+	if len(ctx.args) > 2 {
+		start, end, err = parseBitRange(ctx.args[2], ctx.args[3], ctx.args[4:], int64(len(val)))
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	var cnt = 0
+	for i := start; i <= end; {
+		if i&7 == 0 && i+7 <= end {
+			cnt += bits.OnesCount8(val[i>>3])
+			i += 8
+			continue
+		}
+		cnt += bitmapGetBit(val, i)
+		i++
+	}
+
+	ctx.Conn.WriteInt(cnt)
+}
+
+func bitposCommandFunc(ctx Context) {
+	if len(ctx.args) < 3 || len(ctx.args) > 6 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	bit := string(ctx.args[2])
+	if bit != "0" && bit != "1" {
+		ctx.Conn.WriteError(ErrBitPosValue)
+		return
+	}
+
+	val, err := typeBitmapGet(ctx, ctx.args[1])
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var (
+		start, end = int64(0), int64(len(val))*8 - 1
+		endGiven   = len(ctx.args) > 4
+		endArg     = []byte("-1")
+		unit       [][]byte
+	)
+	if len(ctx.args) > 3 {
+		if endGiven {
+			endArg, unit = ctx.args[4], ctx.args[5:]
+		}
+		start, end, err = parseBitRange(ctx.args[3], endArg, unit, int64(len(val)))
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	if val == nil {
+		if bit == "1" {
+			ctx.Conn.WriteInt(-1)
+		} else {
+			ctx.Conn.WriteInt(0)
+		}
+		return
+	}
+
+	var (
+		want = 0
+		skip = byte(0xff)
+	)
+	if bit == "1" {
+		want, skip = 1, 0
+	}
+	for i := start; i <= end; {
+		if i&7 == 0 && i+7 <= end && val[i>>3] == skip {
+			i += 8
+			continue
+		}
+		if bitmapGetBit(val, i) == want {
+			ctx.Conn.WriteInt64(i)
+			return
+		}
+		i++
+	}
+
+	// looking for a clear bit without an explicit end, the string is
+	// considered padded with zeros on the right
+	if want == 0 && !endGiven && start <= end {
+		ctx.Conn.WriteInt64(end + 1)
+		return
+	}
+	ctx.Conn.WriteInt(-1)
+}
+
+func bitopCommandFunc(ctx Context) {
+	if len(ctx.args) < 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	op := strings.ToLower(string(ctx.args[1]))
+	switch op {
+	case "and", "or", "xor":
+	case "not":
+		if len(ctx.args) != 4 {
+			ctx.Conn.WriteError(ErrBitOpNot)
+			return
+		}
+	default:
+		ctx.Conn.WriteError(ErrSyntax)
+		return
+	}
+
+	var (
+		srcs   [][]byte
+		maxLen = 0
+	)
+	for _, key := range ctx.args[3:] {
+		val, err := typeBitmapGet(ctx, key)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		srcs = append(srcs, val)
+		if len(val) > maxLen {
+			maxLen = len(val)
+		}
+	}
+
+	var res = make([]byte, maxLen)
+	for i := range res {
+		var b byte
+		for j, src := range srcs {
+			var s byte
+			if i < len(src) {
+				s = src[i]
+			}
+			if j == 0 {
+				b = s
+				continue
+			}
+			switch op {
+			case "and":
+				b &= s
+			case "or":
+				b |= s
+			case "xor":
+				b ^= s
+			}
+		}
+		if op == "not" {
+			b = ^b
+		}
+		res[i] = b
+	}
+
+	var dstkey = ctx.args[2]
+	existed, err := typeObjectDelete(ctx, dstkey)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if existed {
+		ctx.forgetExpire(dstkey)
+	}
+
+	if maxLen == 0 {
+		if existed {
+			ctx.notify(notifyGeneric, "del", dstkey)
+		}
+		ctx.Conn.WriteInt(0)
+		return
+	}
+
+	// the result replaces destkey as SET does, without its expiration
+	err = ctx.db.Set(dstkey, append(typeString, res...), 0)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	ctx.forgetExpire(dstkey)
+
+	ctx.notify(notifyString, "set", dstkey)
+	ctx.Conn.WriteInt(maxLen)
+}
+
+func bitfieldCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		ops      []bitfieldOp
+		overflow = bitfieldWrap
+		write    = false
+		maxBit   = int64(-1)
+	)
+	for i := 2; i < len(ctx.args); i++ {
+		var (
+			sub   = strings.ToLower(string(ctx.args[i]))
+			nargs = 2
+		)
+		switch sub {
+		case "get":
+		case "set", "incrby":
+			nargs = 3
+		case "overflow":
+			nargs = 1
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		if i+nargs >= len(ctx.args) {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+
+		if sub == "overflow" {
+			switch strings.ToLower(string(ctx.args[i+1])) {
+			case "wrap":
+				overflow = bitfieldWrap
+			case "sat":
+				overflow = bitfieldSat
+			case "fail":
+				overflow = bitfieldFail
+			default:
+				ctx.Conn.WriteError(ErrBitOverflow)
+				return
+			}
+			i++
+			continue
+		}
+
+		var op = bitfieldOp{op: bitfieldGet, overflow: overflow}
+		var err error
+		op.signed, op.bits, err = parseBitfieldType(ctx.args[i+1])
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		op.offset, err = parseBitOffset(ctx.args[i+2], true, op.bits)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+
+		if sub != "get" {
+			if ctx.cmd == cmdBitFieldRO {
+				ctx.Conn.WriteError(ErrBitFieldRO)
+				return
+			}
+
+			op.op = bitfieldSet
+			if sub == "incrby" {
+				op.op = bitfieldIncrBy
+			}
+			op.value, err = strconv.ParseInt(string(ctx.args[i+3]), 10, 64)
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+
+			write = true
+			if last := op.offset + int64(op.bits) - 1; last > maxBit {
+				maxBit = last
+			}
+		}
+
+		ops = append(ops, op)
+		i += nargs
+	}
+
+	val, err := typeBitmapGet(ctx, ctx.args[1])
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if write {
+		val = bitmapGrow(val, maxBit)
+	}
+
+	var changes = 0
+	ctx.Conn.WriteArray(len(ops))
+	for _, op := range ops {
+		if op.op == bitfieldGet {
+			if op.signed {
+				ctx.Conn.WriteInt64(bitfieldGetSigned(val, op.offset, op.bits))
+			} else {
+				ctx.Conn.WriteInt64(int64(bitfieldGetUnsigned(val, op.offset, op.bits)))
+			}
+			continue
+		}
+
+		var (
+			old, res int64
+			overflow bool
+		)
+		if op.signed {
+			old = bitfieldGetSigned(val, op.offset, op.bits)
+			if op.op == bitfieldSet {
+				res, overflow = bitfieldSignedOverflow(op.value, 0, op.bits, op.overflow)
+			} else {
+				res, overflow = bitfieldSignedOverflow(old, op.value, op.bits, op.overflow)
+			}
+		} else {
+			old = int64(bitfieldGetUnsigned(val, op.offset, op.bits))
+			var r uint64
+			if op.op == bitfieldSet {
+				r, overflow = bitfieldUnsignedOverflow(uint64(op.value), 0, op.bits, op.overflow)
+			} else {
+				r, overflow = bitfieldUnsignedOverflow(uint64(old), op.value, op.bits, op.overflow)
+			}
+			res = int64(r)
+		}
+
+		if overflow && op.overflow == bitfieldFail {
+			ctx.Conn.WriteNull()
+			continue
+		}
+
+		bitfieldSetValue(val, op.offset, op.bits, uint64(res))
+		changes++
+		if op.op == bitfieldSet {
+			ctx.Conn.WriteInt64(old)
+		} else {
+			ctx.Conn.WriteInt64(res)
+		}
+	}
+
+	if changes > 0 {
+		err = setKeepTTL(ctx, ctx.args[1], append(typeString, val...))
+		if err == nil {
+			ctx.notify(notifyString, "setbit", ctx.args[1])
+		}
+	}
+}
+
+// typeBitmapGet returns the string stored at key without its type prefix,
+// a missing key is an empty bitmap.
+func typeBitmapGet(ctx Context, key []byte) ([]byte, error) {
+	val, err := typeStringGetVal(ctx, key)
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+
+	return val[1:], nil
+}
+
+// parseBitOffset parses a bit offset, with hash it accepts the "#N" form
+// of BITFIELD which is multiplied by the width of the field.
+func parseBitOffset(arg []byte, hash bool, width uint) (int64, error) {
+	var mul = int64(1)
+	if hash && len(arg) > 0 && arg[0] == '#' {
+		mul = int64(width)
+		arg = arg[1:]
+	}
+
+	offset, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || offset < 0 || offset > bitmapMaxOffset/mul {
+		return 0, errors.New(ErrBitOffset)
+	}
+	offset *= mul
+	if offset+int64(width)-1 > bitmapMaxOffset {
+		return 0, errors.New(ErrBitOffset)
+	}
+
+	return offset, nil
+}
+
+// parseBitRange turns the start and end of BITCOUNT and BITPOS, in BYTE or
+// BIT units, into an inclusive range of bits, start > end when it is empty.
+func parseBitRange(startArg, endArg []byte, unit [][]byte, length int64) (int64, int64, error) {
+	var isBit = false
+	if len(unit) > 0 {
+		switch strings.ToLower(string(unit[0])) {
+		case "byte":
+		case "bit":
+			isBit = true
+		default:
+			return 0, 0, errors.New(ErrSyntax)
+		}
+	}
+
+	start, err := strconv.ParseInt(string(startArg), 10, 64)
+	if err != nil {
+		return 0, 0, errors.New(ErrValue)
+	}
+	end, err := strconv.ParseInt(string(endArg), 10, 64)
+	if err != nil {
+		return 0, 0, errors.New(ErrValue)
+	}
+
+	var total = length
+	if isBit {
+		total = length * 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+
+	if !isBit {
+		start, end = start*8, end*8+7
+		if end >= total*8 {
+			end = total*8 - 1
+		}
+	}
+
+	return start, end, nil
+}
+
+func parseBitfieldType(arg []byte) (bool, uint, error) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u') {
+		return false, 0, errors.New(ErrBitFieldType)
+	}
+
+	n, err := strconv.Atoi(string(arg[1:]))
+	signed := arg[0] == 'i'
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, errors.New(ErrBitFieldType)
+	}
+
+	return signed, uint(n), nil
+}
+
+func bitmapGrow(val []byte, offset int64) []byte {
+	if need := int(offset>>3) + 1; need > len(val) {
+		grown := make([]byte, need)
+		copy(grown, val)
+		return grown
+	}
+
+	return val
+}
+
+func bitmapGetBit(val []byte, offset int64) int {
+	if offset>>3 >= int64(len(val)) {
+		return 0
+	}
+	if val[offset>>3]&(0x80>>uint(offset&7)) != 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func bitmapSetBit(val []byte, offset int64, on bool) {
+	if on {
+		val[offset>>3] |= 0x80 >> uint(offset&7)
+	} else {
+		val[offset>>3] &^= 0x80 >> uint(offset&7)
+	}
+}
+
+func bitfieldGetUnsigned(val []byte, offset int64, width uint) uint64 {
+	var v uint64
+	for j := uint(0); j < width; j++ {
+		v = v<<1 | uint64(bitmapGetBit(val, offset+int64(j)))
+	}
+
+	return v
+}
+
+func bitfieldGetSigned(val []byte, offset int64, width uint) int64 {
+	v := bitfieldGetUnsigned(val, offset, width)
+	if width < 64 && v&(1<<(width-1)) != 0 {
+		v |= math.MaxUint64 << width
+	}
+
+	return int64(v)
+}
+
+func bitfieldSetValue(val []byte, offset int64, width uint, v uint64) {
+	for j := uint(0); j < width; j++ {
+		bitmapSetBit(val, offset+int64(j), v&(1<<(width-1-j)) != 0)
+	}
+}
+
+// bitfieldUnsignedOverflow returns value+incr as stored in an unsigned
+// field of width bits according to the overflow policy, and whether it
+// overflowed.
+func bitfieldUnsignedOverflow(value uint64, incr int64, width uint, policy int) (uint64, bool) {
+	var max uint64 = math.MaxUint64
+	if width < 64 {
+		max = 1<<width - 1
+	}
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+
+	if value > max || (incr > 0 && incr > maxincr) {
+		if policy == bitfieldSat {
+			return max, true
+		}
+		return (value + uint64(incr)) & max, true
+	}
+	if incr < 0 && incr < minincr {
+		if policy == bitfieldSat {
+			return 0, true
+		}
+		return (value + uint64(incr)) & max, true
+	}
+
+	return value + uint64(incr), false
+}
+
+// bitfieldSignedOverflow is the signed counterpart of
+// bitfieldUnsignedOverflow.
+func bitfieldSignedOverflow(value, incr int64, width uint, policy int) (int64, bool) {
+	var max int64 = math.MaxInt64
+	if width < 64 {
+		max = 1<<(width-1) - 1
+	}
+	min := -max - 1
+	maxincr := max - value
+	minincr := min - value
+
+	var wrap = func() int64 {
+		c := uint64(value) + uint64(incr)
+		if width < 64 {
+			mask := uint64(math.MaxUint64) << width
+			if c&(1<<(width-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c)
+	}
+
+	if value > max || (width != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		if policy == bitfieldSat {
+			return max, true
+		}
+		return wrap(), true
+	}
+	if value < min || (width != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		if policy == bitfieldSat {
+			return min, true
+		}
+		return wrap(), true
+	}
+
+	return value + incr, false
+}
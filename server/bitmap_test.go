@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+)
+
+// testExpiresAt is a unix time far ahead, the keys set to expire then
+// keeping it exactly when their value is rewritten.
+const testExpiresAt = 4000000000
+
+// expiresAt fails the test unless key expires at want, 0 for none.
+func (c *testClient) expiresAt(key string, want uint64) {
+	c.t.Helper()
+	if at, err := c.app.db.ExpiresAt([]byte(key)); err != nil || at != want {
+		c.t.Fatalf("ExpiresAt(%s) = %d %v, want %d", key, at, err, want)
+	}
+}
+
+func TestBitmapKeepTTL(t *testing.T) {
+	var c = newTestClient(t, newTestApp(t))
+
+	c.must("+OK\r\n", "set", "b", "\x00")
+	c.must(":1\r\n", "expireat", "b", "4000000000")
+	c.must(":0\r\n", "setbit", "b", "17", "1")
+	c.expiresAt("b", testExpiresAt)
+	c.must(":1\r\n", "getbit", "b", "17")
+
+	c.must("*1\r\n:0\r\n", "bitfield", "b", "set", "u8", "0", "255")
+	c.expiresAt("b", testExpiresAt)
+	c.must("$3\r\n\xff\x00\x40\r\n", "get", "b")
+
+	// the keys without expiration keep none
+	c.must(":0\r\n", "setbit", "p", "3", "1")
+	c.expiresAt("p", 0)
+
+	// BITOP replaces destkey as SET does
+	c.must("+OK\r\n", "set", "d", "x")
+	c.must(":1\r\n", "expireat", "d", "4000000000")
+	c.must(":3\r\n", "bitop", "or", "d", "b")
+	c.expiresAt("d", 0)
+}
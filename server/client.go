@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// respClient sends commands to another server, one at a time, for the
+// commands talking to other nodes.
+type respClient struct {
+	conn    net.Conn
+	rd      *bufio.Reader
+	timeout time.Duration
+}
+
+// respError is an error reply of the other server.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+func dialRESP(addr string, timeout time.Duration) (*respClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &respClient{conn: conn, rd: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+func (c *respClient) close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and returns its reply, which must be a simple string, a
+// bulk string or an integer. Error replies are returned as respError.
+func (c *respClient) do(args ...[]byte) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(encodeCommand(args)); err != nil {
+		return "", err
+	}
+
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", respError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("unexpected reply %q", line)
+		}
+		if n < 0 {
+			return "", nil
+		}
+		var buf = make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	}
+
+	return "", fmt.Errorf("unexpected reply %q", line)
+}
+
+// auth authenticates with password, if any.
+func (c *respClient) auth(password string) error {
+	if password == "" {
+		return nil
+	}
+	_, err := c.do([]byte("AUTH"), []byte(password))
+
+	return err
+}
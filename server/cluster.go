@@ -0,0 +1,1130 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/qichengzx/raptor/raptor"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/tidwall/redcon"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cmdCluster = "cluster"
+	cmdAsking  = "asking"
+
+	clusterSlots = 16384
+	// clusterBusPortOffset gives the bus port shown by CLUSTER NODES, there
+	// is no bus, the nodes are told of the changes one by one
+	clusterBusPortOffset = 10000
+	clusterMeetTimeout   = 5 * time.Second
+	// clusterConfigFile is where the layout is saved by default
+	clusterConfigFile = "nodes.conf"
+)
+
+// clusterNode is a node of the cluster, the ones serving slots are masters.
+type clusterNode struct {
+	id   string
+	host string
+	port int
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port))
+}
+
+// cluster maps the keys to the 16384 hash slots and the slots to the nodes
+// serving them, as Redis Cluster does. There is no gossip between the nodes:
+// the layout is changed on every node with CLUSTER MEET, ADDSLOTS and
+// SETSLOT, as the cluster management tools do, and saved to path.
+//
+// A slot being moved away is migrating on its owner and importing on its
+// target. The owner asks the clients to go to the target for the keys it no
+// longer has, and the target serves them to the clients that send ASKING.
+type cluster struct {
+	mu        sync.Mutex
+	path      string
+	myself    *clusterNode
+	nodes     map[string]*clusterNode
+	slots     [clusterSlots]*clusterNode
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+	epoch     uint64
+
+	// asking holds the connections that sent ASKING
+	asking map[string]bool
+	// keys indexes the keys of the store by slot
+	keys *slotKeys
+}
+
+// newCluster loads the layout saved at path, or starts a cluster of one node
+// serving no slots.
+func newCluster(path, host string, port int) (*cluster, error) {
+	if path == "" {
+		path = clusterConfigFile
+	}
+	var c = &cluster{
+		path:      path,
+		nodes:     make(map[string]*clusterNode),
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+		asking:    make(map[string]bool),
+		keys:      newSlotKeys(),
+	}
+
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		err = c.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	case os.IsNotExist(err):
+		c.myself = &clusterNode{id: newReplID()}
+		c.nodes[c.myself.id] = c.myself
+	default:
+		return nil, err
+	}
+
+	// the address may have changed since
+	c.myself.host, c.myself.port = host, port
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	log.Printf("cluster: node %s", c.myself.id)
+
+	return c, nil
+}
+
+// load reads the layout in the format of CLUSTER NODES.
+func (c *cluster) load(r io.Reader) error {
+	type pending struct {
+		slot      int
+		id        string
+		migrating bool
+	}
+	var (
+		sc     = bufio.NewScanner(r)
+		owners = make(map[int]string)
+		moves  []pending
+	)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					c.epoch, _ = strconv.ParseUint(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("invalid line %q", sc.Text())
+		}
+
+		host, port, err := net.SplitHostPort(strings.SplitN(fields[1], "@", 2)[0])
+		if err != nil {
+			return err
+		}
+		var n = &clusterNode{id: fields[0], host: host}
+		if n.port, err = strconv.Atoi(port); err != nil {
+			return err
+		}
+		c.nodes[n.id] = n
+		if strings.Contains(fields[2], "myself") {
+			c.myself = n
+		}
+
+		for _, field := range fields[8:] {
+			if strings.HasPrefix(field, "[") {
+				var (
+					spec = strings.Trim(field, "[]")
+					sep  = "->-"
+				)
+				if !strings.Contains(spec, sep) {
+					sep = "-<-"
+				}
+				parts := strings.SplitN(spec, sep, 2)
+				slot, err := strconv.Atoi(parts[0])
+				if len(parts) != 2 || err != nil {
+					return fmt.Errorf("invalid slot %q", field)
+				}
+				moves = append(moves, pending{slot: slot, id: parts[1], migrating: sep == "->-"})
+				continue
+			}
+
+			start, end, err := parseSlotRange(field)
+			if err != nil {
+				return err
+			}
+			for slot := start; slot <= end; slot++ {
+				owners[slot] = n.id
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if c.myself == nil {
+		return fmt.Errorf("no myself node")
+	}
+
+	for slot, id := range owners {
+		c.slots[slot] = c.nodes[id]
+	}
+	for _, m := range moves {
+		n, ok := c.nodes[m.id]
+		if !ok {
+			continue
+		}
+		if m.migrating {
+			c.migrating[m.slot] = n
+		} else {
+			c.importing[m.slot] = n
+		}
+	}
+
+	return nil
+}
+
+func parseSlotRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid slot %q", s)
+	}
+	var end = start
+	if len(parts) == 2 {
+		if end, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid slot %q", s)
+		}
+	}
+	if start < 0 || end >= clusterSlots || start > end {
+		return 0, 0, fmt.Errorf("invalid slot %q", s)
+	}
+
+	return start, end, nil
+}
+
+// save writes the layout to path, c.mu being held or c not shared yet.
+func (c *cluster) save() error {
+	return writeFileAtomic(c.path, func(w io.Writer) error {
+		_, err := io.WriteString(w, c.nodesString()+fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0\n", c.epoch))
+		return err
+	})
+}
+
+// sortedNodes returns the nodes, myself first.
+func (c *cluster) sortedNodes() []*clusterNode {
+	var nodes = make([]*clusterNode, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if (nodes[i] == c.myself) != (nodes[j] == c.myself) {
+			return nodes[i] == c.myself
+		}
+		return nodes[i].id < nodes[j].id
+	})
+
+	return nodes
+}
+
+// slotRanges returns the ranges of slots served by n, in order.
+func (c *cluster) slotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if c.slots[slot] != n {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1][1] == slot-1 {
+			ranges[len(ranges)-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+
+	return ranges
+}
+
+// nodesString returns the layout in the format of CLUSTER NODES.
+func (c *cluster) nodesString() string {
+	var b strings.Builder
+	for _, n := range c.sortedNodes() {
+		var flags = "master"
+		if n == c.myself {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&b, "%s %s@%d %s - 0 0 %d connected", n.id, n.addr(), n.port+clusterBusPortOffset, flags, c.epoch)
+		for _, r := range c.slotRanges(n) {
+			if r[0] == r[1] {
+				fmt.Fprintf(&b, " %d", r[0])
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+			}
+		}
+		if n == c.myself {
+			for _, slot := range sortedSlots(c.migrating) {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, c.migrating[slot].id)
+			}
+			for _, slot := range sortedSlots(c.importing) {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, c.importing[slot].id)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+func sortedSlots(m map[int]*clusterNode) []int {
+	var slots = make([]int, 0, len(m))
+	for slot := range m {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+
+	return slots
+}
+
+// route tells whether the command is for this node, replying MOVED or ASK
+// when it is not.
+func (c *cluster) route(app *App, conn redcon.Conn, cmd string, args [][]byte) bool {
+	var asking bool
+	if cmd != cmdAsking {
+		c.mu.Lock()
+		asking = c.asking[conn.RemoteAddr()]
+		delete(c.asking, conn.RemoteAddr())
+		c.mu.Unlock()
+	}
+
+	var keys = commandKeys(cmd, args)
+	if len(keys) == 0 {
+		return true
+	}
+	var slot = keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			conn.WriteError(ErrCrossSlot)
+			return false
+		}
+	}
+
+	c.mu.Lock()
+	var (
+		owner     = c.slots[slot]
+		mine      = owner == c.myself
+		migrating = c.migrating[slot]
+		importing = c.importing[slot]
+	)
+	c.mu.Unlock()
+
+	switch {
+	case mine && migrating == nil:
+		return true
+	case mine:
+		// the keys moved already are asked for on the target
+		var missing int
+		for _, key := range keys {
+			if _, err := app.db.Get(key); err != nil {
+				missing++
+			}
+		}
+		switch missing {
+		case 0:
+			return true
+		case len(keys):
+			conn.WriteError(fmt.Sprintf(ErrAsk, slot, migrating.addr()))
+		default:
+			conn.WriteError(ErrTryAgainSlot)
+		}
+		return false
+	case importing != nil && asking:
+		return true
+	case owner == nil:
+		conn.WriteError(ErrClusterDown)
+		return false
+	}
+
+	conn.WriteError(fmt.Sprintf(ErrMoved, slot, owner.addr()))
+	return false
+}
+
+// dropConn forgets a connection closed.
+func (c *cluster) dropConn(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.asking, addr)
+}
+
+// keyHashSlot returns the slot of key, from the part between the first {
+// and the next } when not empty, as Redis Cluster does.
+func keyHashSlot(key []byte) int {
+	for i, b := range key {
+		if b != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j > i+1 {
+					key = key[i+1 : j]
+				}
+				return int(crc16(key)) & (clusterSlots - 1)
+			}
+		}
+		break
+	}
+
+	return int(crc16(key)) & (clusterSlots - 1)
+}
+
+// crc16 is the CRC16/XMODEM of Redis Cluster.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// keySpec tells where the keys of a command are: from first to last, a
+// negative last counting from the end, every step arguments. The zero spec
+// is the one of the commands taking no key.
+type keySpec struct {
+	first, last, step int
+}
+
+var commandKeySpecs = map[string]keySpec{
+	cmdMGet:        {1, -1, 1},
+	cmdMSet:        {1, -1, 2},
+	cmdMSetNX:      {1, -1, 2},
+	cmdLCS:         {1, 2, 1},
+	cmdSUnion:      {1, -1, 1},
+	cmdSUnionStore: {1, -1, 1},
+	cmdSDiff:       {1, -1, 1},
+	cmdSDiffStore:  {1, -1, 1},
+	cmdBitOp:       {2, -1, 1},
+	cmdPFCount:     {1, -1, 1},
+	cmdPFMerge:     {1, -1, 1},
+	cmdDel:         {1, -1, 1},
+	cmdExists:      {1, -1, 1},
+	cmdUnlink:      {1, -1, 1},
+	cmdTouch:       {1, -1, 1},
+	cmdRename:      {1, 2, 1},
+	cmdRenameNX:    {1, 2, 1},
+	cmdCopy:        {1, 2, 1},
+	cmdXGroup:      {2, 2, 1},
+	cmdObject:      {2, 2, 1},
+
+	cmdSubscribe:    {},
+	cmdPSubscribe:   {},
+	cmdUnsubscribe:  {},
+	cmdPUnsubscribe: {},
+	cmdPublish:      {},
+	cmdPubSub:       {},
+	cmdSelect:       {},
+	cmdFlushDB:      {},
+	cmdFlushAll:     {},
+	cmdPing:         {},
+	cmdEcho:         {},
+	cmdSave:         {},
+	cmdBgSave:       {},
+	cmdConfig:       {},
+	cmdLastSave:     {},
+	cmdInfo:         {},
+	cmdBackup:       {},
+	cmdStorage:      {},
+	cmdWaitAOF:      {},
+	cmdReplicaOf:    {},
+	cmdSlaveOf:      {},
+	cmdRole:         {},
+	cmdReplConf:     {},
+	cmdPSync:        {},
+	cmdRaft:         {},
+	cmdCluster:      {},
+	cmdAsking:       {},
+}
+
+// commandKeys returns the keys named by a command. The commands missing from
+// commandKeySpecs take a single key, the first argument.
+func commandKeys(cmd string, args [][]byte) [][]byte {
+	var keys [][]byte
+	switch cmd {
+	case cmdMSetEX:
+		if len(args) < 2 {
+			return nil
+		}
+		numkeys, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return nil
+		}
+		for i := 0; i < numkeys && 2+i*2 < len(args); i++ {
+			keys = append(keys, args[2+i*2])
+		}
+		return keys
+	case cmdXRead, cmdXReadGroup:
+		for i := 1; i < len(args); i++ {
+			if strings.ToLower(string(args[i])) == "streams" {
+				var rest = args[i+1:]
+				return rest[:len(rest)/2]
+			}
+		}
+		return nil
+	case cmdMigrate:
+		if len(args) > 3 && len(args[3]) != 0 {
+			return args[3:4]
+		}
+		for i := 6; i < len(args); i++ {
+			if strings.ToLower(string(args[i])) == "keys" {
+				return args[i+1:]
+			}
+		}
+		return nil
+	}
+
+	spec, ok := commandKeySpecs[cmd]
+	if !ok {
+		if commands[cmd] == nil {
+			return nil
+		}
+		spec = keySpec{1, 1, 1}
+	}
+	if spec.first == 0 {
+		return nil
+	}
+
+	var last = spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+
+	return keys
+}
+
+// keysInSlot calls fn with the keys of the store in slot in order, until it
+// returns false.
+func keysInSlot(app *App, slot int, fn func(key []byte) bool) {
+	app.cluster.keys.visit(app.db, slot, fn)
+}
+
+// slotKeys indexes the top level keys of the store by slot, so that the
+// keys of a slot are found without scanning the store. The index is built
+// once from the store and kept up to date from the journal, which gives the
+// keys written and deleted. It may hold keys gone from the store since, as
+// the keys expired or the members of an object written before the object,
+// and drops them when visiting their slot.
+type slotKeys struct {
+	mu    sync.Mutex
+	slots [clusterSlots]map[string]struct{}
+}
+
+func newSlotKeys() *slotKeys {
+	return &slotKeys{}
+}
+
+// build indexes the keys of db. The journal is to feed the index already,
+// so that the keys written meanwhile are not missed.
+func (s *slotKeys) build(db storage.Reader) error {
+	return typeObjectScanKeys(db, func(k []byte) {
+		s.mu.Lock()
+		s.addLocked(k)
+		s.mu.Unlock()
+	})
+}
+
+// update applies op of the journal of db to the index.
+func (s *slotKeys) update(db storage.Reader, op [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToLower(string(op[0])) {
+	case raptor.OpFlushDB:
+		s.slots = [clusterSlots]map[string]struct{}{}
+	case raptor.OpDel:
+		for _, key := range op[1:] {
+			delete(s.slots[keyHashSlot(key)], string(key))
+		}
+	default:
+		// the members of an object are written along with it
+		var lastOwner []byte
+		for _, key := range opKeys(op) {
+			if owner, objType, ok := typeObjectOwner(key); ok {
+				if lastOwner != nil && string(owner) == string(lastOwner) {
+					continue
+				}
+				if val, err := db.Get(owner); err == nil && len(val) > 0 && string(val[:1]) == objType {
+					lastOwner = owner
+					continue
+				}
+			}
+			s.addLocked(key)
+		}
+	}
+}
+
+func (s *slotKeys) addLocked(key []byte) {
+	var slot = keyHashSlot(key)
+	if s.slots[slot] == nil {
+		s.slots[slot] = make(map[string]struct{})
+	}
+	s.slots[slot][string(key)] = struct{}{}
+}
+
+// visit calls fn with the keys of db in slot in order, until it returns
+// false. The writes wait meanwhile, for a key checked missing in db not to
+// be written before it leaves the index, fn must not write to db.
+func (s *slotKeys) visit(db storage.Reader, slot int, fn func(key []byte) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys = make([]string, 0, len(s.slots[slot]))
+	for key := range s.slots[slot] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !topLevelKey(db, []byte(key)) {
+			delete(s.slots[slot], key)
+			continue
+		}
+		if !fn([]byte(key)) {
+			return
+		}
+	}
+}
+
+// topLevelKey tells whether key is in db and is not a member of an object.
+func topLevelKey(db storage.Reader, key []byte) bool {
+	if _, err := db.Get(key); err != nil {
+		return false
+	}
+	owner, objType, ok := typeObjectOwner(key)
+	if !ok {
+		return true
+	}
+	val, err := db.Get(owner)
+
+	return err != nil || len(val) == 0 || string(val[:1]) != objType
+}
+
+func askingCommandFunc(ctx Context) {
+	if len(ctx.args) != 1 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+	var c = ctx.app.cluster
+	if c == nil {
+		ctx.Conn.WriteError(ErrClusterDisabled)
+		return
+	}
+
+	c.mu.Lock()
+	c.asking[ctx.Conn.RemoteAddr()] = true
+	c.mu.Unlock()
+
+	ctx.Conn.WriteString(RespOK)
+}
+
+// clusterSubcommands gives the number of arguments of the CLUSTER
+// subcommands, negative for at least as many.
+var clusterSubcommands = map[string]int{
+	"info":            2,
+	"myid":            2,
+	"nodes":           2,
+	"slots":           2,
+	"shards":          2,
+	"keyslot":         3,
+	"countkeysinslot": 3,
+	"getkeysinslot":   4,
+	"meet":            -4,
+	"forget":          3,
+	"addslots":        -3,
+	"delslots":        -3,
+	"addslotsrange":   -4,
+	"delslotsrange":   -4,
+	"setslot":         -4,
+	"saveconfig":      2,
+}
+
+func clusterCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+	var c = ctx.app.cluster
+	if c == nil {
+		ctx.Conn.WriteError(ErrClusterDisabled)
+		return
+	}
+
+	var sub = strings.ToLower(string(ctx.args[1]))
+	n, ok := clusterSubcommands[sub]
+	if !ok {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrSubCmd, sub))
+		return
+	}
+	if (n > 0 && len(ctx.args) != n) || (n < 0 && len(ctx.args) < -n) {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+		return
+	}
+
+	switch sub {
+	case "info":
+		clusterInfo(ctx, c)
+	case "myid":
+		ctx.Conn.WriteBulkString(c.myself.id)
+	case "nodes":
+		c.mu.Lock()
+		nodes := c.nodesString()
+		c.mu.Unlock()
+		ctx.Conn.WriteBulkString(nodes)
+	case "slots":
+		clusterSlotsReply(ctx, c)
+	case "shards":
+		clusterShardsReply(ctx, c)
+	case "keyslot":
+		ctx.Conn.WriteInt(keyHashSlot(ctx.args[2]))
+	case "countkeysinslot":
+		slot, ok := parseSlot(ctx, ctx.args[2])
+		if !ok {
+			return
+		}
+		var count int
+		keysInSlot(ctx.app, slot, func(key []byte) bool {
+			count++
+			return true
+		})
+		ctx.Conn.WriteInt(count)
+	case "getkeysinslot":
+		slot, ok := parseSlot(ctx, ctx.args[2])
+		if !ok {
+			return
+		}
+		count, err := strconv.Atoi(string(ctx.args[3]))
+		if err != nil || count < 0 {
+			ctx.Conn.WriteError(ErrKeysCount)
+			return
+		}
+		var keys [][]byte
+		if count > 0 {
+			keysInSlot(ctx.app, slot, func(key []byte) bool {
+				keys = append(keys, key)
+				return len(keys) < count
+			})
+		}
+		ctx.Conn.WriteArray(len(keys))
+		for _, key := range keys {
+			ctx.Conn.WriteBulk(key)
+		}
+	case "meet":
+		clusterMeet(ctx, c)
+	case "forget":
+		clusterForget(ctx, c)
+	case "addslots", "delslots", "addslotsrange", "delslotsrange":
+		clusterChangeSlots(ctx, c, sub)
+	case "setslot":
+		clusterSetSlot(ctx, c)
+	case "saveconfig":
+		c.mu.Lock()
+		err := c.save()
+		c.mu.Unlock()
+		if err != nil {
+			ctx.Conn.WriteError("ERR " + err.Error())
+			return
+		}
+		ctx.Conn.WriteString(RespOK)
+	}
+}
+
+func parseSlot(ctx Context, arg []byte) (int, bool) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		ctx.Conn.WriteError(ErrSlotInvalid)
+		return 0, false
+	}
+
+	return slot, true
+}
+
+func clusterInfo(ctx Context, c *cluster) {
+	c.mu.Lock()
+	var (
+		assigned int
+		masters  = make(map[*clusterNode]bool)
+	)
+	for _, n := range c.slots {
+		if n != nil {
+			assigned++
+			masters[n] = true
+		}
+	}
+	var (
+		known = len(c.nodes)
+		epoch = c.epoch
+		state = "fail"
+	)
+	c.mu.Unlock()
+	if assigned == clusterSlots {
+		state = "ok"
+	}
+
+	ctx.Conn.WriteBulkString(strings.Join([]string{
+		"cluster_state:" + state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned),
+		"cluster_slots_pfail:0",
+		"cluster_slots_fail:0",
+		fmt.Sprintf("cluster_known_nodes:%d", known),
+		fmt.Sprintf("cluster_size:%d", len(masters)),
+		fmt.Sprintf("cluster_current_epoch:%d", epoch),
+		fmt.Sprintf("cluster_my_epoch:%d", epoch),
+	}, "\r\n") + "\r\n")
+}
+
+func clusterSlotsReply(ctx Context, c *cluster) {
+	type slotRange struct {
+		start, end int
+		node       clusterNode
+	}
+	var ranges []slotRange
+
+	c.mu.Lock()
+	for slot := 0; slot < clusterSlots; slot++ {
+		var n = c.slots[slot]
+		if n == nil {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1].end == slot-1 && ranges[len(ranges)-1].node.id == n.id {
+			ranges[len(ranges)-1].end = slot
+		} else {
+			ranges = append(ranges, slotRange{start: slot, end: slot, node: *n})
+		}
+	}
+	c.mu.Unlock()
+
+	ctx.Conn.WriteArray(len(ranges))
+	for _, r := range ranges {
+		ctx.Conn.WriteArray(3)
+		ctx.Conn.WriteInt(r.start)
+		ctx.Conn.WriteInt(r.end)
+		ctx.Conn.WriteArray(3)
+		ctx.Conn.WriteBulkString(r.node.host)
+		ctx.Conn.WriteInt(r.node.port)
+		ctx.Conn.WriteBulkString(r.node.id)
+	}
+}
+
+func clusterShardsReply(ctx Context, c *cluster) {
+	type shard struct {
+		node   clusterNode
+		ranges [][2]int
+	}
+	var shards []shard
+
+	c.mu.Lock()
+	for _, n := range c.sortedNodes() {
+		shards = append(shards, shard{node: *n, ranges: c.slotRanges(n)})
+	}
+	c.mu.Unlock()
+
+	ctx.Conn.WriteArray(len(shards))
+	for _, s := range shards {
+		ctx.Conn.WriteArray(4)
+		ctx.Conn.WriteBulkString("slots")
+		ctx.Conn.WriteArray(len(s.ranges) * 2)
+		for _, r := range s.ranges {
+			ctx.Conn.WriteInt(r[0])
+			ctx.Conn.WriteInt(r[1])
+		}
+		ctx.Conn.WriteBulkString("nodes")
+		ctx.Conn.WriteArray(1)
+		ctx.Conn.WriteArray(14)
+		ctx.Conn.WriteBulkString("id")
+		ctx.Conn.WriteBulkString(s.node.id)
+		ctx.Conn.WriteBulkString("port")
+		ctx.Conn.WriteInt(s.node.port)
+		ctx.Conn.WriteBulkString("ip")
+		ctx.Conn.WriteBulkString(s.node.host)
+		ctx.Conn.WriteBulkString("endpoint")
+		ctx.Conn.WriteBulkString(s.node.host)
+		ctx.Conn.WriteBulkString("role")
+		ctx.Conn.WriteBulkString("master")
+		ctx.Conn.WriteBulkString("replication-offset")
+		ctx.Conn.WriteInt(0)
+		ctx.Conn.WriteBulkString("health")
+		ctx.Conn.WriteBulkString("online")
+	}
+}
+
+// clusterMeet implements CLUSTER MEET host port, adding the node listening
+// there, which shares the password of this one.
+func clusterMeet(ctx Context, c *cluster) {
+	var host = string(ctx.args[2])
+	port, err := strconv.Atoi(string(ctx.args[3]))
+	if err != nil || port <= 0 || port > 65535 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrClusterPort, ctx.args[3]))
+		return
+	}
+
+	var n = &clusterNode{host: host, port: port}
+	client, err := dialRESP(n.addr(), clusterMeetTimeout)
+	if err == nil {
+		defer client.close()
+		err = client.auth(ctx.app.conf.Raptor.Auth)
+	}
+	if err == nil {
+		n.id, err = client.do([]byte(cmdCluster), []byte("myid"))
+	}
+	if err != nil {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrClusterMeet, n.addr(), err))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n.id == c.myself.id {
+		ctx.Conn.WriteString(RespOK)
+		return
+	}
+	if old, ok := c.nodes[n.id]; ok {
+		old.host, old.port = n.host, n.port
+	} else {
+		c.nodes[n.id] = n
+	}
+	if err := c.save(); err != nil {
+		ctx.Conn.WriteError("ERR " + err.Error())
+		return
+	}
+	ctx.Conn.WriteString(RespOK)
+}
+
+func clusterForget(ctx Context, c *cluster) {
+	var id = string(ctx.args[2])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[id]
+	if !ok {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrUnknownNode, id))
+		return
+	}
+	if n == c.myself {
+		ctx.Conn.WriteError(ErrForgetMyself)
+		return
+	}
+
+	delete(c.nodes, id)
+	for slot := range c.slots {
+		if c.slots[slot] == n {
+			c.slots[slot] = nil
+		}
+	}
+	for slot, to := range c.migrating {
+		if to == n {
+			delete(c.migrating, slot)
+		}
+	}
+	for slot, from := range c.importing {
+		if from == n {
+			delete(c.importing, slot)
+		}
+	}
+	if err := c.save(); err != nil {
+		ctx.Conn.WriteError("ERR " + err.Error())
+		return
+	}
+	ctx.Conn.WriteString(RespOK)
+}
+
+// clusterChangeSlots implements ADDSLOTS, DELSLOTS, ADDSLOTSRANGE and
+// DELSLOTSRANGE, changing all the slots or none.
+func clusterChangeSlots(ctx Context, c *cluster, sub string) {
+	var (
+		args  = ctx.args[2:]
+		add   = strings.HasPrefix(sub, "add")
+		slots []int
+		seen  = make(map[int]bool)
+	)
+	if strings.HasSuffix(sub, "range") {
+		if len(args)%2 != 0 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+			return
+		}
+		for i := 0; i < len(args); i += 2 {
+			start, ok := parseSlot(ctx, args[i])
+			if !ok {
+				return
+			}
+			end, ok := parseSlot(ctx, args[i+1])
+			if !ok {
+				return
+			}
+			if start > end {
+				ctx.Conn.WriteError(fmt.Sprintf(ErrSlotRange, start, end))
+				return
+			}
+			for slot := start; slot <= end; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+	} else {
+		for _, arg := range args {
+			slot, ok := parseSlot(ctx, arg)
+			if !ok {
+				return
+			}
+			slots = append(slots, slot)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, slot := range slots {
+		if seen[slot] {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrSlotTwice, slot))
+			return
+		}
+		seen[slot] = true
+		if add && c.slots[slot] != nil {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrSlotBusy, slot))
+			return
+		}
+		if !add && c.slots[slot] == nil {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrSlotUnassigned, slot))
+			return
+		}
+	}
+
+	for _, slot := range slots {
+		if add {
+			c.slots[slot] = c.myself
+			delete(c.importing, slot)
+		} else {
+			c.slots[slot] = nil
+			delete(c.migrating, slot)
+		}
+	}
+	if err := c.save(); err != nil {
+		ctx.Conn.WriteError("ERR " + err.Error())
+		return
+	}
+	ctx.Conn.WriteString(RespOK)
+}
+
+// clusterSetSlot implements CLUSTER SETSLOT slot IMPORTING id | MIGRATING
+// id | NODE id | STABLE.
+func clusterSetSlot(ctx Context, c *cluster) {
+	slot, ok := parseSlot(ctx, ctx.args[2])
+	if !ok {
+		return
+	}
+	var action = strings.ToLower(string(ctx.args[3]))
+	if (action == "stable" && len(ctx.args) != 4) || (action != "stable" && len(ctx.args) != 5) {
+		ctx.Conn.WriteError(ErrSyntax)
+		return
+	}
+
+	// a slot changing hands must be empty here first
+	var hasKeys bool
+	if action == "node" {
+		keysInSlot(ctx.app, slot, func(key []byte) bool {
+			hasKeys = true
+			return false
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n *clusterNode
+	if action != "stable" {
+		var id = string(ctx.args[4])
+		if n = c.nodes[id]; n == nil {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrUnknownNode, id))
+			return
+		}
+	}
+
+	switch action {
+	case "importing":
+		if c.slots[slot] == c.myself {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrSlotMine, slot))
+			return
+		}
+		if n == c.myself {
+			ctx.Conn.WriteError(ErrSlotSelf)
+			return
+		}
+		c.importing[slot] = n
+	case "migrating":
+		if c.slots[slot] != c.myself {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrSlotNotMine, slot))
+			return
+		}
+		if n == c.myself {
+			ctx.Conn.WriteError(ErrSlotSelf)
+			return
+		}
+		c.migrating[slot] = n
+	case "stable":
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+	case "node":
+		if c.slots[slot] == c.myself && n != c.myself && hasKeys {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrSlotKeys, slot))
+			return
+		}
+		if n != c.myself {
+			delete(c.migrating, slot)
+		}
+		if n == c.myself && c.importing[slot] != nil {
+			delete(c.importing, slot)
+			c.epoch++
+		}
+		c.slots[slot] = n
+	default:
+		ctx.Conn.WriteError(ErrSyntax)
+		return
+	}
+
+	if err := c.save(); err != nil {
+		ctx.Conn.WriteError("ERR " + err.Error())
+		return
+	}
+	ctx.Conn.WriteString(RespOK)
+}
+
+func infoClusterFields(app *App) []string {
+	if app.cluster == nil {
+		return []string{"cluster_enabled:0"}
+	}
+	return []string{"cluster_enabled:1"}
+}
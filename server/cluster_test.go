@@ -0,0 +1,144 @@
+package server
+
+import (
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	for key, slot := range map[string]int{
+		"123456789":            12739,
+		"foo":                  12182,
+		"{user1000}.following": 3443,
+		"{user1000}.followers": 3443,
+		"user1000":             3443,
+		"foo{}{bar}":           8363,
+		"foo{{bar}}zap":        4015,
+	} {
+		if got := keyHashSlot([]byte(key)); got != slot {
+			t.Errorf("keyHashSlot(%q) = %d, want %d", key, got, slot)
+		}
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	for line, want := range map[string]string{
+		"get a":                               "a",
+		"mset a 1 b 2":                        "a b",
+		"msetex 2 a 1 b 2 ex 10":              "a b",
+		"bitop and dest x y":                  "dest x y",
+		"xread count 1 streams s1 s2 0 0":     "s1 s2",
+		"xreadgroup group g c streams s1 >":   "s1",
+		"xgroup create s g $":                 "s",
+		"object encoding a":                   "a",
+		"rename a b":                          "a b",
+		"copy a b replace":                    "a b",
+		"ping":                                "",
+		"publish ch msg":                      "",
+		"cluster keyslot a":                   "",
+		"migrate h 7000 a 0 1000 copy":        "a",
+		"migrate h 7000 \"\" 0 1000 keys a b": "a b",
+	} {
+		var args [][]byte
+		for _, f := range strings.Fields(line) {
+			args = append(args, []byte(strings.Trim(f, `"`)))
+		}
+		var got []string
+		for _, key := range commandKeys(strings.Fields(line)[0], args) {
+			got = append(got, string(key))
+		}
+		if !reflect.DeepEqual(got, strings.Fields(want)) && !(len(got) == 0 && want == "") {
+			t.Errorf("commandKeys(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestClusterLoad(t *testing.T) {
+	var layout = "a1 127.0.0.1:7000@17000 myself,master - 0 0 3 connected 0-5 7 [8->-b2] [9-<-b2]\n" +
+		"b2 127.0.0.1:7001@17001 master - 0 0 3 connected 8 10-16383\n" +
+		"vars currentEpoch 3 lastVoteEpoch 0\n"
+
+	var c = &cluster{
+		nodes:     make(map[string]*clusterNode),
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+	}
+	if err := c.load(strings.NewReader(layout)); err != nil {
+		t.Fatal(err)
+	}
+	if c.myself.id != "a1" || c.epoch != 3 || c.slots[7] != c.myself || c.slots[6] != nil || c.slots[8].id != "b2" {
+		t.Fatalf("loaded %+v", c)
+	}
+	if c.migrating[8].id != "b2" || c.importing[9].id != "b2" {
+		t.Fatalf("migrating %v importing %v", c.migrating, c.importing)
+	}
+	if got := c.nodesString() + "vars currentEpoch 3 lastVoteEpoch 0\n"; got != layout {
+		t.Fatalf("nodesString =\n%s\nwant\n%s", got, layout)
+	}
+}
+
+// scanCounter counts the scans of the store.
+type scanCounter struct {
+	storage.DB
+	scans int
+}
+
+func (db *scanCounter) Scan(opts storage.ScannerOptions) error {
+	db.scans++
+	return db.DB.Scan(opts)
+}
+
+func TestKeysInSlot(t *testing.T) {
+	var conf config.Config
+	conf.Raptor.Directory = t.TempDir()
+	conf.Raptor.Engine = "bolt"
+	conf.Raptor.Auth = "pass"
+
+	// the keys already in the store are indexed at start
+	app := New(&conf)
+	c := newTestClient(t, app)
+	c.must("+OK\r\n", "set", "{t}a", "1")
+	c.must("+OK\r\n", "hmset", "{t}h", "f1", "v", "f2", "v", "f3", "v")
+	app.Close()
+
+	conf.Raptor.ClusterEnabled = true
+	conf.Raptor.ClusterConfigFile = filepath.Join(t.TempDir(), "nodes.conf")
+	app = New(&conf)
+	defer app.Close()
+	var db = &scanCounter{DB: app.db.DB}
+	app.db.DB = db
+	c = newTestClient(t, app)
+	c.must("+OK\r\n", "cluster", "addslotsrange", "0", "16383")
+
+	var slot = strconv.Itoa(keyHashSlot([]byte("t")))
+	c.must(":2\r\n", "cluster", "countkeysinslot", slot)
+
+	// and the ones written since, the members of the objects aside
+	c.must("+OK\r\n", "set", "{t}b", "2")
+	c.must(":2\r\n", "sadd", "{t}s", "x", "y")
+	c.must(":1\r\n", "hset", "{t}h", "f4", "v")
+	c.must(":1\r\n", "del", "{t}a")
+	c.must("+OK\r\n", "rename", "{t}b", "{t}c")
+	c.must("+OK\r\n", "set", "other", "1")
+	c.must(":3\r\n", "cluster", "countkeysinslot", slot)
+	c.must("*2\r\n$4\r\n{t}c\r\n$4\r\n{t}h\r\n", "cluster", "getkeysinslot", slot, "2")
+	c.must("*3\r\n$4\r\n{t}c\r\n$4\r\n{t}h\r\n$4\r\n{t}s\r\n", "cluster", "getkeysinslot", slot, "10")
+
+	// a key expiring leaves on the next visit of its slot
+	c.must("+OK\r\n", "setex", "{t}e", "1", "v")
+	c.must(":4\r\n", "cluster", "countkeysinslot", slot)
+	waitUntil(t, "the key to expire", func() bool {
+		return c.do("cluster", "countkeysinslot", slot) == ":3\r\n"
+	})
+
+	c.must("+OK\r\n", "flushall")
+	c.must(":0\r\n", "cluster", "countkeysinslot", slot)
+	if db.scans != 0 {
+		t.Fatalf("%d scans of the store", db.scans)
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"github.com/qichengzx/raptor/raptor"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/tidwall/redcon"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// coalesceMaxBatch bounds the commands of a pipeline run as one batch, all
+// of their writes being held in memory until committed
+const coalesceMaxBatch = 1024
+
+// notCoalesced lists the write commands never run in a batch: the ones
+// flushing the store, talking to another node or blocking.
+var notCoalesced = map[string]bool{
+	cmdFlushDB:    true,
+	cmdFlushAll:   true,
+	cmdMigrate:    true,
+	cmdXReadGroup: true,
+}
+
+func (app *App) coalesceWrites() bool {
+	return atomic.LoadInt32(&app.coalesce) == 1
+}
+
+func (app *App) setCoalesceWrites(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&app.coalesce, v)
+}
+
+// coalescing tells whether cmd may run in a batch with the write commands
+// pipelined next to it. In raft mode the writes go through the log instead.
+func (app *App) coalescing(cmd redcon.Command) bool {
+	if len(cmd.Args) == 0 || app.raft != nil || !app.coalesceWrites() {
+		return false
+	}
+
+	var name = strings.TrimSpace(strings.ToLower(string(cmd.Args[0])))
+	return writeCommands[name] && !notCoalesced[name]
+}
+
+func firstCommand(cmds []redcon.Command) redcon.Command {
+	if len(cmds) == 0 {
+		return redcon.Command{}
+	}
+
+	return cmds[0]
+}
+
+// execBatch runs the write commands cmds of a pipeline one after another on
+// an overlay of the store, each one seeing the writes of the ones before,
+// then commits their writes at once. The replies and the side effects of
+// the writes, as the notifications, are held until then. On failure every
+// command replies with the error and the side effects are dropped.
+//
+// The overlay reads the keys it does not hold from the store, the keys of
+// every command of the batch are locked until the commit so that no other
+// write command changes them in between, which the commit would undo.
+//
+// The batch is atomic as far as the engine commits it at once: the badger
+// engine splits a large batch into several transactions, so a failure may
+// leave the first ones committed, other clients possibly reading some of
+// the writes before the others meanwhile.
+func (app *App) execBatch(conn redcon.Conn, cmds []redcon.Command) {
+	var (
+		overlay = storage.NewOverlay(app.db)
+		db      = &raptor.Raptor{DB: overlay}
+		reply   = &heldReply{Conn: conn}
+		effects []func()
+		keys    [][]byte
+	)
+	for _, cmd := range cmds {
+		var name = strings.TrimSpace(strings.ToLower(string(cmd.Args[0])))
+		keys = append(keys, commandKeys(name, cmd.Args)...)
+	}
+	var locked = app.locks.lock(keys)
+	for _, cmd := range cmds {
+		app.execHeld(reply, db, cmd, &effects)
+	}
+
+	var entries, flushed = overlay.Entries()
+	var err error
+	if flushed {
+		err = app.db.FlushDB()
+	}
+	if err == nil && len(entries) > 0 {
+		err = app.db.WriteBatch(entries)
+	}
+	if err != nil {
+		app.locks.unlock(locked)
+		for range cmds {
+			conn.WriteError("ERR " + err.Error())
+		}
+		return
+	}
+
+	atomic.AddInt64(&app.infoStat.coalescedBatches, 1)
+	atomic.AddInt64(&app.infoStat.coalescedCommands, int64(len(cmds)))
+	for _, fn := range effects {
+		fn()
+	}
+	app.locks.unlock(locked)
+	for _, key := range keys {
+		app.waiters.signal(key)
+	}
+	// one write for the whole batch, a single sync with always
+	seq := app.fsync.wrote(conn.RemoteAddr())
+	if app.fsync.getPolicy() == fsyncAlways {
+		if err := app.fsync.wait(app.db, seq, 0); err != nil {
+			for range cmds {
+				conn.WriteError(fmt.Sprintf(ErrFsync, err))
+			}
+			return
+		}
+	}
+
+	conn.WriteRaw(reply.buf)
+}
+
+// effect runs fn, a side effect of a write, at once or, in a batch, once
+// the batch is committed.
+func (ctx Context) effect(fn func()) {
+	if ctx.effects != nil {
+		*ctx.effects = append(*ctx.effects, fn)
+		return
+	}
+
+	fn()
+}
+
+func (ctx Context) notify(class int, event string, key []byte) {
+	ctx.effect(func() { ctx.app.notify(class, event, key) })
+}
+
+func (ctx Context) watchExpire(key []byte, seconds int) {
+	ctx.effect(func() { ctx.app.watchExpire(key, seconds) })
+}
+
+func (ctx Context) forgetExpire(key []byte) {
+	ctx.effect(func() { ctx.app.forgetExpire(key) })
+}
+
+func (ctx Context) signal(key []byte) {
+	ctx.effect(func() { ctx.app.waiters.signal(key) })
+}
+
+func (ctx Context) forgetAccess(key []byte) {
+	ctx.effect(func() { ctx.app.access.forget(key) })
+}
+
+func (ctx Context) moveAccess(key, newkey []byte) {
+	ctx.effect(func() { ctx.app.access.move(key, newkey) })
+}
+
+func (ctx Context) setAccess(key []byte, idle time.Duration, freq uint8) {
+	ctx.effect(func() { ctx.app.access.set(key, idle, freq) })
+}
+
+func (ctx Context) resetAccess() {
+	ctx.effect(ctx.app.access.reset)
+}
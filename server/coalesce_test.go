@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/tidwall/redcon"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConn keeps the replies written to it.
+type testConn struct {
+	heldReply
+	addr string
+}
+
+func (c *testConn) RemoteAddr() string { return c.addr }
+
+func newTestApp(t *testing.T) *App {
+	var conf config.Config
+	conf.Raptor.Directory = t.TempDir()
+	conf.Raptor.Engine = "memory"
+	conf.Raptor.Auth = "pass"
+	app := New(&conf)
+	t.Cleanup(func() { app.Close() })
+
+	return app
+}
+
+func testCommands(lines ...string) []redcon.Command {
+	var cmds []redcon.Command
+	for _, line := range lines {
+		var cmd redcon.Command
+		for _, arg := range strings.Fields(line) {
+			cmd.Args = append(cmd.Args, []byte(arg))
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	return cmds
+}
+
+func TestExecBatch(t *testing.T) {
+	var cmds = testCommands(
+		"incr n", "incr n", "set s abc", "incr s", "hset h a 1", "hset h b 2",
+		"del s", "setex t 100 v", "getdel n", "zadd z 1 m",
+	)
+
+	// the replies are the ones of the commands run one by one
+	var replies [2][]byte
+	for i, coalesce := range []bool{false, true} {
+		var (
+			app  = newTestApp(t)
+			conn = &testConn{addr: "client"}
+		)
+		app.setCoalesceWrites(coalesce)
+		app.exec(conn, app.db, testCommands("auth pass")[0])
+		conn.buf = nil
+
+		if coalesce {
+			for _, cmd := range cmds {
+				if !app.coalescing(cmd) {
+					t.Fatalf("%s not coalescing", cmd.Args[0])
+				}
+			}
+			app.execBatch(conn, cmds)
+		} else {
+			for _, cmd := range cmds {
+				app.exec(conn, app.db, cmd)
+			}
+		}
+		replies[i] = conn.buf
+
+		if _, err := app.db.Get([]byte("n")); err == nil {
+			t.Error("the key deleted by the batch is still there")
+		}
+		if ttl, _ := app.db.TTL([]byte("t")); ttl < 99 {
+			t.Errorf("TTL(t) = %d", ttl)
+		}
+		conn.buf = nil
+		app.exec(conn, app.db, testCommands("hget h b")[0])
+		if string(conn.buf) != "$1\r\n2\r\n" {
+			t.Errorf("hget after the batch = %q", conn.buf)
+		}
+		if coalesce && app.infoStat.coalescedCommands != int64(len(cmds)) {
+			t.Errorf("coalesced_commands %d", app.infoStat.coalescedCommands)
+		}
+	}
+	if !bytes.Equal(replies[0], replies[1]) {
+		t.Fatalf("batch replies %q, want %q", replies[1], replies[0])
+	}
+
+	var app = newTestApp(t)
+	for _, line := range []string{"flushall", "get a", "migrate h 1 a 0 100"} {
+		if app.coalescing(testCommands(line)[0]) {
+			t.Errorf("%s coalescing", line)
+		}
+	}
+	app.setCoalesceWrites(false)
+	if app.coalescing(testCommands("set a b")[0]) {
+		t.Error("coalescing while disabled")
+	}
+}
+
+// batchCommitter fails the batches with err, recording whether messages were
+// published before the commit.
+type batchCommitter struct {
+	storage.DB
+	err     error
+	s       *subscriber
+	early   bool
+	commits int
+}
+
+func (db *batchCommitter) WriteBatch(entries []storage.Entry) error {
+	db.commits++
+	if len(db.s.queue) > 0 {
+		db.early = true
+	}
+	if db.err != nil {
+		return db.err
+	}
+
+	return db.DB.WriteBatch(entries)
+}
+
+func TestExecBatchEffects(t *testing.T) {
+	var (
+		app  = newTestApp(t)
+		conn = &testConn{addr: "client"}
+		s    = &subscriber{
+			channels: make(map[string]struct{}),
+			patterns: make(map[string]struct{}),
+			queue:    make(chan []byte, 16),
+			done:     make(chan struct{}),
+		}
+		db = &batchCommitter{DB: app.db.DB, err: errors.New("disk full"), s: s}
+	)
+	app.db.DB = db
+	app.setNotifyFlags(notifyKeyevent | notifyAll)
+	app.exec(conn, app.db, testCommands("auth pass")[0])
+	app.pubsub.subscribe(s, true, [][]byte{[]byte(notifyKeyeventPrefix + "*")})
+	<-s.queue
+
+	var cmds = testCommands("set a 1", "expire a 100", "del b")
+	app.execBatch(conn, cmds)
+	if db.commits != 1 || len(s.queue) != 0 || len(app.expires.tracked()) != 0 {
+		t.Fatalf("the failed batch notified %d events, tracked %q", len(s.queue), app.expires.tracked())
+	}
+
+	db.err = nil
+	app.execBatch(conn, cmds)
+	if db.early {
+		t.Fatal("notified before the commit")
+	}
+	if len(s.queue) != 2 || strings.Join(app.expires.tracked(), " ") != "a" {
+		t.Fatalf("the batch notified %d events, tracked %q", len(s.queue), app.expires.tracked())
+	}
+}
+
+// heldCommitter holds the first batch committed until released.
+type heldCommitter struct {
+	storage.DB
+	committing, release chan struct{}
+	once                sync.Once
+}
+
+func (db *heldCommitter) WriteBatch(entries []storage.Entry) error {
+	db.once.Do(func() {
+		close(db.committing)
+		<-db.release
+	})
+
+	return db.DB.WriteBatch(entries)
+}
+
+func TestExecBatchIsolation(t *testing.T) {
+	var (
+		app = newTestApp(t)
+		db  = &heldCommitter{
+			DB:         app.db.DB,
+			committing: make(chan struct{}),
+			release:    make(chan struct{}),
+		}
+		replies = make(chan string)
+	)
+	app.setCoalesceWrites(true)
+	app.db.DB = db
+
+	var pipeline = func(name string, cmds ...string) {
+		var conn = &testConn{addr: name}
+		app.exec(conn, app.db, testCommands("auth pass")[0])
+		conn.buf = nil
+		app.execBatch(conn, testCommands(cmds...))
+		replies <- string(conn.buf)
+	}
+
+	// a batch writing a key another one read waits for the other to be
+	// committed, not to undo its write
+	go pipeline("first", "incr n", "incr n")
+	<-db.committing
+	go pipeline("second", "incr n", "incr other")
+	select {
+	case reply := <-replies:
+		t.Fatalf("the second batch replied %q before the first was committed", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(db.release)
+
+	if reply := <-replies; reply != ":1\r\n:2\r\n" {
+		t.Fatalf("first batch = %q", reply)
+	}
+	if reply := <-replies; reply != ":3\r\n:1\r\n" {
+		t.Fatalf("second batch = %q", reply)
+	}
+	newTestClient(t, app).must("$1\r\n3\r\n", "get", "n")
+}
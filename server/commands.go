@@ -9,9 +9,13 @@ type CommandHandler func(c Context)
 
 type Context struct {
 	redcon.Conn
+	app  *App
 	db   *raptor.Raptor
 	cmd  string
 	args [][]byte
+
+	// the side effects of the writes of a batch, held until it commits
+	effects *[]func()
 }
 
 var (
@@ -34,6 +38,12 @@ var (
 		cmdMSet:        msetCommandFunc,
 		cmdMSetNX:      msetnxCommandFunc,
 		cmdMGet:        mgetCommandFunc,
+		cmdMSetEX:      msetexCommandFunc,
+		cmdSetRange:    setrangeCommandFunc,
+		cmdGetDel:      getdelCommandFunc,
+		cmdGetEX:       getexCommandFunc,
+		cmdLCS:         lcsCommandFunc,
+		cmdSubstr:      getrangeCommandFunc,
 
 		//SET
 		cmdSAdd:        saddCommandFunc,
@@ -57,6 +67,13 @@ var (
 		cmdZCount:  zcountCommandFunc,
 		cmdZRem:    zremCommandFunc,
 
+		//GEO
+		cmdGeoAdd:    geoaddCommandFunc,
+		cmdGeoDist:   geodistCommandFunc,
+		cmdGeoPos:    geoposCommandFunc,
+		cmdGeoSearch: geosearchCommandFunc,
+		cmdGeoHash:   geohashCommandFunc,
+
 		//HASH
 		cmdHSet:    hsetCommandFunc,
 		cmdHSetNX:  hsetnxCommandFunc,
@@ -72,6 +89,43 @@ var (
 		cmdHKeys:   hkeysCommandFunc,
 		cmdHVals:   hvalsCommandFunc,
 
+		//STREAM
+		cmdXAdd:   xaddCommandFunc,
+		cmdXRange: xrangeCommandFunc,
+		cmdXRead:  xreadCommandFunc,
+		cmdXLen:   xlenCommandFunc,
+		cmdXTrim:  xtrimCommandFunc,
+		cmdXDel:   xdelCommandFunc,
+
+		cmdXGroup:     xgroupCommandFunc,
+		cmdXReadGroup: xreadgroupCommandFunc,
+		cmdXAck:       xackCommandFunc,
+		cmdXPending:   xpendingCommandFunc,
+		cmdXClaim:     xclaimCommandFunc,
+		cmdXAutoClaim: xautoclaimCommandFunc,
+
+		//BITMAP
+		cmdSetBit:     setbitCommandFunc,
+		cmdGetBit:     getbitCommandFunc,
+		cmdBitCount:   bitcountCommandFunc,
+		cmdBitPos:     bitposCommandFunc,
+		cmdBitOp:      bitopCommandFunc,
+		cmdBitField:   bitfieldCommandFunc,
+		cmdBitFieldRO: bitfieldCommandFunc,
+
+		//HYPERLOGLOG
+		cmdPFAdd:   pfaddCommandFunc,
+		cmdPFCount: pfcountCommandFunc,
+		cmdPFMerge: pfmergeCommandFunc,
+
+		//PUBSUB
+		cmdSubscribe:    subscribeCommandFunc,
+		cmdPSubscribe:   subscribeCommandFunc,
+		cmdUnsubscribe:  unsubscribeCommandFunc,
+		cmdPUnsubscribe: unsubscribeCommandFunc,
+		cmdPublish:      publishCommandFunc,
+		cmdPubSub:       pubsubCommandFunc,
+
 		//DATABASE
 		cmdSelect:   selectCommandFunc,
 		cmdDel:      delCommandFunc,
@@ -81,6 +135,13 @@ var (
 		cmdFlushDB:  flushdbCommandFunc,
 		cmdFlushAll: flushallCommandFunc,
 		cmdType:     typeCommandFunc,
+		cmdCopy:     copyCommandFunc,
+		cmdUnlink:   unlinkCommandFunc,
+		cmdTouch:    touchCommandFunc,
+		cmdObject:   objectCommandFunc,
+		cmdDump:     dumpCommandFunc,
+		cmdRestore:  restoreCommandFunc,
+		cmdMigrate:  migrateCommandFunc,
 
 		//EXPIRE
 		cmdExpire:   expireCommandFunc,
@@ -94,7 +155,27 @@ var (
 		cmdEcho: echoCommandFunc,
 
 		//SERVER
-		cmdSave:   saveCommandFunc,
-		cmdBgSave: bgsaveCommandFunc,
+		cmdSave:     saveCommandFunc,
+		cmdBgSave:   bgsaveCommandFunc,
+		cmdConfig:   configCommandFunc,
+		cmdLastSave: lastsaveCommandFunc,
+		cmdInfo:     infoCommandFunc,
+		cmdBackup:   backupCommandFunc,
+		cmdStorage:  storageCommandFunc,
+		cmdWaitAOF:  waitaofCommandFunc,
+
+		//REPLICATION
+		cmdReplicaOf: replicaofCommandFunc,
+		cmdSlaveOf:   replicaofCommandFunc,
+		cmdRole:      roleCommandFunc,
+		cmdReplConf:  replconfCommandFunc,
+		cmdPSync:     psyncCommandFunc,
+
+		//RAFT
+		cmdRaft: raftCommandFunc,
+
+		//CLUSTER
+		cmdCluster: clusterCommandFunc,
+		cmdAsking:  askingCommandFunc,
 	}
 )
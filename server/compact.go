@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cmdStorage = "storage"
+)
+
+// storageCommandFunc implements STORAGE GC [discard-ratio], replying with
+// the bytes of value log reclaimed, and STORAGE FLATTEN. Both run on the
+// store of every database, and wait for the work to be done.
+func storageCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		sub  = strings.ToLower(string(ctx.args[1]))
+		argc = map[string][2]int{"gc": {2, 3}, "flatten": {2, 2}}
+	)
+	n, ok := argc[sub]
+	if !ok {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrSubCmd, sub))
+		return
+	}
+	if len(ctx.args) < n[0] || len(ctx.args) > n[1] {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+		return
+	}
+
+	c, ok := ctx.app.db.DB.(storage.Compactor)
+	if !ok {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrNoCompactor, storageEngine(ctx.app)))
+		return
+	}
+
+	switch sub {
+	case "gc":
+		var ratio = ctx.app.conf.Storage.GCDiscardRatio
+		if len(ctx.args) == 3 {
+			r, err := strconv.ParseFloat(string(ctx.args[2]), 64)
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+			ratio = r
+		}
+		if ratio <= 0 || ratio >= 1 {
+			ctx.Conn.WriteError(ErrDiscardRatio)
+			return
+		}
+
+		reclaimed, err := c.GC(ratio)
+		if err != nil {
+			storageWriteError(ctx, err)
+			return
+		}
+		ctx.Conn.WriteInt64(reclaimed)
+	case "flatten":
+		if err := c.Flatten(); err != nil {
+			storageWriteError(ctx, err)
+			return
+		}
+		ctx.Conn.WriteString(RespOK)
+	}
+}
+
+func storageWriteError(ctx Context, err error) {
+	if err == storage.ErrCompacting {
+		ctx.Conn.WriteError(ErrCompacting)
+		return
+	}
+
+	ctx.Conn.WriteError("ERR " + err.Error())
+}
+
+// infoStorageFields tells what the value log GC did, the scheduled runs as
+// well as the ones of STORAGE GC.
+func infoStorageFields(app *App) []string {
+	c, ok := app.db.DB.(storage.Compactor)
+	if !ok {
+		return []string{"vlog_gc_enabled:0"}
+	}
+
+	var (
+		st       = c.GCStats()
+		status   = "ok"
+		lastRun  = int64(-1)
+		running  = 0
+		flatting = 0
+	)
+	if st.LastErr != nil {
+		status = "err"
+	}
+	if !st.LastRun.IsZero() {
+		lastRun = st.LastRun.Unix()
+	}
+	if st.Running {
+		running = 1
+	}
+	if st.Flattening {
+		flatting = 1
+	}
+
+	var s = app.conf.Storage
+	var interval = int64(-1)
+	if s.GCInterval > 0 {
+		interval = int64(s.GCInterval / time.Second)
+	}
+	return []string{
+		"vlog_gc_enabled:1",
+		fmt.Sprintf("vlog_gc_interval_sec:%d", interval),
+		fmt.Sprintf("vlog_gc_discard_ratio:%g", s.GCDiscardRatio),
+		"vlog_gc_quiet_hours:" + s.GCQuietHours,
+		fmt.Sprintf("vlog_gc_in_progress:%d", running),
+		fmt.Sprintf("vlog_gc_runs:%d", st.Runs),
+		fmt.Sprintf("vlog_gc_last_run_time:%d", lastRun),
+		"vlog_gc_last_status:" + status,
+		fmt.Sprintf("vlog_gc_last_reclaimed_bytes:%d", st.LastReclaimed),
+		fmt.Sprintf("vlog_gc_reclaimed_bytes:%d", st.Reclaimed),
+		fmt.Sprintf("flatten_in_progress:%d", flatting),
+		fmt.Sprintf("flatten_runs:%d", st.Flattens),
+	}
+}
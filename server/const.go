@@ -7,20 +7,120 @@ const (
 	RespErr  = 0
 	RespSync = "Background saving started"
 
+	RespSyncScheduled = "Background saving scheduled"
+	RespSameMaster    = "OK Already connected to specified master"
+	RespNoKey         = "NOKEY"
+
 	ErrTypeNone    = "none"
 	ErrKeyNotExist = "Key not found"
 
-	ErrNoAuth     = "NOAUTH Authentication required"
-	ErrCmd        = "ERR unknown command '%s'"
-	ErrWrongArgs  = "ERR wrong number of arguments for '%s' command"
-	ErrWrongArgsN = "wrong number of arguments (given %d, expected %d)"
-	ErrPassword   = "ERR invalid password"
-	ErrValue      = "ERR value is not an integer or out of range"
-	ErrNoKey      = "ERR no such key"
-	ErrKeyExist   = "ERR key is exist"
-	ErrSyntax     = "ERR syntax error"
-	ErrEmpty      = "empty list or set"
-	ErrHashValue  = "ERR hash value is not an integer"
-	ErrExpireTime = "ERR invalid expire time in setex"
-	ErrWrongType  = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	ErrNoAuth      = "NOAUTH Authentication required"
+	ErrCmd         = "ERR unknown command '%s'"
+	ErrSubCmd      = "ERR unknown subcommand '%s'"
+	ErrConfigParam = "ERR Unknown option or number of arguments for CONFIG SET - '%s'"
+	ErrConfigValue = "ERR Invalid argument for CONFIG SET '%s' - %s"
+	ErrWrongArgs   = "ERR wrong number of arguments for '%s' command"
+	ErrWrongArgsN  = "wrong number of arguments (given %d, expected %d)"
+	ErrPassword    = "ERR invalid password"
+	ErrValue       = "ERR value is not an integer or out of range"
+	ErrFloat       = "ERR value is not a valid float"
+	ErrScoreRange  = "ERR min or max is not a float"
+	ErrScoreNaN    = "ERR resulting score is not a number (NaN)"
+	ErrNoKey       = "ERR no such key"
+	ErrKeyExist    = "ERR key is exist"
+	ErrDBIndex     = "ERR DB index is out of range"
+	ErrSameObject  = "ERR source and destination objects are the same"
+	ErrSyntax      = "ERR syntax error"
+	ErrEmpty       = "empty list or set"
+	ErrHashValue   = "ERR hash value is not an integer"
+	ErrExpireTime  = "ERR invalid expire time in setex"
+	ErrOffset      = "ERR offset is out of range"
+	ErrStringSize  = "ERR string exceeds maximum allowed size (proto-max-bulk-len)"
+	ErrNumKeys     = "ERR numkeys should be greater than 0"
+	ErrLCSLenIdx   = "ERR If you want both the length and indexes, please just use IDX."
+	ErrLCSMemory   = "ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len"
+
+	ErrBusyKey       = "BUSYKEY Target key name already exists."
+	ErrDumpPayload   = "ERR DUMP payload version or checksum are wrong"
+	ErrBadFormat     = "ERR Bad data format"
+	ErrRestoreType   = "ERR Bad data format, lists and modules are not supported"
+	ErrRestoreTTL    = "ERR Invalid TTL value, must be >= 0"
+	ErrRestoreIdle   = "ERR Invalid IDLETIME value, must be >= 0"
+	ErrRestoreFreq   = "ERR Invalid FREQ value, must be >= 0 and <= 255"
+	ErrMigrateKeys   = "ERR When using MIGRATE KEYS option, the key argument must be set to the empty string"
+	ErrMigrateIO     = "IOERR error or timeout %s target instance"
+	ErrMigrateTarget = "ERR Target instance replied with error: %s"
+	ErrExpireTimeCmd = "ERR invalid expire time in '%s' command"
+	ErrWrongType     = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+	ErrStreamID      = "ERR Invalid stream ID specified as stream command argument"
+	ErrStreamIDSmall = "ERR The ID specified in XADD is equal or smaller than the target stream top item"
+	ErrStreamIDZero  = "ERR The ID specified in XADD must be greater than 0-0"
+	ErrStreamLimit   = "ERR syntax error, LIMIT cannot be used without the special ~ option"
+	ErrStreamArgs    = "ERR Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified."
+	ErrTimeout       = "ERR timeout is not an integer or out of range"
+	ErrNoGroup       = "NOGROUP No such key '%s' or consumer group '%s'"
+	ErrBusyGroup     = "BUSYGROUP Consumer Group name already exists"
+	ErrGroupNoKey    = "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."
+
+	ErrBitOffset    = "ERR bit offset is not an integer or out of range"
+	ErrBitValue     = "ERR bit is not an integer or out of range"
+	ErrBitPosValue  = "ERR The bit argument must be 1 or 0."
+	ErrBitOpNot     = "ERR BITOP NOT must be called with a single source key."
+	ErrBitOverflow  = "ERR Invalid OVERFLOW type specified"
+	ErrBitFieldType = "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+	ErrBitFieldRO   = "ERR BITFIELD_RO only supports the GET subcommand"
+
+	ErrGeoLonLat  = "ERR invalid longitude,latitude pair %f,%f"
+	ErrGeoNXXX    = "ERR XX and NX options at the same time are not compatible"
+	ErrGeoAddArgs = "ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... "
+	ErrGeoUnit    = "ERR unsupported unit provided. please use M, KM, FT, MI"
+	ErrGeoRadius  = "ERR need numeric radius"
+	ErrGeoCount   = "ERR COUNT must be > 0"
+	ErrGeoFrom    = "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH"
+	ErrGeoBy      = "ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH"
+	ErrGeoAny     = "ERR the ANY argument requires COUNT argument"
+	ErrGeoMember  = "ERR could not decode requested zset member"
+
+	ErrHLLType      = "WRONGTYPE Key is not a valid HyperLogLog string value."
+	ErrHLLCorrupted = "INVALIDOBJ Corrupted HLL object detected"
+
+	ErrReadOnly     = "READONLY You can't write against a read only replica."
+	ErrNoMasterLink = "NOMASTERLINK Can't SYNC while not connected with my master"
+	ErrMasterPort   = "ERR Invalid master port"
+
+	ErrRaftDisabled  = "ERR raft mode is not enabled"
+	ErrRaftNoLeader  = "CLUSTERDOWN No raft leader elected"
+	ErrRaftMoved     = "MOVED 0 %s"
+	ErrRaftRetry     = "TRYAGAIN %v"
+	ErrRaftReplicaOf = "ERR REPLICAOF is not allowed in raft mode"
+	ErrRaftBlock     = "ERR BLOCK is not supported by XREADGROUP in raft mode"
+
+	ErrClusterDisabled = "ERR This instance has cluster support disabled"
+	ErrClusterDown     = "CLUSTERDOWN Hash slot not served"
+	ErrCrossSlot       = "CROSSSLOT Keys in request don't hash to the same slot"
+	ErrMoved           = "MOVED %d %s"
+	ErrAsk             = "ASK %d %s"
+	ErrTryAgainSlot    = "TRYAGAIN Multiple keys request during rehashing of slot"
+	ErrSlotInvalid     = "ERR Invalid or out of range slot"
+	ErrSlotRange       = "ERR start slot number %d is greater than end slot number %d"
+	ErrSlotTwice       = "ERR Slot %d specified multiple times"
+	ErrSlotBusy        = "ERR Slot %d is already busy"
+	ErrSlotUnassigned  = "ERR Slot %d is already unassigned"
+	ErrSlotMine        = "ERR I'm already the owner of hash slot %d"
+	ErrSlotNotMine     = "ERR I'm not the owner of hash slot %d"
+	ErrSlotSelf        = "ERR Target node is myself"
+	ErrSlotKeys        = "ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot."
+	ErrUnknownNode     = "ERR Unknown node %s"
+	ErrForgetMyself    = "ERR I tried hard but I can't forget myself..."
+	ErrClusterPort     = "ERR Invalid node address specified: %s"
+	ErrClusterMeet     = "ERR can't meet %s: %v"
+	ErrKeysCount       = "ERR Invalid number of keys"
+
+	ErrNoCompactor  = "ERR the %s storage engine has no value log GC"
+	ErrCompacting   = "ERR a value log GC or a flatten is running already"
+	ErrDiscardRatio = "ERR discard ratio must be between 0 and 1, exclusive"
+
+	ErrWaitAOFReplicas = "ERR WAITAOF can't wait for replicas, numreplicas must be 0"
+	ErrFsync           = "ERR syncing the store to disk failed: %v"
 )
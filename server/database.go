@@ -1,8 +1,12 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/qichengzx/raptor/storage"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -14,6 +18,10 @@ const (
 	cmdFlushDB  = "flushdb"
 	cmdFlushAll = "flushall"
 	cmdType     = "type"
+	cmdCopy     = "copy"
+	cmdUnlink   = "unlink"
+	cmdTouch    = "touch"
+	cmdObject   = "object"
 )
 
 func selectCommandFunc(ctx Context) {
@@ -26,20 +34,45 @@ func delCommandFunc(ctx Context) {
 		return
 	}
 
-	var keysToDel [][]byte
+	deleteKeys(ctx, ctx.app.lazyfree.lazyUserDel())
+}
+
+// deleteKeys deletes the keys given as arguments and replies with the number
+// of keys that existed, a key given twice is only counted once. Large
+// objects are freed in the background when lazy.
+func deleteKeys(ctx Context, lazy bool) {
+	var (
+		cnt  = 0
+		seen = make(map[string]bool)
+	)
 	for _, key := range ctx.args[1:] {
-		keys := scan(ctx, key)
-		if len(keys) > 0 {
-			keysToDel = append(keysToDel, keys...)
+		if seen[string(key)] {
+			continue
 		}
-	}
+		seen[string(key)] = true
 
-	err := ctx.db.Del(keysToDel)
-	if err != nil {
-		ctx.Conn.WriteInt(0)
-	} else {
-		ctx.Conn.WriteInt(len(ctx.args[1:]))
+		var (
+			deleted bool
+			err     error
+		)
+		if lazy {
+			deleted, err = ctx.app.lazyfree.free(ctx, key)
+		} else {
+			deleted, err = typeObjectDelete(ctx, key)
+		}
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		if deleted {
+			ctx.forgetExpire(key)
+			ctx.forgetAccess(key)
+			ctx.notify(notifyGeneric, "del", key)
+			cnt++
+		}
 	}
+
+	ctx.Conn.WriteInt(cnt)
 }
 
 func existsCommandFunc(ctx Context) {
@@ -65,14 +98,12 @@ func renameCommandFunc(ctx Context) {
 		return
 	}
 
-	//TODO
-	//set/zset/hash etc...
-	err := ctx.db.Rename(ctx.args[1], ctx.args[2], false)
+	_, err := renameObject(ctx, ctx.args[1], ctx.args[2], false)
 	if err != nil {
 		ctx.Conn.WriteError(err.Error())
-	} else {
-		ctx.Conn.WriteString(RespOK)
+		return
 	}
+	ctx.Conn.WriteString(RespOK)
 }
 
 func renamenxCommandFunc(ctx Context) {
@@ -81,13 +112,181 @@ func renamenxCommandFunc(ctx Context) {
 		return
 	}
 
-	//TODO
-	//set/zset/hash etc...
-	err := ctx.db.Rename(ctx.args[1], ctx.args[2], true)
+	renamed, err := renameObject(ctx, ctx.args[1], ctx.args[2], true)
 	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if !renamed {
 		ctx.Conn.WriteInt(RespErr)
-	} else {
-		ctx.Conn.WriteInt(RespSucc)
+		return
+	}
+	ctx.Conn.WriteInt(RespSucc)
+}
+
+// renameObject moves the object stored at key, members included, to newkey.
+// With nx nothing is done when newkey exists.
+func renameObject(ctx Context, key, newkey []byte, nx bool) (bool, error) {
+	_, err := ctx.db.Get(key)
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			return false, errors.New(ErrNoKey)
+		}
+		return false, err
+	}
+	if bytes.Equal(key, newkey) {
+		return !nx, nil
+	}
+
+	if nx {
+		if _, err = ctx.db.Get(newkey); err == nil {
+			return false, nil
+		}
+	}
+
+	if err = typeObjectMove(ctx, key, newkey); err != nil {
+		return false, err
+	}
+
+	ctx.moveAccess(key, newkey)
+	notifyRename(ctx, key, newkey)
+	return true, nil
+}
+
+func notifyRename(ctx Context, key, newkey []byte) {
+	ctx.forgetExpire(key)
+	ctx.notify(notifyGeneric, "rename_from", key)
+	ctx.notify(notifyGeneric, "rename_to", newkey)
+}
+
+func copyCommandFunc(ctx Context) {
+	if len(ctx.args) < 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var replace = false
+	for i := 3; i < len(ctx.args); i++ {
+		switch strings.ToLower(string(ctx.args[i])) {
+		case "replace":
+			replace = true
+		case "db":
+			if i+1 >= len(ctx.args) {
+				ctx.Conn.WriteError(ErrSyntax)
+				return
+			}
+			// there is a single database
+			db, err := strconv.Atoi(string(ctx.args[i+1]))
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+			if db != 0 {
+				ctx.Conn.WriteError(ErrDBIndex)
+				return
+			}
+			i++
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+
+	var src, dst = ctx.args[1], ctx.args[2]
+	if bytes.Equal(src, dst) {
+		ctx.Conn.WriteError(ErrSameObject)
+		return
+	}
+
+	if _, err := ctx.db.Get(src); err != nil {
+		ctx.Conn.WriteInt(RespErr)
+		return
+	}
+	if _, err := ctx.db.Get(dst); err == nil {
+		if !replace {
+			ctx.Conn.WriteInt(RespErr)
+			return
+		}
+		if _, err = typeObjectDelete(ctx, dst); err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		ctx.forgetExpire(dst)
+	}
+
+	err := typeObjectCopy(ctx, src, dst)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	// the copy is a new object
+	ctx.setAccess(dst, 0, lfuInitVal)
+	ctx.notify(notifyGeneric, "copy_to", dst)
+	ctx.Conn.WriteInt(RespSucc)
+}
+
+func unlinkCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	deleteKeys(ctx, true)
+}
+
+func touchCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var cnt = 0
+	for _, key := range ctx.args[1:] {
+		if _, err := ctx.db.Get(key); err == nil {
+			ctx.app.access.touch(key)
+			cnt++
+		}
+	}
+
+	ctx.Conn.WriteInt(cnt)
+}
+
+func objectCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var sub = strings.ToLower(string(ctx.args[1]))
+	switch sub {
+	case "encoding", "idletime", "freq", "refcount":
+	default:
+		ctx.Conn.WriteError(fmt.Sprintf(ErrSubCmd, ctx.args[1]))
+		return
+	}
+	if len(ctx.args) != 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+		return
+	}
+
+	val, err := ctx.db.Get(ctx.args[2])
+	if err != nil {
+		ctx.Conn.WriteNull()
+		return
+	}
+
+	switch sub {
+	case "encoding":
+		ctx.Conn.WriteBulkString(typeObjectEncoding(ctx, ctx.args[2], val))
+	case "idletime":
+		idle, _ := ctx.app.access.get(ctx.args[2])
+		ctx.Conn.WriteInt64(int64(idle.Seconds()))
+	case "freq":
+		_, freq := ctx.app.access.get(ctx.args[2])
+		ctx.Conn.WriteInt(int(freq))
+	case "refcount":
+		ctx.Conn.WriteInt(1)
 	}
 }
 
@@ -96,6 +295,7 @@ func flushdbCommandFunc(ctx Context) {
 	if err != nil {
 		//TODO
 	}
+	ctx.resetAccess()
 	ctx.Conn.WriteString(RespOK)
 }
 
@@ -104,6 +304,7 @@ func flushallCommandFunc(ctx Context) {
 	if err != nil {
 		//TODO
 	}
+	ctx.resetAccess()
 	ctx.Conn.WriteString(RespOK)
 }
 
@@ -128,28 +329,3 @@ func typeCommandFunc(ctx Context) {
 	ctx.Conn.WriteString(ErrTypeNone)
 	return
 }
-
-func scan(ctx Context, key []byte) [][]byte {
-	var keys [][]byte
-	data, err := ctx.db.Get(key)
-	if err != nil {
-		return nil
-	}
-
-	keys = append(keys, key)
-	switch string(data[:1]) {
-	case storage.ObjectHash:
-		fields, _ := typeHashScan(ctx, key, 0)
-		keys = append(keys, fields...)
-
-	case storage.ObjectSet:
-		members := typeSetScan(ctx, key, nil, 0)
-		keys = append(keys, members...)
-
-	case storage.ObjectZset:
-		members, _ := typeZSetScan(ctx, key, 0)
-		keys = append(keys, members...)
-	}
-
-	return keys
-}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"testing"
+)
+
+// writeCounter counts the writes made to the store.
+type writeCounter struct {
+	storage.DB
+	batches, others int
+}
+
+func (db *writeCounter) WriteBatch(entries []storage.Entry) error {
+	db.batches++
+	return db.DB.WriteBatch(entries)
+}
+
+func (db *writeCounter) MSetTTL(keys, values [][]byte, ttls []int) error {
+	db.others++
+	return db.DB.MSetTTL(keys, values, ttls)
+}
+
+func (db *writeCounter) Set(key, value []byte, ttl int) error {
+	db.others++
+	return db.DB.Set(key, value, ttl)
+}
+
+func (db *writeCounter) Del(keys [][]byte) error {
+	db.others++
+	return db.DB.Del(keys)
+}
+
+func TestRenameLargeObject(t *testing.T) {
+	var (
+		app = newTestApp(t)
+		c   = newTestClient(t, app)
+		n   = typeObjectBatchSize * 3
+	)
+
+	var args = []string{"hmset", "h"}
+	for i := 0; i < n; i++ {
+		args = append(args, fmt.Sprintf("f%d", i), "v")
+	}
+	c.must("+OK\r\n", args...)
+	c.must(":1\r\n", "expire", "h", "100")
+	c.must(":3\r\n", "sadd", "s", "a", "b", "c")
+
+	// the members of both objects are moved or deleted in one batch
+	var db = &writeCounter{DB: app.db.DB}
+	app.db.DB = db
+	c.must("+OK\r\n", "rename", "h", "s")
+	if db.batches != 1 || db.others != 0 {
+		t.Fatalf("RENAME made %d batches and %d other writes", db.batches, db.others)
+	}
+
+	c.must(fmt.Sprintf(":%d\r\n", n), "hlen", "s")
+	c.must("$1\r\nv\r\n", "hget", "s", "f0")
+	c.must(":100\r\n", "ttl", "s")
+	c.must(":0\r\n", "exists", "h")
+	if left := members(t, app, "h", storage.ObjectHash); left != 0 {
+		t.Fatalf("%d members left under the old key", left)
+	}
+	if left := members(t, app, "s", storage.ObjectSet); left != 0 {
+		t.Fatalf("%d members of the replaced set left", left)
+	}
+
+	// a key moved onto itself is untouched
+	c.must(":0\r\n", "renamenx", "s", "s")
+	c.must(fmt.Sprintf(":%d\r\n", n), "hlen", "s")
+}
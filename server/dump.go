@@ -0,0 +1,396 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/rdb"
+	"github.com/qichengzx/raptor/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cmdDump    = "dump"
+	cmdRestore = "restore"
+)
+
+func dumpCommandFunc(ctx Context) {
+	if len(ctx.args) != 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	obj, err := typeObjectLoad(ctx.db, ctx.args[1])
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			ctx.Conn.WriteNull()
+			return
+		}
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.Conn.WriteBulk(rdb.EncodeDump(obj))
+}
+
+// restoreCommandFunc implements RESTORE key ttl payload [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency]
+func restoreCommandFunc(ctx Context) {
+	if len(ctx.args) < 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		key     = ctx.args[1]
+		replace = false
+		absTTL  = false
+		idle    = int64(-1)
+		freq    = int64(-1)
+	)
+	for i := 4; i < len(ctx.args); i++ {
+		var (
+			opt  = strings.ToLower(string(ctx.args[i]))
+			more = i+1 < len(ctx.args)
+		)
+		switch {
+		case opt == "replace":
+			replace = true
+		case opt == "absttl":
+			absTTL = true
+		case opt == "idletime" && more && freq == -1:
+			v, err := strconv.ParseInt(string(ctx.args[i+1]), 10, 64)
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+			if v < 0 {
+				ctx.Conn.WriteError(ErrRestoreIdle)
+				return
+			}
+			idle = v
+			i++
+		case opt == "freq" && more && idle == -1:
+			v, err := strconv.ParseInt(string(ctx.args[i+1]), 10, 64)
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+			if v < 0 || v > 255 {
+				ctx.Conn.WriteError(ErrRestoreFreq)
+				return
+			}
+			freq = v
+			i++
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+
+	ttl, err := strconv.ParseInt(string(ctx.args[2]), 10, 64)
+	if err != nil {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+	if ttl < 0 {
+		ctx.Conn.WriteError(ErrRestoreTTL)
+		return
+	}
+
+	_, err = ctx.db.Get(key)
+	var exists = err == nil
+	if exists && !replace {
+		ctx.Conn.WriteError(ErrBusyKey)
+		return
+	}
+
+	obj, err := rdb.DecodeDump(ctx.args[3])
+	switch err {
+	case nil:
+	case rdb.ErrVersion, rdb.ErrChecksum:
+		ctx.Conn.WriteError(ErrDumpPayload)
+		return
+	case rdb.ErrUnsupported:
+		ctx.Conn.WriteError(ErrRestoreType)
+		return
+	default:
+		ctx.Conn.WriteError(ErrBadFormat)
+		return
+	}
+	if obj.Kind == rdb.KindList {
+		ctx.Conn.WriteError(ErrRestoreType)
+		return
+	}
+
+	if exists {
+		if _, err = typeObjectDelete(ctx, key); err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		ctx.forgetExpire(key)
+	}
+
+	// the TTL is in milliseconds, expirations are kept in seconds
+	var seconds int64
+	if ttl > 0 {
+		if absTTL {
+			ttl -= time.Now().UnixNano() / int64(time.Millisecond)
+			if ttl <= 0 {
+				// already expired, the old value is gone all the same
+				if exists {
+					ctx.notify(notifyGeneric, "del", key)
+				}
+				ctx.Conn.WriteString(RespOK)
+				return
+			}
+		}
+		seconds = (ttl + 999) / 1000
+	}
+
+	err = typeObjectStore(ctx.db, key, obj)
+	if err == nil && seconds > 0 {
+		err = ctx.db.Expire(key, int(seconds))
+		ctx.watchExpire(key, int(seconds))
+	}
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	switch {
+	case idle >= 0:
+		ctx.setAccess(key, time.Duration(idle)*time.Second, lfuInitVal)
+	case freq >= 0:
+		ctx.setAccess(key, 0, uint8(freq))
+	}
+
+	ctx.notify(notifyGeneric, "restore", key)
+	ctx.Conn.WriteString(RespOK)
+}
+
+// typeObjectLoad reads the object stored at key, with all its members.
+func typeObjectLoad(db storage.Reader, key []byte) (*rdb.Object, error) {
+	val, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var objType = storage.ObjectString
+	if len(val) > 0 {
+		objType = string(val[:1])
+	}
+
+	var obj = &rdb.Object{}
+	switch objType {
+	case storage.ObjectString:
+		obj.Kind = rdb.KindString
+		if len(val) > 0 {
+			obj.Value = val[1:]
+		}
+	case storage.ObjectHash:
+		obj.Kind = rdb.KindHash
+		var prefix = typeObjectPrefixes(key, objType)[0]
+		db.Scan(storage.ScannerOptions{
+			Prefix:      prefix,
+			FetchValues: true,
+			Handler: func(k, v []byte) {
+				obj.Members = append(obj.Members, k[len(prefix):])
+				obj.Values = append(obj.Values, v)
+			},
+		})
+	case storage.ObjectSet:
+		obj.Kind = rdb.KindSet
+		var prefix = typeObjectPrefixes(key, objType)[0]
+		db.Scan(storage.ScannerOptions{
+			Prefix:      prefix,
+			FetchValues: false,
+			Handler: func(k, v []byte) {
+				obj.Members = append(obj.Members, k[len(prefix):])
+			},
+		})
+	case storage.ObjectZset:
+		obj.Kind = rdb.KindZSet
+		var prefix = typeZSetScorePrefix(key)
+		db.Scan(storage.ScannerOptions{
+			Prefix:      prefix,
+			FetchValues: false,
+			Handler: func(k, v []byte) {
+				obj.Scores = append(obj.Scores, bytesToZSetScore(k[len(prefix):len(prefix)+8]))
+				obj.Members = append(obj.Members, k[len(prefix)+8:])
+			},
+		})
+	case storage.ObjectStream:
+		obj.Kind = rdb.KindStream
+		obj.Stream = typeStreamLoad(db, key, val)
+	default:
+		return nil, errors.New(ErrWrongType)
+	}
+
+	return obj, nil
+}
+
+// typeStreamLoad reads the entries and the consumer groups of the stream
+// stored at key.
+func typeStreamLoad(db storage.Reader, key, metaValue []byte) *rdb.Stream {
+	_, last := typeStreamMetaInfo(metaValue)
+	var s = &rdb.Stream{LastID: rdb.StreamID{Ms: last.ms, Seq: last.seq}}
+
+	var prefix = typeStreamPrefix(key)
+	db.Scan(storage.ScannerOptions{
+		Prefix:      prefix,
+		FetchValues: true,
+		Handler: func(k, v []byte) {
+			id := bytesToStreamID(k[len(prefix):])
+			s.Entries = append(s.Entries, rdb.StreamEntry{
+				ID:     rdb.StreamID{Ms: id.ms, Seq: id.seq},
+				Fields: typeStreamUnmarshalFields(v),
+			})
+		},
+	})
+
+	// consumers, groups and pending entries sort in this order, a group is
+	// created by the first key seen of it
+	var (
+		groupPrefix = typeStreamGroupKeyPrefix(key)
+		groups      = make(map[string]int)
+	)
+	db.Scan(storage.ScannerOptions{
+		Prefix:      groupPrefix,
+		FetchValues: true,
+		Handler: func(k, v []byte) {
+			var (
+				tag  = k[len(groupPrefix)]
+				size = bytesToUint32(k[len(groupPrefix)+1 : len(groupPrefix)+5])
+				name = k[len(groupPrefix)+5 : len(groupPrefix)+5+int(size)]
+				rest = k[len(groupPrefix)+5+int(size):]
+			)
+			pos, ok := groups[string(name)]
+			if !ok {
+				pos = len(s.Groups)
+				groups[string(name)] = pos
+				s.Groups = append(s.Groups, rdb.StreamGroup{Name: name})
+			}
+
+			var g = &s.Groups[pos]
+			switch tag {
+			case typeStreamGroupTag:
+				id := bytesToStreamID(v)
+				g.LastID = rdb.StreamID{Ms: id.ms, Seq: id.seq}
+			case typeStreamConsumerTag:
+				g.Consumers = append(g.Consumers, rdb.StreamConsumer{
+					Name:     rest,
+					SeenTime: int64(bytesToUint64(v)),
+				})
+			case typeStreamPendingTag:
+				p := typeStreamUnmarshalPending(bytesToStreamID(rest), v)
+				g.Pending = append(g.Pending, rdb.StreamPending{
+					ID:            rdb.StreamID{Ms: p.id.ms, Seq: p.id.seq},
+					Consumer:      p.consumer,
+					DeliveryTime:  p.time,
+					DeliveryCount: p.count,
+				})
+			}
+		},
+	})
+
+	// a consumer owning pending entries must be listed, even if it was
+	// never seen
+	for i := range s.Groups {
+		var (
+			g     = &s.Groups[i]
+			known = make(map[string]bool)
+		)
+		for _, c := range g.Consumers {
+			known[string(c.Name)] = true
+		}
+		for _, p := range g.Pending {
+			if !known[string(p.Consumer)] {
+				known[string(p.Consumer)] = true
+				g.Consumers = append(g.Consumers, rdb.StreamConsumer{Name: p.Consumer})
+			}
+		}
+	}
+
+	return s
+}
+
+// typeObjectStore writes obj at key, which is expected not to hold an
+// object. The top level value goes last so that the object only shows up
+// once complete.
+func typeObjectStore(db storage.DB, key []byte, obj *rdb.Object) error {
+	var w = &objectWriter{db: db}
+	meta, err := typeObjectWriteMembers(w, key, obj)
+	if err != nil {
+		return err
+	}
+	if err = w.flush(); err != nil {
+		return err
+	}
+
+	return db.Set(key, meta, 0)
+}
+
+// typeObjectWriteMembers buffers the members of obj in w and returns the top
+// level value of the object, left to the caller.
+func typeObjectWriteMembers(w *objectWriter, key []byte, obj *rdb.Object) ([]byte, error) {
+	if obj.Kind != rdb.KindString && obj.Kind != rdb.KindStream && len(obj.Members) == 0 {
+		return nil, errors.New(ErrBadFormat)
+	}
+
+	var meta []byte
+	switch obj.Kind {
+	case rdb.KindString:
+		meta = append(append([]byte{}, typeString...), obj.Value...)
+	case rdb.KindHash:
+		for i, f := range obj.Members {
+			w.set(typeHashMarshalField(key, f), obj.Values[i])
+		}
+		meta = typeHashMetaVal(uint32(len(obj.Members)))
+	case rdb.KindSet:
+		var keySize = uint32ToBytes(typeSetKeySize, uint32(len(key)))
+		for _, m := range obj.Members {
+			w.set(typeSetMarshalMember(key, m, keySize), nil)
+		}
+		meta = typeSetMetaVal(uint32(len(obj.Members)))
+	case rdb.KindZSet:
+		for i, m := range obj.Members {
+			w.set(typeZSetMarshalMember(key, m), []byte(formatZSetScore(obj.Scores[i])))
+			w.set(typeZSetMarshalScore(key, obj.Scores[i], m), nil)
+		}
+		meta = typeZSetMetaVal(uint32(len(obj.Members)))
+	case rdb.KindStream:
+		meta = typeStreamStore(w, key, obj.Stream)
+	default:
+		return nil, errors.New(ErrRestoreType)
+	}
+
+	return meta, nil
+}
+
+// typeStreamStore writes the entries and the consumer groups of s, and
+// returns the top level value of the stream.
+func typeStreamStore(w *objectWriter, key []byte, s *rdb.Stream) []byte {
+	for _, e := range s.Entries {
+		w.set(typeStreamMarshalEntry(key, streamID{ms: e.ID.Ms, seq: e.ID.Seq}), typeStreamMarshalFields(e.Fields))
+	}
+
+	for _, g := range s.Groups {
+		w.set(typeStreamMarshalGroup(key, g.Name), streamID{ms: g.LastID.Ms, seq: g.LastID.Seq}.bytes())
+		for _, c := range g.Consumers {
+			w.set(typeStreamMarshalConsumer(key, g.Name, c.Name), uint64ToBytes(8, uint64(c.SeenTime)))
+		}
+		for _, p := range g.Pending {
+			pending := &streamPending{
+				id:       streamID{ms: p.ID.Ms, seq: p.ID.Seq},
+				consumer: p.Consumer,
+				time:     p.DeliveryTime,
+				count:    p.DeliveryCount,
+			}
+			w.set(typeStreamMarshalPending(key, g.Name, pending.id), typeStreamMarshalPendingVal(pending))
+		}
+	}
+
+	return typeStreamMetaVal(uint32(len(s.Entries)), streamID{ms: s.LastID.Ms, seq: s.LastID.Seq})
+}
@@ -1,8 +1,12 @@
 package server
 
 import (
+	"container/heap"
 	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"log"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -30,6 +34,8 @@ func expireCommandFunc(ctx Context) {
 		ctx.Conn.WriteInt(0)
 		return
 	}
+	ctx.notify(notifyGeneric, "expire", ctx.args[1])
+	ctx.watchExpire(ctx.args[1], seconds)
 	ctx.Conn.WriteInt(1)
 }
 
@@ -50,6 +56,8 @@ func pexpireCommandFunc(ctx Context) {
 		ctx.Conn.WriteInt(0)
 		return
 	}
+	ctx.notify(notifyGeneric, "expire", ctx.args[1])
+	ctx.watchExpire(ctx.args[1], millisecond/1000)
 	ctx.Conn.WriteInt(1)
 }
 
@@ -70,6 +78,8 @@ func expireatCommandFunc(ctx Context) {
 		ctx.Conn.WriteInt(RespErr)
 		return
 	}
+	ctx.notify(notifyGeneric, "expire", ctx.args[1])
+	ctx.watchExpire(ctx.args[1], int(ttl))
 	ctx.Conn.WriteInt(RespSucc)
 }
 
@@ -91,8 +101,165 @@ func persistCommandFunc(ctx Context) {
 
 	err := ctx.db.Persist(ctx.args[1])
 	if err == nil {
+		ctx.forgetExpire(ctx.args[1])
+		ctx.notify(notifyGeneric, "persist", ctx.args[1])
 		ctx.Conn.WriteInt(RespSucc)
 		return
 	}
 	ctx.Conn.WriteInt(RespErr)
 }
+
+// expireWatcher remembers when keys given a TTL are due, badger drops
+// expired keys silently so this is the only way to notify expirations.
+// Keys are only tracked while expired events are enabled, the ones already
+// having a TTL in the store being seeded when they get enabled and at
+// startup.
+type expireWatcher struct {
+	mu        sync.Mutex
+	deadlines map[string]int64
+	queue     expireQueue
+}
+
+type expireEntry struct {
+	key string
+	at  int64
+}
+
+type expireQueue []expireEntry
+
+func (q expireQueue) Len() int            { return len(q) }
+func (q expireQueue) Less(i, j int) bool  { return q[i].at < q[j].at }
+func (q expireQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expireQueue) Push(x interface{}) { *q = append(*q, x.(expireEntry)) }
+func (q *expireQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+func newExpireWatcher() *expireWatcher {
+	return &expireWatcher{
+		deadlines: make(map[string]int64),
+	}
+}
+
+func (w *expireWatcher) track(key []byte, at int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.push(string(key), at)
+}
+
+// seed tracks key unless it already is, its TTL having been set since.
+func (w *expireWatcher) seed(key []byte, at int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.deadlines[string(key)]; !ok {
+		w.push(string(key), at)
+	}
+}
+
+// push queues the deadline of key. The deadlines replaced or forgotten stay
+// queued until due, the queue is rebuilt once they are the most of it.
+func (w *expireWatcher) push(key string, at int64) {
+	w.deadlines[key] = at
+	heap.Push(&w.queue, expireEntry{key: key, at: at})
+
+	if len(w.queue) > 2*len(w.deadlines)+64 {
+		w.queue = w.queue[:0]
+		for key, at := range w.deadlines {
+			w.queue = append(w.queue, expireEntry{key: key, at: at})
+		}
+		heap.Init(&w.queue)
+	}
+}
+
+// reset forgets every key, once the expired events are disabled.
+func (w *expireWatcher) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.deadlines = make(map[string]int64)
+	w.queue = nil
+}
+
+func (w *expireWatcher) forget(key []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.deadlines, string(key))
+}
+
+// due pops every key whose deadline has passed.
+func (w *expireWatcher) due(now int64) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var keys []string
+	for w.queue.Len() > 0 && w.queue[0].at <= now {
+		e := heap.Pop(&w.queue).(expireEntry)
+		if at, ok := w.deadlines[e.key]; !ok || at != e.at {
+			continue
+		}
+
+		delete(w.deadlines, e.key)
+		keys = append(keys, e.key)
+	}
+
+	return keys
+}
+
+func (app *App) watchExpire(key []byte, seconds int) {
+	if !app.notifyEnabled(notifyExpired) {
+		return
+	}
+
+	app.expires.track(key, time.Now().Unix()+int64(seconds))
+}
+
+func (app *App) forgetExpire(key []byte) {
+	app.expires.forget(key)
+}
+
+// seedExpires tracks the keys of the store having a TTL, given before the
+// expired events were enabled or before a restart.
+func (app *App) seedExpires() {
+	err := app.db.View(func(snap storage.Reader) error {
+		return typeObjectScanKeys(snap, func(k []byte) {
+			if !app.notifyEnabled(notifyExpired) {
+				return
+			}
+			if at, _ := snap.ExpiresAt(k); at > 0 {
+				app.expires.seed(k, int64(at))
+			}
+		})
+	})
+	if err != nil {
+		log.Printf("expired events: seeding the keys with a TTL: %v", err)
+	}
+}
+
+func (app *App) runExpireWatcher() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		app.fireExpired(now.Unix())
+	}
+}
+
+// fireExpired notifies the keys due at now that are gone, tracking again
+// the ones whose TTL was pushed back meanwhile.
+func (app *App) fireExpired(now int64) {
+	for _, key := range app.expires.due(now) {
+		at, err := app.db.ExpiresAt([]byte(key))
+		switch {
+		case err == storage.ErrKeyNotFound:
+			app.notify(notifyExpired, "expired", []byte(key))
+		case err == nil && int64(at) > now:
+			app.expires.track([]byte(key), int64(at))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (w *expireWatcher) tracked() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var keys []string
+	for key := range w.deadlines {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestExpireWatcherSeed(t *testing.T) {
+	var (
+		app = newTestApp(t)
+		c   = newTestClient(t, app)
+	)
+
+	// the TTLs given before the expired events are enabled
+	c.must("+OK\r\n", "set", "a", "1")
+	c.must(":1\r\n", "expire", "a", "1")
+	c.must(":1\r\n", "hset", "h", "f", "v")
+	c.must(":1\r\n", "expire", "h", "1")
+	c.must("+OK\r\n", "set", "b", "1")
+	c.must(":1\r\n", "expireat", "b", "4000000000")
+	c.must("+OK\r\n", "set", "p", "1")
+	if keys := app.expires.tracked(); len(keys) != 0 {
+		t.Fatalf("tracked %q with the expired events disabled", keys)
+	}
+
+	c.must("+OK\r\n", "config", "set", "notify-keyspace-events", "Ex")
+	var deadline = time.Now().Add(time.Second)
+	for len(app.expires.tracked()) != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if keys := strings.Join(app.expires.tracked(), " "); keys != "a b h" {
+		t.Fatalf("seeded %q, want a b h", keys)
+	}
+
+	var s = &subscriber{
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		queue:    make(chan []byte, 16),
+		done:     make(chan struct{}),
+	}
+	app.pubsub.subscribe(s, false, [][]byte{[]byte(notifyKeyeventPrefix + "expired")})
+	<-s.queue
+
+	for at, _ := app.db.ExpiresAt([]byte("a")); time.Now().Unix() <= int64(at); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	app.fireExpired(time.Now().Unix())
+	var expired []string
+	for len(s.queue) > 0 {
+		frame := string(<-s.queue)
+		expired = append(expired, frame[strings.LastIndex(frame, "\r\n$1\r\n")+6:len(frame)-2])
+	}
+	sort.Strings(expired)
+	if strings.Join(expired, " ") != "a h" {
+		t.Fatalf("expired %q, want a h", expired)
+	}
+	if keys := strings.Join(app.expires.tracked(), " "); keys != "b" {
+		t.Fatalf("still tracked %q, want b", keys)
+	}
+
+	// the deadlines replaced do not pile up
+	for i := 0; i < 1000; i++ {
+		c.must(":1\r\n", "expireat", "b", "4000000000")
+	}
+	if n := len(app.expires.queue); n > 2*1+64 {
+		t.Fatalf("%d deadlines queued for one key", n)
+	}
+
+	c.must("+OK\r\n", "config", "set", "notify-keyspace-events", "")
+	if keys := app.expires.tracked(); len(keys) != 0 {
+		t.Fatalf("tracked %q once the expired events are disabled", keys)
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cmdWaitAOF = "waitaof"
+)
+
+// The appendfsync policies: fsync after every write command, once a second
+// or never, leaving it to the engine and the OS.
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+)
+
+var (
+	errFsyncPolicy  = errors.New("argument must be 'always', 'everysec' or 'no'")
+	errFsyncTimeout = errors.New("timeout waiting for the sync")
+)
+
+// appendFsync syncs the store to disk by the appendfsync policy. Every write
+// command takes the next sequence number, a sync covers the writes numbered
+// up to the last one when it started. One sync runs at a time, the callers
+// waiting meanwhile share the next one.
+type appendFsync struct {
+	mu      sync.Mutex
+	policy  string
+	written uint64
+	synced  uint64
+	syncing bool
+	notify  chan struct{} // closed at the end of every sync
+	lastErr error         // of the last sync, the writes staying unsynced
+	conns   map[string]uint64
+	done    chan struct{}
+}
+
+func newAppendFsync(policy string) (*appendFsync, error) {
+	f := &appendFsync{
+		notify: make(chan struct{}),
+		conns:  make(map[string]uint64),
+		done:   make(chan struct{}),
+	}
+	if policy == "" {
+		policy = fsyncEverySec
+	}
+
+	return f, f.setPolicy(policy)
+}
+
+func (f *appendFsync) getPolicy() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.policy
+}
+
+func (f *appendFsync) setPolicy(policy string) error {
+	policy = strings.ToLower(policy)
+	if policy != fsyncAlways && policy != fsyncEverySec && policy != fsyncNo {
+		return errFsyncPolicy
+	}
+
+	f.mu.Lock()
+	f.policy = policy
+	f.mu.Unlock()
+	return nil
+}
+
+// run syncs the writes of the last second while the policy is everysec,
+// until close is called.
+func (f *appendFsync) run(db storage.DB) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		var due = f.policy == fsyncEverySec && f.written > f.synced
+		var seq = f.written
+		f.mu.Unlock()
+
+		if due {
+			if err := f.wait(db, seq, 0); err != nil {
+				log.Printf("appendfsync: %v", err)
+			}
+		}
+	}
+}
+
+func (f *appendFsync) close() {
+	close(f.done)
+}
+
+// wrote records a write command of the connection addr and returns its
+// sequence number, to wait for with the always policy.
+func (f *appendFsync) wrote(addr string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.written++
+	f.conns[addr] = f.written
+	return f.written
+}
+
+func (f *appendFsync) lastStatus() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.lastErr
+}
+
+// lastWrite returns the sequence number of the last write of addr, zero if
+// none.
+func (f *appendFsync) lastWrite(addr string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.conns[addr]
+}
+
+func (f *appendFsync) dropConn(addr string) {
+	f.mu.Lock()
+	delete(f.conns, addr)
+	f.mu.Unlock()
+}
+
+func (f *appendFsync) isSynced(seq uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.synced >= seq
+}
+
+// wait returns once the writes up to seq are synced, syncing them itself
+// when no sync is running. It returns the error of its own sync, or
+// errFsyncTimeout after timeout if not zero.
+func (f *appendFsync) wait(db storage.DB, seq uint64, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		f.mu.Lock()
+		if f.synced >= seq {
+			f.mu.Unlock()
+			return nil
+		}
+		if !f.syncing {
+			f.syncing = true
+			var target = f.written
+			f.mu.Unlock()
+
+			err := db.Sync()
+
+			f.mu.Lock()
+			if err == nil {
+				f.synced = target
+			}
+			f.lastErr = err
+			f.syncing = false
+			close(f.notify)
+			f.notify = make(chan struct{})
+			f.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var notify = f.notify
+		f.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-expired:
+			return errFsyncTimeout
+		}
+	}
+}
+
+// waitaofCommandFunc implements WAITAOF numlocal numreplicas timeout. It
+// blocks, if numlocal is not 0, until the writes of the connection are
+// synced to disk, syncing them at once whatever the policy. It replies with
+// 1 when they are, 0 on timeout, or an error if the sync fails, and the
+// number of replicas that synced them, always 0 as replicas do not tell when
+// they sync.
+func waitaofCommandFunc(ctx Context) {
+	if len(ctx.args) != 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var n [3]int64
+	for i, arg := range ctx.args[1:] {
+		v, err := strconv.ParseInt(string(arg), 10, 64)
+		if err != nil || v < 0 {
+			ctx.Conn.WriteError(ErrValue)
+			return
+		}
+		n[i] = v
+	}
+	if n[1] > 0 {
+		ctx.Conn.WriteError(ErrWaitAOFReplicas)
+		return
+	}
+
+	var (
+		f       = ctx.app.fsync
+		seq     = f.lastWrite(ctx.Conn.RemoteAddr())
+		timeout = time.Duration(n[2]) * time.Millisecond
+		synced  = 0
+	)
+	if n[0] == 0 {
+		if f.isSynced(seq) {
+			synced = 1
+		}
+	} else {
+		switch err := f.wait(ctx.app.db, seq, timeout); err {
+		case nil:
+			synced = 1
+		case errFsyncTimeout:
+		default:
+			ctx.Conn.WriteError(fmt.Sprintf(ErrFsync, err))
+			return
+		}
+	}
+
+	ctx.Conn.WriteArray(2)
+	ctx.Conn.WriteInt(synced)
+	ctx.Conn.WriteInt(0)
+}
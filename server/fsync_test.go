@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"github.com/qichengzx/raptor/storage"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// syncCounter counts the syncs, each one waiting for release if set and
+// failing with err.
+type syncCounter struct {
+	storage.DB
+	syncs   int32
+	release chan struct{}
+	err     error
+}
+
+func (db *syncCounter) Sync() error {
+	atomic.AddInt32(&db.syncs, 1)
+	if db.release != nil {
+		<-db.release
+	}
+	return db.err
+}
+
+func TestAppendFsync(t *testing.T) {
+	f, err := newAppendFsync("")
+	if err != nil || f.getPolicy() != fsyncEverySec {
+		t.Fatalf("default policy %q, %v", f.getPolicy(), err)
+	}
+	if err := f.setPolicy("sometimes"); err != errFsyncPolicy {
+		t.Fatalf("setPolicy(sometimes) = %v", err)
+	}
+
+	var db = &syncCounter{}
+	f.setPolicy("NO")
+	f.wrote("a")
+	f.wrote("b")
+	if db.syncs != 0 || f.isSynced(f.lastWrite("a")) {
+		t.Fatalf("no policy synced %d times", db.syncs)
+	}
+	if f.wait(db, f.lastWrite("a"), 0) != nil || db.syncs != 1 || !f.isSynced(f.lastWrite("b")) {
+		t.Fatalf("wait synced %d times", db.syncs)
+	}
+
+	// the writes made while a sync runs wait for the next one
+	db.release = make(chan struct{})
+	f.wrote("a")
+	var done = make(chan error)
+	go func() { done <- f.wait(db, f.lastWrite("a"), 0) }()
+	for atomic.LoadInt32(&db.syncs) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	f.wrote("b")
+	if err := f.wait(db, f.lastWrite("b"), 10*time.Millisecond); err != errFsyncTimeout {
+		t.Fatalf("wait while syncing = %v", err)
+	}
+	db.release <- struct{}{}
+	<-done
+	go func() { done <- f.wait(db, f.lastWrite("b"), 0) }()
+	db.release <- struct{}{}
+	if <-done != nil || db.syncs != 3 {
+		t.Fatalf("synced %d times, want 3", db.syncs)
+	}
+
+	// a failed sync leaves the writes unsynced
+	db.release = nil
+	db.err = errors.New("disk full")
+	f.wrote("a")
+	if err := f.wait(db, f.lastWrite("a"), 0); err != db.err {
+		t.Fatalf("failed sync = %v", err)
+	}
+	if f.isSynced(f.lastWrite("a")) || f.lastStatus() != db.err {
+		t.Fatal("the failed sync advanced the synced writes")
+	}
+	db.err = nil
+	if f.wait(db, f.lastWrite("a"), 0) != nil || f.lastStatus() != nil {
+		t.Fatal("the sync after a failure did not succeed")
+	}
+
+	f.dropConn("a")
+	if f.lastWrite("a") != 0 {
+		t.Fatal("dropConn kept the last write")
+	}
+}
+
+func TestAppendFsyncAlways(t *testing.T) {
+	var app = newTestApp(t)
+	var db = &syncCounter{DB: app.db.DB, err: errors.New("disk full")}
+	app.db.DB = db
+	app.fsync.setPolicy(fsyncAlways)
+
+	var c = newTestClient(t, app)
+	c.must("-ERR syncing the store to disk failed: disk full\r\n", "set", "a", "1")
+	c.must("-ERR syncing the store to disk failed: disk full\r\n", "waitaof", "1", "0", "0")
+	if !strings.Contains(c.do("info", "persistence"), "aof_last_write_status:err") {
+		t.Error("INFO does not report the failed sync")
+	}
+
+	db.err = nil
+	c.must("+OK\r\n", "set", "a", "1")
+	c.must("*2\r\n:1\r\n:0\r\n", "waitaof", "1", "0", "0")
+}
@@ -0,0 +1,753 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	cmdGeoAdd    = "geoadd"
+	cmdGeoDist   = "geodist"
+	cmdGeoPos    = "geopos"
+	cmdGeoSearch = "geosearch"
+	cmdGeoHash   = "geohash"
+)
+
+// geo members are stored in a sorted set, scored by the 52 bits geohash of
+// their position, the same way as Redis does so that scores are portable.
+const (
+	geoStepMax     = 26
+	geoLatMin      = -85.05112878
+	geoLatMax      = 85.05112878
+	geoLonMin      = -180.0
+	geoLonMax      = 180.0
+	geoEarthRadius = 6372797.560856
+	geoMercatorMax = 20037726.37
+	geoAlphabet    = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+type geoHash struct {
+	bits uint64
+	step uint
+}
+
+type geoArea struct {
+	hash           geoHash
+	lonMin, lonMax float64
+	latMin, latMax float64
+}
+
+// geoShape is the area searched by GEOSEARCH, either a circle of radius
+// meters or a box of width and height meters.
+type geoShape struct {
+	lon, lat      float64
+	radius        float64
+	width, height float64
+	byBox         bool
+	unit          float64
+}
+
+type geoPoint struct {
+	member   []byte
+	score    float64
+	lon, lat float64
+	dist     float64
+}
+
+func geoaddCommandFunc(ctx Context) {
+	if len(ctx.args) < 5 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		key        = ctx.args[1]
+		nx, xx, ch bool
+		i          = 2
+	)
+	for ; i < len(ctx.args); i++ {
+		switch strings.ToLower(string(ctx.args[i])) {
+		case "nx":
+			nx = true
+			continue
+		case "xx":
+			xx = true
+			continue
+		case "ch":
+			ch = true
+			continue
+		}
+		break
+	}
+	if nx && xx {
+		ctx.Conn.WriteError(ErrGeoNXXX)
+		return
+	}
+	if len(ctx.args[i:]) == 0 || len(ctx.args[i:])%3 != 0 {
+		ctx.Conn.WriteError(ErrGeoAddArgs)
+		return
+	}
+
+	var scores []float64
+	for j := i; j < len(ctx.args); j += 3 {
+		lon, lat, err := parseGeoLonLat(ctx.args[j], ctx.args[j+1])
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		scores = append(scores, float64(geoEncode(lon, lat, geoStepMax).bits))
+	}
+
+	metaValue, err := typeZSetGetMeta(ctx, key)
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var zsetSize uint32 = 0
+	if metaValue != nil {
+		zsetSize = bytesToUint32(metaValue[1:5])
+	}
+
+	var added, changed uint32
+	for n, score := range scores {
+		member := ctx.args[i+n*3+2]
+		old, existed, err := typeZSetGetScore(ctx, key, member)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		if (nx && existed) || (xx && !existed) || (existed && old == score) {
+			continue
+		}
+
+		_, err = typeZSetSetScore(ctx, key, member, score)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		if existed {
+			changed++
+		} else {
+			added++
+		}
+	}
+
+	if added > 0 {
+		err = typeZSetSetMeta(ctx, key, zsetSize+added)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+	if added+changed > 0 {
+		ctx.notify(notifyZSet, "zadd", key)
+	}
+
+	if ch {
+		ctx.Conn.WriteInt64(int64(added + changed))
+		return
+	}
+	ctx.Conn.WriteInt64(int64(added))
+}
+
+func geodistCommandFunc(ctx Context) {
+	if len(ctx.args) != 4 && len(ctx.args) != 5 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var unit = 1.0
+	if len(ctx.args) == 5 {
+		var ok bool
+		if unit, ok = parseGeoUnit(ctx.args[4]); !ok {
+			ctx.Conn.WriteError(ErrGeoUnit)
+			return
+		}
+	}
+
+	if _, err := typeZSetGetMeta(ctx, ctx.args[1]); err != nil {
+		if err.Error() == ErrKeyNotExist {
+			ctx.Conn.WriteNull()
+			return
+		}
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var coords [2][2]float64
+	for i, member := range ctx.args[2:4] {
+		score, ok, err := typeZSetGetScore(ctx, ctx.args[1], member)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		if !ok {
+			ctx.Conn.WriteNull()
+			return
+		}
+		coords[i][0], coords[i][1] = geoDecode(uint64(score))
+	}
+
+	dist := geoDistance(coords[0][0], coords[0][1], coords[1][0], coords[1][1])
+	ctx.Conn.WriteBulkString(strconv.FormatFloat(dist/unit, 'f', 4, 64))
+}
+
+func geoposCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	if _, err := typeZSetGetMeta(ctx, ctx.args[1]); err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.Conn.WriteArray(len(ctx.args[2:]))
+	for _, member := range ctx.args[2:] {
+		score, ok, err := typeZSetGetScore(ctx, ctx.args[1], member)
+		if err != nil || !ok {
+			ctx.Conn.WriteNull()
+			continue
+		}
+
+		lon, lat := geoDecode(uint64(score))
+		ctx.Conn.WriteArray(2)
+		ctx.Conn.WriteBulkString(formatGeoCoord(lon))
+		ctx.Conn.WriteBulkString(formatGeoCoord(lat))
+	}
+}
+
+func geohashCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	if _, err := typeZSetGetMeta(ctx, ctx.args[1]); err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.Conn.WriteArray(len(ctx.args[2:]))
+	for _, member := range ctx.args[2:] {
+		score, ok, err := typeZSetGetScore(ctx, ctx.args[1], member)
+		if err != nil || !ok {
+			ctx.Conn.WriteNull()
+			continue
+		}
+
+		// the standard geohash covers latitudes from -90 to 90, unlike the
+		// mercator limited one used for the scores
+		lon, lat := geoDecode(uint64(score))
+		bits := geoInterleave(
+			uint32((lat+90)/180*(1<<geoStepMax)),
+			uint32((lon+180)/360*(1<<geoStepMax)),
+		)
+
+		var hash = make([]byte, 11)
+		for i := range hash {
+			var idx uint64
+			if i < 10 {
+				idx = bits >> uint(52-(i+1)*5) & 0x1f
+			}
+			hash[i] = geoAlphabet[idx]
+		}
+		ctx.Conn.WriteBulk(hash)
+	}
+}
+
+func geosearchCommandFunc(ctx Context) {
+	if len(ctx.args) < 7 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		key                           = ctx.args[1]
+		shape                         geoShape
+		fromMember                    []byte
+		fromLonLat, byRadius          bool
+		withDist, withCoord, withHash bool
+		sortOrder                     = 0
+		count                         = 0
+		anyPoint                      bool
+	)
+	for i := 2; i < len(ctx.args); i++ {
+		var (
+			arg  = strings.ToLower(string(ctx.args[i]))
+			left = len(ctx.args) - i - 1
+		)
+		switch {
+		case arg == "frommember" && left >= 1:
+			fromMember = ctx.args[i+1]
+			i++
+		case arg == "fromlonlat" && left >= 2:
+			lon, lat, err := parseGeoLonLat(ctx.args[i+1], ctx.args[i+2])
+			if err != nil {
+				ctx.Conn.WriteError(err.Error())
+				return
+			}
+			shape.lon, shape.lat = lon, lat
+			fromLonLat = true
+			i += 2
+		case arg == "byradius" && left >= 2:
+			radius, err := strconv.ParseFloat(string(ctx.args[i+1]), 64)
+			if err != nil || radius < 0 {
+				ctx.Conn.WriteError(ErrGeoRadius)
+				return
+			}
+			unit, ok := parseGeoUnit(ctx.args[i+2])
+			if !ok {
+				ctx.Conn.WriteError(ErrGeoUnit)
+				return
+			}
+			shape.radius, shape.unit = radius*unit, unit
+			byRadius = true
+			i += 2
+		case arg == "bybox" && left >= 3:
+			width, err := strconv.ParseFloat(string(ctx.args[i+1]), 64)
+			if err != nil || width < 0 {
+				ctx.Conn.WriteError(ErrGeoRadius)
+				return
+			}
+			height, err := strconv.ParseFloat(string(ctx.args[i+2]), 64)
+			if err != nil || height < 0 {
+				ctx.Conn.WriteError(ErrGeoRadius)
+				return
+			}
+			unit, ok := parseGeoUnit(ctx.args[i+3])
+			if !ok {
+				ctx.Conn.WriteError(ErrGeoUnit)
+				return
+			}
+			shape.width, shape.height, shape.unit = width*unit, height*unit, unit
+			shape.byBox = true
+			i += 3
+		case arg == "asc":
+			sortOrder = 1
+		case arg == "desc":
+			sortOrder = -1
+		case arg == "count" && left >= 1:
+			n, err := strconv.Atoi(string(ctx.args[i+1]))
+			if err != nil || n <= 0 {
+				ctx.Conn.WriteError(ErrGeoCount)
+				return
+			}
+			count = n
+			i++
+			if i+1 < len(ctx.args) && strings.ToLower(string(ctx.args[i+1])) == "any" {
+				anyPoint = true
+				i++
+			}
+		case arg == "withdist":
+			withDist = true
+		case arg == "withcoord":
+			withCoord = true
+		case arg == "withhash":
+			withHash = true
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+
+	if (fromMember != nil) == fromLonLat {
+		ctx.Conn.WriteError(ErrGeoFrom)
+		return
+	}
+	if byRadius == shape.byBox {
+		ctx.Conn.WriteError(ErrGeoBy)
+		return
+	}
+	if anyPoint && count == 0 {
+		ctx.Conn.WriteError(ErrGeoAny)
+		return
+	}
+
+	_, err := typeZSetGetMeta(ctx, key)
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			ctx.Conn.WriteArray(0)
+			return
+		}
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	if fromMember != nil {
+		score, ok, err := typeZSetGetScore(ctx, key, fromMember)
+		if err != nil || !ok {
+			ctx.Conn.WriteError(ErrGeoMember)
+			return
+		}
+		shape.lon, shape.lat = geoDecode(uint64(score))
+	}
+
+	// sorting is needed to return the nearest points first unless any
+	// point will do
+	if count > 0 && sortOrder == 0 && !anyPoint {
+		sortOrder = 1
+	}
+
+	var points []geoPoint
+	var limit = 0
+	if anyPoint {
+		limit = count
+	}
+	for _, area := range geoSearchAreas(shape) {
+		var (
+			min = float64(area.bits << (52 - area.step*2))
+			max = float64((area.bits + 1) << (52 - area.step*2))
+		)
+		typeZSetScanScore(ctx, key, min, math.Nextafter(max, math.Inf(-1)), func(score float64, member []byte) {
+			if limit > 0 && len(points) >= limit {
+				return
+			}
+			lon, lat := geoDecode(uint64(score))
+			if dist, ok := shape.contains(lon, lat); ok {
+				points = append(points, geoPoint{member: member, score: score, lon: lon, lat: lat, dist: dist})
+			}
+		})
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+	}
+
+	if sortOrder != 0 {
+		sort.SliceStable(points, func(i, j int) bool {
+			if sortOrder > 0 {
+				return points[i].dist < points[j].dist
+			}
+			return points[i].dist > points[j].dist
+		})
+	}
+	if count > 0 && len(points) > count {
+		points = points[:count]
+	}
+
+	var fields = 1
+	for _, with := range []bool{withDist, withHash, withCoord} {
+		if with {
+			fields++
+		}
+	}
+
+	ctx.Conn.WriteArray(len(points))
+	for _, p := range points {
+		if fields == 1 {
+			ctx.Conn.WriteBulk(p.member)
+			continue
+		}
+
+		ctx.Conn.WriteArray(fields)
+		ctx.Conn.WriteBulk(p.member)
+		if withDist {
+			ctx.Conn.WriteBulkString(strconv.FormatFloat(p.dist/shape.unit, 'f', 4, 64))
+		}
+		if withHash {
+			ctx.Conn.WriteInt64(int64(p.score))
+		}
+		if withCoord {
+			ctx.Conn.WriteArray(2)
+			ctx.Conn.WriteBulkString(formatGeoCoord(p.lon))
+			ctx.Conn.WriteBulkString(formatGeoCoord(p.lat))
+		}
+	}
+}
+
+// contains returns the distance in meters between the centre of the shape
+// and the point, and whether the point is inside the shape.
+func (s geoShape) contains(lon, lat float64) (float64, bool) {
+	if !s.byBox {
+		dist := geoDistance(s.lon, s.lat, lon, lat)
+		return dist, dist <= s.radius
+	}
+
+	if geoEarthRadius*math.Abs(geoDegRad(lat)-geoDegRad(s.lat)) > s.height/2 {
+		return 0, false
+	}
+	if geoDistance(s.lon, lat, lon, lat) > s.width/2 {
+		return 0, false
+	}
+
+	return geoDistance(s.lon, s.lat, lon, lat), true
+}
+
+// geoSearchAreas returns the geohash boxes, the one holding the centre of the
+// shape and its neighbours, which together cover the whole shape.
+func geoSearchAreas(s geoShape) []geoHash {
+	var (
+		radius = s.radius
+		height = s.radius * 2
+		width  = s.radius * 2
+	)
+	if s.byBox {
+		radius = math.Sqrt(s.width*s.width/4 + s.height*s.height/4)
+		height, width = s.height, s.width
+	}
+
+	latDelta := geoRadDeg(height / 2 / geoEarthRadius)
+	lonDeltaTop := geoRadDeg(width / 2 / geoEarthRadius / math.Cos(geoDegRad(s.lat+latDelta)))
+	lonDeltaBottom := geoRadDeg(width / 2 / geoEarthRadius / math.Cos(geoDegRad(s.lat-latDelta)))
+	lonDelta := lonDeltaTop
+	if s.lat < 0 {
+		lonDelta = lonDeltaBottom
+	}
+	var (
+		minLon, maxLon = s.lon - lonDelta, s.lon + lonDelta
+		minLat, maxLat = s.lat - latDelta, s.lat + latDelta
+	)
+
+	step := geoEstimateSteps(radius, s.lat)
+	hash := geoEncode(s.lon, s.lat, step)
+	neighbors := geoNeighbors(hash)
+
+	// the neighbours may not cover the whole shape when it sits on the
+	// border of a box, use larger boxes then
+	if step > 1 {
+		north, south := geoDecodeArea(neighbors[0]), geoDecodeArea(neighbors[1])
+		east, west := geoDecodeArea(neighbors[2]), geoDecodeArea(neighbors[3])
+		if north.latMax < maxLat || south.latMin > minLat || east.lonMax < maxLon || west.lonMin > minLon {
+			step--
+			hash = geoEncode(s.lon, s.lat, step)
+			neighbors = geoNeighbors(hash)
+		}
+	}
+
+	// order: north, south, east, west, north east, north west, south east,
+	// south west
+	var skip [8]bool
+	if step >= 2 {
+		area := geoDecodeArea(hash)
+		if area.latMin < minLat {
+			skip[1], skip[6], skip[7] = true, true, true
+		}
+		if area.latMax > maxLat {
+			skip[0], skip[4], skip[5] = true, true, true
+		}
+		if area.lonMin < minLon {
+			skip[3], skip[5], skip[7] = true, true, true
+		}
+		if area.lonMax > maxLon {
+			skip[2], skip[4], skip[6] = true, true, true
+		}
+	}
+
+	var (
+		areas = []geoHash{hash}
+		seen  = map[geoHash]bool{hash: true}
+	)
+	for i, n := range neighbors {
+		// small steps wrap around, making some neighbours the same box
+		if skip[i] || seen[n] {
+			continue
+		}
+		seen[n] = true
+		areas = append(areas, n)
+	}
+
+	return areas
+}
+
+func geoEstimateSteps(radius, lat float64) uint {
+	if radius == 0 {
+		return geoStepMax
+	}
+
+	var step = 1
+	for radius < geoMercatorMax {
+		radius *= 2
+		step++
+	}
+	step -= 2
+
+	// the boxes are narrower near the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	if step < 1 {
+		step = 1
+	}
+	if step > geoStepMax {
+		step = geoStepMax
+	}
+
+	return uint(step)
+}
+
+func geoEncode(lon, lat float64, step uint) geoHash {
+	latOffset := (lat - geoLatMin) / (geoLatMax - geoLatMin)
+	lonOffset := (lon - geoLonMin) / (geoLonMax - geoLonMin)
+	latOffset *= float64(uint64(1) << step)
+	lonOffset *= float64(uint64(1) << step)
+
+	return geoHash{bits: geoInterleave(uint32(latOffset), uint32(lonOffset)), step: step}
+}
+
+func geoDecodeArea(hash geoHash) geoArea {
+	var (
+		lat   = geoDeinterleave(hash.bits)
+		lon   = geoDeinterleave(hash.bits >> 1)
+		scale = float64(uint64(1) << hash.step)
+	)
+
+	return geoArea{
+		hash:   hash,
+		latMin: geoLatMin + float64(lat)/scale*(geoLatMax-geoLatMin),
+		latMax: geoLatMin + float64(lat+1)/scale*(geoLatMax-geoLatMin),
+		lonMin: geoLonMin + float64(lon)/scale*(geoLonMax-geoLonMin),
+		lonMax: geoLonMin + float64(lon+1)/scale*(geoLonMax-geoLonMin),
+	}
+}
+
+// geoDecode returns the centre of the box of a 52 bits geohash.
+func geoDecode(bits uint64) (float64, float64) {
+	area := geoDecodeArea(geoHash{bits: bits, step: geoStepMax})
+	lon := math.Max(geoLonMin, math.Min(geoLonMax, (area.lonMin+area.lonMax)/2))
+	lat := math.Max(geoLatMin, math.Min(geoLatMax, (area.latMin+area.latMax)/2))
+
+	return lon, lat
+}
+
+// geoNeighbors returns the boxes around hash: north, south, east, west,
+// north east, north west, south east and south west.
+func geoNeighbors(hash geoHash) [8]geoHash {
+	return [8]geoHash{
+		geoMove(hash, 0, 1),
+		geoMove(hash, 0, -1),
+		geoMove(hash, 1, 0),
+		geoMove(hash, -1, 0),
+		geoMove(hash, 1, 1),
+		geoMove(hash, -1, 1),
+		geoMove(hash, 1, -1),
+		geoMove(hash, -1, -1),
+	}
+}
+
+// geoMove moves hash by one box, longitudes are held by the odd bits and
+// latitudes by the even ones.
+func geoMove(hash geoHash, dx, dy int) geoHash {
+	var shift = 64 - hash.step*2
+	if dx != 0 {
+		x := hash.bits & 0xaaaaaaaaaaaaaaaa
+		y := hash.bits & 0x5555555555555555
+		zz := uint64(0x5555555555555555) >> shift
+		if dx > 0 {
+			x += zz + 1
+		} else {
+			x |= zz
+			x -= zz + 1
+		}
+		x &= 0xaaaaaaaaaaaaaaaa >> shift
+		hash.bits = x | y
+	}
+	if dy != 0 {
+		x := hash.bits & 0xaaaaaaaaaaaaaaaa
+		y := hash.bits & 0x5555555555555555
+		zz := uint64(0xaaaaaaaaaaaaaaaa) >> shift
+		if dy > 0 {
+			y += zz + 1
+		} else {
+			y |= zz
+			y -= zz + 1
+		}
+		y &= 0x5555555555555555 >> shift
+		hash.bits = x | y
+	}
+
+	return hash
+}
+
+// geoInterleave puts the bits of x in the even positions and the bits of y
+// in the odd ones.
+func geoInterleave(x, y uint32) uint64 {
+	return geoSpread(x) | geoSpread(y)<<1
+}
+
+func geoSpread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+
+	return x
+}
+
+func geoDeinterleave(x uint64) uint64 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x>>4) & 0x00ff00ff00ff00ff
+	x = (x | x>>8) & 0x0000ffff0000ffff
+	x = (x | x>>16) & 0x00000000ffffffff
+
+	return x
+}
+
+// geoDistance is the haversine distance in meters.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r, lon1r := geoDegRad(lat1), geoDegRad(lon1)
+	lat2r, lon2r := geoDegRad(lat2), geoDegRad(lon2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2r - lon1r) / 2)
+
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+func geoDegRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func geoRadDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+func parseGeoLonLat(lonArg, latArg []byte) (float64, float64, error) {
+	lon, err := strconv.ParseFloat(string(lonArg), 64)
+	if err != nil {
+		return 0, 0, errors.New(ErrFloat)
+	}
+	lat, err := strconv.ParseFloat(string(latArg), 64)
+	if err != nil {
+		return 0, 0, errors.New(ErrFloat)
+	}
+	if lon < geoLonMin || lon > geoLonMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, fmt.Errorf(ErrGeoLonLat, lon, lat)
+	}
+
+	return lon, lat, nil
+}
+
+func parseGeoUnit(arg []byte) (float64, bool) {
+	switch strings.ToLower(string(arg)) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+
+	return 0, false
+}
+
+func formatGeoCoord(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+
+	return strings.TrimSuffix(s, ".")
+}
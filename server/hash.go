@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"github.com/qichengzx/raptor/storage/badger"
+	"github.com/qichengzx/raptor/storage"
 	"strconv"
 )
 
@@ -69,6 +69,7 @@ func hsetCommandFunc(ctx Context) {
 		return
 	}
 
+	ctx.notify(notifyHash, "hset", key)
 	ctx.Conn.WriteInt(1)
 }
 
@@ -109,6 +110,7 @@ func hsetnxCommandFunc(ctx Context) {
 		return
 	}
 
+	ctx.notify(notifyHash, "hset", key)
 	ctx.Conn.WriteInt(1)
 }
 
@@ -204,7 +206,9 @@ func hdelCommandFunc(ctx Context) {
 		}
 
 		ctx.db.Del(fieldToDel)
+		ctx.notify(notifyHash, "hdel", key)
 		if hashSize == 0 {
+			ctx.notify(notifyGeneric, "del", key)
 			ctx.Conn.WriteInt(lenToDel)
 			return
 		}
@@ -225,7 +229,7 @@ func hincrbyCommandFunc(ctx Context) {
 		return
 	}
 
-	var key             = ctx.args[1]
+	var key = ctx.args[1]
 	metaValue, err := typeHashGetMeta(ctx, key)
 	if err != nil && err.Error() != ErrKeyNotExist {
 		ctx.Conn.WriteError(err.Error())
@@ -256,6 +260,7 @@ func hincrbyCommandFunc(ctx Context) {
 		}
 	}
 
+	ctx.notify(notifyHash, "hincrby", key)
 	ctx.Conn.WriteInt64(valInt)
 }
 
@@ -373,6 +378,7 @@ func hmsetCommandFunc(ctx Context) {
 		return
 	}
 
+	ctx.notify(notifyHash, "hset", key)
 	ctx.Conn.WriteString(RespOK)
 }
 
@@ -504,7 +510,7 @@ func typeHashScan(ctx Context, key []byte, cnt int64) ([][]byte, [][]byte) {
 	prefixBuff.Write(keySize)
 	prefixBuff.Write(key)
 
-	scanOpts := badger.ScannerOptions{
+	scanOpts := storage.ScannerOptions{
 		Prefix:      prefixBuff.Bytes(),
 		FetchValues: true,
 		Handler:     scanFunc,
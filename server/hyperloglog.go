@@ -0,0 +1,492 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	cmdPFAdd   = "pfadd"
+	cmdPFCount = "pfcount"
+	cmdPFMerge = "pfmerge"
+)
+
+// the HyperLogLog layout is the one used by Redis, so that values can be
+// exchanged with it: a 16 bytes header ("HYLL", encoding, 3 unused bytes and
+// the cached cardinality, little-endian, whose most significant bit marks it
+// as invalid) followed by the registers, either dense (6 bits each) or sparse
+// (run length encoded with the ZERO, XZERO and VAL opcodes).
+const (
+	hllP          = 14
+	hllQ          = 64 - hllP
+	hllRegisters  = 1 << hllP
+	hllPMask      = hllRegisters - 1
+	hllBits       = 6
+	hllRegMax     = (1 << hllBits) - 1
+	hllHdrSize    = 16
+	hllDenseSize  = hllHdrSize + (hllRegisters*hllBits+7)/8
+	hllDense      = 0
+	hllSparse     = 1
+	hllSparseMax  = 3000
+	hllSeed       = 0xadc83b19
+	hllAlphaInf   = 0.721347520444481703680
+	hllCacheValid = 7
+
+	hllOpZero     = 0x00
+	hllOpXZero    = 0x40
+	hllOpVal      = 0x80
+	hllZeroMaxLen = 64
+	hllXZeroMax   = 16384
+	hllValMax     = 32
+	hllValMaxLen  = 4
+)
+
+var hllMagic = []byte("HYLL")
+
+func pfaddCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var key = ctx.args[1]
+	registers, err := typeHLLGet(ctx, key)
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var updated = registers == nil
+	if registers == nil {
+		registers = make([]uint8, hllRegisters)
+	}
+	for _, element := range ctx.args[2:] {
+		index, count := hllPatLen(element)
+		if count > registers[index] {
+			registers[index] = count
+			updated = true
+		}
+	}
+
+	if !updated {
+		ctx.Conn.WriteInt(RespErr)
+		return
+	}
+
+	err = setKeepTTL(ctx, key, append(typeString, hllEncode(registers, -1)...))
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyString, "pfadd", key)
+	ctx.Conn.WriteInt(RespSucc)
+}
+
+func pfcountCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	if len(ctx.args) == 2 {
+		val, err := typeStringGetVal(ctx, ctx.args[1])
+		if err != nil {
+			if err.Error() == ErrKeyNotExist {
+				ctx.Conn.WriteInt(0)
+				return
+			}
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		if err = hllValidate(val[1:]); err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+
+		var hll = val[1:]
+		if hll[hllCacheValid+8]&0x80 == 0 {
+			ctx.Conn.WriteInt64(int64(binary.LittleEndian.Uint64(hll[8:16])))
+			return
+		}
+
+		registers, _ := hllDecode(hll)
+		card := hllCount(registers)
+
+		// cache the cardinality until the next update, replicas leave
+		// their data set to the master and raft nodes to the log
+		if !ctx.app.repl.isReplica() && ctx.app.raft == nil {
+			binary.LittleEndian.PutUint64(hll[8:16], card)
+			setKeepTTL(ctx, ctx.args[1], val)
+		}
+
+		ctx.Conn.WriteInt64(int64(card))
+		return
+	}
+
+	var union = make([]uint8, hllRegisters)
+	for _, key := range ctx.args[1:] {
+		registers, err := typeHLLGet(ctx, key)
+		if err != nil {
+			if err.Error() == ErrKeyNotExist {
+				continue
+			}
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		hllMerge(union, registers)
+	}
+
+	ctx.Conn.WriteInt64(int64(hllCount(union)))
+}
+
+func pfmergeCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var union = make([]uint8, hllRegisters)
+	for _, key := range ctx.args[1:] {
+		registers, err := typeHLLGet(ctx, key)
+		if err != nil {
+			if err.Error() == ErrKeyNotExist {
+				continue
+			}
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		hllMerge(union, registers)
+	}
+
+	var dstkey = ctx.args[1]
+	err := setKeepTTL(ctx, dstkey, append(typeString, hllEncodeDense(union, -1)...))
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyString, "pfadd", dstkey)
+	ctx.Conn.WriteString(RespOK)
+}
+
+// typeHLLGet returns the registers of the HyperLogLog stored at key.
+func typeHLLGet(ctx Context, key []byte) ([]uint8, error) {
+	val, err := typeStringGetVal(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, errors.New(ErrKeyNotExist)
+	}
+
+	return hllDecode(val[1:])
+}
+
+func hllValidate(hll []byte) error {
+	if len(hll) < hllHdrSize || !bytes.Equal(hll[:4], hllMagic) {
+		return errors.New(ErrHLLType)
+	}
+
+	switch hll[4] {
+	case hllDense:
+		if len(hll) != hllDenseSize {
+			return errors.New(ErrHLLType)
+		}
+	case hllSparse:
+	default:
+		return errors.New(ErrHLLType)
+	}
+
+	return nil
+}
+
+// hllDecode returns one byte per register from a dense or sparse value.
+func hllDecode(hll []byte) ([]uint8, error) {
+	if err := hllValidate(hll); err != nil {
+		return nil, err
+	}
+
+	var registers = make([]uint8, hllRegisters)
+	if hll[4] == hllDense {
+		for i := 0; i < hllRegisters; i++ {
+			registers[i] = hllDenseGet(hll[hllHdrSize:], i)
+		}
+		return registers, nil
+	}
+
+	var idx = 0
+	for p := hll[hllHdrSize:]; len(p) > 0; {
+		var run, val int
+		switch {
+		case p[0]&0xc0 == hllOpZero:
+			run = int(p[0]&0x3f) + 1
+			p = p[1:]
+		case p[0]&0xc0 == hllOpXZero:
+			if len(p) < 2 {
+				return nil, errors.New(ErrHLLCorrupted)
+			}
+			run = (int(p[0]&0x3f)<<8 | int(p[1])) + 1
+			p = p[2:]
+		default:
+			val = int(p[0]>>2&0x1f) + 1
+			run = int(p[0]&0x03) + 1
+			p = p[1:]
+		}
+
+		if idx+run > hllRegisters {
+			return nil, errors.New(ErrHLLCorrupted)
+		}
+		for ; run > 0; run-- {
+			registers[idx] = uint8(val)
+			idx++
+		}
+	}
+	if idx != hllRegisters {
+		return nil, errors.New(ErrHLLCorrupted)
+	}
+
+	return registers, nil
+}
+
+// hllEncode uses the sparse representation while it is small enough and can
+// hold every register, like Redis does, and the dense one otherwise. A
+// negative card marks the cached cardinality as invalid.
+func hllEncode(registers []uint8, card int64) []byte {
+	var sparse = bytes.NewBuffer(hllHeader(hllSparse, card))
+	for i := 0; i < hllRegisters; {
+		var (
+			val = registers[i]
+			run = 1
+		)
+		for i+run < hllRegisters && registers[i+run] == val {
+			run++
+		}
+		i += run
+
+		if val == 0 {
+			for run > hllZeroMaxLen {
+				n := run
+				if n > hllXZeroMax {
+					n = hllXZeroMax
+				}
+				sparse.WriteByte(hllOpXZero | byte((n-1)>>8))
+				sparse.WriteByte(byte((n - 1) & 0xff))
+				run -= n
+			}
+			if run > 0 {
+				sparse.WriteByte(hllOpZero | byte(run-1))
+			}
+			continue
+		}
+
+		if val > hllValMax {
+			return hllEncodeDense(registers, card)
+		}
+		for ; run > 0; run -= hllValMaxLen {
+			n := run
+			if n > hllValMaxLen {
+				n = hllValMaxLen
+			}
+			sparse.WriteByte(hllOpVal | (val-1)<<2 | byte(n-1))
+		}
+	}
+
+	if sparse.Len()-hllHdrSize > hllSparseMax {
+		return hllEncodeDense(registers, card)
+	}
+
+	return sparse.Bytes()
+}
+
+func hllEncodeDense(registers []uint8, card int64) []byte {
+	var hll = make([]byte, hllDenseSize)
+	copy(hll, hllHeader(hllDense, card))
+	for i, val := range registers {
+		hllDenseSet(hll[hllHdrSize:], i, val)
+	}
+
+	return hll
+}
+
+func hllHeader(encoding byte, card int64) []byte {
+	var hdr = make([]byte, hllHdrSize)
+	copy(hdr, hllMagic)
+	hdr[4] = encoding
+	if card < 0 {
+		hdr[hllCacheValid+8] = 0x80
+	} else {
+		binary.LittleEndian.PutUint64(hdr[8:], uint64(card))
+	}
+
+	return hdr
+}
+
+func hllDenseGet(p []byte, regnum int) uint8 {
+	var (
+		idx = regnum * hllBits / 8
+		fb  = uint(regnum * hllBits & 7)
+		b0  = uint(p[idx])
+		b1  uint
+	)
+	if idx+1 < len(p) {
+		b1 = uint(p[idx+1])
+	}
+
+	return uint8((b0>>fb | b1<<(8-fb)) & hllRegMax)
+}
+
+func hllDenseSet(p []byte, regnum int, val uint8) {
+	var (
+		idx = regnum * hllBits / 8
+		fb  = uint(regnum * hllBits & 7)
+		v   = uint(val)
+	)
+	p[idx] &^= byte(hllRegMax << fb)
+	p[idx] |= byte(v << fb)
+	if idx+1 < len(p) {
+		p[idx+1] &^= byte(hllRegMax >> (8 - fb))
+		p[idx+1] |= byte(v >> (8 - fb))
+	}
+}
+
+func hllMerge(dst, src []uint8) {
+	for i, val := range src {
+		if val > dst[i] {
+			dst[i] = val
+		}
+	}
+}
+
+// hllPatLen returns the register of element and the length of its
+// 000..1 pattern, which is the value to store in the register.
+func hllPatLen(element []byte) (int, uint8) {
+	var hash = murmurHash64A(element, hllSeed)
+	var index = int(hash & hllPMask)
+
+	hash >>= hllP
+	hash |= 1 << hllQ
+
+	var count uint8 = 1
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+
+	return index, count
+}
+
+// hllCount estimates the cardinality with the improved estimator of Otmar
+// Ertl, as Redis does since 5.0.
+func hllCount(registers []uint8) uint64 {
+	var (
+		m        = float64(hllRegisters)
+		reghisto [64]int
+	)
+	for _, val := range registers {
+		reghisto[val]++
+	}
+
+	z := m * hllTau((m-float64(reghisto[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(reghisto[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(reghisto[0])/m)
+
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	var (
+		zPrime float64
+		y      = 1.0
+		z      = x
+	)
+	for {
+		x *= x
+		zPrime = z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	var (
+		zPrime float64
+		y      = 1.0
+		z      = 1 - x
+	)
+	for {
+		x = math.Sqrt(x)
+		zPrime = z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the hash function used by the Redis HyperLogLog.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const (
+		m = 0xc6a4a7935bd1e995
+		r = 47
+	)
+
+	var h = seed ^ uint64(len(key))*m
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+
+	switch len(key) {
+	case 7:
+		h ^= uint64(key[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(key[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(key[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(key[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(key[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(key[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(key[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
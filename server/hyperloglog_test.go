@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// The vectors below were computed with the C code of MurmurHash64A,
+// hllPatLen, HLL_DENSE_SET_REGISTER and hllCount of the Redis hyperloglog.c,
+// the payloads being laid out by the Redis sparse format.
+
+func TestMurmurHash64A(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		hash uint64
+	}{
+		{"", 0xd8dfea6585bc9732},
+		{"a", 0x53d2470a9b43b1a7},
+		{"ab", 0x0eaed676437142cf},
+		{"abc", 0x77ec90aeb374e502},
+		{"abcd", 0xb079ee3d44202b3e},
+		{"abcde", 0x52a7daa2324a0e8e},
+		{"abcdef", 0x3a4f3a74f538b54f},
+		{"abcdefg", 0x22fe613bb08c9602},
+		{"abcdefgh", 0xf3a65df559914567},
+		{"abcdefghi", 0x834fba4d9152daf7},
+		{"hello world", 0xa919bc3051f624b7},
+		{"The quick brown fox jumps over the lazy dog", 0x51606c5c5b561ace},
+	} {
+		if hash := murmurHash64A([]byte(tc.key), hllSeed); hash != tc.hash {
+			t.Errorf("murmurHash64A(%q) = %#016x, want %#016x", tc.key, hash, tc.hash)
+		}
+	}
+
+	for _, tc := range []struct {
+		element string
+		index   int
+		count   uint8
+	}{
+		{"", 5938, 2},
+		{"a", 12711, 2},
+		{"ab", 719, 1},
+		{"abcd", 11070, 8},
+		{"abcde", 3726, 4},
+		{"hello world", 9399, 4},
+	} {
+		if index, count := hllPatLen([]byte(tc.element)); index != tc.index || count != tc.count {
+			t.Errorf("hllPatLen(%q) = %d %d, want %d %d", tc.element, index, count, tc.index, tc.count)
+		}
+	}
+}
+
+// hllTestHeader is the header of a sparse value with an invalid cache.
+var hllTestHeader = "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80"
+
+func hllTestRegisters(elements ...string) []uint8 {
+	var registers = make([]uint8, hllRegisters)
+	for _, element := range elements {
+		index, count := hllPatLen([]byte(element))
+		if count > registers[index] {
+			registers[index] = count
+		}
+	}
+
+	return registers
+}
+
+func TestHLLEncode(t *testing.T) {
+	for _, tc := range []struct {
+		elements []string
+		payload  string
+	}{
+		// PFADD key
+		{nil, hllTestHeader + "\x7f\xff"},
+		// PFADD key a
+		{[]string{"a"}, hllTestHeader + "\x71\xa6\x84\x4e\x57"},
+		// PFADD key a ab abc
+		{[]string{"a", "ab", "abc"},
+			hllTestHeader + "\x42\xce\x80\x62\x31\x80\x4c\xa3\x84\x4e\x57"},
+	} {
+		var registers = hllTestRegisters(tc.elements...)
+		if hll := hllEncode(registers, -1); string(hll) != tc.payload {
+			t.Errorf("hllEncode(%q) = %q, want %q", tc.elements, hll, tc.payload)
+		}
+		decoded, err := hllDecode([]byte(tc.payload))
+		if err != nil || !bytes.Equal(decoded, registers) {
+			t.Errorf("hllDecode(%q) = %v", tc.payload, err)
+		}
+	}
+
+	// ZERO and VAL opcodes covering several registers
+	registers, err := hllDecode([]byte(hllTestHeader + "\x02\x92\x7f\xf9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, val := range registers {
+		if want := map[bool]uint8{true: 5}[i >= 3 && i < 6]; val != want {
+			t.Fatalf("register %d = %d, want %d", i, val, want)
+		}
+	}
+	for _, corrupted := range []string{
+		hllTestHeader + "\x7f\xff\x80",
+		hllTestHeader + "\x7f\xfe",
+		hllTestHeader + "\x7f",
+	} {
+		if _, err := hllDecode([]byte(corrupted)); err == nil {
+			t.Errorf("hllDecode(%q) succeeded", corrupted)
+		}
+	}
+
+	// the dense registers of elem:0 to elem:9, by their non zero bytes
+	var elements []string
+	for i := 0; i < 10; i++ {
+		elements = append(elements, "elem:"+strconv.Itoa(i))
+	}
+	var dense = hllEncodeDense(hllTestRegisters(elements...), -1)
+	var want = map[int]byte{
+		909: 0x80, 917: 0x08, 3771: 0x80, 5211: 0x04, 6198: 0x03,
+		8913: 0x01, 9950: 0x04, 10075: 0x40, 11430: 0x01, 11826: 0x01,
+	}
+	if len(dense) != hllDenseSize || dense[4] != hllDense {
+		t.Fatalf("dense value of %d bytes, encoding %d", len(dense), dense[4])
+	}
+	for i, b := range dense[hllHdrSize:] {
+		if b != want[i] {
+			t.Errorf("dense byte %d = %#02x, want %#02x", i, b, want[i])
+		}
+	}
+	if decoded, err := hllDecode(dense); err != nil || !bytes.Equal(decoded, hllTestRegisters(elements...)) {
+		t.Errorf("dense round trip: %v", err)
+	}
+}
+
+func TestHLLCount(t *testing.T) {
+	var (
+		registers = make([]uint8, hllRegisters)
+		added     = 0
+	)
+	for _, tc := range []struct {
+		n    int
+		card uint64
+	}{
+		{0, 0}, {1, 1}, {3, 3}, {10, 10}, {100, 100},
+		{1000, 1005}, {10000, 9922}, {100000, 99904},
+	} {
+		for ; added < tc.n; added++ {
+			index, count := hllPatLen([]byte("elem:" + strconv.Itoa(added)))
+			if count > registers[index] {
+				registers[index] = count
+			}
+		}
+		if card := hllCount(registers); card != tc.card {
+			t.Errorf("hllCount of %d elements = %d, want %d", tc.n, card, tc.card)
+		}
+	}
+}
+
+func TestHLLKeepTTL(t *testing.T) {
+	var c = newTestClient(t, newTestApp(t))
+
+	c.must(":1\r\n", "pfadd", "h", "a")
+	c.must(":1\r\n", "expireat", "h", "4000000000")
+	c.must(":1\r\n", "pfadd", "h", "b", "c")
+	c.expiresAt("h", testExpiresAt)
+	// PFCOUNT caches the cardinality in the value
+	c.must(":3\r\n", "pfcount", "h")
+	c.expiresAt("h", testExpiresAt)
+
+	c.must(":1\r\n", "pfadd", "o", "d")
+	c.must("+OK\r\n", "pfmerge", "h", "o")
+	c.expiresAt("h", testExpiresAt)
+	c.must(":4\r\n", "pfcount", "h")
+
+	c.must("+OK\r\n", "pfmerge", "n", "o")
+	c.expiresAt("n", 0)
+}
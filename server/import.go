@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/raptor"
+	"github.com/qichengzx/raptor/rdb"
+	"log"
+	"os"
+	"time"
+)
+
+// importProgress is the number of keys between two progress logs
+const importProgress = 100000
+
+var errImportList = errors.New("lists are not supported, skip them with -skip-lists")
+
+// ImportRDB loads the keys of database index db of the Redis file at path
+// into the store, replacing the keys that already exist. It is meant to run
+// while the server is stopped, as badger locks its directory.
+//
+// Keys already expired are skipped, and so are the keys of the other
+// databases since raptor has a single one. Lists, which raptor does not
+// support, stop the import with an error, the keys met before it being
+// imported already, unless skipLists is set: they are then skipped, their
+// names logged.
+func ImportRDB(conf *config.Config, path string, db int, skipLists bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store, err := raptor.New(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var (
+		w     = &objectWriter{db: store}
+		start = time.Now()
+
+		imported, expired, lists, otherDB int
+	)
+	err = rdb.NewDecoder(bufio.NewReaderSize(f, 1<<20)).Decode(func(e *rdb.Entry) error {
+		switch {
+		case e.DB != db:
+			otherDB++
+			return nil
+		case e.Object.Kind == rdb.KindList:
+			if !skipLists {
+				return fmt.Errorf("key %q: %w", e.Key, errImportList)
+			}
+			log.Printf("import-rdb: skipped the list %q", e.Key)
+			lists++
+			return nil
+		}
+
+		var seconds int64
+		if e.ExpireAt > 0 {
+			ttl := e.ExpireAt - time.Now().UnixNano()/int64(time.Millisecond)
+			if ttl <= 0 {
+				expired++
+				return nil
+			}
+			seconds = (ttl + 999) / 1000
+		}
+
+		// members left by an object of another type would outlive it
+		if val, err := store.Get(e.Key); err == nil && len(val) > 0 {
+			if err := w.flush(); err != nil {
+				return err
+			}
+			err = typeObjectDeleteMembers(store, typeObjectPrefixes(e.Key, string(val[:1])))
+			if err != nil {
+				return err
+			}
+		}
+
+		meta, err := typeObjectWriteMembers(w, e.Key, e.Object)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", e.Key, err)
+		}
+		w.setTTL(e.Key, meta, int(seconds))
+		if w.err != nil {
+			return w.err
+		}
+
+		imported++
+		if imported%importProgress == 0 {
+			log.Printf("import-rdb: %d keys imported", imported)
+		}
+		return nil
+	})
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := store.Sync(); err != nil {
+		return err
+	}
+	log.Printf("import-rdb: %d keys imported from %s in %s, skipped %d expired keys, %d lists and %d keys of other databases",
+		imported, path, time.Since(start).Round(time.Millisecond), expired, lists, otherDB)
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"github.com/qichengzx/raptor/config"
+	"testing"
+)
+
+// testdata/dump.rdb is assembled by hand after the formats of Redis 7.2,
+// holding the compact encodings Redis picks for small objects: an intset,
+// listpacks and ziplists, with keys expiring, one expired, a list and a key
+// of another database.
+func TestImportRDB(t *testing.T) {
+	var conf config.Config
+	conf.Raptor.Directory = t.TempDir()
+	conf.Raptor.Engine = "bolt"
+	conf.Raptor.Auth = "pass"
+
+	// a list stops the import unless skipped
+	if err := ImportRDB(&conf, "testdata/dump.rdb", 0, false); !errors.Is(err, errImportList) {
+		t.Fatalf("import of a file with a list: %v", err)
+	}
+	if err := ImportRDB(&conf, "testdata/dump.rdb", 0, true); err != nil {
+		t.Fatal(err)
+	}
+	app := New(&conf)
+	defer app.Close()
+	c := newTestClient(t, app)
+
+	c.must(":3\r\n", "scard", "intset")
+	c.must(":1\r\n", "sismember", "intset", "-5")
+	c.must(":1\r\n", "sismember", "intset", "300")
+	c.must(":1\r\n", "sismember", "lpset", "7")
+	c.must(":2\r\n", "scard", "lpset")
+	c.must("*6\r\n$2\r\nf1\r\n$2\r\nv1\r\n$2\r\nf2\r\n$2\r\n12\r\n$2\r\nf3\r\n$4\r\n-200\r\n", "hgetall", "zlhash")
+	c.must("$5\r\nhello\r\n", "hget", "lphash", "b")
+	c.must("$1\r\n1\r\n", "hget", "lphash", "a")
+	c.must("$3\r\n2.5\r\n", "zscore", "zlzset", "x")
+	c.must("$1\r\n3\r\n", "zscore", "zlzset", "y")
+	c.must("$4\r\n-1.5\r\n", "zscore", "lpzset", "m")
+	c.must("$4\r\n1000\r\n", "zscore", "lpzset", "n")
+	c.must(":2\r\n", "zcard", "lpzset")
+	c.must("$2\r\n42\r\n", "get", "str")
+
+	// the expiration times are kept, to the second
+	for _, key := range []string{"intset", "lphash"} {
+		at, err := app.db.ExpiresAt([]byte(key))
+		if err != nil || at != 4102444800 {
+			t.Fatalf("%s expires at %d %v", key, at, err)
+		}
+	}
+	c.must(":-1\r\n", "ttl", "zlhash")
+
+	c.must(":0\r\n", "exists", "list")
+	c.must(":0\r\n", "exists", "gone")
+	c.must(":0\r\n", "exists", "other")
+}
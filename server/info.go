@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cmdInfo = "info"
+)
+
+// infoSections are the sections of INFO in the order they are printed, each
+// one returning its fields as "name:value" lines.
+var infoSections = []struct {
+	name   string
+	fields func(app *App) []string
+}{
+	{"server", infoServerFields},
+	{"clients", infoClientsFields},
+	{"persistence", infoPersistenceFields},
+	{"storage", infoStorageFields},
+	{"stats", infoStatsFields},
+	{"replication", infoReplicationFields},
+	{"raft", infoRaftFields},
+	{"cluster", infoClusterFields},
+}
+
+// infoCommandFunc implements INFO [section ...], with every section when
+// none, "default", "all" or "everything" is given.
+func infoCommandFunc(ctx Context) {
+	var wanted = make(map[string]bool)
+	for _, arg := range ctx.args[1:] {
+		wanted[strings.ToLower(string(arg))] = true
+	}
+	var all = len(wanted) == 0 || wanted["default"] || wanted["all"] || wanted["everything"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, field := range section.fields(ctx.app) {
+			b.WriteString(field + "\r\n")
+		}
+	}
+
+	ctx.Conn.WriteBulkString(b.String())
+}
+
+func infoServerFields(app *App) []string {
+	var uptime = int64(time.Since(app.infoServer.uptime).Seconds())
+	return []string{
+		"os:" + app.infoServer.os,
+		fmt.Sprintf("process_id:%d", app.infoServer.processID),
+		fmt.Sprintf("tcp_port:%d", app.infoServer.tcpPort),
+		fmt.Sprintf("uptime_in_seconds:%d", uptime),
+		fmt.Sprintf("uptime_in_days:%d", uptime/86400),
+		"storage_engine:" + storageEngine(app),
+	}
+}
+
+func storageEngine(app *App) string {
+	if app.conf.Raptor.Engine == "" {
+		return storage.DefaultEngine
+	}
+
+	return app.conf.Raptor.Engine
+}
+
+func infoClientsFields(app *App) []string {
+	return []string{
+		fmt.Sprintf("connected_clients:%d", atomic.LoadInt32(&app.infoClients.connections)),
+	}
+}
+
+func infoPersistenceFields(app *App) []string {
+	var s = app.saver
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		status   = "ok"
+		lastTime = int64(-1)
+		curTime  = int64(-1)
+		progress = 0
+	)
+	if s.lastErr != nil {
+		status = "err"
+	}
+	var fsyncStatus = "ok"
+	if app.fsync.lastStatus() != nil {
+		fsyncStatus = "err"
+	}
+	if s.saved {
+		lastTime = int64(s.lastTime.Seconds())
+	}
+	if s.inProgress {
+		progress = 1
+		curTime = int64(time.Since(s.started).Seconds())
+	}
+
+	return []string{
+		"loading:0",
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", progress),
+		fmt.Sprintf("rdb_last_save_time:%d", s.lastSave.Unix()),
+		"rdb_last_bgsave_status:" + status,
+		fmt.Sprintf("rdb_last_bgsave_time_sec:%d", lastTime),
+		fmt.Sprintf("rdb_current_bgsave_time_sec:%d", curTime),
+		"appendfsync:" + app.fsync.getPolicy(),
+		"aof_last_write_status:" + fsyncStatus,
+	}
+}
+
+func infoReplicationFields(app *App) []string {
+	var repl = app.repl
+	repl.mu.Lock()
+	var (
+		link     = repl.link
+		replid   = repl.replid
+		offset   = repl.offset
+		replid2  = repl.replid2
+		second   = repl.secondOffset
+		backlog  = *repl.backlog
+		readOnly = repl.readOnly
+		replicas = append([]*replica(nil), repl.replicas...)
+	)
+	repl.mu.Unlock()
+
+	var fields []string
+	if link == nil {
+		fields = append(fields, "role:master")
+	} else {
+		link.mu.Lock()
+		var (
+			up      = link.state == replStateConnected
+			syncing = link.state == replStateSync
+			lastIO  = int64(-1)
+			status  = "down"
+			sync    = 0
+		)
+		if up {
+			status = "up"
+			lastIO = int64(time.Since(link.lastIO).Seconds())
+		}
+		if syncing {
+			sync = 1
+		}
+		link.mu.Unlock()
+
+		var ro = 0
+		if readOnly {
+			ro = 1
+		}
+		fields = append(fields,
+			"role:slave",
+			"master_host:"+link.host,
+			fmt.Sprintf("master_port:%d", link.port),
+			"master_link_status:"+status,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", sync),
+			fmt.Sprintf("slave_repl_offset:%d", offset),
+			fmt.Sprintf("slave_read_only:%d", ro),
+		)
+	}
+
+	fields = append(fields, fmt.Sprintf("connected_slaves:%d", len(replicas)))
+	for i, r := range replicas {
+		r.mu.Lock()
+		fields = append(fields, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, r.ip, r.port, r.state, r.ackOffset, int64(time.Since(r.ackTime).Seconds())))
+		r.mu.Unlock()
+	}
+
+	return append(fields,
+		"master_replid:"+replid,
+		"master_replid2:"+replid2,
+		fmt.Sprintf("master_repl_offset:%d", offset),
+		fmt.Sprintf("second_repl_offset:%d", second),
+		"repl_backlog_active:1",
+		fmt.Sprintf("repl_backlog_size:%d", len(backlog.buf)),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", backlog.firstOffset()+1),
+		fmt.Sprintf("repl_backlog_histlen:%d", backlog.n),
+	)
+}
+
+func infoStatsFields(app *App) []string {
+	var repl = app.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	return []string{
+		fmt.Sprintf("total_connections_received:%d", atomic.LoadInt32(&app.infoStat.totalConnectionsReceived)),
+		fmt.Sprintf("total_commands_processed:%d", atomic.LoadInt32(&app.infoStat.totalCommandsProcessed)),
+		fmt.Sprintf("coalesced_batches:%d", atomic.LoadInt64(&app.infoStat.coalescedBatches)),
+		fmt.Sprintf("coalesced_commands:%d", atomic.LoadInt64(&app.infoStat.coalescedCommands)),
+		fmt.Sprintf("sync_full:%d", repl.syncFull),
+		fmt.Sprintf("sync_partial_ok:%d", repl.syncPartialOK),
+		fmt.Sprintf("sync_partial_err:%d", repl.syncPartialErr),
+	}
+}
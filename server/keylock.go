@@ -0,0 +1,89 @@
+package server
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+const keyLockShards = 64
+
+// keyLockSkip lists the write commands not taking the locks of their keys:
+// XREADGROUP may block until another command writes to them.
+var keyLockSkip = map[string]bool{
+	cmdXReadGroup: true,
+}
+
+// keyLocks runs the write commands on the same keys one after another, so
+// that a command reading a key and writing it back later, as MIGRATE does
+// across a round trip to another node, loses no write made meanwhile. The
+// keys are spread over shards locked on their own.
+type keyLocks struct {
+	shards [keyLockShards]keyLockShard
+}
+
+type keyLockShard struct {
+	mu   sync.Mutex
+	held map[string]chan struct{}
+}
+
+func newKeyLocks() *keyLocks {
+	l := &keyLocks{}
+	for i := range l.shards {
+		l.shards[i].held = make(map[string]chan struct{})
+	}
+
+	return l
+}
+
+func (l *keyLocks) shard(key string) *keyLockShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l.shards[h.Sum32()%keyLockShards]
+}
+
+// lock waits for keys to be free and takes them, returning what to pass to
+// unlock. The keys are taken in order, so that two commands sharing some
+// keys never wait for each other.
+func (l *keyLocks) lock(keys [][]byte) []string {
+	var names = make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, string(key))
+	}
+	sort.Strings(names)
+
+	var taken = make([]string, 0, len(names))
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		s := l.shard(name)
+		s.mu.Lock()
+		for {
+			done, ok := s.held[name]
+			if !ok {
+				break
+			}
+			s.mu.Unlock()
+			<-done
+			s.mu.Lock()
+		}
+		s.held[name] = make(chan struct{})
+		s.mu.Unlock()
+		taken = append(taken, name)
+	}
+
+	return taken
+}
+
+// unlock frees the keys taken by lock.
+func (l *keyLocks) unlock(keys []string) {
+	for _, name := range keys {
+		s := l.shard(name)
+		s.mu.Lock()
+		done := s.held[name]
+		delete(s.held, name)
+		s.mu.Unlock()
+		close(done)
+	}
+}
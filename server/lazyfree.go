@@ -0,0 +1,136 @@
+package server
+
+import (
+	"github.com/qichengzx/raptor/storage"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// lazyFreeThreshold is the number of members above which an object is
+	// freed in the background, smaller ones are cheaper to delete at once
+	lazyFreeThreshold = 64
+	lazyFreeQueueSize = 1024
+)
+
+// lazyFree deletes the members of large objects in a background worker. The
+// top level key is removed right away, commands naming it wait until the
+// members are gone so that a new object never sees the old ones.
+type lazyFree struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+	jobs    chan lazyFreeJob
+	userDel int32
+}
+
+type lazyFreeJob struct {
+	key      []byte
+	prefixes [][]byte
+	done     chan struct{}
+}
+
+func newLazyFree(userDel bool) *lazyFree {
+	lf := &lazyFree{
+		pending: make(map[string]chan struct{}),
+		jobs:    make(chan lazyFreeJob, lazyFreeQueueSize),
+	}
+	lf.setLazyUserDel(userDel)
+
+	return lf
+}
+
+func (lf *lazyFree) run(db storage.DB) {
+	for job := range lf.jobs {
+		err := typeObjectDeleteMembers(db, job.prefixes)
+		if err != nil {
+			log.Printf("lazyfree: deleting members of %q: %v", job.key, err)
+		}
+		lf.finish(job.key, job.done)
+	}
+}
+
+// free deletes key, its members in the background when there are many.
+func (lf *lazyFree) free(ctx Context, key []byte) (bool, error) {
+	val, objType, err := typeObjectGet(ctx, key)
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// on an overlay, in raft mode or in a batch of writes, every write is
+	// the command's own
+	if typeObjectSize(val) <= lazyFreeThreshold || ctx.db != ctx.app.db {
+		return typeObjectDelete(ctx, key)
+	}
+
+	var job = lazyFreeJob{
+		key:      key,
+		prefixes: typeObjectPrefixes(key, objType),
+		done:     make(chan struct{}),
+	}
+	lf.mu.Lock()
+	lf.pending[string(key)] = job.done
+	lf.mu.Unlock()
+
+	err = ctx.db.Del([][]byte{key})
+	if err != nil {
+		lf.finish(key, job.done)
+		return false, err
+	}
+
+	select {
+	case lf.jobs <- job:
+	default:
+		// the worker is behind, do it now rather than piling up
+		err = typeObjectDeleteMembers(ctx.db, job.prefixes)
+		lf.finish(key, job.done)
+	}
+
+	return true, err
+}
+
+func (lf *lazyFree) finish(key []byte, done chan struct{}) {
+	lf.mu.Lock()
+	if lf.pending[string(key)] == done {
+		delete(lf.pending, string(key))
+	}
+	lf.mu.Unlock()
+	close(done)
+}
+
+// wait blocks until none of args is being freed.
+func (lf *lazyFree) wait(args [][]byte) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if len(lf.pending) == 0 {
+		return
+	}
+	for _, arg := range args {
+		for {
+			done, ok := lf.pending[string(arg)]
+			if !ok {
+				break
+			}
+			lf.mu.Unlock()
+			<-done
+			lf.mu.Lock()
+		}
+	}
+}
+
+// lazyUserDel tells whether DEL behaves like UNLINK.
+func (lf *lazyFree) lazyUserDel() bool {
+	return atomic.LoadInt32(&lf.userDel) == 1
+}
+
+func (lf *lazyFree) setLazyUserDel(lazy bool) {
+	var v int32 = 0
+	if lazy {
+		v = 1
+	}
+	atomic.StoreInt32(&lf.userDel, v)
+}
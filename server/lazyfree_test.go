@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"testing"
+)
+
+// members counts what is left in the store under the prefixes of the
+// object of type objType at key.
+func members(t *testing.T, app *App, key, objType string) int {
+	var cnt = 0
+	for _, prefix := range typeObjectPrefixes([]byte(key), objType) {
+		err := app.db.Scan(storage.ScannerOptions{
+			Prefix:  prefix,
+			Handler: func(k, v []byte) { cnt++ },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cnt
+}
+
+func TestDelCount(t *testing.T) {
+	var c = newTestClient(t, newTestApp(t))
+
+	c.must("+OK\r\n", "mset", "a", "1", "b", "2")
+	c.must("+OK\r\n", "hmset", "h", "f1", "v1", "f2", "v2")
+	// the keys missing, or given twice, are not counted
+	c.must(":3\r\n", "del", "a", "missing", "a", "b", "h")
+	c.must(":0\r\n", "del", "a", "h")
+	c.must(":0\r\n", "unlink", "a")
+}
+
+func TestLazyFree(t *testing.T) {
+	var (
+		app = newTestApp(t)
+		c   = newTestClient(t, app)
+	)
+	go app.lazyfree.run(app.db)
+
+	var fill = func(key string) {
+		var args = []string{"sadd", key}
+		for i := 0; i < lazyFreeThreshold*4; i++ {
+			args = append(args, fmt.Sprintf("m%d", i))
+		}
+		c.must(fmt.Sprintf(":%d\r\n", lazyFreeThreshold*4), args...)
+	}
+
+	// the members of a large object go in the background, a command on
+	// the key waiting for them to be gone
+	fill("s")
+	c.must(":1\r\n", "unlink", "s")
+	c.must(":1\r\n", "sadd", "s", "new")
+	c.must("*1\r\n$3\r\nnew\r\n", "smembers", "s")
+	if n := members(t, app, "s", storage.ObjectSet); n != 1 {
+		t.Fatalf("%d members left after UNLINK", n)
+	}
+
+	// DEL only when lazyfree-lazy-user-del is set
+	fill("d")
+	c.must("+OK\r\n", "config", "set", "lazyfree-lazy-user-del", "yes")
+	c.must(":1\r\n", "del", "d")
+	c.must(":0\r\n", "scard", "d")
+	app.lazyfree.wait([][]byte{[]byte("d")})
+	if n := members(t, app, "d", storage.ObjectSet); n != 0 {
+		t.Fatalf("%d members left after a lazy DEL", n)
+	}
+
+	// a stream takes its consumer groups along
+	c.must("$3\r\n1-1\r\n", "xadd", "x", "1-1", "f", "v")
+	c.must("+OK\r\n", "xgroup", "create", "x", "g", "0")
+	c.must(":1\r\n", "del", "x")
+	app.lazyfree.wait([][]byte{[]byte("x")})
+	if n := members(t, app, "x", storage.ObjectStream); n != 0 {
+		t.Fatalf("%d entries and groups left after DEL", n)
+	}
+}
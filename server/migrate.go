@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"github.com/qichengzx/raptor/rdb"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cmdMigrate = "migrate"
+
+	migrateDefaultTimeout = time.Second
+)
+
+// migrateItem is a key to move, serialized as a DUMP payload.
+type migrateItem struct {
+	key       []byte
+	payload   []byte
+	expiresAt uint64
+}
+
+// migrateCommandFunc implements MIGRATE host port key|"" destination-db
+// timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password]
+// [KEYS key [key ...]]. Each key is restored on the target with RESTORE and
+// is only deleted here once the target acknowledged it, so a failure half
+// way leaves every key on one side or the other. The keys are locked as for
+// any write command, the other writes to them waiting until they are moved.
+func migrateCommandFunc(ctx Context) {
+	if len(ctx.args) < 6 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		keep, replace bool
+		auth          [][]byte
+		keys          = ctx.args[3:4]
+	)
+	for i := 6; i < len(ctx.args); i++ {
+		switch strings.ToLower(string(ctx.args[i])) {
+		case "copy":
+			keep = true
+		case "replace":
+			replace = true
+		case "auth":
+			if i+1 >= len(ctx.args) {
+				ctx.Conn.WriteError(ErrSyntax)
+				return
+			}
+			auth = ctx.args[i+1 : i+2]
+			i++
+		case "auth2":
+			if i+2 >= len(ctx.args) {
+				ctx.Conn.WriteError(ErrSyntax)
+				return
+			}
+			auth = ctx.args[i+1 : i+3]
+			i += 2
+		case "keys":
+			if len(ctx.args[3]) != 0 {
+				ctx.Conn.WriteError(ErrMigrateKeys)
+				return
+			}
+			keys = ctx.args[i+1:]
+			i = len(ctx.args)
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+
+	port, err := strconv.Atoi(string(ctx.args[2]))
+	if err != nil || port <= 0 || port > 65535 {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+	db, err := strconv.Atoi(string(ctx.args[4]))
+	if err != nil || db < 0 {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+	ms, err := strconv.ParseInt(string(ctx.args[5]), 10, 64)
+	if err != nil {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+	var timeout = time.Duration(ms) * time.Millisecond
+	if timeout <= 0 {
+		timeout = migrateDefaultTimeout
+	}
+
+	// the keys that do not exist are skipped
+	var items []migrateItem
+	for _, key := range keys {
+		obj, err := typeObjectLoad(ctx.db, key)
+		if err != nil {
+			if err.Error() == ErrKeyNotExist {
+				continue
+			}
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		at, _ := ctx.db.ExpiresAt(key)
+		items = append(items, migrateItem{key: key, payload: rdb.EncodeDump(obj), expiresAt: at})
+	}
+	if len(items) == 0 {
+		ctx.Conn.WriteString(RespNoKey)
+		return
+	}
+
+	var addr = net.JoinHostPort(string(ctx.args[1]), strconv.Itoa(port))
+	client, err := dialRESP(addr, timeout)
+	if err != nil {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrMigrateIO, "connecting to"))
+		return
+	}
+	defer client.close()
+
+	var setup [][][]byte
+	if auth != nil {
+		setup = append(setup, append([][]byte{[]byte("AUTH")}, auth...))
+	}
+	if db != 0 {
+		setup = append(setup, [][]byte{[]byte("SELECT"), ctx.args[4]})
+	}
+	for _, args := range setup {
+		if _, err := client.do(args...); err != nil {
+			migrateError(ctx, err)
+			return
+		}
+	}
+
+	var moved [][]byte
+	for _, item := range items {
+		if err = migrateRestore(ctx, client, item, replace); err != nil {
+			break
+		}
+		moved = append(moved, item.key)
+	}
+
+	if !keep {
+		for _, key := range moved {
+			if _, err := typeObjectDelete(ctx, key); err != nil {
+				ctx.Conn.WriteError(err.Error())
+				return
+			}
+			ctx.forgetExpire(key)
+			ctx.notify(notifyGeneric, "del", key)
+		}
+	}
+
+	if err != nil {
+		migrateError(ctx, err)
+		return
+	}
+	ctx.Conn.WriteString(RespOK)
+}
+
+// migrateRestore restores item on the target. In cluster mode the target is
+// told the key is asked for, its slot being imported there.
+func migrateRestore(ctx Context, client *respClient, item migrateItem, replace bool) error {
+	if ctx.app.cluster != nil {
+		if _, err := client.do([]byte("ASKING")); err != nil {
+			return err
+		}
+	}
+
+	var args = [][]byte{[]byte("RESTORE"), item.key, []byte("0"), item.payload}
+	if item.expiresAt > 0 {
+		args[2] = []byte(strconv.FormatUint(item.expiresAt*1000, 10))
+		args = append(args, []byte("ABSTTL"))
+	}
+	if replace {
+		args = append(args, []byte("REPLACE"))
+	}
+	_, err := client.do(args...)
+
+	return err
+}
+
+func migrateError(ctx Context, err error) {
+	if e, ok := err.(respError); ok {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrMigrateTarget, string(e)))
+		return
+	}
+	ctx.Conn.WriteError(fmt.Sprintf(ErrMigrateIO, "reading from"))
+}
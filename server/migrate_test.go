@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bufio"
+	"github.com/tidwall/redcon"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	var (
+		src, dst   = newTestApp(t), newTestApp(t)
+		c, d       = newTestClient(t, src), newTestClient(t, dst)
+		host, port = serveTestApp(t, dst)
+		target     = []string{"migrate", host, strconv.Itoa(port)}
+	)
+	var migrate = func(want string, args ...string) {
+		t.Helper()
+		c.must(want, append(append([]string{}, target...), args...)...)
+	}
+
+	c.must("+OK\r\n", "setex", "a", "1000", "1")
+	migrate("-ERR Target instance replied with error: NOAUTH Authentication required\r\n", "a", "0", "1000")
+	c.must(":1\r\n", "exists", "a")
+
+	// the key moves with its TTL
+	migrate("+OK\r\n", "a", "0", "1000", "auth", "pass")
+	c.must(":0\r\n", "exists", "a")
+	d.must("$1\r\n1\r\n", "get", "a")
+	if reply := d.do("ttl", "a"); reply != ":1000\r\n" && reply != ":999\r\n" {
+		t.Fatalf("ttl = %q", reply)
+	}
+	migrate("+NOKEY\r\n", "a", "0", "1000", "auth", "pass")
+
+	// COPY keeps it here, REPLACE overwrites it there
+	c.must("+OK\r\n", "hmset", "h", "f1", "v1", "f2", "v2")
+	migrate("+OK\r\n", "h", "0", "1000", "copy", "auth", "pass")
+	c.must(":2\r\n", "hlen", "h")
+	d.must(":2\r\n", "hlen", "h")
+	c.must(":1\r\n", "hset", "h", "f3", "v3")
+	migrate("-ERR Target instance replied with error: "+ErrBusyKey+"\r\n", "h", "0", "1000", "auth", "pass")
+	c.must(":3\r\n", "hlen", "h")
+	migrate("+OK\r\n", "h", "0", "1000", "replace", "auth", "pass")
+	c.must(":0\r\n", "exists", "h")
+	d.must(":3\r\n", "hlen", "h")
+
+	// with KEYS the keys before a failure are moved, the others stay here
+	c.must("+OK\r\n", "mset", "k1", "1", "k2", "2", "k3", "3")
+	d.must("+OK\r\n", "set", "k2", "there")
+	migrate("-ERR Target instance replied with error: "+ErrBusyKey+"\r\n", "", "0", "1000", "auth", "pass", "keys", "k1", "missing", "k2", "k3")
+	c.must(":0\r\n", "exists", "k1")
+	c.must(":2\r\n", "exists", "k2", "k3")
+	d.must("$1\r\n1\r\n", "get", "k1")
+	d.must("$5\r\nthere\r\n", "get", "k2")
+	d.must(":0\r\n", "exists", "k3")
+	migrate("-"+ErrMigrateKeys+"\r\n", "k2", "0", "1000", "keys", "k3")
+
+	// a target that is gone leaves the keys here
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	c.must("-IOERR error or timeout connecting to target instance\r\n",
+		"migrate", "127.0.0.1", strconv.Itoa(ln.Addr().(*net.TCPAddr).Port), "k2", "0", "1000")
+	c.must(":1\r\n", "exists", "k2")
+}
+
+// slowTarget serves RESTORE, telling restoring when one arrives and
+// replying once released.
+func slowTarget(t *testing.T, restoring, release chan struct{}) (string, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		var rd = redcon.NewReader(bufio.NewReader(nc))
+		for {
+			cmd, err := rd.ReadCommand()
+			if err != nil {
+				return
+			}
+			if string(cmd.Args[0]) == "RESTORE" {
+				restoring <- struct{}{}
+				<-release
+			}
+			nc.Write([]byte("+OK\r\n"))
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestMigrateConcurrentWrite(t *testing.T) {
+	var (
+		app        = newTestApp(t)
+		c, other   = newTestClient(t, app), newTestClient(t, app)
+		restoring  = make(chan struct{})
+		release    = make(chan struct{})
+		host, port = slowTarget(t, restoring, release)
+		migrated   = make(chan string)
+		written    = make(chan string)
+	)
+	c.must("+OK\r\n", "set", "n", "5")
+
+	go func() { migrated <- c.do("migrate", host, strconv.Itoa(port), "n", "0", "5000") }()
+	<-restoring
+
+	// a write to the key waits for it to be moved, not to be lost with it
+	go func() { written <- other.do("incr", "n") }()
+	select {
+	case reply := <-written:
+		t.Fatalf("INCR during MIGRATE replied %q", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	if reply := <-migrated; reply != "+OK\r\n" {
+		t.Fatalf("MIGRATE = %q", reply)
+	}
+	if reply := <-written; reply != ":1\r\n" {
+		t.Fatalf("INCR = %q", reply)
+	}
+	c.must("$1\r\n1\r\n", "get", "n")
+}
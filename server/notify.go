@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// keyspace notification classes, see notify-keyspace-events
+const (
+	notifyKeyspace = 1 << iota
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyList
+	notifySet
+	notifyHash
+	notifyZSet
+	notifyExpired
+	notifyEvicted
+	notifyStream
+	notifyKeyMiss
+	notifyNew
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZSet | notifyExpired | notifyEvicted | notifyStream
+)
+
+const (
+	notifyKeyspacePrefix = "__keyspace@0__:"
+	notifyKeyeventPrefix = "__keyevent@0__:"
+)
+
+var notifyFlagChars = []struct {
+	flag int
+	char byte
+}{
+	{notifyGeneric, 'g'},
+	{notifyString, '$'},
+	{notifyList, 'l'},
+	{notifySet, 's'},
+	{notifyHash, 'h'},
+	{notifyZSet, 'z'},
+	{notifyExpired, 'x'},
+	{notifyEvicted, 'e'},
+	{notifyStream, 't'},
+	{notifyKeyMiss, 'm'},
+	{notifyNew, 'n'},
+	{notifyKeyspace, 'K'},
+	{notifyKeyevent, 'E'},
+}
+
+var errNotifyFlags = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmn'.")
+
+// parseNotifyFlags parses a notify-keyspace-events string such as "KEA".
+func parseNotifyFlags(s string) (int, error) {
+	var flags = 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+
+		var found = false
+		for _, c := range notifyFlagChars {
+			if c.char == s[i] {
+				flags |= c.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errNotifyFlags
+		}
+	}
+
+	return flags, nil
+}
+
+func notifyFlagsString(flags int) string {
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	}
+	for _, c := range notifyFlagChars {
+		if flags&notifyAll == notifyAll && c.flag&notifyAll != 0 {
+			continue
+		}
+		if flags&c.flag != 0 {
+			b.WriteByte(c.char)
+		}
+	}
+
+	return b.String()
+}
+
+// notify publishes a keyspace and/or keyevent message for key when class is
+// enabled, events are only delivered once at least one of K or E is set.
+func (app *App) notify(class int, event string, key []byte) {
+	flags := app.getNotifyFlags()
+	if flags&class == 0 {
+		return
+	}
+
+	if flags&notifyKeyspace != 0 {
+		channel := append([]byte(notifyKeyspacePrefix), key...)
+		app.pubsub.publish(channel, []byte(event))
+	}
+	if flags&notifyKeyevent != 0 {
+		channel := []byte(notifyKeyeventPrefix + event)
+		app.pubsub.publish(channel, key)
+	}
+}
+
+func (app *App) notifyEnabled(class int) bool {
+	return notifyFlagsEnabled(app.getNotifyFlags(), class)
+}
+
+func notifyFlagsEnabled(flags, class int) bool {
+	return flags&class != 0 && flags&(notifyKeyspace|notifyKeyevent) != 0
+}
+
+func (app *App) getNotifyFlags() int {
+	return int(atomic.LoadInt32(&app.notifyFlags))
+}
+
+// setNotifyFlags changes the events notified, the keys with a TTL being
+// tracked only while the expired ones are.
+func (app *App) setNotifyFlags(flags int) {
+	old := int(atomic.SwapInt32(&app.notifyFlags, int32(flags)))
+
+	switch was, now := notifyFlagsEnabled(old, notifyExpired), notifyFlagsEnabled(flags, notifyExpired); {
+	case now && !was:
+		go app.seedExpires()
+	case was && !now:
+		app.expires.reset()
+	}
+}
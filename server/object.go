@@ -0,0 +1,554 @@
+package server
+
+import (
+	"bytes"
+	"github.com/qichengzx/raptor/storage"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	typeObjectKeySize = 4
+
+	// typeObjectBatchSize bounds the number of members written or deleted
+	// at once
+	typeObjectBatchSize = 1024
+)
+
+// typeObjectPrefixes returns the prefixes of the keys holding the members of
+// the object stored at key, the top level key itself excluded.
+func typeObjectPrefixes(key []byte, objType string) [][]byte {
+	var tags [][]byte
+	switch objType {
+	case storage.ObjectHash:
+		tags = [][]byte{typeHash}
+	case storage.ObjectSet:
+		tags = [][]byte{typeSet}
+	case storage.ObjectZset:
+		tags = [][]byte{typeZSet, typeZSetScore}
+	case storage.ObjectStream:
+		tags = [][]byte{typeStream, typeStreamGroup}
+	}
+
+	var prefixes [][]byte
+	for _, tag := range tags {
+		prefixBuff := bytes.NewBuffer([]byte{})
+		prefixBuff.Write(tag)
+		prefixBuff.Write(uint32ToBytes(typeObjectKeySize, uint32(len(key))))
+		prefixBuff.Write(key)
+		prefixes = append(prefixes, prefixBuff.Bytes())
+	}
+
+	return prefixes
+}
+
+// typeObjectOwner returns the top level key and the type of the object a key
+// holding a member would belong to, if k is shaped like one.
+func typeObjectOwner(k []byte) ([]byte, string, bool) {
+	if len(k) < 1+typeObjectKeySize {
+		return nil, "", false
+	}
+
+	var objType string
+	switch string(k[:1]) {
+	case string(typeHash):
+		objType = storage.ObjectHash
+	case string(typeSet):
+		objType = storage.ObjectSet
+	case string(typeZSet), string(typeZSetScore):
+		objType = storage.ObjectZset
+	case string(typeStream), string(typeStreamGroup):
+		objType = storage.ObjectStream
+	default:
+		return nil, "", false
+	}
+
+	size := int(bytesToUint32(k[1 : 1+typeObjectKeySize]))
+	if 1+typeObjectKeySize+size > len(k) {
+		return nil, "", false
+	}
+
+	return k[1+typeObjectKeySize : 1+typeObjectKeySize+size], objType, true
+}
+
+// typeObjectScanKeys calls fn with the top level keys of snap in order, the
+// keys holding members of objects skipped.
+func typeObjectScanKeys(snap storage.Reader, fn func(k []byte)) error {
+	// members of an object are contiguous, remember the last owner
+	var (
+		lastOwner  []byte
+		lastMember bool
+	)
+	isMember := func(k []byte) bool {
+		owner, objType, ok := typeObjectOwner(k)
+		if !ok {
+			return false
+		}
+		if lastOwner != nil && string(owner) == string(lastOwner) {
+			return lastMember
+		}
+		val, err := snap.Get(owner)
+		lastOwner = owner
+		lastMember = err == nil && len(val) > 0 && string(val[:1]) == objType
+		return lastMember
+	}
+
+	return snap.Scan(storage.ScannerOptions{
+		Handler: func(k, v []byte) {
+			if !isMember(k) {
+				fn(k)
+			}
+		},
+	})
+}
+
+// typeObjectGet returns the top level value of key and the type of the
+// object.
+func typeObjectGet(ctx Context, key []byte) ([]byte, string, error) {
+	val, err := ctx.db.Get(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(val) == 0 {
+		return val, storage.ObjectString, nil
+	}
+
+	return val, string(val[:1]), nil
+}
+
+// typeObjectCopy copies the object stored at src to dst, members and TTL
+// included. dst is expected not to hold an object.
+func typeObjectCopy(ctx Context, src, dst []byte) error {
+	val, objType, err := typeObjectGet(ctx, src)
+	if err != nil {
+		return err
+	}
+	ttl, _ := ctx.db.TTL(src)
+
+	var w = &objectWriter{db: ctx.db}
+	dstPrefixes := typeObjectPrefixes(dst, objType)
+	for i, prefix := range typeObjectPrefixes(src, objType) {
+		var (
+			srcPrefix = prefix
+			dstPrefix = dstPrefixes[i]
+		)
+		ctx.db.Scan(storage.ScannerOptions{
+			Prefix:      srcPrefix,
+			FetchValues: true,
+			Handler: func(k, v []byte) {
+				w.set(append(append([]byte{}, dstPrefix...), k[len(srcPrefix):]...), v)
+			},
+		})
+	}
+	if err = w.flush(); err != nil {
+		return err
+	}
+
+	err = ctx.db.Set(dst, val, 0)
+	if err == nil && ttl > 0 {
+		err = ctx.db.Expire(dst, int(ttl))
+		ctx.watchExpire(dst, int(ttl))
+	}
+
+	return err
+}
+
+// typeObjectMove moves the object stored at src to dst, members and
+// expiration included, replacing the object dst holds. Unlike a copy
+// followed by a deletion the move is a single batch, so that no other
+// client sees both objects or neither, at the cost of holding the keys of
+// both objects in memory at once. The badger engine still commits a batch
+// too large for one transaction in several.
+func typeObjectMove(ctx Context, src, dst []byte) error {
+	val, objType, err := typeObjectGet(ctx, src)
+	if err != nil {
+		return err
+	}
+	at, err := ctx.db.ExpiresAt(src)
+	if err != nil {
+		return err
+	}
+
+	// the members of dst not overwritten go, each key being written once
+	var stale = make(map[string]bool)
+	if _, dstType, err := typeObjectGet(ctx, dst); err == nil {
+		for _, prefix := range typeObjectPrefixes(dst, dstType) {
+			ctx.db.Scan(storage.ScannerOptions{
+				Prefix: prefix,
+				Handler: func(k, v []byte) {
+					stale[string(k)] = true
+				},
+			})
+		}
+	}
+
+	var entries []storage.Entry
+	dstPrefixes := typeObjectPrefixes(dst, objType)
+	for i, prefix := range typeObjectPrefixes(src, objType) {
+		var (
+			srcPrefix = prefix
+			dstPrefix = dstPrefixes[i]
+		)
+		ctx.db.Scan(storage.ScannerOptions{
+			Prefix:      srcPrefix,
+			FetchValues: true,
+			Handler: func(k, v []byte) {
+				member := append(append([]byte{}, dstPrefix...), k[len(srcPrefix):]...)
+				delete(stale, string(member))
+				entries = append(entries,
+					storage.Entry{Key: member, Value: v},
+					storage.Entry{Key: append([]byte{}, k...), Delete: true})
+			},
+		})
+	}
+	for k := range stale {
+		entries = append(entries, storage.Entry{Key: []byte(k), Delete: true})
+	}
+	entries = append(entries,
+		storage.Entry{Key: dst, Value: val, ExpiresAt: at},
+		storage.Entry{Key: src, Delete: true})
+	if err = ctx.db.WriteBatch(entries); err != nil {
+		return err
+	}
+
+	ctx.forgetExpire(dst)
+	if at > 0 {
+		ctx.watchExpire(dst, int(int64(at)-time.Now().Unix()))
+	}
+
+	return nil
+}
+
+// objectWriter writes the members of objects in batches of
+// typeObjectBatchSize keys.
+type objectWriter struct {
+	db           storage.DB
+	keys, values [][]byte
+	ttls         []int
+	err          error
+}
+
+func (w *objectWriter) set(key, value []byte) {
+	w.setTTL(key, value, 0)
+}
+
+// setTTL buffers a key expiring after seconds, zero for none.
+func (w *objectWriter) setTTL(key, value []byte, seconds int) {
+	w.keys = append(w.keys, key)
+	w.values = append(w.values, value)
+	w.ttls = append(w.ttls, seconds)
+	if len(w.keys) >= typeObjectBatchSize {
+		w.flush()
+	}
+}
+
+// flush writes the pending keys and returns the first error met.
+func (w *objectWriter) flush() error {
+	if len(w.keys) > 0 && w.err == nil {
+		w.err = w.db.MSetTTL(w.keys, w.values, w.ttls)
+	}
+	w.keys, w.values, w.ttls = nil, nil, nil
+
+	return w.err
+}
+
+// typeObjectDelete deletes the object stored at key with all its members,
+// returning whether it existed. Members go first so that an interrupted
+// deletion is completed by deleting the key again.
+func typeObjectDelete(ctx Context, key []byte) (bool, error) {
+	_, objType, err := typeObjectGet(ctx, key)
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			return false, nil
+		}
+		return false, err
+	}
+
+	err = typeObjectDeleteMembers(ctx.db, typeObjectPrefixes(key, objType))
+	if err != nil {
+		return true, err
+	}
+
+	return true, ctx.db.Del([][]byte{key})
+}
+
+// typeObjectDeleteMembers deletes every key under prefixes, in batches of
+// typeObjectBatchSize keys so that neither the memory used nor the size of
+// a transaction depends on the size of the object.
+func typeObjectDeleteMembers(db storage.DB, prefixes [][]byte) error {
+	var (
+		keys   [][]byte
+		delErr error
+	)
+	for _, prefix := range prefixes {
+		db.Scan(storage.ScannerOptions{
+			Prefix:      prefix,
+			FetchValues: false,
+			Handler: func(k, v []byte) {
+				keys = append(keys, k)
+				if len(keys) >= typeObjectBatchSize {
+					if delErr == nil {
+						delErr = db.Del(keys)
+					}
+					keys = nil
+				}
+			},
+		})
+	}
+	if len(keys) > 0 && delErr == nil {
+		delErr = db.Del(keys)
+	}
+
+	return delErr
+}
+
+// typeObjectSize returns the number of members of an object from its top
+// level value.
+func typeObjectSize(val []byte) int {
+	switch string(val[:1]) {
+	case storage.ObjectHash, storage.ObjectSet, storage.ObjectZset, storage.ObjectStream:
+		if len(val) >= 5 {
+			return int(bytesToUint32(val[1:5]))
+		}
+	}
+
+	return 1
+}
+
+// typeObjectEncoding mimics the encodings Redis would pick for the object,
+// using its default thresholds.
+func typeObjectEncoding(ctx Context, key, val []byte) string {
+	const (
+		maxEntries   = 128
+		maxValue     = 64
+		maxIntset    = 512
+		maxEmbstrLen = 44
+	)
+
+	var objType = string(val[:1])
+	switch objType {
+	case storage.ObjectString:
+		v := val[1:]
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(v) {
+			return "int"
+		}
+		if len(v) <= maxEmbstrLen {
+			return "embstr"
+		}
+		return "raw"
+	case storage.ObjectStream:
+		return "stream"
+	}
+
+	var size = int(bytesToUint32(val[1:5]))
+	if size > maxIntset || (size > maxEntries && objType != storage.ObjectSet) {
+		switch objType {
+		case storage.ObjectZset:
+			return "skiplist"
+		}
+		return "hashtable"
+	}
+
+	// small objects, look at their members
+	var (
+		prefix = typeObjectPrefixes(key, objType)[0]
+		ints   = objType == storage.ObjectSet
+		small  = size <= maxEntries
+	)
+	ctx.db.Scan(storage.ScannerOptions{
+		Prefix:      prefix,
+		FetchValues: objType == storage.ObjectHash,
+		Handler: func(k, v []byte) {
+			member := k[len(prefix):]
+			if len(member) > maxValue || len(v) > maxValue {
+				small = false
+			}
+			if ints {
+				if _, err := strconv.ParseInt(string(member), 10, 64); err != nil {
+					ints = false
+				}
+			}
+		},
+	})
+
+	switch {
+	case ints:
+		return "intset"
+	case small:
+		return "listpack"
+	case objType == storage.ObjectZset:
+		return "skiplist"
+	}
+
+	return "hashtable"
+}
+
+// accessTracker remembers when keys were last accessed and how often, for
+// OBJECT IDLETIME and OBJECT FREQ. It only lives in memory and forgets
+// random keys once it is full. The keys are spread over shards locked on
+// their own, so that commands on different keys do not wait for each other.
+type accessTracker struct {
+	shards [accessShards]accessShard
+	start  time.Time
+}
+
+type accessShard struct {
+	mu   sync.Mutex
+	keys map[string]accessInfo
+}
+
+type accessInfo struct {
+	last time.Time
+	freq uint8
+}
+
+const (
+	accessTrackerMax = 1 << 20
+	accessShards     = 64
+
+	// the logarithmic access counter of Redis: new keys start at 5, the
+	// counter gets harder to increment as it grows and decays by one every
+	// minute without access
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+// accessNoTouch lists the commands whose keys are not accessed by running
+// them: OBJECT reads the access info and TOUCH accesses the existing keys
+// itself.
+var accessNoTouch = map[string]bool{
+	cmdObject: true,
+	cmdTouch:  true,
+}
+
+func newAccessTracker() *accessTracker {
+	t := &accessTracker{start: time.Now()}
+	for i := range t.shards {
+		t.shards[i].keys = make(map[string]accessInfo)
+	}
+
+	return t
+}
+
+func (t *accessTracker) shard(key []byte) *accessShard {
+	h := fnv.New32a()
+	h.Write(key)
+	return &t.shards[h.Sum32()%accessShards]
+}
+
+// touchKeys accesses the keys named by cmd, as given by commandKeys.
+func (t *accessTracker) touchKeys(cmd string, args [][]byte) {
+	if accessNoTouch[cmd] {
+		return
+	}
+
+	for _, key := range commandKeys(cmd, args) {
+		t.touch(key)
+	}
+}
+
+func (t *accessTracker) touch(key []byte) {
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var now = time.Now()
+	info, ok := s.keys[string(key)]
+	if !ok {
+		if len(s.keys) >= accessTrackerMax/accessShards {
+			for k := range s.keys {
+				delete(s.keys, k)
+				break
+			}
+		}
+		info.freq = lfuInitVal
+	} else {
+		info.freq = lfuDecay(info, now)
+	}
+
+	if info.freq < 255 {
+		base := float64(0)
+		if info.freq > lfuInitVal {
+			base = float64(info.freq - lfuInitVal)
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			info.freq++
+		}
+	}
+	info.last = now
+	s.keys[string(key)] = info
+}
+
+// get returns the idle time of key, counted from the server start for keys
+// not tracked, and its access counter.
+func (t *accessTracker) get(key []byte) (time.Duration, uint8) {
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var now = time.Now()
+	info, ok := s.keys[string(key)]
+	if !ok {
+		return now.Sub(t.start), 0
+	}
+
+	return now.Sub(info.last), lfuDecay(info, now)
+}
+
+// set overrides the idle time and the access counter of key, as RESTORE
+// does with IDLETIME and FREQ.
+func (t *accessTracker) set(key []byte, idle time.Duration, freq uint8) {
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[string(key)] = accessInfo{last: time.Now().Add(-idle), freq: freq}
+}
+
+// forget drops key, once deleted.
+func (t *accessTracker) forget(key []byte) {
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, string(key))
+}
+
+// move hands the access info of key over to newkey, as RENAME keeps the
+// object.
+func (t *accessTracker) move(key, newkey []byte) {
+	s := t.shard(key)
+	s.mu.Lock()
+	info, ok := s.keys[string(key)]
+	delete(s.keys, string(key))
+	s.mu.Unlock()
+
+	if !ok {
+		t.forget(newkey)
+		return
+	}
+	t.set(newkey, time.Since(info.last), info.freq)
+}
+
+// reset forgets every key, once the store is flushed.
+func (t *accessTracker) reset() {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		s.keys = make(map[string]accessInfo)
+		s.mu.Unlock()
+	}
+}
+
+func lfuDecay(info accessInfo, now time.Time) uint8 {
+	periods := int(now.Sub(info.last) / lfuDecayTime)
+	if periods >= int(info.freq) {
+		return 0
+	}
+
+	return info.freq - uint8(periods)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func (t *accessTracker) tracked(key string) bool {
+	s := t.shard([]byte(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.keys[key]
+	return ok
+}
+
+func TestAccessTracker(t *testing.T) {
+	var (
+		app = newTestApp(t)
+		c   = newTestClient(t, app)
+	)
+
+	// OBJECT reads the access info without changing it
+	c.must("+OK\r\n", "set", "a", "1")
+	app.access.set([]byte("a"), 10*time.Second, 20)
+	c.must(":10\r\n", "object", "idletime", "a")
+	c.must(":20\r\n", "object", "freq", "a")
+	c.must(":10\r\n", "object", "idletime", "a")
+
+	// RENAME keeps the object, accessing it
+	c.must("+OK\r\n", "rename", "a", "b")
+	if idle, freq := app.access.get([]byte("b")); idle > time.Second || freq < 20 {
+		t.Fatalf("renamed key idle %v freq %d", idle, freq)
+	}
+	if app.access.tracked("a") {
+		t.Fatal("the renamed key is still tracked")
+	}
+
+	// COPY makes a new object
+	c.must(":1\r\n", "copy", "b", "c")
+	c.must(":5\r\n", "object", "freq", "c")
+	if _, freq := app.access.get([]byte("b")); freq < 20 {
+		t.Fatalf("copied key freq %d", freq)
+	}
+
+	c.must(":1\r\n", "unlink", "b")
+	c.must(":1\r\n", "del", "c")
+	c.must("+OK\r\n", "set", "g", "1")
+	c.must("$1\r\n1\r\n", "getdel", "g")
+	for _, key := range []string{"b", "c", "g"} {
+		if app.access.tracked(key) {
+			t.Fatalf("the deleted key %s is still tracked", key)
+		}
+	}
+
+	// every key of a command is accessed, none for the keyless ones
+	c.must("*2\r\n$-1\r\n$-1\r\n", "mget", "m1", "m2")
+	c.must(":0\r\n", "touch", "t1")
+	c.must("+hello\r\n", "echo", "hello")
+	c.do("config", "get", "appendfsync")
+	for key, want := range map[string]bool{"m1": true, "m2": true, "t1": false, "hello": false, "get": false} {
+		if app.access.tracked(key) != want {
+			t.Errorf("tracked(%s) = %v", key, !want)
+		}
+	}
+
+	c.must("+OK\r\n", "flushall")
+	if app.access.tracked("m1") {
+		t.Fatal("tracked a key after FLUSHALL")
+	}
+}
+
+func TestAccessTrackerConcurrent(t *testing.T) {
+	var (
+		tracker = newAccessTracker()
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := []byte{byte(i), byte(j)}
+				tracker.touch(key)
+				tracker.get(key)
+				tracker.move(key, []byte{byte(i), byte(j), 0})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, freq := tracker.get([]byte{3, 7, 0}); freq < lfuInitVal {
+		t.Fatalf("moved key freq %d", freq)
+	}
+}
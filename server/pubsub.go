@@ -0,0 +1,424 @@
+package server
+
+import (
+	"fmt"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	cmdSubscribe    = "subscribe"
+	cmdPSubscribe   = "psubscribe"
+	cmdUnsubscribe  = "unsubscribe"
+	cmdPUnsubscribe = "punsubscribe"
+	cmdPublish      = "publish"
+	cmdPubSub       = "pubsub"
+)
+
+const (
+	defaultPubSubLimit = 1024
+)
+
+// pubSub is the registry of channel and pattern subscriptions.
+type pubSub struct {
+	mu       sync.RWMutex
+	limit    int
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+// subscriber is a client connection detached from redcon once it has
+// entered the subscribed state. Every reply and message goes through queue,
+// which holds at most limit frames; a subscriber that can not keep up is
+// disconnected instead of blocking the publishers.
+type subscriber struct {
+	conn     redcon.DetachedConn
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	queue    chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newPubSub(limit int) *pubSub {
+	if limit <= 0 {
+		limit = defaultPubSubLimit
+	}
+
+	return &pubSub{
+		limit:    limit,
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+func subscribeCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	ctx.app.pubsub.attach(ctx.Conn, ctx.cmd == cmdPSubscribe, ctx.args[1:])
+}
+
+func unsubscribeCommandFunc(ctx Context) {
+	var channels = ctx.args[1:]
+	if len(channels) == 0 {
+		channels = [][]byte{nil}
+	}
+
+	for _, channel := range channels {
+		ctx.Conn.WriteArray(3)
+		ctx.Conn.WriteBulkString(ctx.cmd)
+		if channel == nil {
+			ctx.Conn.WriteNull()
+		} else {
+			ctx.Conn.WriteBulk(channel)
+		}
+		ctx.Conn.WriteInt(0)
+	}
+}
+
+func publishCommandFunc(ctx Context) {
+	if len(ctx.args) != 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	ctx.Conn.WriteInt(ctx.app.pubsub.publish(ctx.args[1], ctx.args[2]))
+}
+
+func pubsubCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var ps = ctx.app.pubsub
+	switch strings.ToLower(string(ctx.args[1])) {
+	case "channels":
+		if len(ctx.args) > 3 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+			return
+		}
+
+		var pattern = "*"
+		if len(ctx.args) == 3 {
+			pattern = string(ctx.args[2])
+		}
+
+		channels := ps.channelNames(pattern)
+		ctx.Conn.WriteArray(len(channels))
+		for _, channel := range channels {
+			ctx.Conn.WriteBulkString(channel)
+		}
+	case "numsub":
+		ctx.Conn.WriteArray(len(ctx.args[2:]) * 2)
+		for _, channel := range ctx.args[2:] {
+			ctx.Conn.WriteBulk(channel)
+			ctx.Conn.WriteInt(ps.numSub(string(channel)))
+		}
+	case "numpat":
+		if len(ctx.args) != 2 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+			return
+		}
+
+		ctx.Conn.WriteInt(ps.numPat())
+	default:
+		ctx.Conn.WriteError(fmt.Sprintf(ErrSubCmd, ctx.args[1]))
+	}
+}
+
+// attach detaches conn from the server loop, subscribes it and starts
+// serving it in the background.
+func (ps *pubSub) attach(conn redcon.Conn, pattern bool, names [][]byte) {
+	s := &subscriber{
+		conn:     conn.Detach(),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		queue:    make(chan []byte, ps.limit),
+		done:     make(chan struct{}),
+	}
+
+	go s.writeLoop()
+	ps.subscribe(s, pattern, names)
+	go ps.serve(s)
+}
+
+// serve reads the commands a subscriber is allowed to send until the
+// connection is closed.
+func (ps *pubSub) serve(s *subscriber) {
+	defer ps.remove(s)
+
+	for {
+		cmd, err := s.conn.ReadCommand()
+		if err != nil {
+			s.close()
+			return
+		}
+		if len(cmd.Args) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(string(cmd.Args[0]))
+		switch name {
+		case cmdSubscribe, cmdPSubscribe:
+			if len(cmd.Args) < 2 {
+				s.reply(redcon.AppendError(nil, fmt.Sprintf(ErrWrongArgs, name)))
+				continue
+			}
+			ps.subscribe(s, name == cmdPSubscribe, cmd.Args[1:])
+		case cmdUnsubscribe, cmdPUnsubscribe:
+			ps.unsubscribe(s, name == cmdPUnsubscribe, cmd.Args[1:])
+		case cmdPing:
+			var frame = redcon.AppendArray(nil, 2)
+			frame = redcon.AppendBulkString(frame, "pong")
+			if len(cmd.Args) > 1 {
+				frame = redcon.AppendBulk(frame, cmd.Args[1])
+			} else {
+				frame = redcon.AppendBulkString(frame, "")
+			}
+			s.reply(frame)
+		case "quit":
+			s.reply(redcon.AppendOK(nil))
+			s.reply(nil)
+			return
+		default:
+			s.reply(redcon.AppendError(nil, fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", name)))
+		}
+	}
+}
+
+func (ps *pubSub) subscribe(s *subscriber, pattern bool, names [][]byte) {
+	var (
+		kind   = cmdSubscribe
+		frames [][]byte
+	)
+	if pattern {
+		kind = cmdPSubscribe
+	}
+
+	ps.mu.Lock()
+	for _, name := range names {
+		registry, subscribed := ps.channels, s.channels
+		if pattern {
+			registry, subscribed = ps.patterns, s.patterns
+		}
+
+		if registry[string(name)] == nil {
+			registry[string(name)] = make(map[*subscriber]struct{})
+		}
+		registry[string(name)][s] = struct{}{}
+		subscribed[string(name)] = struct{}{}
+
+		frames = append(frames, subscriptionFrame(kind, name, s.count()))
+	}
+	ps.mu.Unlock()
+
+	for _, frame := range frames {
+		s.reply(frame)
+	}
+}
+
+func (ps *pubSub) unsubscribe(s *subscriber, pattern bool, names [][]byte) {
+	var (
+		kind   = cmdUnsubscribe
+		frames [][]byte
+	)
+	if pattern {
+		kind = cmdPUnsubscribe
+	}
+
+	ps.mu.Lock()
+	registry, subscribed := ps.channels, s.channels
+	if pattern {
+		registry, subscribed = ps.patterns, s.patterns
+	}
+
+	if len(names) == 0 {
+		for name := range subscribed {
+			names = append(names, []byte(name))
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return string(names[i]) < string(names[j])
+		})
+	}
+	if len(names) == 0 {
+		frames = append(frames, subscriptionFrame(kind, nil, s.count()))
+	}
+
+	for _, name := range names {
+		delete(subscribed, string(name))
+		if subs, ok := registry[string(name)]; ok {
+			delete(subs, s)
+			if len(subs) == 0 {
+				delete(registry, string(name))
+			}
+		}
+
+		frames = append(frames, subscriptionFrame(kind, name, s.count()))
+	}
+	ps.mu.Unlock()
+
+	for _, frame := range frames {
+		s.reply(frame)
+	}
+}
+
+// remove drops every subscription held by s.
+func (ps *pubSub) remove(s *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for name := range s.channels {
+		delete(ps.channels[name], s)
+		if len(ps.channels[name]) == 0 {
+			delete(ps.channels, name)
+		}
+	}
+	for name := range s.patterns {
+		delete(ps.patterns[name], s)
+		if len(ps.patterns[name]) == 0 {
+			delete(ps.patterns, name)
+		}
+	}
+}
+
+// publish sends message to every subscriber of channel and to every pattern
+// subscriber matching it, returning the number of receivers.
+func (ps *pubSub) publish(channel, message []byte) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var cnt = 0
+	if subs, ok := ps.channels[string(channel)]; ok {
+		frame := redcon.AppendArray(nil, 3)
+		frame = redcon.AppendBulkString(frame, "message")
+		frame = redcon.AppendBulk(frame, channel)
+		frame = redcon.AppendBulk(frame, message)
+		for s := range subs {
+			s.send(frame)
+			cnt++
+		}
+	}
+
+	for pattern, subs := range ps.patterns {
+		if !match.Match(string(channel), pattern) {
+			continue
+		}
+
+		frame := redcon.AppendArray(nil, 4)
+		frame = redcon.AppendBulkString(frame, "pmessage")
+		frame = redcon.AppendBulkString(frame, pattern)
+		frame = redcon.AppendBulk(frame, channel)
+		frame = redcon.AppendBulk(frame, message)
+		for s := range subs {
+			s.send(frame)
+			cnt++
+		}
+	}
+
+	return cnt
+}
+
+func (ps *pubSub) channelNames(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var names []string
+	for name := range ps.channels {
+		if match.Match(name, pattern) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (ps *pubSub) numSub(channel string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.channels[channel])
+}
+
+func (ps *pubSub) numPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.patterns)
+}
+
+// count return the number of channels and patterns s is subscribed to,
+// the caller must hold the registry lock.
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// send queues a published message, dropping the subscriber when its
+// queue is full.
+func (s *subscriber) send(frame []byte) {
+	select {
+	case s.queue <- frame:
+	default:
+		log.Printf("pubsub: closing slow subscriber %s, %d messages pending", s.conn.RemoteAddr(), len(s.queue))
+		s.close()
+	}
+}
+
+// reply queues a command reply, a nil frame closes the connection once
+// everything before it has been written.
+func (s *subscriber) reply(frame []byte) {
+	select {
+	case s.queue <- frame:
+	case <-s.done:
+	}
+}
+
+func (s *subscriber) writeLoop() {
+	for {
+		select {
+		case frame := <-s.queue:
+			for frame != nil {
+				s.conn.WriteRaw(frame)
+				if len(s.queue) == 0 {
+					break
+				}
+				frame = <-s.queue
+			}
+
+			err := s.conn.Flush()
+			if err != nil || frame == nil {
+				s.close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *subscriber) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.NetConn().Close()
+	})
+}
+
+func subscriptionFrame(kind string, name []byte, count int) []byte {
+	frame := redcon.AppendArray(nil, 3)
+	frame = redcon.AppendBulkString(frame, kind)
+	if name == nil {
+		frame = redcon.AppendNull(frame)
+	} else {
+		frame = redcon.AppendBulk(frame, name)
+	}
+
+	return redcon.AppendInt(frame, int64(count))
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rawConn talks RESP to an app served over TCP.
+type rawConn struct {
+	t  *testing.T
+	nc net.Conn
+	rd *bufio.Reader
+}
+
+func dialTestApp(t *testing.T, app *App) *rawConn {
+	host, port := serveTestApp(t, app)
+	nc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+
+	c := &rawConn{t: t, nc: nc, rd: bufio.NewReader(nc)}
+	c.send("auth", "pass")
+	c.expect("+OK\r\n")
+	return c
+}
+
+func (c *rawConn) send(args ...string) {
+	var bargs = make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	if _, err := c.nc.Write(encodeCommand(bargs)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads what the server sends next, failing the test unless it is
+// want.
+func (c *rawConn) expect(want string) {
+	c.t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got = make([]byte, len(want))
+	if _, err := io.ReadFull(c.rd, got); err != nil || string(got) != want {
+		c.t.Fatalf("read %q %v, want %q", got, err, want)
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	var (
+		app = newTestApp(t)
+		sub = dialTestApp(t, app)
+		c   = newTestClient(t, app)
+	)
+
+	sub.send("subscribe", "news", "sport")
+	sub.expect("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	sub.expect("*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n")
+	sub.send("psubscribe", "n*")
+	sub.expect("*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n")
+
+	// a message goes to the channel and to every pattern matching it
+	c.must(":2\r\n", "publish", "news", "hello")
+	sub.expect("*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+	sub.expect("*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+	c.must(":0\r\n", "publish", "weather", "rain")
+
+	c.must("*2\r\n$4\r\nnews\r\n$5\r\nsport\r\n", "pubsub", "channels")
+	c.must("*1\r\n$4\r\nnews\r\n", "pubsub", "channels", "n*")
+	c.must("*4\r\n$4\r\nnews\r\n:1\r\n$7\r\nweather\r\n:0\r\n", "pubsub", "numsub", "news", "weather")
+	c.must(":1\r\n", "pubsub", "numpat")
+
+	// a subscriber runs the subscription commands only
+	sub.send("get", "k")
+	sub.expect("-ERR Can't execute 'get'")
+	sub.rd.ReadString('\n')
+	sub.send("ping")
+	sub.expect("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+
+	sub.send("unsubscribe")
+	sub.expect("*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n")
+	sub.expect("*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:1\r\n")
+	c.must(":1\r\n", "publish", "news", "again")
+	sub.expect("*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nagain\r\n")
+
+	// and its subscriptions go away with the connection
+	sub.send("quit")
+	sub.expect("+OK\r\n")
+	waitUntil(t, "the subscriber to go", func() bool { return c.do("pubsub", "numpat") == ":0\r\n" })
+	c.must(":0\r\n", "publish", "news", "gone")
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/raft"
+	"github.com/qichengzx/raptor/raptor"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/tidwall/redcon"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cmdRaft = "raft"
+
+	raftProposeTimeout   = 10 * time.Second
+	raftTransportTimeout = 2 * time.Second
+	raftMembersTimeout   = 10 * time.Second
+)
+
+var errRaftNotEmpty = errors.New("raft: the data set is not empty and raft_dir holds no raft state, " +
+	"set raft_import with a raft_bootstrap of this node alone to start a group from it, " +
+	"or empty the data set")
+
+// raftMode makes the write commands strongly consistent across a raft
+// group. The leader runs a write command on an overlay of the store, which
+// keeps the writes aside, and proposes the ops of the journal they give. The
+// ops are applied to the store of every node once committed, and only then
+// does the client get its reply. The followers redirect the write commands
+// to the leader and serve the reads from their own store.
+type raftMode struct {
+	node  *raft.Node
+	trans *raft.TCPTransport
+
+	// execMu runs the write commands one at a time, each one seeing the
+	// writes of the ones before applied
+	execMu sync.Mutex
+	// unsure is set when a proposal timed out, its entry may still be
+	// applied later
+	unsure bool
+}
+
+func newRaftMode(app *App) (*raftMode, error) {
+	var conf = app.conf.Raptor
+	bootstrap, err := parseRaftServers(conf.RaftBootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	hasState, err := raft.HasState(conf.RaftDir)
+	if err != nil {
+		return nil, err
+	}
+	empty, err := storeEmpty(app.db)
+	if err != nil {
+		return nil, err
+	}
+
+	var fsm = &raftFSM{app: app}
+	var importState func(w io.Writer) error
+	switch {
+	case hasState:
+		// the data set is rebuilt from the snapshot and the log of the node
+		if !empty {
+			log.Printf("raft: rebuilding the data set from the raft state in %s", conf.RaftDir)
+		}
+		if err := app.db.FlushDB(); err != nil {
+			return nil, err
+		}
+	case empty:
+	case conf.RaftImport:
+		log.Printf("raft: starting the group from the data set")
+		importState = fsm.Snapshot
+	default:
+		return nil, errRaftNotEmpty
+	}
+
+	trans, err := raft.NewTCPTransport(conf.RaftAddr, raftTransportTimeout)
+	if err != nil {
+		return nil, err
+	}
+	node, err := raft.New(raft.Config{
+		ID:        conf.RaftID,
+		Addr:      conf.RaftAddr,
+		Dir:       conf.RaftDir,
+		Transport: trans,
+		FSM:       fsm,
+		Bootstrap: bootstrap,
+		Import:    importState,
+	})
+	if err != nil {
+		trans.Close()
+		return nil, err
+	}
+	go trans.Serve(node)
+
+	return &raftMode{node: node, trans: trans}, nil
+}
+
+func (rm *raftMode) close() {
+	rm.trans.Close()
+	rm.node.Shutdown()
+}
+
+// storeEmpty tells whether there is no key in db.
+func storeEmpty(db *raptor.Raptor) (bool, error) {
+	var empty = true
+	err := db.Scan(storage.ScannerOptions{
+		Count:   1,
+		Handler: func(k, v []byte) { empty = false },
+	})
+
+	return empty, err
+}
+
+// parseRaftServers parses the "id raftaddr clientaddr" of the members in
+// the raft_bootstrap setting.
+func parseRaftServers(specs []string) ([]raft.Server, error) {
+	var servers []raft.Server
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("raft_bootstrap %q: want \"id raftaddr clientaddr\"", spec)
+		}
+		servers = append(servers, raft.Server{ID: fields[0], Addr: fields[1], Client: fields[2]})
+	}
+
+	return servers, nil
+}
+
+// exec runs the write command fn through the raft log.
+func (rm *raftMode) exec(ctx Context, fn CommandHandler) {
+	rm.execMu.Lock()
+	defer rm.execMu.Unlock()
+
+	if err := rm.node.WaitReady(raftProposeTimeout); err != nil {
+		rm.writeError(ctx.Conn, err)
+		return
+	}
+	if rm.unsure {
+		if err := rm.node.Barrier(raftProposeTimeout); err != nil {
+			rm.writeError(ctx.Conn, err)
+			return
+		}
+		rm.unsure = false
+	}
+
+	// the side effects of the command, as the notifications, are held
+	// until its writes are committed, and dropped if they are not
+	var (
+		conn    = ctx.Conn
+		reply   = &heldReply{Conn: conn}
+		db      = &raptor.Raptor{DB: storage.NewOverlay(ctx.app.db)}
+		ops     []byte
+		effects []func()
+	)
+	db.SetJournal(func(op [][]byte, applied bool) {
+		ops = append(ops, encodeCommand(op)...)
+	})
+	ctx.Conn, ctx.db, ctx.effects = reply, db, &effects
+	fn(ctx)
+
+	if len(ops) == 0 {
+		for _, fn := range effects {
+			fn()
+		}
+		conn.WriteRaw(reply.buf)
+		return
+	}
+
+	res, err := rm.node.Propose(ops, raftProposeTimeout)
+	if err == nil {
+		err, _ = res.(error)
+	}
+	if err == raft.ErrTimeout {
+		rm.unsure = true
+	}
+	if err != nil {
+		rm.writeError(conn, err)
+		return
+	}
+
+	for _, fn := range effects {
+		fn()
+	}
+	conn.WriteRaw(reply.buf)
+}
+
+// writeError tells the client to go to the leader, or to retry.
+func (rm *raftMode) writeError(conn redcon.Conn, err error) {
+	if err != raft.ErrNotLeader {
+		conn.WriteError(fmt.Sprintf(ErrRaftRetry, err))
+		return
+	}
+
+	leader, ok := rm.node.Leader()
+	if !ok || leader.Client == "" {
+		conn.WriteError(ErrRaftNoLeader)
+		return
+	}
+	conn.WriteError(fmt.Sprintf(ErrRaftMoved, leader.Client))
+}
+
+// heldReply keeps the replies of commands until their writes are committed.
+type heldReply struct {
+	redcon.Conn
+	buf []byte
+}
+
+func (r *heldReply) WriteError(msg string)       { r.buf = redcon.AppendError(r.buf, msg) }
+func (r *heldReply) WriteString(str string)      { r.buf = redcon.AppendString(r.buf, str) }
+func (r *heldReply) WriteBulk(bulk []byte)       { r.buf = redcon.AppendBulk(r.buf, bulk) }
+func (r *heldReply) WriteBulkString(bulk string) { r.buf = redcon.AppendBulkString(r.buf, bulk) }
+func (r *heldReply) WriteInt(num int)            { r.buf = redcon.AppendInt(r.buf, int64(num)) }
+func (r *heldReply) WriteInt64(num int64)        { r.buf = redcon.AppendInt(r.buf, num) }
+func (r *heldReply) WriteUint64(num uint64)      { r.buf = redcon.AppendUint(r.buf, num) }
+func (r *heldReply) WriteArray(count int)        { r.buf = redcon.AppendArray(r.buf, count) }
+func (r *heldReply) WriteNull()                  { r.buf = redcon.AppendNull(r.buf) }
+func (r *heldReply) WriteRaw(data []byte)        { r.buf = append(r.buf, data...) }
+func (r *heldReply) WriteAny(v interface{})      { r.buf = redcon.AppendAny(r.buf, v) }
+
+// raftFSM applies the committed ops to the store.
+type raftFSM struct {
+	app *App
+}
+
+func (f *raftFSM) Apply(e *raft.Entry) interface{} {
+	var rd = redcon.NewReader(bytes.NewReader(e.Data))
+	for {
+		cmd, err := rd.ReadCommand()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = f.app.db.Apply(cmd.Args)
+		}
+		if err != nil {
+			log.Printf("raft: applying entry %d: %v", e.Index, err)
+			return err
+		}
+
+		for _, key := range opKeys(cmd.Args) {
+			f.app.waiters.signal(key)
+		}
+	}
+}
+
+func (f *raftFSM) Snapshot(w io.Writer) error {
+	_, err := f.app.db.Backup(w, 0)
+	return err
+}
+
+func (f *raftFSM) Restore(r io.Reader) error {
+	if err := f.app.db.FlushDB(); err != nil {
+		return err
+	}
+
+	return f.app.db.Load(r)
+}
+
+// opKeys returns the keys written by an op of the journal.
+func opKeys(op [][]byte) [][]byte {
+	var (
+		args = op[1:]
+		step = 1
+	)
+	switch strings.ToLower(string(op[0])) {
+	case raptor.OpSet, raptor.OpExpireAt, raptor.OpPersist:
+		args = args[:1]
+	case raptor.OpMSetAt:
+		step = 3
+	case raptor.OpMSet:
+		step = 2
+	case raptor.OpFlushDB:
+		return nil
+	}
+
+	var keys [][]byte
+	for i := 0; i < len(args); i += step {
+		keys = append(keys, args[i])
+	}
+
+	return keys
+}
+
+// raftCommandFunc implements RAFT STATUS, RAFT LEADER, RAFT SNAPSHOT,
+// RAFT ADDNODE id raftaddr clientaddr and RAFT REMOVENODE id.
+func raftCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+	var rm = ctx.app.raft
+	if rm == nil {
+		ctx.Conn.WriteError(ErrRaftDisabled)
+		return
+	}
+
+	var (
+		sub  = strings.ToLower(string(ctx.args[1]))
+		argc = map[string]int{"status": 2, "leader": 2, "snapshot": 2, "addnode": 5, "removenode": 3}
+	)
+	n, ok := argc[sub]
+	if !ok {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrSubCmd, sub))
+		return
+	}
+	if len(ctx.args) != n {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+		return
+	}
+
+	var err error
+	switch sub {
+	case "status":
+		ctx.Conn.WriteBulkString(strings.Join(infoRaftFields(ctx.app), "\r\n") + "\r\n")
+		return
+	case "leader":
+		leader, ok := rm.node.Leader()
+		if !ok {
+			ctx.Conn.WriteNull()
+			return
+		}
+		ctx.Conn.WriteArray(3)
+		ctx.Conn.WriteBulkString(leader.ID)
+		ctx.Conn.WriteBulkString(leader.Addr)
+		ctx.Conn.WriteBulkString(leader.Client)
+		return
+	case "snapshot":
+		err = rm.node.Snapshot()
+	case "addnode":
+		err = rm.node.AddServer(raft.Server{
+			ID:     string(ctx.args[2]),
+			Addr:   string(ctx.args[3]),
+			Client: string(ctx.args[4]),
+		}, raftMembersTimeout)
+	case "removenode":
+		err = rm.node.RemoveServer(string(ctx.args[2]), raftMembersTimeout)
+	}
+
+	switch {
+	case err == nil:
+		ctx.Conn.WriteString(RespOK)
+	case err == raft.ErrNotLeader:
+		rm.writeError(ctx.Conn, err)
+	case errors.Is(err, raft.ErrServerExists), errors.Is(err, raft.ErrUnknownServer):
+		ctx.Conn.WriteError("ERR " + err.Error())
+	default:
+		ctx.Conn.WriteError(fmt.Sprintf(ErrRaftRetry, err))
+	}
+}
+
+func infoRaftFields(app *App) []string {
+	if app.raft == nil {
+		return []string{"raft_enabled:0"}
+	}
+
+	var st = app.raft.node.Status()
+	var fields = []string{
+		"raft_enabled:1",
+		"raft_id:" + st.ID,
+		"raft_role:" + st.Role.String(),
+		fmt.Sprintf("raft_term:%d", st.Term),
+		"raft_leader_id:" + st.Leader.ID,
+		"raft_leader_addr:" + st.Leader.Client,
+		fmt.Sprintf("raft_commit_index:%d", st.CommitIndex),
+		fmt.Sprintf("raft_last_applied:%d", st.LastApplied),
+		fmt.Sprintf("raft_last_index:%d", st.LastIndex),
+		fmt.Sprintf("raft_snapshot_index:%d", st.SnapshotIndex),
+		fmt.Sprintf("raft_members:%d", len(st.Configuration.Servers)),
+	}
+	for i, s := range st.Configuration.Servers {
+		fields = append(fields, fmt.Sprintf("raft_member%d:id=%s,addr=%s,client=%s", i, s.ID, s.Addr, s.Client))
+	}
+
+	return fields
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"github.com/qichengzx/raptor/storage"
+	"testing"
+	"time"
+)
+
+func TestRaftNonEmptyStore(t *testing.T) {
+	app := newTestApp(t)
+	c := newTestClient(t, app)
+	c.must("+OK\r\n", "set", "a", "1")
+
+	var conf = &app.conf.Raptor
+	conf.RaftID = "n1"
+	conf.RaftAddr = "127.0.0.1:0"
+	conf.RaftDir = t.TempDir()
+	conf.RaftBootstrap = []string{"n1 127.0.0.1:0 127.0.0.1:6390"}
+
+	// the data set is never wiped without the opt-in
+	if _, err := newRaftMode(app); err != errRaftNotEmpty {
+		t.Fatalf("starting on a non-empty store = %v", err)
+	}
+	c.must("$1\r\n1\r\n", "get", "a")
+
+	// and taken as the first snapshot with it
+	conf.RaftImport = true
+	rm, err := newRaftMode(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.raft = rm
+	for rm.node.WaitReady(time.Second) != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.must("$1\r\n1\r\n", "get", "a")
+	c.must("+OK\r\n", "set", "b", "2")
+	if st := rm.node.Status(); st.SnapshotIndex != 1 {
+		t.Fatalf("after the import %+v", st)
+	}
+	rm.close()
+	app.raft = nil
+
+	// a restart rebuilds the data set from the raft state, the import
+	// included
+	if app.raft, err = newRaftMode(app); err != nil {
+		t.Fatal(err)
+	}
+	for app.raft.node.WaitReady(time.Second) != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.must("$1\r\n1\r\n", "get", "a")
+	c.must("$1\r\n2\r\n", "get", "b")
+}
+
+// badKeyStore fails the writes of the key bad.
+type badKeyStore struct {
+	storage.DB
+}
+
+func (db badKeyStore) MSetTTL(keys, values [][]byte, ttls []int) error {
+	if string(keys[0]) == "bad" {
+		return errors.New("disk full")
+	}
+	return db.DB.MSetTTL(keys, values, ttls)
+}
+
+func TestRaftEffects(t *testing.T) {
+	app := newTestApp(t)
+	var conf = &app.conf.Raptor
+	conf.RaftID = "n1"
+	conf.RaftAddr = "127.0.0.1:0"
+	conf.RaftDir = t.TempDir()
+	conf.RaftBootstrap = []string{"n1 127.0.0.1:0 127.0.0.1:6390"}
+	rm, err := newRaftMode(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.raft = rm
+	defer rm.close()
+	for rm.node.WaitReady(time.Second) != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	app.db.DB = badKeyStore{DB: app.db.DB}
+
+	var (
+		sub = dialTestApp(t, app)
+		c   = newTestClient(t, app)
+	)
+	c.must("+OK\r\n", "config", "set", "notify-keyspace-events", "E$x")
+	sub.send("subscribe", "__keyevent@0__:set")
+	sub.expect("*3\r\n$9\r\nsubscribe\r\n$18\r\n__keyevent@0__:set\r\n:1\r\n")
+
+	// nothing is told of the writes failing to commit, and their
+	// expiration is not watched
+	for _, args := range [][]string{{"set", "bad", "1"}, {"setex", "bad", "100", "v"}} {
+		if reply := c.do(args...); reply[0] != '-' {
+			t.Fatalf("%s of a key failing to commit = %q", args[0], reply)
+		}
+	}
+	if keys := app.expires.tracked(); len(keys) != 0 {
+		t.Fatalf("watching the expiration of %q", keys)
+	}
+	c.must("+OK\r\n", "setex", "good", "100", "v")
+	sub.expect("*3\r\n$7\r\nmessage\r\n$18\r\n__keyevent@0__:set\r\n$4\r\ngood\r\n")
+	if keys := app.expires.tracked(); len(keys) != 1 || keys[0] != "good" {
+		t.Fatalf("watching the expiration of %q", keys)
+	}
+}
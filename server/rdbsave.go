@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/rdb"
+	"github.com/qichengzx/raptor/storage"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	cmdLastSave = "lastsave"
+
+	rdbDefaultFilename = "dump.rdb"
+)
+
+var errSaveInProgress = errors.New("ERR Background save already in progress")
+
+// rdbSaver runs the snapshots of SAVE and BGSAVE, one at a time, and keeps
+// the outcome of the last one for LASTSAVE and INFO.
+type rdbSaver struct {
+	mu         sync.Mutex
+	path       string
+	inProgress bool
+	scheduled  bool
+	started    time.Time
+	lastSave   time.Time
+	lastErr    error
+	lastTime   time.Duration
+	saved      bool
+}
+
+func newRDBSaver(path string) *rdbSaver {
+	if path == "" {
+		path = rdbDefaultFilename
+	}
+
+	return &rdbSaver{
+		path:     path,
+		lastSave: time.Now(),
+	}
+}
+
+func (s *rdbSaver) getPath() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.path
+}
+
+func (s *rdbSaver) setPath(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = path
+}
+
+// begin marks a snapshot as started and returns the file to write, it fails
+// when one is running already.
+func (s *rdbSaver) begin() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inProgress {
+		return "", errSaveInProgress
+	}
+	s.inProgress = true
+	s.started = time.Now()
+
+	return s.path, nil
+}
+
+// finish records the outcome of a snapshot and returns whether another one
+// was scheduled meanwhile.
+func (s *rdbSaver) finish(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inProgress = false
+	s.lastErr = err
+	s.lastTime = time.Since(s.started)
+	s.saved = true
+	if err == nil {
+		s.lastSave = time.Now()
+	}
+
+	var scheduled = s.scheduled
+	s.scheduled = false
+	return scheduled
+}
+
+// schedule asks for a snapshot once the running one is done, it returns
+// false when none is running.
+func (s *rdbSaver) schedule() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.inProgress {
+		return false
+	}
+	s.scheduled = true
+	return true
+}
+
+// save writes a snapshot of db, and returns once it is on disk.
+func (s *rdbSaver) save(db storage.DB) error {
+	path, err := s.begin()
+	if err != nil {
+		return err
+	}
+
+	err = writeRDBFile(db, path)
+	s.finish(err)
+
+	return err
+}
+
+// bgsave writes a snapshot of db in the background, along with the ones
+// scheduled while it runs.
+func (s *rdbSaver) bgsave(db storage.DB) error {
+	path, err := s.begin()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			start := time.Now()
+			err := writeRDBFile(db, path)
+			if err != nil {
+				log.Printf("background saving error: %v", err)
+			} else {
+				log.Printf("DB saved on disk in %s", time.Since(start).Round(time.Millisecond))
+			}
+			if !s.finish(err) {
+				return
+			}
+			if path, err = s.begin(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// writeRDBFile writes a snapshot of db at path.
+func writeRDBFile(db storage.DB, path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return writeRDB(db, w)
+	})
+}
+
+// writeFileAtomic writes path with fn through a temporary file, so that path
+// either holds the previous content or the complete new one.
+func writeFileAtomic(path string, fn func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf("temp-%d-*", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Chmod(0644)
+
+	w := bufio.NewWriterSize(f, 1<<20)
+	err = fn(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// writeRDB writes every object of db to w, as seen by a single read
+// transaction. Top level keys are told apart from the keys holding members
+// by looking for the object owning them.
+func writeRDB(db storage.DB, w io.Writer) error {
+	return db.View(func(snap storage.Reader) error {
+		enc := rdb.NewEncoder(w)
+		err := enc.WriteHeader()
+		if err == nil {
+			err = enc.WriteAux("redis-bits", strconv.Itoa(strconv.IntSize))
+		}
+		if err == nil {
+			err = enc.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+		}
+		if err == nil {
+			err = enc.WriteDB(0, 0, 0)
+		}
+		if err != nil {
+			return err
+		}
+
+		var writeErr error
+		err = typeObjectScanKeys(snap, func(k []byte) {
+			if writeErr != nil {
+				return
+			}
+
+			obj, lerr := typeObjectLoad(snap, k)
+			if lerr != nil {
+				// not an object raptor knows of
+				return
+			}
+			var expireAt int64
+			if at, _ := snap.ExpiresAt(k); at > 0 {
+				expireAt = int64(at) * 1000
+			}
+			writeErr = enc.WriteObject(k, obj, expireAt)
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		return enc.WriteFooter()
+	})
+}
+
+func lastsaveCommandFunc(ctx Context) {
+	if len(ctx.args) != 1 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	ctx.app.saver.mu.Lock()
+	lastSave := ctx.app.saver.lastSave
+	ctx.app.saver.mu.Unlock()
+
+	ctx.Conn.WriteInt64(lastSave.Unix())
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"github.com/qichengzx/raptor/config"
+	"path/filepath"
+	"testing"
+)
+
+func TestRDBRoundTrip(t *testing.T) {
+	var (
+		app  = newTestApp(t)
+		c    = newTestClient(t, app)
+		path = filepath.Join(t.TempDir(), "dump.rdb")
+	)
+	app.saver.setPath(path)
+
+	c.must("+OK\r\n", "set", "str", "v")
+	c.must("+OK\r\n", "setex", "ttl", "1000", "v")
+	c.must("+OK\r\n", "hmset", "hash", "f1", "v1", "f2", "v2")
+	c.must(":2\r\n", "sadd", "set", "m1", "m2")
+	c.must(":2\r\n", "zadd", "zset", "1.5", "a", "-2", "b")
+	c.must("$3\r\n1-1\r\n", "xadd", "stream", "1-1", "f", "v")
+	c.must("+OK\r\n", "save")
+
+	// a store importing the file gets the same objects
+	var conf config.Config
+	conf.Raptor.Directory = t.TempDir()
+	conf.Raptor.Engine = "bolt"
+	conf.Raptor.Auth = "pass"
+	if err := ImportRDB(&conf, path, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New(&conf)
+	defer loaded.Close()
+	c = newTestClient(t, loaded)
+
+	c.must("$1\r\nv\r\n", "get", "str")
+	c.must("$1\r\nv\r\n", "get", "ttl")
+	if reply := c.do("ttl", "ttl"); reply != ":1000\r\n" && reply != ":999\r\n" {
+		t.Fatalf("ttl = %q", reply)
+	}
+	c.must(":-1\r\n", "ttl", "str")
+	c.must("*4\r\n$2\r\nf1\r\n$2\r\nv1\r\n$2\r\nf2\r\n$2\r\nv2\r\n", "hgetall", "hash")
+	c.must(":1\r\n", "sismember", "set", "m1")
+	c.must(":1\r\n", "sismember", "set", "m2")
+	c.must(":2\r\n", "scard", "set")
+	c.must("$3\r\n1.5\r\n", "zscore", "zset", "a")
+	c.must("$2\r\n-2\r\n", "zscore", "zset", "b")
+	c.must(":2\r\n", "zcard", "zset")
+	c.must("*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n", "xrange", "stream", "-", "+")
+	c.must("+stream\r\n", "type", "stream")
+}
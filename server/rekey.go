@@ -0,0 +1,36 @@
+package server
+
+import (
+	"errors"
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/qichengzx/raptor/storage/badger"
+	"log"
+)
+
+// Rekey changes the master key of encryption at rest, the store being
+// opened with the key of conf, if any, and left with the one read from
+// newKeyFile or the environment variable newKeyEnv. It is meant to run while
+// the server is stopped, see badger.Rekey.
+func Rekey(conf *config.Config, newKeyFile, newKeyEnv string) error {
+	if conf.Raptor.Engine != "" && conf.Raptor.Engine != storage.DefaultEngine {
+		return errors.New("encryption at rest is only supported by the badger engine")
+	}
+
+	newKey, err := badger.EncryptionKey(&config.Storage{
+		EncryptionKeyFile: newKeyFile,
+		EncryptionKeyEnv:  newKeyEnv,
+	})
+	if err != nil {
+		return err
+	}
+	if newKey == nil {
+		return errors.New("set the new key with -new-key-file or -new-key-env")
+	}
+	if err := badger.Rekey(conf, newKey); err != nil {
+		return err
+	}
+
+	log.Printf("rekey: %s is encrypted with the new key, point storage encryption_key_file or encryption_key_env to it", conf.Raptor.Directory)
+	return nil
+}
@@ -0,0 +1,1117 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/raptor"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/tidwall/redcon"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cmdReplicaOf = "replicaof"
+	cmdSlaveOf   = "slaveof"
+	cmdRole      = "role"
+	cmdReplConf  = "replconf"
+	cmdPSync     = "psync"
+
+	replPingPeriod    = 10 * time.Second
+	replAckPeriod     = time.Second
+	replRetryPeriod   = time.Second
+	replTimeout       = 60 * time.Second
+	replSnapshotBatch = 1024
+	// replBacklogSize is the default size of the backlog
+	replBacklogSize = 1 << 20
+	// replBufferLimit is how far a replica may lag behind before it is
+	// disconnected, to sync again from scratch
+	replBufferLimit = 256 << 20
+)
+
+// states of the link of a replica with its master, as shown by ROLE
+const (
+	replStateConnect    = "connect"
+	replStateConnecting = "connecting"
+	replStateSync       = "sync"
+	replStateConnected  = "connected"
+)
+
+// states of a replica as seen by its master, as shown by INFO
+const (
+	replicaStateWaitSnapshot = "wait_bgsave"
+	replicaStateSendSnapshot = "send_bulk"
+	replicaStateOnline       = "online"
+)
+
+var errLinkClosed = errors.New("link closed")
+
+// writeCommands lists the commands changing the data set, which read only
+// replicas refuse.
+var writeCommands = map[string]bool{
+	cmdSet:         true,
+	cmdSetNX:       true,
+	cmdSetEX:       true,
+	cmdPSetEX:      true,
+	cmdGetSet:      true,
+	cmdAppend:      true,
+	cmdIncr:        true,
+	cmdIncrBy:      true,
+	cmdDecr:        true,
+	cmdDecrBy:      true,
+	cmdIncrByFloat: true,
+	cmdMSet:        true,
+	cmdMSetNX:      true,
+	cmdMSetEX:      true,
+	cmdSetRange:    true,
+	cmdGetDel:      true,
+	cmdGetEX:       true,
+	cmdSAdd:        true,
+	cmdSPop:        true,
+	cmdSRem:        true,
+	cmdSUnionStore: true,
+	cmdSDiffStore:  true,
+	cmdZAdd:        true,
+	cmdZIncrby:     true,
+	cmdZRem:        true,
+	cmdGeoAdd:      true,
+	cmdHSet:        true,
+	cmdHSetNX:      true,
+	cmdHDel:        true,
+	cmdHIncrby:     true,
+	cmdHMSet:       true,
+	cmdXAdd:        true,
+	cmdXTrim:       true,
+	cmdXDel:        true,
+	cmdXGroup:      true,
+	cmdXReadGroup:  true,
+	cmdXAck:        true,
+	cmdXClaim:      true,
+	cmdXAutoClaim:  true,
+	cmdSetBit:      true,
+	cmdBitOp:       true,
+	cmdBitField:    true,
+	cmdPFAdd:       true,
+	cmdPFMerge:     true,
+	cmdDel:         true,
+	cmdRename:      true,
+	cmdRenameNX:    true,
+	cmdFlushDB:     true,
+	cmdFlushAll:    true,
+	cmdCopy:        true,
+	cmdUnlink:      true,
+	cmdRestore:     true,
+	cmdMigrate:     true,
+	cmdExpire:      true,
+	cmdPExpire:     true,
+	cmdExpireAt:    true,
+	cmdPersist:     true,
+}
+
+// replication holds both sides of replication. The ops of the journal of
+// the store are streamed to the replicas, replid and offset naming the
+// point of the stream the data set is at. A replica follows the stream of
+// its master through link, taking on its replid and offset.
+//
+// The tail of the stream stays in backlog, for the replicas reconnecting to
+// carry on from their offset. replid2 is the replid the stream had up to
+// secondOffset, before a promotion, so that the replicas of the former
+// master can carry on too.
+type replication struct {
+	mu           sync.Mutex
+	replid       string
+	offset       int64
+	replid2      string
+	secondOffset int64
+	backlog      *replBacklog
+	replicas     []*replica
+	link         *masterLink
+	readOnly     bool
+	masterAuth   string
+
+	syncFull       int64
+	syncPartialOK  int64
+	syncPartialErr int64
+}
+
+func newReplication(readOnly bool, masterAuth string, backlogSize int) *replication {
+	if backlogSize <= 0 {
+		backlogSize = replBacklogSize
+	}
+
+	return &replication{
+		replid:       newReplID(),
+		replid2:      strings.Repeat("0", 40),
+		secondOffset: -1,
+		backlog:      newReplBacklog(backlogSize),
+		readOnly:     readOnly,
+		masterAuth:   masterAuth,
+	}
+}
+
+// replBacklog keeps the last bytes of the stream in a ring, the byte at
+// offset o being at o modulo the size of the ring.
+type replBacklog struct {
+	buf []byte
+	end int64 // offset after the last byte
+	n   int   // number of bytes kept
+}
+
+func newReplBacklog(size int) *replBacklog {
+	return &replBacklog{buf: make([]byte, size)}
+}
+
+func (b *replBacklog) write(p []byte) {
+	var size = len(b.buf)
+	if len(p) > size {
+		b.end += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+
+	for len(p) > 0 {
+		i := int(b.end % int64(size))
+		n := copy(b.buf[i:], p)
+		p = p[n:]
+		b.end += int64(n)
+		b.n += n
+	}
+	if b.n > size {
+		b.n = size
+	}
+}
+
+// since returns the bytes after offset, false when some are gone already.
+func (b *replBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.end-int64(b.n) || offset > b.end {
+		return nil, false
+	}
+
+	var (
+		size = int64(len(b.buf))
+		out  = make([]byte, 0, b.end-offset)
+	)
+	for offset < b.end {
+		i := offset % size
+		j := size
+		if b.end-offset < size-i {
+			j = i + b.end - offset
+		}
+		out = append(out, b.buf[i:j]...)
+		offset += j - i
+	}
+
+	return out, true
+}
+
+// reset empties the backlog, the stream going on at offset.
+func (b *replBacklog) reset(offset int64) {
+	b.end = offset
+	b.n = 0
+}
+
+// resize keeps as much of the stream as fits in size.
+func (b *replBacklog) resize(size int) {
+	data, _ := b.since(b.end - int64(b.n))
+	var nb = newReplBacklog(size)
+	nb.end = b.end - int64(len(data))
+	nb.write(data)
+	*b = *nb
+}
+
+func (b *replBacklog) firstOffset() int64 {
+	return b.end - int64(b.n)
+}
+
+func newReplID() string {
+	var b = make([]byte, 20)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// feedOp is the journal of the store.
+func (repl *replication) feedOp(op [][]byte, applied bool) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	// the writes made on a writable replica stay there, its stream is the
+	// one of its master
+	if !applied && repl.link != nil {
+		return
+	}
+	repl.feedLocked(encodeCommand(op))
+}
+
+// feed appends raw to the stream.
+func (repl *replication) feed(raw []byte) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	repl.feedLocked(raw)
+}
+
+func (repl *replication) feedLocked(raw []byte) {
+	repl.offset += int64(len(raw))
+	repl.backlog.write(raw)
+	for _, r := range repl.replicas {
+		r.push(raw)
+	}
+}
+
+func (repl *replication) setBacklogSize(size int) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	repl.backlog.resize(size)
+}
+
+func (repl *replication) getBacklogSize() int {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	return len(repl.backlog.buf)
+}
+
+// shiftReplID names the stream from now on newID, the replicas of the old
+// one being able to carry on.
+func (repl *replication) shiftReplID(newID string) {
+	repl.replid2 = repl.replid
+	repl.secondOffset = repl.offset + 1
+	repl.replid = newID
+}
+
+// run pings the replicas of a master, which tells them the link is alive.
+func (repl *replication) run() {
+	var ping = encodeCommand([][]byte{[]byte(cmdPing)})
+	for range time.Tick(replPingPeriod) {
+		repl.mu.Lock()
+		var feed = repl.link == nil && len(repl.replicas) > 0
+		repl.mu.Unlock()
+
+		if feed {
+			repl.feed(ping)
+		}
+	}
+}
+
+func encodeCommand(args [][]byte) []byte {
+	var b = redcon.AppendArray(nil, len(args))
+	for _, arg := range args {
+		b = redcon.AppendBulk(b, arg)
+	}
+
+	return b
+}
+
+func (repl *replication) rejectsWrites() bool {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	return repl.link != nil && repl.readOnly
+}
+
+func (repl *replication) isReplica() bool {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	return repl.link != nil
+}
+
+func (repl *replication) setReadOnly(readOnly bool) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	repl.readOnly = readOnly
+}
+
+func (repl *replication) getReadOnly() bool {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	return repl.readOnly
+}
+
+func (repl *replication) setMasterAuth(auth string) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	repl.masterAuth = auth
+}
+
+func (repl *replication) getMasterAuth() string {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	return repl.masterAuth
+}
+
+// replicaOf makes the server a replica of host:port, it returns false when
+// it follows that master already.
+func (repl *replication) replicaOf(app *App, host string, port int) bool {
+	repl.mu.Lock()
+	var old = repl.link
+	if old != nil && old.host == host && old.port == port {
+		repl.mu.Unlock()
+		return false
+	}
+	var link = &masterLink{
+		host:  host,
+		port:  port,
+		stop:  make(chan struct{}),
+		state: replStateConnect,
+	}
+	repl.link = link
+	repl.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	// the replicas of a replica follow its data set, which is replaced
+	repl.dropReplicas()
+
+	log.Printf("replication: following master %s", link.addr())
+	go repl.follow(app, link)
+	return true
+}
+
+// promote turns a replica into a master, keeping its data set under a new
+// replid.
+func (repl *replication) promote() {
+	repl.mu.Lock()
+	var link = repl.link
+	repl.link = nil
+	if link != nil {
+		repl.shiftReplID(newReplID())
+	}
+	repl.mu.Unlock()
+
+	if link != nil {
+		link.close()
+		log.Printf("replication: master mode enabled")
+	}
+}
+
+// replica is a replica connected to this server.
+type replica struct {
+	conn redcon.DetachedConn
+	ip   string
+	port int
+
+	mu        sync.Mutex
+	state     string
+	pending   []byte
+	wake      chan struct{}
+	closed    bool
+	ackOffset int64
+	ackTime   time.Time
+}
+
+// push queues raw for the replica, it is dropped when too much is queued.
+func (r *replica) push(raw []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	if len(r.pending)+len(raw) > replBufferLimit {
+		log.Printf("replication: closing replica %s, %d bytes pending", r.conn.RemoteAddr(), len(r.pending))
+		r.closeLocked()
+		return
+	}
+
+	r.pending = append(r.pending, raw...)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *replica) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closeLocked()
+}
+
+func (r *replica) closeLocked() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.pending = nil
+	close(r.wake)
+	// not the redcon conn, whose writer belongs to the sender
+	r.conn.NetConn().Close()
+}
+
+func (r *replica) setState(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state = state
+	if state == replicaStateOnline {
+		r.ackTime = time.Now()
+	}
+}
+
+func (repl *replication) dropReplica(r *replica) {
+	repl.mu.Lock()
+	for i, rr := range repl.replicas {
+		if rr == r {
+			repl.replicas = append(repl.replicas[:i], repl.replicas[i+1:]...)
+			break
+		}
+	}
+	repl.mu.Unlock()
+
+	r.close()
+}
+
+func (repl *replication) dropReplicas() {
+	repl.mu.Lock()
+	var replicas = repl.replicas
+	repl.replicas = nil
+	repl.mu.Unlock()
+
+	for _, r := range replicas {
+		r.close()
+	}
+}
+
+// serveReplica syncs a replica with a snapshot of the store, and then
+// streams the ops written after it.
+func (repl *replication) serveReplica(app *App, conn redcon.DetachedConn, port int, replid string, offset int64) {
+	var r = &replica{
+		conn:  conn,
+		port:  port,
+		state: replicaStateWaitSnapshot,
+		wake:  make(chan struct{}, 1),
+	}
+	r.ip, _, _ = net.SplitHostPort(conn.RemoteAddr())
+	defer repl.dropReplica(r)
+
+	if newID, ok := repl.resume(r, replid, offset); ok {
+		conn.WriteRaw([]byte("+CONTINUE " + newID + "\r\n"))
+		if err := conn.Flush(); err != nil {
+			return
+		}
+		log.Printf("replication: replica %s carries on from offset %d", conn.RemoteAddr(), offset)
+	} else {
+		err := repl.sendSnapshot(app, r)
+		if err != nil {
+			log.Printf("replication: sync of replica %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		log.Printf("replication: replica %s synced", conn.RemoteAddr())
+	}
+	r.setState(replicaStateOnline)
+
+	go repl.readAcks(r)
+	for range r.wake {
+		r.mu.Lock()
+		var buf = r.pending
+		r.pending = nil
+		r.mu.Unlock()
+
+		if len(buf) == 0 {
+			continue
+		}
+		conn.WriteRaw(buf)
+		if err := conn.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// resume attaches the replica at offset, the next byte of the stream it
+// wants, when the backlog still has it. It returns the replid to carry on
+// with.
+func (repl *replication) resume(r *replica, replid string, offset int64) (string, bool) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	if replid == "?" {
+		return "", false
+	}
+	if replid != repl.replid && (replid != repl.replid2 || offset > repl.secondOffset) {
+		repl.syncPartialErr++
+		return "", false
+	}
+	data, ok := repl.backlog.since(offset - 1)
+	if !ok {
+		repl.syncPartialErr++
+		return "", false
+	}
+
+	repl.syncPartialOK++
+	repl.replicas = append(repl.replicas, r)
+	if len(data) > 0 {
+		r.push(data)
+	}
+	return repl.replid, true
+}
+
+// sendSnapshot writes a snapshot of the store to a temporary file, and then
+// sends it to the replica as a bulk following the FULLRESYNC reply. The
+// replica is fed the ops from the point of the snapshot on.
+func (repl *replication) sendSnapshot(app *App, r *replica) error {
+	f, err := os.CreateTemp(filepath.Dir(app.saver.getPath()), fmt.Sprintf("temp-repl-%d-*", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	var (
+		replid string
+		offset int64
+		w      = bufio.NewWriterSize(f, 1<<20)
+	)
+	err = app.db.ViewPinned(func() {
+		repl.mu.Lock()
+		replid, offset = repl.replid, repl.offset
+		repl.replicas = append(repl.replicas, r)
+		repl.syncFull++
+		repl.mu.Unlock()
+	}, func(snap storage.Reader) error {
+		return writeReplSnapshot(snap, w)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.setState(replicaStateSendSnapshot)
+	r.conn.WriteRaw([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n$%d\r\n", replid, offset, size)))
+	if err := r.conn.Flush(); err != nil {
+		return err
+	}
+	_, err = io.Copy(r.conn.NetConn(), f)
+
+	return err
+}
+
+// writeReplSnapshot writes every key of snap as ops of the journal.
+func writeReplSnapshot(snap storage.Reader, w io.Writer) error {
+	var (
+		args     [][]byte
+		writeErr error
+	)
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+		_, err := w.Write(encodeCommand(append([][]byte{[]byte(raptor.OpMSetAt)}, args...)))
+		args = args[:0]
+		return err
+	}
+
+	err := snap.Scan(storage.ScannerOptions{
+		FetchValues: true,
+		EntryHandler: func(e storage.Entry) {
+			if writeErr != nil {
+				return
+			}
+
+			args = append(args, e.Key, e.Value, strconv.AppendUint(nil, e.ExpiresAt, 10))
+			if len(args) >= replSnapshotBatch*3 {
+				writeErr = flush()
+			}
+		},
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = flush()
+	}
+
+	return err
+}
+
+// readAcks records the offsets acknowledged by the replica, and drops it
+// when it goes quiet.
+func (repl *replication) readAcks(r *replica) {
+	defer r.close()
+
+	for {
+		r.conn.NetConn().SetReadDeadline(time.Now().Add(replTimeout))
+		cmd, err := r.conn.ReadCommand()
+		if err != nil {
+			return
+		}
+		if len(cmd.Args) != 3 ||
+			strings.ToLower(string(cmd.Args[0])) != cmdReplConf ||
+			strings.ToLower(string(cmd.Args[1])) != "ack" {
+			continue
+		}
+
+		offset, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil {
+			continue
+		}
+		r.mu.Lock()
+		r.ackOffset = offset
+		r.ackTime = time.Now()
+		r.mu.Unlock()
+	}
+}
+
+// masterLink is the link of a replica with its master.
+type masterLink struct {
+	host string
+	port int
+	stop chan struct{}
+
+	mu      sync.Mutex
+	state   string
+	conn    net.Conn
+	lastIO  time.Time
+	stopped bool
+}
+
+func (l *masterLink) addr() string {
+	return net.JoinHostPort(l.host, strconv.Itoa(l.port))
+}
+
+func (l *masterLink) getState() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.state
+}
+
+func (l *masterLink) setState(state string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.state = state
+}
+
+func (l *masterLink) touch() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastIO = time.Now()
+}
+
+// setConn makes conn the connection to close on close, it returns false once
+// the link is closed.
+func (l *masterLink) setConn(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopped {
+		return false
+	}
+	l.conn = conn
+	l.lastIO = time.Now()
+	return true
+}
+
+func (l *masterLink) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	close(l.stop)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// follow syncs with the master of link, again every time the link breaks,
+// until it is closed.
+func (repl *replication) follow(app *App, link *masterLink) {
+	for {
+		err := repl.sync(app, link)
+		select {
+		case <-link.stop:
+			return
+		default:
+		}
+
+		log.Printf("replication: link with master %s lost: %v", link.addr(), err)
+		link.setState(replStateConnect)
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(replRetryPeriod):
+		}
+	}
+}
+
+// sync does the handshake with the master and asks to carry on from the
+// offset of the data set. Unless the master can, the data set is replaced
+// with its snapshot. It then applies the ops it streams, until the link
+// breaks.
+func (repl *replication) sync(app *App, link *masterLink) error {
+	link.setState(replStateConnecting)
+	conn, err := net.DialTimeout("tcp", link.addr(), replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !link.setConn(conn) {
+		return errLinkClosed
+	}
+
+	var rd = bufio.NewReaderSize(conn, 1<<20)
+	command := func(args ...string) (string, error) {
+		var bargs = make([][]byte, len(args))
+		for i, arg := range args {
+			bargs[i] = []byte(arg)
+		}
+		conn.SetDeadline(time.Now().Add(replTimeout))
+		if _, err := conn.Write(encodeCommand(bargs)); err != nil {
+			return "", err
+		}
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "-") {
+			return "", fmt.Errorf("%s: %s", args[0], line[1:])
+		}
+		return line, nil
+	}
+
+	if _, err := command("AUTH", repl.getMasterAuth()); err != nil {
+		return err
+	}
+	if _, err := command("REPLCONF", "listening-port", strconv.Itoa(app.conf.Raptor.Port)); err != nil {
+		return err
+	}
+
+	repl.mu.Lock()
+	var psync = [][]byte{[]byte("PSYNC"), []byte(repl.replid), []byte(strconv.FormatInt(repl.offset+1, 10))}
+	repl.mu.Unlock()
+
+	// the master takes its snapshot before replying
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(encodeCommand(psync)); err != nil {
+		return err
+	}
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var fields = strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "+CONTINUE" {
+		repl.mu.Lock()
+		if len(fields) > 1 && fields[1] != repl.replid {
+			repl.shiftReplID(fields[1])
+			repl.mu.Unlock()
+			// they carry on from the former replid
+			repl.dropReplicas()
+		} else {
+			repl.mu.Unlock()
+		}
+		log.Printf("replication: carrying on with master %s", link.addr())
+
+		return repl.stream(app, link, conn, rd)
+	}
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		return fmt.Errorf("unexpected reply to PSYNC: %q", strings.TrimSpace(line))
+	}
+	replid := fields[1]
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected reply to PSYNC: %q", strings.TrimSpace(line))
+	}
+
+	link.setState(replStateSync)
+	line, err = rd.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "$")), 10, 64)
+	if err != nil || !strings.HasPrefix(line, "$") {
+		return fmt.Errorf("unexpected snapshot header: %q", strings.TrimSpace(line))
+	}
+
+	log.Printf("replication: loading %d bytes of snapshot from master %s", size, link.addr())
+	if err := repl.loadSnapshot(app, io.LimitReader(rd, size), size); err != nil {
+		return err
+	}
+
+	repl.mu.Lock()
+	repl.replid, repl.offset = replid, offset
+	repl.replid2, repl.secondOffset = strings.Repeat("0", 40), -1
+	repl.backlog.reset(offset)
+	repl.mu.Unlock()
+	log.Printf("replication: synced with master %s, replid %s offset %d", link.addr(), replid, offset)
+
+	return repl.stream(app, link, conn, rd)
+}
+
+// stream applies the ops streamed by the master, until the link breaks.
+func (repl *replication) stream(app *App, link *masterLink, conn net.Conn, rd *bufio.Reader) error {
+	link.setState(replStateConnected)
+	link.touch()
+
+	var done = make(chan struct{})
+	defer close(done)
+	go repl.sendAcks(conn, done)
+
+	var stream = redcon.NewReader(rd)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		cmd, err := stream.ReadCommand()
+		if err != nil {
+			return err
+		}
+		link.touch()
+
+		if strings.ToLower(string(cmd.Args[0])) == cmdPing {
+			repl.feed(cmd.Raw)
+			continue
+		}
+		if err := app.db.Apply(cmd.Args); err != nil {
+			return err
+		}
+	}
+}
+
+// loadSnapshot replaces the data set with the snapshot of size bytes in r.
+func (repl *replication) loadSnapshot(app *App, r io.Reader, size int64) error {
+	// the data set the replicas of this replica follow goes away, and so
+	// does the point of the stream it was at
+	repl.mu.Lock()
+	repl.replid = newReplID()
+	repl.mu.Unlock()
+	repl.dropReplicas()
+	if err := app.db.FlushDB(); err != nil {
+		return err
+	}
+
+	var (
+		rd   = redcon.NewReader(r)
+		read int64
+	)
+	for {
+		cmd, err := rd.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := app.db.Apply(cmd.Args); err != nil {
+			return err
+		}
+		read += int64(len(cmd.Raw))
+	}
+	if read != size {
+		return io.ErrUnexpectedEOF
+	}
+
+	return nil
+}
+
+// sendAcks tells the master the offset applied so far, until done.
+func (repl *replication) sendAcks(conn net.Conn, done chan struct{}) {
+	var ticker = time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		repl.mu.Lock()
+		var offset = repl.offset
+		repl.mu.Unlock()
+
+		ack := encodeCommand([][]byte{[]byte("REPLCONF"), []byte("ACK"), []byte(strconv.FormatInt(offset, 10))})
+		if _, err := conn.Write(ack); err != nil {
+			return
+		}
+	}
+}
+
+// replicaofCommandFunc implements REPLICAOF host port and REPLICAOF NO ONE.
+func replicaofCommandFunc(ctx Context) {
+	if len(ctx.args) != 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+	if ctx.app.raft != nil {
+		ctx.Conn.WriteError(ErrRaftReplicaOf)
+		return
+	}
+
+	if strings.ToLower(string(ctx.args[1])) == "no" && strings.ToLower(string(ctx.args[2])) == "one" {
+		ctx.app.repl.promote()
+		ctx.Conn.WriteString(RespOK)
+		return
+	}
+
+	port, err := strconv.Atoi(string(ctx.args[2]))
+	if err != nil || port <= 0 || port > 65535 {
+		ctx.Conn.WriteError(ErrMasterPort)
+		return
+	}
+
+	if !ctx.app.repl.replicaOf(ctx.app, string(ctx.args[1]), port) {
+		ctx.Conn.WriteString(RespSameMaster)
+		return
+	}
+
+	ctx.Conn.WriteString(RespOK)
+}
+
+func roleCommandFunc(ctx Context) {
+	if len(ctx.args) != 1 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var repl = ctx.app.repl
+	repl.mu.Lock()
+	var (
+		link     = repl.link
+		offset   = repl.offset
+		replicas = append([]*replica(nil), repl.replicas...)
+	)
+	repl.mu.Unlock()
+
+	if link != nil {
+		var state = link.getState()
+		if state != replStateConnected {
+			offset = -1
+		}
+
+		ctx.Conn.WriteArray(5)
+		ctx.Conn.WriteBulkString("slave")
+		ctx.Conn.WriteBulkString(link.host)
+		ctx.Conn.WriteInt(link.port)
+		ctx.Conn.WriteBulkString(state)
+		ctx.Conn.WriteInt64(offset)
+		return
+	}
+
+	ctx.Conn.WriteArray(3)
+	ctx.Conn.WriteBulkString("master")
+	ctx.Conn.WriteInt64(offset)
+	ctx.Conn.WriteArray(len(replicas))
+	for _, r := range replicas {
+		r.mu.Lock()
+		var ackOffset = r.ackOffset
+		r.mu.Unlock()
+
+		ctx.Conn.WriteArray(3)
+		ctx.Conn.WriteBulkString(r.ip)
+		ctx.Conn.WriteBulkString(strconv.Itoa(r.port))
+		ctx.Conn.WriteBulkString(strconv.FormatInt(ackOffset, 10))
+	}
+}
+
+// replConf is what REPLCONF tells of a replica before its PSYNC.
+type replConf struct {
+	port int
+}
+
+func replconfCommandFunc(ctx Context) {
+	if len(ctx.args) < 3 || len(ctx.args)%2 != 1 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	conf, _ := ctx.Conn.Context().(*replConf)
+	if conf == nil {
+		conf = &replConf{}
+	}
+	for i := 1; i < len(ctx.args); i += 2 {
+		switch strings.ToLower(string(ctx.args[i])) {
+		case "listening-port":
+			port, err := strconv.Atoi(string(ctx.args[i+1]))
+			if err != nil || port < 0 || port > 65535 {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+			conf.port = port
+		case "capa", "ack", "getack":
+		default:
+			ctx.Conn.WriteError(fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", ctx.args[i]))
+			return
+		}
+	}
+	ctx.Conn.SetContext(conf)
+
+	ctx.Conn.WriteString(RespOK)
+}
+
+// psyncCommandFunc implements PSYNC replid offset, offset being the next
+// byte of the stream the replica wants. It carries on from there when the
+// backlog allows, and falls back to a full sync otherwise. The connection is
+// taken over by the replica stream.
+func psyncCommandFunc(ctx Context) {
+	if len(ctx.args) != 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	offset, err := strconv.ParseInt(string(ctx.args[2]), 10, 64)
+	if err != nil {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+
+	var repl = ctx.app.repl
+	repl.mu.Lock()
+	var link = repl.link
+	repl.mu.Unlock()
+	if link != nil && link.getState() != replStateConnected {
+		ctx.Conn.WriteError(ErrNoMasterLink)
+		return
+	}
+
+	var port int
+	if conf, ok := ctx.Conn.Context().(*replConf); ok {
+		port = conf.port
+	}
+	go repl.serveReplica(ctx.app, ctx.Conn.Detach(), port, string(ctx.args[1]), offset)
+}
+
+// parseReplicaOf parses the "host port" of the replicaof setting.
+func parseReplicaOf(s string) (string, int, error) {
+	var fields = strings.Fields(s)
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("replicaof %q: want \"host port\"", s)
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("replicaof %q: invalid port", s)
+	}
+
+	return fields[0], port, nil
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/tidwall/redcon"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplBacklog(t *testing.T) {
+	var (
+		b      = newReplBacklog(8)
+		stream []byte
+	)
+	for _, p := range []string{"abc", "defgh", "ij", "klmnopqrstu", "v"} {
+		b.write([]byte(p))
+		stream = append(stream, p...)
+	}
+
+	if b.end != int64(len(stream)) || b.n != 8 {
+		t.Fatalf("end %d n %d, want %d 8", b.end, b.n, len(stream))
+	}
+	for offset := b.end - 8; offset <= b.end; offset++ {
+		data, ok := b.since(offset)
+		if !ok || !bytes.Equal(data, stream[offset:]) {
+			t.Errorf("since(%d) = %q %v, want %q", offset, data, ok, stream[offset:])
+		}
+	}
+	if _, ok := b.since(b.end - 9); ok {
+		t.Error("since before the first byte kept succeeded")
+	}
+	if _, ok := b.since(b.end + 1); ok {
+		t.Error("since after the last byte succeeded")
+	}
+
+	b.resize(4)
+	if data, ok := b.since(b.end - 4); !ok || !bytes.Equal(data, stream[len(stream)-4:]) {
+		t.Errorf("after resize since = %q %v", data, ok)
+	}
+
+	b.reset(100)
+	if data, ok := b.since(100); !ok || len(data) != 0 {
+		t.Errorf("after reset since = %q %v", data, ok)
+	}
+	if _, ok := b.since(99); ok {
+		t.Error("since before a reset succeeded")
+	}
+}
+
+// serveTestApp serves app on a local port, returning its address.
+func serveTestApp(t *testing.T, app *App) (string, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := redcon.NewServer(ln.Addr().String(), app.onCommand(), app.onAccept(), app.onClose())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// waitUntil waits for cond to hold, failing the test after a while.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPartialResync(t *testing.T) {
+	var (
+		master  = newTestApp(t)
+		replica = newTestApp(t)
+		m       = newTestClient(t, master)
+		r       = newTestClient(t, replica)
+	)
+	host, port := serveTestApp(t, master)
+	replica.repl.setMasterAuth("pass")
+
+	var (
+		stats = func() (full, partialOK, partialErr int64) {
+			master.repl.mu.Lock()
+			defer master.repl.mu.Unlock()
+			return master.repl.syncFull, master.repl.syncPartialOK, master.repl.syncPartialErr
+		}
+		offsets = func() bool {
+			master.repl.mu.Lock()
+			var want = master.repl.offset
+			master.repl.mu.Unlock()
+			replica.repl.mu.Lock()
+			defer replica.repl.mu.Unlock()
+			return replica.repl.offset == want
+		}
+		// breakLink drops the connection of the replica, which reconnects
+		breakLink = func() {
+			replica.repl.mu.Lock()
+			var link = replica.repl.link
+			replica.repl.mu.Unlock()
+			link.mu.Lock()
+			link.conn.Close()
+			link.mu.Unlock()
+			waitUntil(t, "the link to break", func() bool { return link.getState() != replStateConnected })
+		}
+		connected = func() bool {
+			replica.repl.mu.Lock()
+			defer replica.repl.mu.Unlock()
+			return replica.repl.link.getState() == replStateConnected
+		}
+	)
+
+	m.must("+OK\r\n", "set", "k0", "v0")
+	replica.repl.replicaOf(replica, host, port)
+	waitUntil(t, "the full sync", func() bool { return r.do("get", "k0") == "$2\r\nv0\r\n" })
+	m.must("+OK\r\n", "set", "k1", "v1")
+	waitUntil(t, "the stream", func() bool { return r.do("get", "k1") == "$2\r\nv1\r\n" })
+	waitUntil(t, "the offsets", offsets)
+	// the replica asked to carry on the stream of its own data set
+	if full, ok, failed := stats(); full != 1 || ok != 0 || failed != 1 {
+		t.Fatalf("full syncs %d, partial %d, failed %d", full, ok, failed)
+	}
+
+	// the writes made while the link is down come from the backlog
+	breakLink()
+	for i := 2; i < 10; i++ {
+		m.must("+OK\r\n", "set", fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	waitUntil(t, "the partial resync", func() bool { return r.do("get", "k9") == "$2\r\nv9\r\n" && connected() })
+	waitUntil(t, "the offsets", offsets)
+	r.must("$2\r\nv2\r\n", "get", "k2")
+	if full, ok, _ := stats(); full != 1 || ok != 1 {
+		t.Fatalf("full syncs %d, partial %d, want a partial resync", full, ok)
+	}
+
+	// and once they are gone from it, a full sync is back
+	master.repl.setBacklogSize(64)
+	breakLink()
+	for i := 10; i < 30; i++ {
+		m.must("+OK\r\n", "set", fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	waitUntil(t, "the full sync", func() bool { return r.do("get", "k29") == "$3\r\nv29\r\n" && connected() })
+	waitUntil(t, "the offsets", offsets)
+	r.must("$3\r\nv10\r\n", "get", "k10")
+	if full, ok, failed := stats(); full != 2 || ok != 1 || failed != 2 {
+		t.Fatalf("full syncs %d, partial %d, failed %d", full, ok, failed)
+	}
+}
+
+// expiresAtCounter counts the lookups of the expiration times in a
+// snapshot.
+type expiresAtCounter struct {
+	storage.Reader
+	lookups int
+}
+
+func (r *expiresAtCounter) ExpiresAt(key []byte) (uint64, error) {
+	r.lookups++
+	return r.Reader.ExpiresAt(key)
+}
+
+func TestReplSnapshot(t *testing.T) {
+	var (
+		master  = newTestApp(t)
+		replica = newTestApp(t)
+		c       = newTestClient(t, master)
+		n       = replSnapshotBatch*2 + 10
+	)
+	var args = []string{"mset"}
+	for i := 0; i < n; i++ {
+		args = append(args, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	c.must("+OK\r\n", args...)
+	c.must("+OK\r\n", "setex", "ttl", "1000", "v")
+	c.must(":3\r\n", "sadd", "s", "a", "b", "c")
+	c.must(":1\r\n", "expire", "s", "500")
+	want, _ := master.db.ExpiresAt([]byte("s"))
+
+	// the expiration times come with the keys scanned, in batches
+	var buf bytes.Buffer
+	err := master.db.View(func(snap storage.Reader) error {
+		var r = &expiresAtCounter{Reader: snap}
+		err := writeReplSnapshot(r, &buf)
+		if r.lookups != 0 {
+			t.Errorf("%d expiration times looked up", r.lookups)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops := bytes.Count(buf.Bytes(), []byte("$6\r\nmsetat\r\n")); ops != 3 {
+		t.Fatalf("%d ops written, want 3", ops)
+	}
+
+	replica.db.Set([]byte("stale"), []byte("v"), 0)
+	if err := replica.repl.loadSnapshot(replica, &buf, int64(buf.Len())); err != nil {
+		t.Fatal(err)
+	}
+	c = newTestClient(t, replica)
+	c.must(fmt.Sprintf("$%d\r\nv%d\r\n", len(fmt.Sprint(n-1))+1, n-1), "get", fmt.Sprintf("k%d", n-1))
+	c.must("$2\r\nv0\r\n", "get", "k0")
+	c.must(":0\r\n", "exists", "stale")
+	c.must(":3\r\n", "scard", "s")
+	if at, _ := replica.db.ExpiresAt([]byte("s")); at != want {
+		t.Fatalf("s expires at %d, want %d", at, want)
+	}
+	if at, _ := replica.db.ExpiresAt([]byte("k0")); at != 0 {
+		t.Fatalf("k0 expires at %d", at)
+	}
+	if reply := c.do("ttl", "ttl"); reply != ":1000\r\n" && reply != ":999\r\n" {
+		t.Fatalf("ttl = %q", reply)
+	}
+}
@@ -1,28 +1,296 @@
 package server
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/config"
+	"github.com/tidwall/match"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 const (
 	cmdSave   = "save"
 	cmdBgSave = "bgsave"
+	cmdConfig = "config"
 )
 
+// configParam is a parameter readable with CONFIG GET and, when set is not
+// nil, changeable at runtime with CONFIG SET.
+type configParam struct {
+	get func(app *App) string
+	set func(app *App, value string) error
+}
+
+var configParams = map[string]configParam{
+	"notify-keyspace-events": {
+		get: func(app *App) string {
+			return notifyFlagsString(app.getNotifyFlags())
+		},
+		set: func(app *App, value string) error {
+			flags, err := parseNotifyFlags(value)
+			if err != nil {
+				return err
+			}
+
+			app.setNotifyFlags(flags)
+			app.conf.Raptor.NotifyKeyspaceEvents = value
+			return nil
+		},
+	},
+	"dbfilename": {
+		get: func(app *App) string {
+			return app.saver.getPath()
+		},
+		set: func(app *App, value string) error {
+			if value == "" {
+				return errors.New("dbfilename can't be empty")
+			}
+
+			app.saver.setPath(value)
+			app.conf.Raptor.DBFilename = value
+			return nil
+		},
+	},
+	"appendfsync": {
+		get: func(app *App) string {
+			return app.fsync.getPolicy()
+		},
+		set: func(app *App, value string) error {
+			if err := app.fsync.setPolicy(value); err != nil {
+				return err
+			}
+
+			app.conf.Raptor.AppendFsync = app.fsync.getPolicy()
+			return nil
+		},
+	},
+	"coalesce-writes": {
+		get: func(app *App) string {
+			return configBoolString(app.coalesceWrites())
+		},
+		set: func(app *App, value string) error {
+			on, err := parseConfigBool(value)
+			if err != nil {
+				return err
+			}
+
+			app.setCoalesceWrites(on)
+			app.conf.Raptor.CoalesceWrites = on
+			return nil
+		},
+	},
+	"replica-read-only": {
+		get: func(app *App) string {
+			return configBoolString(app.repl.getReadOnly())
+		},
+		set: func(app *App, value string) error {
+			readOnly, err := parseConfigBool(value)
+			if err != nil {
+				return err
+			}
+
+			app.repl.setReadOnly(readOnly)
+			app.conf.Raptor.ReplicaReadOnly = readOnly
+			return nil
+		},
+	},
+	"repl-backlog-size": {
+		get: func(app *App) string {
+			return strconv.Itoa(app.repl.getBacklogSize())
+		},
+		set: func(app *App, value string) error {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 16*1024 {
+				return errors.New("argument must be a size of at least 16384 bytes")
+			}
+
+			app.repl.setBacklogSize(size)
+			app.conf.Raptor.ReplBacklogSize = size
+			return nil
+		},
+	},
+	"masterauth": {
+		get: func(app *App) string {
+			return app.repl.getMasterAuth()
+		},
+		set: func(app *App, value string) error {
+			app.repl.setMasterAuth(value)
+			app.conf.Raptor.MasterAuth = value
+			return nil
+		},
+	},
+	"lazyfree-lazy-user-del": {
+		get: func(app *App) string {
+			return configBoolString(app.lazyfree.lazyUserDel())
+		},
+		set: func(app *App, value string) error {
+			lazy, err := parseConfigBool(value)
+			if err != nil {
+				return err
+			}
+
+			app.lazyfree.setLazyUserDel(lazy)
+			app.conf.Raptor.LazyFreeLazyUserDel = lazy
+			return nil
+		},
+	},
+}
+
+// storageConfigParams are the settings of the storage section, read only as
+// they are only used when the store is opened.
+var storageConfigParams = map[string]func(s *config.Storage) string{
+	"storage-sync-writes":         func(s *config.Storage) string { return configBoolString(s.SyncWrites) },
+	"storage-memtable-size":       func(s *config.Storage) string { return strconv.FormatInt(s.MemTableSize, 10) },
+	"storage-block-cache-size":    func(s *config.Storage) string { return strconv.FormatInt(s.BlockCacheSize, 10) },
+	"storage-index-cache-size":    func(s *config.Storage) string { return strconv.FormatInt(s.IndexCacheSize, 10) },
+	"storage-value-threshold":     func(s *config.Storage) string { return strconv.FormatInt(s.ValueThreshold, 10) },
+	"storage-compression":         func(s *config.Storage) string { return s.Compression },
+	"storage-zstd-level":          func(s *config.Storage) string { return strconv.Itoa(s.ZSTDLevel) },
+	"storage-num-compactors":      func(s *config.Storage) string { return strconv.Itoa(s.NumCompactors) },
+	"storage-in-memory":           func(s *config.Storage) string { return configBoolString(s.InMemory) },
+	"storage-log-level":           func(s *config.Storage) string { return s.LogLevel },
+	"storage-value-log-file-size": func(s *config.Storage) string { return strconv.FormatInt(s.ValueLogFileSize, 10) },
+	"storage-encryption-key-file": func(s *config.Storage) string { return s.EncryptionKeyFile },
+	"storage-encryption-key-env":  func(s *config.Storage) string { return s.EncryptionKeyEnv },
+	"storage-encryption-key-rotation-duration": func(s *config.Storage) string {
+		return s.EncryptionKeyRotationDuration.String()
+	},
+	"storage-gc-interval":      func(s *config.Storage) string { return s.GCInterval.String() },
+	"storage-gc-discard-ratio": func(s *config.Storage) string { return strconv.FormatFloat(s.GCDiscardRatio, 'g', -1, 64) },
+	"storage-gc-quiet-hours":   func(s *config.Storage) string { return s.GCQuietHours },
+}
+
+func init() {
+	for name, get := range storageConfigParams {
+		get := get
+		configParams[name] = configParam{
+			get: func(app *App) string {
+				return get(&app.conf.Storage)
+			},
+		}
+	}
+}
+
+var errConfigBool = errors.New("argument must be 'yes' or 'no'")
+
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+
+	return false, errConfigBool
+}
+
+func configBoolString(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
+
 func saveCommandFunc(ctx Context) {
 	if len(ctx.args) != 1 {
 		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
 		return
 	}
 
-	ctx.db.Sync()
-	ctx.Conn.WriteString(RespSync)
+	err := ctx.app.saver.save(ctx.db)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.Conn.WriteString(RespOK)
 }
 
+// bgsaveCommandFunc writes the RDB snapshot in the background, with SCHEDULE
+// it is started once the running one is done instead of failing.
 func bgsaveCommandFunc(ctx Context) {
-	if len(ctx.args) != 1 {
+	var schedule = false
+	switch len(ctx.args) {
+	case 1:
+	case 2:
+		if strings.ToLower(string(ctx.args[1])) != "schedule" {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		schedule = true
+	default:
 		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
 		return
 	}
 
-	ctx.db.Sync()
+	if schedule && ctx.app.saver.schedule() {
+		ctx.Conn.WriteString(RespSyncScheduled)
+		return
+	}
+
+	err := ctx.app.saver.bgsave(ctx.db)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
 	ctx.Conn.WriteString(RespSync)
 }
+
+func configCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	switch strings.ToLower(string(ctx.args[1])) {
+	case "get":
+		if len(ctx.args) != 3 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+			return
+		}
+
+		var (
+			pattern = strings.ToLower(string(ctx.args[2]))
+			names   []string
+		)
+		for name := range configParams {
+			if match.Match(name, pattern) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		ctx.Conn.WriteArray(len(names) * 2)
+		for _, name := range names {
+			ctx.Conn.WriteBulkString(name)
+			ctx.Conn.WriteBulkString(configParams[name].get(ctx.app))
+		}
+	case "set":
+		if len(ctx.args) < 4 || len(ctx.args)&1 != 0 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+			return
+		}
+
+		for i := 2; i < len(ctx.args); i += 2 {
+			name := strings.ToLower(string(ctx.args[i]))
+			param, ok := configParams[name]
+			if !ok || param.set == nil {
+				ctx.Conn.WriteError(fmt.Sprintf(ErrConfigParam, name))
+				return
+			}
+
+			err := param.set(ctx.app, string(ctx.args[i+1]))
+			if err != nil {
+				ctx.Conn.WriteError(fmt.Sprintf(ErrConfigValue, name, err.Error()))
+				return
+			}
+		}
+
+		ctx.Conn.WriteString(RespOK)
+	default:
+		ctx.Conn.WriteError(fmt.Sprintf(ErrSubCmd, ctx.args[1]))
+	}
+}
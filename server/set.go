@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"github.com/qichengzx/raptor/storage/badger"
+	"github.com/qichengzx/raptor/storage"
 	"strconv"
 )
 
@@ -81,6 +81,9 @@ func saddCommandFunc(ctx Context) {
 		return
 	}
 
+	if cnt > 0 {
+		ctx.notify(notifySet, "sadd", key)
+	}
 	ctx.Conn.WriteInt64(int64(cnt))
 }
 
@@ -152,6 +155,10 @@ func spopCommandFunc(ctx Context) {
 		}
 
 		ctx.db.Del(memberToDel)
+		ctx.notify(notifySet, "spop", key)
+		if setSize == 0 {
+			ctx.notify(notifyGeneric, "del", key)
+		}
 	}
 
 	if setSize > 0 {
@@ -253,7 +260,9 @@ func sremCommandFunc(ctx Context) {
 		}
 
 		ctx.db.Del(memberToDel)
+		ctx.notify(notifySet, "srem", key)
 		if setSize == 0 {
+			ctx.notify(notifyGeneric, "del", key)
 			ctx.Conn.WriteInt(lenToDel)
 			return
 		}
@@ -313,7 +322,7 @@ func smembersCommandFunc(ctx Context) {
 
 	var (
 		memberPos = typeSetMemberPos(key)
-		members = typeSetScan(ctx, key, nil, 0)
+		members   = typeSetScan(ctx, key, nil, 0)
 	)
 	ctx.Conn.WriteArray(len(members))
 	for _, member := range members {
@@ -429,15 +438,9 @@ func sunionstoreCommandFunc(ctx Context) {
 	}
 
 	var dstkey = ctx.args[1]
-	keys := scan(ctx, dstkey)
-	if len(keys) > 0 {
-		var keysToDel [][]byte
-		keysToDel = append(keysToDel, keys...)
-		err := ctx.db.Del(keysToDel)
-		if err != nil {
-			ctx.Conn.WriteInt(0)
-			return
-		}
+	if _, err := typeObjectDelete(ctx, dstkey); err != nil {
+		ctx.Conn.WriteInt(0)
+		return
 	}
 
 	var cnt uint32 = 0
@@ -455,6 +458,7 @@ func sunionstoreCommandFunc(ctx Context) {
 		return
 	}
 
+	ctx.notify(notifySet, "sunionstore", dstkey)
 	ctx.Conn.WriteInt(len(union))
 }
 
@@ -519,15 +523,9 @@ func sdiffstoreCommandFunc(ctx Context) {
 	}
 
 	var dstkey = ctx.args[1]
-	keys := scan(ctx, dstkey)
-	if len(keys) > 0 {
-		var keysToDel [][]byte
-		keysToDel = append(keysToDel, keys...)
-		err := ctx.db.Del(keysToDel)
-		if err != nil {
-			ctx.Conn.WriteInt(0)
-			return
-		}
+	if _, err := typeObjectDelete(ctx, dstkey); err != nil {
+		ctx.Conn.WriteInt(0)
+		return
 	}
 
 	var cnt uint32 = 0
@@ -545,6 +543,7 @@ func sdiffstoreCommandFunc(ctx Context) {
 		return
 	}
 
+	ctx.notify(notifySet, "sdiffstore", dstkey)
 	ctx.Conn.WriteInt(len(diff))
 }
 
@@ -586,7 +585,7 @@ func typeSetScan(ctx Context, key, prefix []byte, cnt int64) [][]byte {
 		prefixBuff.Write(prefix)
 	}
 
-	scanOpts := badger.ScannerOptions{
+	scanOpts := storage.ScannerOptions{
 		Prefix:      prefixBuff.Bytes(),
 		FetchValues: false,
 		Handler:     scanFunc,
@@ -607,7 +606,7 @@ func typeSetMarshalMember(key, member, keySize []byte) []byte {
 	return memBuff.Bytes()
 }
 
-//typeSetMemberPos return real member position
+// typeSetMemberPos return real member position
 func typeSetMemberPos(key []byte) uint32 {
 	return typeSetSize + typeSetKeySize + uint32(len(key))
 }
@@ -0,0 +1,834 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cmdXAdd   = "xadd"
+	cmdXRange = "xrange"
+	cmdXRead  = "xread"
+	cmdXLen   = "xlen"
+	cmdXTrim  = "xtrim"
+	cmdXDel   = "xdel"
+)
+
+const (
+	typeStreamKeySize = 4
+	typeStreamIDSize  = 16
+)
+
+var (
+	typeStream = []byte("X")
+
+	streamIDMin = streamID{}
+	streamIDMax = streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+)
+
+// streamID is an entry ID, stored big-endian after the stream prefix so that
+// entries are kept in ID order by badger.
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+type streamEntry struct {
+	id     streamID
+	fields [][]byte
+}
+
+// streamTrim holds the MAXLEN|MINID [=|~] threshold [LIMIT count] options
+type streamTrim struct {
+	maxLen *uint64
+	minID  streamID
+	limit  int64
+}
+
+func xaddCommandFunc(ctx Context) {
+	if len(ctx.args) < 5 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		key        = ctx.args[1]
+		noMkStream = false
+		trim       *streamTrim
+		i          = 2
+		err        error
+	)
+options:
+	for i < len(ctx.args) {
+		switch strings.ToLower(string(ctx.args[i])) {
+		case "nomkstream":
+			noMkStream = true
+			i++
+		case "maxlen", "minid":
+			trim, i, err = parseStreamTrim(ctx.args, i)
+			if err != nil {
+				ctx.Conn.WriteError(err.Error())
+				return
+			}
+		default:
+			break options
+		}
+	}
+
+	if i+1 >= len(ctx.args) || len(ctx.args[i+1:])&1 != 0 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+	var fields = ctx.args[i+1:]
+
+	metaValue, err := typeStreamGetMeta(ctx, key)
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if metaValue == nil && noMkStream {
+		ctx.Conn.WriteNull()
+		return
+	}
+
+	size, last := typeStreamMetaInfo(metaValue)
+	id, err := streamNextID(ctx.args[i], last)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	size += 1
+	err = ctx.db.MSet(
+		[][]byte{typeStreamMarshalEntry(key, id), key},
+		[][]byte{typeStreamMarshalFields(fields), typeStreamMetaVal(size, id)},
+	)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	if trim != nil {
+		_, err = typeStreamTrim(ctx, key, size, id, trim)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	ctx.notify(notifyStream, "xadd", key)
+	ctx.signal(key)
+	ctx.Conn.WriteBulkString(id.String())
+}
+
+func xrangeCommandFunc(ctx Context) {
+	if len(ctx.args) != 4 && len(ctx.args) != 6 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var key = ctx.args[1]
+	_, err := typeStreamGetMeta(ctx, key)
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	start, startOk, err := parseStreamRangeID(ctx.args[2], true)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	end, endOk, err := parseStreamRangeID(ctx.args[3], false)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var cnt int64 = 0
+	if len(ctx.args) == 6 {
+		if strings.ToLower(string(ctx.args[4])) != "count" {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		cnt, err = strconv.ParseInt(string(ctx.args[5]), 10, 64)
+		if err != nil {
+			ctx.Conn.WriteError(ErrValue)
+			return
+		}
+		if cnt <= 0 {
+			ctx.Conn.WriteArray(0)
+			return
+		}
+	}
+
+	var entries []streamEntry
+	if startOk && endOk && !end.less(start) {
+		entries = typeStreamRange(ctx, key, start, end, cnt)
+	}
+
+	writeStreamEntries(ctx, entries)
+}
+
+func xreadCommandFunc(ctx Context) {
+	if len(ctx.args) < 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		cnt   int64 = 0
+		block int64 = -1
+		i           = 1
+		err   error
+	)
+	for ; i < len(ctx.args); i++ {
+		opt := strings.ToLower(string(ctx.args[i]))
+		if opt == "streams" {
+			i++
+			break
+		}
+
+		if i+1 >= len(ctx.args) {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		switch opt {
+		case "count":
+			cnt, err = strconv.ParseInt(string(ctx.args[i+1]), 10, 64)
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+		case "block":
+			block, err = strconv.ParseInt(string(ctx.args[i+1]), 10, 64)
+			if err != nil || block < 0 {
+				ctx.Conn.WriteError(ErrTimeout)
+				return
+			}
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		i++
+	}
+
+	var streams = ctx.args[i:]
+	if len(streams) == 0 || len(streams)&1 != 0 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrStreamArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		keys = streams[:len(streams)/2]
+		ids  = make([]streamID, len(keys))
+	)
+	for j, arg := range streams[len(streams)/2:] {
+		metaValue, err := typeStreamGetMeta(ctx, keys[j])
+		if err != nil && err.Error() != ErrKeyNotExist {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+
+		if string(arg) == "$" {
+			_, ids[j] = typeStreamMetaInfo(metaValue)
+			continue
+		}
+
+		ids[j], err = parseStreamID(arg, 0)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	read := func() bool {
+		var (
+			found   [][]byte
+			entries [][]streamEntry
+		)
+		for j, key := range keys {
+			start, ok := ids[j].next()
+			if !ok {
+				continue
+			}
+
+			e := typeStreamRange(ctx, key, start, streamIDMax, cnt)
+			if len(e) > 0 {
+				found = append(found, key)
+				entries = append(entries, e)
+			}
+		}
+		if len(found) == 0 {
+			return false
+		}
+
+		ctx.Conn.WriteArray(len(found))
+		for j, key := range found {
+			ctx.Conn.WriteArray(2)
+			ctx.Conn.WriteBulk(key)
+			writeStreamEntries(ctx, entries[j])
+		}
+		return true
+	}
+
+	if block < 0 {
+		if !read() {
+			ctx.Conn.WriteNull()
+		}
+		return
+	}
+
+	wakeup := ctx.app.waiters.watch(keys)
+	defer ctx.app.waiters.unwatch(keys, wakeup)
+
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(time.Duration(block) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for !read() {
+		select {
+		case <-wakeup:
+		case <-timeout:
+			ctx.Conn.WriteNull()
+			return
+		}
+	}
+}
+
+func xlenCommandFunc(ctx Context) {
+	if len(ctx.args) != 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	metaValue, err := typeStreamGetMeta(ctx, ctx.args[1])
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	size, _ := typeStreamMetaInfo(metaValue)
+	ctx.Conn.WriteInt(int(size))
+}
+
+func xtrimCommandFunc(ctx Context) {
+	if len(ctx.args) < 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var key = ctx.args[1]
+	trim, i, err := parseStreamTrim(ctx.args, 2)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if i != len(ctx.args) {
+		ctx.Conn.WriteError(ErrSyntax)
+		return
+	}
+
+	metaValue, err := typeStreamGetMeta(ctx, key)
+	if err != nil {
+		if err.Error() != ErrKeyNotExist {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		ctx.Conn.WriteInt(0)
+		return
+	}
+
+	size, last := typeStreamMetaInfo(metaValue)
+	cnt, err := typeStreamTrim(ctx, key, size, last, trim)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	if cnt > 0 {
+		ctx.notify(notifyStream, "xtrim", key)
+	}
+	ctx.Conn.WriteInt(cnt)
+}
+
+func xdelCommandFunc(ctx Context) {
+	if len(ctx.args) < 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var key = ctx.args[1]
+	var ids []streamID
+	for _, arg := range ctx.args[2:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	metaValue, err := typeStreamGetMeta(ctx, key)
+	if err != nil {
+		if err.Error() != ErrKeyNotExist {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		ctx.Conn.WriteInt(0)
+		return
+	}
+
+	var (
+		entryToDel [][]byte
+		check      = make(map[streamID]struct{})
+	)
+	for _, id := range ids {
+		if _, ok := check[id]; ok {
+			continue
+		}
+		check[id] = struct{}{}
+
+		entry := typeStreamMarshalEntry(key, id)
+		_, err := ctx.db.Get(entry)
+		if err == nil {
+			entryToDel = append(entryToDel, entry)
+		}
+	}
+
+	var lenToDel = len(entryToDel)
+	if lenToDel > 0 {
+		size, last := typeStreamMetaInfo(metaValue)
+		err = ctx.db.Del(entryToDel)
+		if err == nil {
+			err = typeStreamSetMeta(ctx, key, size-uint32(lenToDel), last)
+		}
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+
+		ctx.notify(notifyStream, "xdel", key)
+	}
+
+	ctx.Conn.WriteInt(lenToDel)
+}
+
+// writeStreamEntries writes entries as [id, [field, value, ...]] pairs, the
+// fields of a pending entry deleted from the stream are written as null.
+func writeStreamEntries(ctx Context, entries []streamEntry) {
+	ctx.Conn.WriteArray(len(entries))
+	for _, e := range entries {
+		ctx.Conn.WriteArray(2)
+		ctx.Conn.WriteBulkString(e.id.String())
+		if e.fields == nil {
+			ctx.Conn.WriteNull()
+			continue
+		}
+		ctx.Conn.WriteArray(len(e.fields))
+		for _, f := range e.fields {
+			ctx.Conn.WriteBulk(f)
+		}
+	}
+}
+
+// parseStreamTrim parses the trimming options starting at args[i] and
+// returns the index of the first argument after them.
+func parseStreamTrim(args [][]byte, i int) (*streamTrim, int, error) {
+	var (
+		trim     = &streamTrim{}
+		strategy = strings.ToLower(string(args[i]))
+		approx   = false
+	)
+	i++
+	if i < len(args) && (string(args[i]) == "=" || string(args[i]) == "~") {
+		approx = string(args[i]) == "~"
+		i++
+	}
+	if i >= len(args) {
+		return nil, i, errors.New(ErrSyntax)
+	}
+
+	if strategy == "maxlen" {
+		maxLen, err := strconv.ParseUint(string(args[i]), 10, 64)
+		if err != nil {
+			return nil, i, errors.New(ErrValue)
+		}
+		trim.maxLen = &maxLen
+	} else {
+		minID, err := parseStreamID(args[i], 0)
+		if err != nil {
+			return nil, i, err
+		}
+		trim.minID = minID
+	}
+	i++
+
+	if i+1 < len(args) && strings.ToLower(string(args[i])) == "limit" {
+		if !approx {
+			return nil, i, errors.New(ErrStreamLimit)
+		}
+
+		limit, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil || limit < 0 {
+			return nil, i, errors.New(ErrValue)
+		}
+		trim.limit = limit
+		i += 2
+	}
+
+	return trim, i, nil
+}
+
+// parseStreamID parses "ms-seq" or "ms", using seq when it is omitted.
+func parseStreamID(arg []byte, seq uint64) (streamID, error) {
+	var (
+		id  streamID
+		err error
+		s   = string(arg)
+	)
+	if pos := strings.IndexByte(s, '-'); pos >= 0 {
+		id.seq, err = strconv.ParseUint(s[pos+1:], 10, 64)
+		if err != nil {
+			return id, errors.New(ErrStreamID)
+		}
+		s = s[:pos]
+	} else {
+		id.seq = seq
+	}
+
+	id.ms, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return id, errors.New(ErrStreamID)
+	}
+
+	return id, nil
+}
+
+// parseStreamRangeID parses a XRANGE boundary, the bool result is false when
+// an exclusive boundary leaves nothing to read.
+func parseStreamRangeID(arg []byte, start bool) (streamID, bool, error) {
+	switch string(arg) {
+	case "-":
+		return streamIDMin, true, nil
+	case "+":
+		return streamIDMax, true, nil
+	}
+
+	var exclusive = len(arg) > 0 && arg[0] == '('
+	if exclusive {
+		arg = arg[1:]
+	}
+
+	var seq uint64 = 0
+	if !start {
+		seq = math.MaxUint64
+	}
+	id, err := parseStreamID(arg, seq)
+	if err != nil || !exclusive {
+		return id, true, err
+	}
+
+	if start {
+		id, ok := id.next()
+		return id, ok, nil
+	}
+	id, ok := id.prev()
+	return id, ok, nil
+}
+
+// streamNextID returns the ID of a new entry from a XADD ID argument.
+func streamNextID(arg []byte, last streamID) (streamID, error) {
+	var s = string(arg)
+	if s == "*" {
+		ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+		if ms > last.ms {
+			return streamID{ms: ms}, nil
+		}
+
+		id, ok := last.next()
+		if !ok {
+			return id, errors.New(ErrStreamIDSmall)
+		}
+		return id, nil
+	}
+
+	if strings.HasSuffix(s, "-*") {
+		ms, err := strconv.ParseUint(s[:len(s)-2], 10, 64)
+		if err != nil {
+			return streamID{}, errors.New(ErrStreamID)
+		}
+		if ms > last.ms {
+			return streamID{ms: ms}, nil
+		}
+		if ms < last.ms || last.seq == math.MaxUint64 {
+			return streamID{}, errors.New(ErrStreamIDSmall)
+		}
+		return streamID{ms: ms, seq: last.seq + 1}, nil
+	}
+
+	id, err := parseStreamID(arg, 0)
+	if err != nil {
+		return id, err
+	}
+	if id == streamIDMin {
+		return id, errors.New(ErrStreamIDZero)
+	}
+	if !last.less(id) {
+		return id, errors.New(ErrStreamIDSmall)
+	}
+
+	return id, nil
+}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// next returns the smallest ID greater than id.
+func (id streamID) next() (streamID, bool) {
+	if id.seq < math.MaxUint64 {
+		return streamID{ms: id.ms, seq: id.seq + 1}, true
+	}
+	if id.ms < math.MaxUint64 {
+		return streamID{ms: id.ms + 1}, true
+	}
+	return id, false
+}
+
+// prev returns the greatest ID smaller than id.
+func (id streamID) prev() (streamID, bool) {
+	if id.seq > 0 {
+		return streamID{ms: id.ms, seq: id.seq - 1}, true
+	}
+	if id.ms > 0 {
+		return streamID{ms: id.ms - 1, seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+func (id streamID) bytes() []byte {
+	return append(uint64ToBytes(8, id.ms), uint64ToBytes(8, id.seq)...)
+}
+
+func bytesToStreamID(b []byte) streamID {
+	return streamID{ms: bytesToUint64(b[:8]), seq: bytesToUint64(b[8:16])}
+}
+
+// typeStreamTrim evicts the oldest entries according to trim and returns how
+// many were deleted.
+func typeStreamTrim(ctx Context, key []byte, size uint32, last streamID, trim *streamTrim) (int, error) {
+	var (
+		cnt int64 = 0
+		end       = streamIDMax
+		ok        = true
+	)
+	if trim.maxLen != nil {
+		if uint64(size) <= *trim.maxLen {
+			return 0, nil
+		}
+		cnt = int64(uint64(size) - *trim.maxLen)
+	} else {
+		end, ok = trim.minID.prev()
+		if !ok {
+			return 0, nil
+		}
+	}
+	if trim.limit > 0 && (cnt == 0 || trim.limit < cnt) {
+		cnt = trim.limit
+	}
+
+	entries, _ := typeStreamScan(ctx, key, streamIDMin, end, cnt, false)
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	err := ctx.db.Del(entries)
+	if err != nil {
+		return 0, err
+	}
+
+	err = typeStreamSetMeta(ctx, key, size-uint32(len(entries)), last)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entries), nil
+}
+
+func typeStreamRange(ctx Context, key []byte, start, end streamID, cnt int64) []streamEntry {
+	keys, values := typeStreamScan(ctx, key, start, end, cnt, true)
+
+	var entries []streamEntry
+	for i, k := range keys {
+		entries = append(entries, streamEntry{
+			id:     bytesToStreamID(k[len(k)-typeStreamIDSize:]),
+			fields: typeStreamUnmarshalFields(values[i]),
+		})
+	}
+
+	return entries
+}
+
+func typeStreamScan(ctx Context, key []byte, start, end streamID, cnt int64, fetchValues bool) ([][]byte, [][]byte) {
+	var (
+		keys     [][]byte
+		values   [][]byte
+		scanFunc = func(k, v []byte) {
+			keys = append(keys, k)
+			values = append(values, v)
+		}
+	)
+
+	scanOpts := storage.ScannerOptions{
+		Prefix:      typeStreamPrefix(key),
+		Start:       typeStreamMarshalEntry(key, start),
+		End:         typeStreamMarshalEntry(key, end),
+		FetchValues: fetchValues,
+		Handler:     scanFunc,
+		Count:       cnt,
+	}
+	ctx.db.Scan(scanOpts)
+
+	return keys, values
+}
+
+func typeStreamGetMeta(ctx Context, key []byte) ([]byte, error) {
+	metaValue, err := ctx.db.Get(key)
+	if err != nil && err.Error() == ErrKeyNotExist {
+		return nil, err
+	}
+
+	// an empty string is the type tag alone
+	if len(metaValue) >= 1 && string(metaValue[0]) != string(typeStream) {
+		return nil, errors.New(ErrWrongType)
+	}
+
+	return metaValue, nil
+}
+
+// typeStreamMetaInfo returns the length and last ID of a stream, both are zero
+// when the stream does not exist.
+func typeStreamMetaInfo(metaValue []byte) (uint32, streamID) {
+	if len(metaValue) < 21 {
+		return 0, streamIDMin
+	}
+
+	return bytesToUint32(metaValue[1:5]), bytesToStreamID(metaValue[5:21])
+}
+
+func typeStreamSetMeta(ctx Context, key []byte, size uint32, last streamID) error {
+	return ctx.db.Set(key, typeStreamMetaVal(size, last), 0)
+}
+
+func typeStreamMetaVal(size uint32, last streamID) []byte {
+	metaBuff := bytes.NewBuffer([]byte{})
+	metaBuff.Write(typeStream)
+	metaBuff.Write(uint32ToBytes(typeStreamKeySize, size))
+	metaBuff.Write(last.bytes())
+
+	return metaBuff.Bytes()
+}
+
+func typeStreamPrefix(key []byte) []byte {
+	var keySize = uint32ToBytes(typeStreamKeySize, uint32(len(key)))
+	prefixBuff := bytes.NewBuffer([]byte{})
+	prefixBuff.Write(typeStream)
+	prefixBuff.Write(keySize)
+	prefixBuff.Write(key)
+
+	return prefixBuff.Bytes()
+}
+
+func typeStreamMarshalEntry(key []byte, id streamID) []byte {
+	return append(typeStreamPrefix(key), id.bytes()...)
+}
+
+// typeStreamMarshalFields encodes the field/value pairs of an entry, each
+// one prefixed by its length
+func typeStreamMarshalFields(fields [][]byte) []byte {
+	fieldBuff := bytes.NewBuffer([]byte{})
+	for _, f := range fields {
+		fieldBuff.Write(uint32ToBytes(4, uint32(len(f))))
+		fieldBuff.Write(f)
+	}
+
+	return fieldBuff.Bytes()
+}
+
+func typeStreamUnmarshalFields(b []byte) [][]byte {
+	var fields [][]byte
+	for len(b) >= 4 {
+		size := bytesToUint32(b[:4])
+		fields = append(fields, b[4:4+size])
+		b = b[4+size:]
+	}
+
+	return fields
+}
+
+// keyWaiters wakes up clients blocked on keys, such as XREAD BLOCK, when
+// new data is written to one of them.
+type keyWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+func newKeyWaiters() *keyWaiters {
+	return &keyWaiters{
+		waiters: make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+func (w *keyWaiters) watch(keys [][]byte) chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var ch = make(chan struct{}, 1)
+	for _, key := range keys {
+		if w.waiters[string(key)] == nil {
+			w.waiters[string(key)] = make(map[chan struct{}]struct{})
+		}
+		w.waiters[string(key)][ch] = struct{}{}
+	}
+
+	return ch
+}
+
+func (w *keyWaiters) unwatch(keys [][]byte, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, key := range keys {
+		delete(w.waiters[string(key)], ch)
+		if len(w.waiters[string(key)]) == 0 {
+			delete(w.waiters, string(key))
+		}
+	}
+}
+
+func (w *keyWaiters) signal(key []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ch := range w.waiters[string(key)] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"github.com/tidwall/redcon"
+	"regexp"
+	"testing"
+)
+
+var idleTimes = regexp.MustCompile(`\r\n:\d+\r\n`)
+
+// testClient runs commands on an app as an authenticated connection.
+type testClient struct {
+	t    *testing.T
+	app  *App
+	conn *testConn
+}
+
+func newTestClient(t *testing.T, app *App) *testClient {
+	c := &testClient{t: t, app: app, conn: &testConn{addr: t.Name()}}
+	if reply := c.do("auth", "pass"); reply != "+OK\r\n" {
+		t.Fatalf("auth: %q", reply)
+	}
+
+	return c
+}
+
+// do runs a command and returns its raw reply.
+func (c *testClient) do(args ...string) string {
+	var cmd redcon.Command
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+	c.conn.buf = nil
+	c.app.exec(c.conn, c.app.db, cmd)
+
+	return string(c.conn.buf)
+}
+
+// must runs a command, failing the test unless it replies want.
+func (c *testClient) must(want string, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); got != want {
+		c.t.Fatalf("%q = %q, want %q", args, got, want)
+	}
+}
+
+func TestStreamWrongType(t *testing.T) {
+	var c = newTestClient(t, newTestApp(t))
+
+	// an empty string is the type tag alone
+	c.must("+OK\r\n", "set", "k", "")
+	var wrongType = "-" + ErrWrongType + "\r\n"
+	c.must(wrongType, "xlen", "k")
+	c.must(wrongType, "xadd", "k", "*", "f", "v")
+	c.must(wrongType, "xrange", "k", "-", "+")
+	c.must(wrongType, "xgroup", "create", "k", "g", "$")
+	c.must(wrongType, "xgroup", "create", "k", "g", "$", "mkstream")
+	c.must(wrongType, "xgroup", "destroy", "k", "g")
+	c.must(wrongType, "xreadgroup", "group", "g", "c", "streams", "k", ">")
+	c.must(wrongType, "xack", "k", "g", "1-1")
+	c.must("$0\r\n\r\n", "get", "k")
+}
+
+func TestStreamGroupPending(t *testing.T) {
+	var c = newTestClient(t, newTestApp(t))
+
+	c.must("+OK\r\n", "xgroup", "create", "s", "g", "$", "mkstream")
+	for _, id := range []string{"1-1", "2-1", "3-1"} {
+		c.must("$3\r\n"+id+"\r\n", "xadd", "s", id, "f", id)
+	}
+	var entry = func(id string) string {
+		return "*2\r\n$3\r\n" + id + "\r\n*2\r\n$1\r\nf\r\n$3\r\n" + id + "\r\n"
+	}
+
+	// new entries go to a single consumer each, and into the PEL
+	c.must("*1\r\n*2\r\n$1\r\ns\r\n*2\r\n"+entry("1-1")+entry("2-1"),
+		"xreadgroup", "group", "g", "alice", "count", "2", "streams", "s", ">")
+	c.must("*1\r\n*2\r\n$1\r\ns\r\n*1\r\n"+entry("3-1"),
+		"xreadgroup", "group", "g", "bob", "streams", "s", ">")
+	c.must("$-1\r\n", "xreadgroup", "group", "g", "bob", "streams", "s", ">")
+	c.must("*4\r\n:3\r\n$3\r\n1-1\r\n$3\r\n3-1\r\n*2\r\n*2\r\n$5\r\nalice\r\n$1\r\n2\r\n*2\r\n$3\r\nbob\r\n$1\r\n1\r\n",
+		"xpending", "s", "g")
+
+	// the history of a consumer is its PEL
+	c.must("*1\r\n*2\r\n$1\r\ns\r\n*2\r\n"+entry("1-1")+entry("2-1"),
+		"xreadgroup", "group", "g", "alice", "streams", "s", "0")
+
+	// XACK takes the entries out of the PEL once
+	c.must(":1\r\n", "xack", "s", "g", "1-1", "1-1", "9-9")
+	c.must(":0\r\n", "xack", "s", "g", "1-1")
+	c.must("*1\r\n*2\r\n$1\r\ns\r\n*1\r\n"+entry("2-1"),
+		"xreadgroup", "group", "g", "alice", "streams", "s", "0")
+
+	// XCLAIM moves an entry to another consumer and counts the delivery
+	c.must("*1\r\n"+entry("2-1"), "xclaim", "s", "g", "bob", "0", "2-1")
+	c.must("*0\r\n", "xclaim", "s", "g", "bob", "3600000", "2-1")
+	c.must("*1\r\n*2\r\n$1\r\ns\r\n*0\r\n", "xreadgroup", "group", "g", "alice", "streams", "s", "0")
+	// with the idle times left out
+	var pending = idleTimes.ReplaceAllString(c.do("xpending", "s", "g", "-", "+", "10", "bob"), "\r\n\r\n")
+	if want := "*2\r\n*4\r\n$3\r\n2-1\r\n$3\r\nbob\r\n\r\n:2\r\n*4\r\n$3\r\n3-1\r\n$3\r\nbob\r\n\r\n:1\r\n"; pending != want {
+		t.Fatalf("xpending = %q, want %q", pending, want)
+	}
+	c.must("*1\r\n$3\r\n2-1\r\n", "xclaim", "s", "g", "alice", "0", "2-1", "justid")
+	c.must("*4\r\n:2\r\n$3\r\n2-1\r\n$3\r\n3-1\r\n*2\r\n*2\r\n$5\r\nalice\r\n$1\r\n1\r\n*2\r\n$3\r\nbob\r\n$1\r\n1\r\n",
+		"xpending", "s", "g")
+}
@@ -0,0 +1,1098 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cmdXGroup     = "xgroup"
+	cmdXReadGroup = "xreadgroup"
+	cmdXAck       = "xack"
+	cmdXPending   = "xpending"
+	cmdXClaim     = "xclaim"
+	cmdXAutoClaim = "xautoclaim"
+)
+
+// consumer group state lives under its own prefix, so that it never shows
+// up in the range scans of the stream entries:
+//
+//	G + keySize + key + 'g' + groupSize + group            => last delivered ID
+//	G + keySize + key + 'c' + groupSize + group + consumer => last seen time
+//	G + keySize + key + 'p' + groupSize + group + ID       => pending entry
+const (
+	typeStreamGroupKeySize = 4
+	typeStreamGroupTag     = 'g'
+	typeStreamConsumerTag  = 'c'
+	typeStreamPendingTag   = 'p'
+
+	streamAutoClaimCount = 100
+)
+
+var (
+	typeStreamGroup = []byte("G")
+
+	// streamGroupMu serializes the changes made to consumer groups, so that
+	// a new entry is only delivered to a single consumer of a group
+	streamGroupMu sync.Mutex
+)
+
+// streamPending is an entry delivered to a consumer and not acknowledged yet.
+type streamPending struct {
+	id       streamID
+	consumer []byte
+	time     int64
+	count    uint64
+}
+
+func xgroupCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var sub = strings.ToLower(string(ctx.args[1]))
+	switch sub {
+	case "create":
+		if len(ctx.args) != 5 && len(ctx.args) != 6 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+			return
+		}
+		xgroupCreate(ctx)
+	case "setid":
+		if len(ctx.args) != 5 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+			return
+		}
+		xgroupSetID(ctx)
+	case "destroy":
+		if len(ctx.args) != 4 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+			return
+		}
+		xgroupDestroy(ctx)
+	case "createconsumer":
+		if len(ctx.args) != 5 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+			return
+		}
+		xgroupCreateConsumer(ctx)
+	case "delconsumer":
+		if len(ctx.args) != 5 {
+			ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd+"|"+sub))
+			return
+		}
+		xgroupDelConsumer(ctx)
+	default:
+		ctx.Conn.WriteError(fmt.Sprintf(ErrSubCmd, ctx.args[1]))
+	}
+}
+
+func xgroupCreate(ctx Context) {
+	var (
+		key      = ctx.args[2]
+		group    = ctx.args[3]
+		mkStream = false
+	)
+	if len(ctx.args) == 6 {
+		if strings.ToLower(string(ctx.args[5])) != "mkstream" {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		mkStream = true
+	}
+
+	streamGroupMu.Lock()
+	defer streamGroupMu.Unlock()
+
+	metaValue, err := typeStreamGetMeta(ctx, key)
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if metaValue == nil && !mkStream {
+		ctx.Conn.WriteError(ErrGroupNoKey)
+		return
+	}
+
+	_, last := typeStreamMetaInfo(metaValue)
+	var id = last
+	if string(ctx.args[4]) != "$" {
+		id, err = parseStreamID(ctx.args[4], 0)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	groupKey := typeStreamMarshalGroup(key, group)
+	_, err = ctx.db.Get(groupKey)
+	if err == nil {
+		ctx.Conn.WriteError(ErrBusyGroup)
+		return
+	}
+
+	var (
+		keys   = [][]byte{groupKey}
+		values = [][]byte{id.bytes()}
+	)
+	if metaValue == nil {
+		keys = append(keys, key)
+		values = append(values, typeStreamMetaVal(0, streamIDMin))
+	}
+	err = ctx.db.MSet(keys, values)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyStream, "xgroup-create", key)
+	ctx.Conn.WriteString(RespOK)
+}
+
+func xgroupSetID(ctx Context) {
+	var key, group = ctx.args[2], ctx.args[3]
+
+	streamGroupMu.Lock()
+	defer streamGroupMu.Unlock()
+
+	_, err := typeStreamGroupGet(ctx, key, group)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var id streamID
+	if string(ctx.args[4]) == "$" {
+		metaValue, _ := typeStreamGetMeta(ctx, key)
+		_, id = typeStreamMetaInfo(metaValue)
+	} else {
+		id, err = parseStreamID(ctx.args[4], 0)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	err = ctx.db.Set(typeStreamMarshalGroup(key, group), id.bytes(), 0)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyStream, "xgroup-setid", key)
+	ctx.Conn.WriteString(RespOK)
+}
+
+func xgroupDestroy(ctx Context) {
+	var key, group = ctx.args[2], ctx.args[3]
+
+	streamGroupMu.Lock()
+	defer streamGroupMu.Unlock()
+
+	metaValue, err := typeStreamGetMeta(ctx, key)
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if metaValue == nil {
+		ctx.Conn.WriteError(ErrGroupNoKey)
+		return
+	}
+
+	groupKey := typeStreamMarshalGroup(key, group)
+	_, err = ctx.db.Get(groupKey)
+	if err != nil {
+		ctx.Conn.WriteInt(0)
+		return
+	}
+
+	var keysToDel = [][]byte{groupKey}
+	keysToDel = append(keysToDel, typeStreamGroupScan(ctx, typeStreamGroupPrefix(key, typeStreamConsumerTag, group))...)
+	keysToDel = append(keysToDel, typeStreamGroupScan(ctx, typeStreamGroupPrefix(key, typeStreamPendingTag, group))...)
+	err = ctx.db.Del(keysToDel)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyStream, "xgroup-destroy", key)
+	ctx.Conn.WriteInt(1)
+}
+
+func xgroupCreateConsumer(ctx Context) {
+	var key, group, consumer = ctx.args[2], ctx.args[3], ctx.args[4]
+
+	streamGroupMu.Lock()
+	defer streamGroupMu.Unlock()
+
+	_, err := typeStreamGroupGet(ctx, key, group)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	_, err = ctx.db.Get(typeStreamMarshalConsumer(key, group, consumer))
+	if err == nil {
+		ctx.Conn.WriteInt(0)
+		return
+	}
+
+	err = typeStreamConsumerTouch(ctx, key, group, consumer, streamNow())
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyStream, "xgroup-createconsumer", key)
+	ctx.Conn.WriteInt(1)
+}
+
+func xgroupDelConsumer(ctx Context) {
+	var key, group, consumer = ctx.args[2], ctx.args[3], ctx.args[4]
+
+	streamGroupMu.Lock()
+	defer streamGroupMu.Unlock()
+
+	_, err := typeStreamGroupGet(ctx, key, group)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var keysToDel = [][]byte{typeStreamMarshalConsumer(key, group, consumer)}
+	for _, p := range typeStreamPendingScan(ctx, key, group, streamIDMin, streamIDMax, 0) {
+		if bytes.Equal(p.consumer, consumer) {
+			keysToDel = append(keysToDel, typeStreamMarshalPending(key, group, p.id))
+		}
+	}
+
+	err = ctx.db.Del(keysToDel)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyStream, "xgroup-delconsumer", key)
+	ctx.Conn.WriteInt(len(keysToDel) - 1)
+}
+
+func xreadgroupCommandFunc(ctx Context) {
+	if len(ctx.args) < 7 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+	if strings.ToLower(string(ctx.args[1])) != "group" {
+		ctx.Conn.WriteError(ErrSyntax)
+		return
+	}
+
+	var (
+		group          = ctx.args[2]
+		consumer       = ctx.args[3]
+		cnt      int64 = 0
+		block    int64 = -1
+		noAck          = false
+		i              = 4
+		err      error
+	)
+	for ; i < len(ctx.args); i++ {
+		opt := strings.ToLower(string(ctx.args[i]))
+		if opt == "streams" {
+			i++
+			break
+		}
+		if opt == "noack" {
+			noAck = true
+			continue
+		}
+
+		if i+1 >= len(ctx.args) {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		switch opt {
+		case "count":
+			cnt, err = strconv.ParseInt(string(ctx.args[i+1]), 10, 64)
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+		case "block":
+			block, err = strconv.ParseInt(string(ctx.args[i+1]), 10, 64)
+			if err != nil || block < 0 {
+				ctx.Conn.WriteError(ErrTimeout)
+				return
+			}
+			// the write commands can't wait for others in raft mode
+			if ctx.app.raft != nil {
+				ctx.Conn.WriteError(ErrRaftBlock)
+				return
+			}
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		i++
+	}
+
+	var streams = ctx.args[i:]
+	if len(streams) == 0 || len(streams)&1 != 0 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrStreamArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		keys = streams[:len(streams)/2]
+		ids  = make([]*streamID, len(keys))
+	)
+	for j, arg := range streams[len(streams)/2:] {
+		_, err := typeStreamGroupGet(ctx, keys[j], group)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+
+		if string(arg) == ">" {
+			continue
+		}
+
+		// reading the history of pending entries never blocks
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		ids[j] = &id
+		block = -1
+	}
+
+	read := func() bool {
+		streamGroupMu.Lock()
+		defer streamGroupMu.Unlock()
+
+		var (
+			found   [][]byte
+			entries [][]streamEntry
+			now     = streamNow()
+		)
+		for j, key := range keys {
+			var (
+				e   []streamEntry
+				err error
+			)
+			if ids[j] == nil {
+				e, err = typeStreamGroupDeliver(ctx, key, group, consumer, cnt, noAck, now)
+			} else {
+				e, err = typeStreamGroupHistory(ctx, key, group, consumer, *ids[j], cnt)
+			}
+			if err != nil {
+				ctx.Conn.WriteError(err.Error())
+				return true
+			}
+
+			if len(e) > 0 || ids[j] != nil {
+				found = append(found, key)
+				entries = append(entries, e)
+			}
+		}
+		if len(found) == 0 {
+			return false
+		}
+
+		ctx.Conn.WriteArray(len(found))
+		for j, key := range found {
+			ctx.Conn.WriteArray(2)
+			ctx.Conn.WriteBulk(key)
+			writeStreamEntries(ctx, entries[j])
+		}
+		return true
+	}
+
+	if block < 0 {
+		if !read() {
+			ctx.Conn.WriteNull()
+		}
+		return
+	}
+
+	wakeup := ctx.app.waiters.watch(keys)
+	defer ctx.app.waiters.unwatch(keys, wakeup)
+
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(time.Duration(block) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for !read() {
+		select {
+		case <-wakeup:
+		case <-timeout:
+			ctx.Conn.WriteNull()
+			return
+		}
+	}
+}
+
+func xackCommandFunc(ctx Context) {
+	if len(ctx.args) < 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var key, group = ctx.args[1], ctx.args[2]
+	var pendingToDel [][]byte
+	for _, arg := range ctx.args[3:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		pendingToDel = append(pendingToDel, typeStreamMarshalPending(key, group, id))
+	}
+
+	streamGroupMu.Lock()
+	defer streamGroupMu.Unlock()
+
+	_, err := typeStreamGetMeta(ctx, key)
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var (
+		acked [][]byte
+		check = make(map[string]struct{})
+	)
+	for _, pending := range pendingToDel {
+		if _, ok := check[string(pending)]; ok {
+			continue
+		}
+		check[string(pending)] = struct{}{}
+
+		_, err := ctx.db.Get(pending)
+		if err == nil {
+			acked = append(acked, pending)
+		}
+	}
+
+	if len(acked) > 0 {
+		err = ctx.db.Del(acked)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	ctx.Conn.WriteInt(len(acked))
+}
+
+func xpendingCommandFunc(ctx Context) {
+	if len(ctx.args) < 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var key, group = ctx.args[1], ctx.args[2]
+	_, err := typeStreamGroupGet(ctx, key, group)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	if len(ctx.args) == 3 {
+		xpendingSummary(ctx)
+		return
+	}
+
+	var (
+		i             = 3
+		minIdle int64 = 0
+	)
+	if strings.ToLower(string(ctx.args[3])) == "idle" {
+		if len(ctx.args) < 5 {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		minIdle, err = strconv.ParseInt(string(ctx.args[4]), 10, 64)
+		if err != nil {
+			ctx.Conn.WriteError(ErrValue)
+			return
+		}
+		i = 5
+	}
+	if len(ctx.args)-i != 3 && len(ctx.args)-i != 4 {
+		ctx.Conn.WriteError(ErrSyntax)
+		return
+	}
+
+	start, startOk, err := parseStreamRangeID(ctx.args[i], true)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	end, endOk, err := parseStreamRangeID(ctx.args[i+1], false)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	cnt, err := strconv.ParseInt(string(ctx.args[i+2]), 10, 64)
+	if err != nil {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+	var consumer []byte
+	if len(ctx.args)-i == 4 {
+		consumer = ctx.args[i+3]
+	}
+
+	var (
+		pending []streamPending
+		now     = streamNow()
+	)
+	if startOk && endOk && !end.less(start) && cnt > 0 {
+		for _, p := range typeStreamPendingScan(ctx, key, group, start, end, 0) {
+			if consumer != nil && !bytes.Equal(p.consumer, consumer) {
+				continue
+			}
+			if now-p.time < minIdle {
+				continue
+			}
+
+			pending = append(pending, p)
+			if int64(len(pending)) >= cnt {
+				break
+			}
+		}
+	}
+
+	ctx.Conn.WriteArray(len(pending))
+	for _, p := range pending {
+		ctx.Conn.WriteArray(4)
+		ctx.Conn.WriteBulkString(p.id.String())
+		ctx.Conn.WriteBulk(p.consumer)
+		ctx.Conn.WriteInt64(now - p.time)
+		ctx.Conn.WriteUint64(p.count)
+	}
+}
+
+func xpendingSummary(ctx Context) {
+	var (
+		pending   = typeStreamPendingScan(ctx, ctx.args[1], ctx.args[2], streamIDMin, streamIDMax, 0)
+		consumers = make(map[string]int)
+		names     []string
+	)
+	if len(pending) == 0 {
+		ctx.Conn.WriteArray(4)
+		ctx.Conn.WriteInt(0)
+		ctx.Conn.WriteNull()
+		ctx.Conn.WriteNull()
+		ctx.Conn.WriteNull()
+		return
+	}
+
+	for _, p := range pending {
+		if _, ok := consumers[string(p.consumer)]; !ok {
+			names = append(names, string(p.consumer))
+		}
+		consumers[string(p.consumer)]++
+	}
+	sort.Strings(names)
+
+	ctx.Conn.WriteArray(4)
+	ctx.Conn.WriteInt(len(pending))
+	ctx.Conn.WriteBulkString(pending[0].id.String())
+	ctx.Conn.WriteBulkString(pending[len(pending)-1].id.String())
+	ctx.Conn.WriteArray(len(names))
+	for _, name := range names {
+		ctx.Conn.WriteArray(2)
+		ctx.Conn.WriteBulkString(name)
+		ctx.Conn.WriteBulkString(strconv.Itoa(consumers[name]))
+	}
+}
+
+func xclaimCommandFunc(ctx Context) {
+	if len(ctx.args) < 6 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		key      = ctx.args[1]
+		group    = ctx.args[2]
+		consumer = ctx.args[3]
+		ids      []streamID
+		i        = 5
+	)
+	minIdle, err := strconv.ParseInt(string(ctx.args[4]), 10, 64)
+	if err != nil {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+	for ; i < len(ctx.args); i++ {
+		id, err := parseStreamID(ctx.args[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		ctx.Conn.WriteError(ErrStreamID)
+		return
+	}
+
+	var (
+		now                = streamNow()
+		deliveryTime       = now
+		retryCount   int64 = -1
+		force              = false
+		justID             = false
+		lastID       *streamID
+	)
+	for ; i < len(ctx.args); i++ {
+		opt := strings.ToLower(string(ctx.args[i]))
+		switch opt {
+		case "force":
+			force = true
+			continue
+		case "justid":
+			justID = true
+			continue
+		}
+
+		if i+1 >= len(ctx.args) {
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+		i++
+		switch opt {
+		case "idle", "time", "retrycount":
+			v, err := strconv.ParseInt(string(ctx.args[i]), 10, 64)
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+			if opt == "idle" {
+				deliveryTime = now - v
+			} else if opt == "time" {
+				deliveryTime = v
+			} else {
+				retryCount = v
+			}
+		case "lastid":
+			id, err := parseStreamID(ctx.args[i], 0)
+			if err != nil {
+				ctx.Conn.WriteError(err.Error())
+				return
+			}
+			lastID = &id
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+
+	streamGroupMu.Lock()
+	defer streamGroupMu.Unlock()
+
+	last, err := typeStreamGroupGet(ctx, key, group)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if lastID != nil && last.less(*lastID) {
+		err = ctx.db.Set(typeStreamMarshalGroup(key, group), lastID.bytes(), 0)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	var claimed []streamEntry
+	for _, id := range ids {
+		p := typeStreamPendingGet(ctx, key, group, id)
+		entry := typeStreamGetEntry(ctx, key, id)
+		if p == nil {
+			if !force || entry == nil {
+				continue
+			}
+			p = &streamPending{id: id}
+		} else if entry == nil {
+			ctx.db.Del([][]byte{typeStreamMarshalPending(key, group, id)})
+			continue
+		} else if now-p.time < minIdle {
+			continue
+		}
+
+		p.consumer = consumer
+		p.time = deliveryTime
+		if retryCount >= 0 {
+			p.count = uint64(retryCount)
+		} else if !justID {
+			p.count++
+		}
+		err = typeStreamPendingSet(ctx, key, group, p)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+
+		claimed = append(claimed, *entry)
+	}
+
+	err = typeStreamConsumerTouch(ctx, key, group, consumer, now)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	if justID {
+		ctx.Conn.WriteArray(len(claimed))
+		for _, e := range claimed {
+			ctx.Conn.WriteBulkString(e.id.String())
+		}
+		return
+	}
+	writeStreamEntries(ctx, claimed)
+}
+
+func xautoclaimCommandFunc(ctx Context) {
+	if len(ctx.args) < 6 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		key      = ctx.args[1]
+		group    = ctx.args[2]
+		consumer = ctx.args[3]
+		cnt      = int64(streamAutoClaimCount)
+		justID   = false
+	)
+	minIdle, err := strconv.ParseInt(string(ctx.args[4]), 10, 64)
+	if err != nil {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+	start, startOk, err := parseStreamRangeID(ctx.args[5], true)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	for i := 6; i < len(ctx.args); i++ {
+		switch strings.ToLower(string(ctx.args[i])) {
+		case "count":
+			if i+1 >= len(ctx.args) {
+				ctx.Conn.WriteError(ErrSyntax)
+				return
+			}
+			i++
+			cnt, err = strconv.ParseInt(string(ctx.args[i]), 10, 64)
+			if err != nil || cnt < 1 {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+		case "justid":
+			justID = true
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+
+	streamGroupMu.Lock()
+	defer streamGroupMu.Unlock()
+
+	_, err = typeStreamGroupGet(ctx, key, group)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	var (
+		now      = streamNow()
+		next     = streamIDMin
+		attempts = cnt * 10
+		claimed  []streamEntry
+		deleted  []streamID
+		pending  []streamPending
+	)
+	if startOk {
+		pending = typeStreamPendingScan(ctx, key, group, start, streamIDMax, attempts+1)
+	}
+	for n, p := range pending {
+		if int64(len(claimed)) >= cnt || int64(n) >= attempts {
+			next = p.id
+			break
+		}
+		if now-p.time < minIdle {
+			continue
+		}
+
+		entry := typeStreamGetEntry(ctx, key, p.id)
+		if entry == nil {
+			ctx.db.Del([][]byte{typeStreamMarshalPending(key, group, p.id)})
+			deleted = append(deleted, p.id)
+			continue
+		}
+
+		p.consumer = consumer
+		p.time = now
+		if !justID {
+			p.count++
+		}
+		err = typeStreamPendingSet(ctx, key, group, &p)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		claimed = append(claimed, *entry)
+	}
+
+	err = typeStreamConsumerTouch(ctx, key, group, consumer, now)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.Conn.WriteArray(3)
+	ctx.Conn.WriteBulkString(next.String())
+	if justID {
+		ctx.Conn.WriteArray(len(claimed))
+		for _, e := range claimed {
+			ctx.Conn.WriteBulkString(e.id.String())
+		}
+	} else {
+		writeStreamEntries(ctx, claimed)
+	}
+	ctx.Conn.WriteArray(len(deleted))
+	for _, id := range deleted {
+		ctx.Conn.WriteBulkString(id.String())
+	}
+}
+
+// typeStreamGroupDeliver reads the entries never delivered to the group and
+// adds them to the pending entries list of consumer, the caller must hold
+// streamGroupMu.
+func typeStreamGroupDeliver(ctx Context, key, group, consumer []byte, cnt int64, noAck bool, now int64) ([]streamEntry, error) {
+	last, err := typeStreamGroupGet(ctx, key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	err = typeStreamConsumerTouch(ctx, key, group, consumer, now)
+	if err != nil {
+		return nil, err
+	}
+
+	start, ok := last.next()
+	if !ok {
+		return nil, nil
+	}
+	entries := typeStreamRange(ctx, key, start, streamIDMax, cnt)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	var (
+		keys   = [][]byte{typeStreamMarshalGroup(key, group)}
+		values = [][]byte{entries[len(entries)-1].id.bytes()}
+	)
+	if !noAck {
+		for _, e := range entries {
+			p := streamPending{id: e.id, consumer: consumer, time: now, count: 1}
+			keys = append(keys, typeStreamMarshalPending(key, group, e.id))
+			values = append(values, typeStreamMarshalPendingVal(&p))
+		}
+	}
+
+	err = ctx.db.MSet(keys, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// typeStreamGroupHistory returns the entries pending for consumer after id.
+func typeStreamGroupHistory(ctx Context, key, group, consumer []byte, id streamID, cnt int64) ([]streamEntry, error) {
+	_, err := typeStreamGroupGet(ctx, key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	start, ok := id.next()
+	if !ok {
+		return nil, nil
+	}
+
+	var entries = []streamEntry{}
+	for _, p := range typeStreamPendingScan(ctx, key, group, start, streamIDMax, 0) {
+		if !bytes.Equal(p.consumer, consumer) {
+			continue
+		}
+
+		entry := typeStreamGetEntry(ctx, key, p.id)
+		if entry == nil {
+			entry = &streamEntry{id: p.id}
+		}
+		entries = append(entries, *entry)
+		if cnt > 0 && int64(len(entries)) >= cnt {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+// typeStreamGroupGet returns the last delivered ID of group.
+func typeStreamGroupGet(ctx Context, key, group []byte) (streamID, error) {
+	_, err := typeStreamGetMeta(ctx, key)
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			return streamIDMin, fmt.Errorf(ErrNoGroup, key, group)
+		}
+		return streamIDMin, err
+	}
+
+	v, err := ctx.db.Get(typeStreamMarshalGroup(key, group))
+	if err != nil {
+		return streamIDMin, fmt.Errorf(ErrNoGroup, key, group)
+	}
+
+	return bytesToStreamID(v), nil
+}
+
+func typeStreamConsumerTouch(ctx Context, key, group, consumer []byte, now int64) error {
+	return ctx.db.Set(typeStreamMarshalConsumer(key, group, consumer), uint64ToBytes(8, uint64(now)), 0)
+}
+
+func typeStreamGetEntry(ctx Context, key []byte, id streamID) *streamEntry {
+	v, err := ctx.db.Get(typeStreamMarshalEntry(key, id))
+	if err != nil {
+		return nil
+	}
+
+	return &streamEntry{id: id, fields: typeStreamUnmarshalFields(v)}
+}
+
+func typeStreamPendingGet(ctx Context, key, group []byte, id streamID) *streamPending {
+	v, err := ctx.db.Get(typeStreamMarshalPending(key, group, id))
+	if err != nil {
+		return nil
+	}
+
+	return typeStreamUnmarshalPending(id, v)
+}
+
+func typeStreamPendingSet(ctx Context, key, group []byte, p *streamPending) error {
+	return ctx.db.Set(typeStreamMarshalPending(key, group, p.id), typeStreamMarshalPendingVal(p), 0)
+}
+
+func typeStreamPendingScan(ctx Context, key, group []byte, start, end streamID, cnt int64) []streamPending {
+	var (
+		pending  []streamPending
+		scanFunc = func(k, v []byte) {
+			id := bytesToStreamID(k[len(k)-typeStreamIDSize:])
+			pending = append(pending, *typeStreamUnmarshalPending(id, v))
+		}
+	)
+
+	scanOpts := storage.ScannerOptions{
+		Prefix:      typeStreamGroupPrefix(key, typeStreamPendingTag, group),
+		Start:       typeStreamMarshalPending(key, group, start),
+		End:         typeStreamMarshalPending(key, group, end),
+		FetchValues: true,
+		Handler:     scanFunc,
+		Count:       cnt,
+	}
+	ctx.db.Scan(scanOpts)
+
+	return pending
+}
+
+// typeStreamGroupScan returns every key starting with prefix.
+func typeStreamGroupScan(ctx Context, prefix []byte) [][]byte {
+	var keys [][]byte
+	var scanFunc = func(k, v []byte) {
+		keys = append(keys, k)
+	}
+
+	scanOpts := storage.ScannerOptions{
+		Prefix:      prefix,
+		FetchValues: false,
+		Handler:     scanFunc,
+	}
+	ctx.db.Scan(scanOpts)
+
+	return keys
+}
+
+// typeStreamGroupKeyPrefix is the prefix of all the consumer group state of a
+// stream.
+func typeStreamGroupKeyPrefix(key []byte) []byte {
+	var keySize = uint32ToBytes(typeStreamGroupKeySize, uint32(len(key)))
+	prefixBuff := bytes.NewBuffer([]byte{})
+	prefixBuff.Write(typeStreamGroup)
+	prefixBuff.Write(keySize)
+	prefixBuff.Write(key)
+
+	return prefixBuff.Bytes()
+}
+
+func typeStreamGroupPrefix(key []byte, tag byte, group []byte) []byte {
+	var groupSize = uint32ToBytes(typeStreamGroupKeySize, uint32(len(group)))
+	prefixBuff := bytes.NewBuffer(typeStreamGroupKeyPrefix(key))
+	prefixBuff.WriteByte(tag)
+	prefixBuff.Write(groupSize)
+	prefixBuff.Write(group)
+
+	return prefixBuff.Bytes()
+}
+
+func typeStreamMarshalGroup(key, group []byte) []byte {
+	return typeStreamGroupPrefix(key, typeStreamGroupTag, group)
+}
+
+func typeStreamMarshalConsumer(key, group, consumer []byte) []byte {
+	return append(typeStreamGroupPrefix(key, typeStreamConsumerTag, group), consumer...)
+}
+
+func typeStreamMarshalPending(key, group []byte, id streamID) []byte {
+	return append(typeStreamGroupPrefix(key, typeStreamPendingTag, group), id.bytes()...)
+}
+
+func typeStreamMarshalPendingVal(p *streamPending) []byte {
+	valBuff := bytes.NewBuffer([]byte{})
+	valBuff.Write(uint32ToBytes(4, uint32(len(p.consumer))))
+	valBuff.Write(p.consumer)
+	valBuff.Write(uint64ToBytes(8, uint64(p.time)))
+	valBuff.Write(uint64ToBytes(8, p.count))
+
+	return valBuff.Bytes()
+}
+
+func typeStreamUnmarshalPending(id streamID, v []byte) *streamPending {
+	size := bytesToUint32(v[:4])
+	v = v[4:]
+
+	return &streamPending{
+		id:       id,
+		consumer: v[:size],
+		time:     int64(bytesToUint64(v[size : size+8])),
+		count:    bytesToUint64(v[size+8 : size+16]),
+	}
+}
+
+// streamNow returns the current unix time in milliseconds.
+func streamNow() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
@@ -3,8 +3,10 @@ package server
 import (
 	"errors"
 	"fmt"
+	"github.com/qichengzx/raptor/storage"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -25,8 +27,17 @@ const (
 	cmdMSet        = "mset"
 	cmdMSetNX      = "msetnx"
 	cmdMGet        = "mget"
+	cmdMSetEX      = "msetex"
+	cmdSetRange    = "setrange"
+	cmdGetDel      = "getdel"
+	cmdGetEX       = "getex"
+	cmdLCS         = "lcs"
+	cmdSubstr      = "substr"
 )
 
+// stringMaxSize is the largest value a string can grow to, 512MB.
+const stringMaxSize = 512 * 1024 * 1024
+
 var typeString = []byte("s")
 
 func setCommandFunc(ctx Context) {
@@ -127,6 +138,11 @@ func setCommandFunc(ctx Context) {
 	if err != nil {
 		ctx.Conn.WriteNull()
 	} else {
+		ctx.notify(notifyString, "set", ctx.args[1])
+		if ttl > 0 {
+			ctx.notify(notifyGeneric, "expire", ctx.args[1])
+			ctx.watchExpire(ctx.args[1], ttl)
+		}
 		ctx.Conn.WriteString(RespOK)
 	}
 }
@@ -152,6 +168,7 @@ func setnxCommandFunc(ctx Context) {
 	if err != nil {
 		ctx.Conn.WriteInt(RespErr)
 	} else {
+		ctx.notify(notifyString, "set", ctx.args[1])
 		ctx.Conn.WriteInt(RespSucc)
 	}
 }
@@ -174,6 +191,9 @@ func setexCommandFunc(ctx Context) {
 
 	err = ctx.db.Set(ctx.args[1], append(typeString, ctx.args[3]...), seconds)
 	if err == nil {
+		ctx.notify(notifyString, "set", ctx.args[1])
+		ctx.notify(notifyGeneric, "expire", ctx.args[1])
+		ctx.watchExpire(ctx.args[1], seconds)
 		ctx.Conn.WriteString(RespOK)
 	} else {
 		ctx.Conn.WriteNull()
@@ -199,6 +219,9 @@ func psetexCommandFunc(ctx Context) {
 
 	err = ctx.db.Set(ctx.args[1], append(typeString, ctx.args[3]...), seconds)
 	if err == nil {
+		ctx.notify(notifyString, "set", ctx.args[1])
+		ctx.notify(notifyGeneric, "expire", ctx.args[1])
+		ctx.watchExpire(ctx.args[1], seconds)
 		ctx.Conn.WriteString(RespOK)
 	} else {
 		ctx.Conn.WriteNull()
@@ -240,6 +263,7 @@ func getsetCommandFunc(ctx Context) {
 		ctx.Conn.WriteNull()
 		return
 	}
+	ctx.notify(notifyString, "set", ctx.args[1])
 	if val == nil {
 		ctx.Conn.WriteNull()
 		return
@@ -284,6 +308,7 @@ func appendCommandFunc(ctx Context) {
 	val = append(val, ctx.args[2]...)
 	err = ctx.db.Set(ctx.args[1], val, 0)
 	if err == nil {
+		ctx.notify(notifyString, "append", ctx.args[1])
 		ctx.Conn.WriteInt(len(val[1:]))
 	} else {
 		ctx.Conn.WriteInt(0)
@@ -306,7 +331,7 @@ func getrangeCommandFunc(ctx Context) {
 		return
 	}
 
-	offset, err := strconv.ParseInt(string(ctx.args[2]), 10, 64)
+	start, err := strconv.ParseInt(string(ctx.args[2]), 10, 64)
 	if err != nil {
 		ctx.Conn.WriteError(ErrValue)
 		return
@@ -317,17 +342,33 @@ func getrangeCommandFunc(ctx Context) {
 		return
 	}
 
+	// negative offsets count from the end of the value
 	length := int64(len(val[1:]))
-	if offset > length {
-		ctx.Conn.WriteString("")
+	if start < 0 && end < 0 && start > end {
+		ctx.Conn.WriteBulkString("")
 		return
 	}
-
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
 	if end >= length {
-		ctx.Conn.WriteBulk(val[offset+1:])
+		end = length - 1
+	}
+	if start > end || length == 0 {
+		ctx.Conn.WriteBulkString("")
 		return
 	}
-	ctx.Conn.WriteBulk(val[offset+1 : end+2])
+
+	ctx.Conn.WriteBulk(val[start+1 : end+2])
 }
 
 func incrCommandFunc(ctx Context) {
@@ -358,6 +399,7 @@ func incrCommandFunc(ctx Context) {
 		ctx.Conn.WriteError(err.Error())
 		return
 	}
+	ctx.notify(notifyString, "incrby", ctx.args[1])
 	ctx.Conn.WriteInt64(valInt)
 }
 
@@ -394,6 +436,7 @@ func incrByCommandFunc(ctx Context) {
 		ctx.Conn.WriteError(err.Error())
 		return
 	}
+	ctx.notify(notifyString, "incrby", ctx.args[1])
 	ctx.Conn.WriteInt64(valInt)
 }
 
@@ -425,6 +468,7 @@ func decrCommandFunc(ctx Context) {
 		ctx.Conn.WriteError(err.Error())
 		return
 	}
+	ctx.notify(notifyString, "incrby", ctx.args[1])
 	ctx.Conn.WriteInt64(valInt)
 }
 
@@ -462,6 +506,7 @@ func decrByCommandFunc(ctx Context) {
 		ctx.Conn.WriteError(err.Error())
 		return
 	}
+	ctx.notify(notifyString, "incrby", ctx.args[1])
 	ctx.Conn.WriteInt64(valInt)
 }
 
@@ -499,6 +544,7 @@ func incrByFloatCommandFunc(ctx Context) {
 		ctx.Conn.WriteError(err.Error())
 		return
 	}
+	ctx.notify(notifyString, "incrbyfloat", ctx.args[1])
 	ctx.Conn.WriteString(strconv.FormatFloat(valFloat, 'f', 17, 64))
 }
 
@@ -522,6 +568,9 @@ func msetCommandFunc(ctx Context) {
 		ctx.Conn.WriteError(err.Error())
 		return
 	}
+	for _, key := range keys {
+		ctx.notify(notifyString, "set", key)
+	}
 
 	ctx.Conn.WriteString(RespOK)
 }
@@ -545,6 +594,9 @@ func msetnxCommandFunc(ctx Context) {
 	if err != nil {
 		ctx.Conn.WriteInt(0)
 	} else {
+		for _, key := range keys {
+			ctx.notify(notifyString, "set", key)
+		}
 		ctx.Conn.WriteInt(1)
 	}
 }
@@ -576,6 +628,438 @@ func mgetCommandFunc(ctx Context) {
 	}
 }
 
+func setrangeCommandFunc(ctx Context) {
+	if len(ctx.args) != 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	offset, err := strconv.ParseInt(string(ctx.args[2]), 10, 64)
+	if err != nil {
+		ctx.Conn.WriteError(ErrValue)
+		return
+	}
+	if offset < 0 {
+		ctx.Conn.WriteError(ErrOffset)
+		return
+	}
+
+	val, err := typeStringGetVal(ctx, ctx.args[1])
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	if val == nil {
+		val = typeString
+	}
+
+	var value = ctx.args[3]
+	if len(value) == 0 {
+		ctx.Conn.WriteInt(len(val[1:]))
+		return
+	}
+	if offset+int64(len(value)) > stringMaxSize {
+		ctx.Conn.WriteError(ErrStringSize)
+		return
+	}
+
+	// offsets are relative to the value, after its type prefix
+	if end := int(offset) + len(value) + 1; end > len(val) {
+		grown := make([]byte, end)
+		copy(grown, val)
+		val = grown
+	}
+	copy(val[offset+1:], value)
+
+	err = setKeepTTL(ctx, ctx.args[1], val)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.notify(notifyString, "setrange", ctx.args[1])
+	ctx.Conn.WriteInt(len(val[1:]))
+}
+
+func getdelCommandFunc(ctx Context) {
+	if len(ctx.args) != 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	val, err := typeStringGetVal(ctx, ctx.args[1])
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			ctx.Conn.WriteNull()
+			return
+		}
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	err = ctx.db.Del([][]byte{ctx.args[1]})
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.forgetExpire(ctx.args[1])
+	ctx.forgetAccess(ctx.args[1])
+	ctx.notify(notifyGeneric, "del", ctx.args[1])
+	ctx.Conn.WriteBulk(val[1:])
+}
+
+func getexCommandFunc(ctx Context) {
+	if len(ctx.args) < 2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		seconds = 0
+		expire  = false
+		persist = false
+	)
+	for i := 2; i < len(ctx.args); i++ {
+		opt := strings.ToLower(string(ctx.args[i]))
+		switch {
+		case opt == "persist" && !expire && !persist:
+			persist = true
+		case (opt == "ex" || opt == "px" || opt == "exat" || opt == "pxat") && !expire && !persist && i+1 < len(ctx.args):
+			var err error
+			seconds, err = parseStringExpire(ctx.cmd, opt, ctx.args[i+1])
+			if err != nil {
+				ctx.Conn.WriteError(err.Error())
+				return
+			}
+			expire = true
+			i++
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+
+	val, err := typeStringGetVal(ctx, ctx.args[1])
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			ctx.Conn.WriteNull()
+			return
+		}
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	switch {
+	case expire && seconds <= 0:
+		// an absolute time in the past expires the key right away
+		err = ctx.db.Del([][]byte{ctx.args[1]})
+		if err == nil {
+			ctx.forgetExpire(ctx.args[1])
+			ctx.notify(notifyGeneric, "del", ctx.args[1])
+		}
+	case expire:
+		err = ctx.db.Expire(ctx.args[1], seconds)
+		if err == nil {
+			ctx.notify(notifyGeneric, "expire", ctx.args[1])
+			ctx.watchExpire(ctx.args[1], seconds)
+		}
+	case persist:
+		if ctx.db.Persist(ctx.args[1]) == nil {
+			ctx.forgetExpire(ctx.args[1])
+			ctx.notify(notifyGeneric, "persist", ctx.args[1])
+		}
+	}
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+
+	ctx.Conn.WriteBulk(val[1:])
+}
+
+func msetexCommandFunc(ctx Context) {
+	if len(ctx.args) < 4 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	numkeys, err := strconv.Atoi(string(ctx.args[1]))
+	if err != nil || numkeys <= 0 {
+		ctx.Conn.WriteError(ErrNumKeys)
+		return
+	}
+	if len(ctx.args) < 2+numkeys*2 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		nx, xx, keepTTL bool
+		expire          = false
+		seconds         = 0
+	)
+	for i := 2 + numkeys*2; i < len(ctx.args); i++ {
+		opt := strings.ToLower(string(ctx.args[i]))
+		switch {
+		case opt == "nx" && !xx:
+			nx = true
+		case opt == "xx" && !nx:
+			xx = true
+		case opt == "keepttl" && !expire:
+			keepTTL = true
+		case (opt == "ex" || opt == "px" || opt == "exat" || opt == "pxat") && !expire && !keepTTL && i+1 < len(ctx.args):
+			seconds, err = parseStringExpire(ctx.cmd, opt, ctx.args[i+1])
+			if err != nil {
+				ctx.Conn.WriteError(err.Error())
+				return
+			}
+			expire = true
+			i++
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+
+	var keys, values [][]byte
+	for i := 2; i < 2+numkeys*2; i += 2 {
+		keys = append(keys, ctx.args[i])
+		values = append(values, append(typeString, ctx.args[i+1]...))
+	}
+
+	// either every key is set or none of them
+	var ttls = make([]int, len(keys))
+	for i, key := range keys {
+		ttl, _ := ctx.db.TTL(key)
+		if (nx && ttl != -2) || (xx && ttl == -2) {
+			ctx.Conn.WriteInt(0)
+			return
+		}
+		if keepTTL && ttl > 0 {
+			ttls[i] = int(ttl)
+		}
+		if expire {
+			ttls[i] = seconds
+		}
+	}
+
+	for i, key := range keys {
+		if expire && seconds <= 0 {
+			err = ctx.db.Del([][]byte{key})
+		} else {
+			err = ctx.db.Set(key, values[i], 0)
+			if err == nil && ttls[i] > 0 {
+				err = ctx.db.Expire(key, ttls[i])
+			}
+		}
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	for i, key := range keys {
+		ctx.notify(notifyString, "set", key)
+		if expire {
+			ctx.notify(notifyGeneric, "expire", key)
+			ctx.watchExpire(key, ttls[i])
+		} else if !keepTTL {
+			ctx.forgetExpire(key)
+		}
+	}
+
+	ctx.Conn.WriteInt(1)
+}
+
+func lcsCommandFunc(ctx Context) {
+	if len(ctx.args) < 3 {
+		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
+		return
+	}
+
+	var (
+		getLen, getIdx, withMatchLen bool
+		minMatchLen                  = 0
+	)
+	for i := 3; i < len(ctx.args); i++ {
+		switch strings.ToLower(string(ctx.args[i])) {
+		case "len":
+			getLen = true
+		case "idx":
+			getIdx = true
+		case "withmatchlen":
+			withMatchLen = true
+		case "minmatchlen":
+			if i+1 >= len(ctx.args) {
+				ctx.Conn.WriteError(ErrSyntax)
+				return
+			}
+			n, err := strconv.Atoi(string(ctx.args[i+1]))
+			if err != nil {
+				ctx.Conn.WriteError(ErrValue)
+				return
+			}
+			if n > 0 {
+				minMatchLen = n
+			}
+			i++
+		default:
+			ctx.Conn.WriteError(ErrSyntax)
+			return
+		}
+	}
+	if getLen && getIdx {
+		ctx.Conn.WriteError(ErrLCSLenIdx)
+		return
+	}
+
+	var strs [2][]byte
+	for i, key := range ctx.args[1:3] {
+		val, err := typeStringGetVal(ctx, key)
+		if err != nil && err.Error() != ErrKeyNotExist {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		if val != nil {
+			strs[i] = val[1:]
+		}
+	}
+
+	var (
+		a, b       = strs[0], strs[1]
+		alen, blen = len(a), len(b)
+	)
+	if uint64(alen+1)*uint64(blen+1)*4 > stringMaxSize {
+		ctx.Conn.WriteError(ErrLCSMemory)
+		return
+	}
+
+	// dp[i*(blen+1)+j] is the length of the LCS of a[:i] and b[:j]
+	var dp = make([]uint32, (alen+1)*(blen+1))
+	var lcs = func(i, j int) uint32 {
+		return dp[i*(blen+1)+j]
+	}
+	for i := 1; i <= alen; i++ {
+		for j := 1; j <= blen; j++ {
+			switch {
+			case a[i-1] == b[j-1]:
+				dp[i*(blen+1)+j] = lcs(i-1, j-1) + 1
+			case lcs(i-1, j) > lcs(i, j-1):
+				dp[i*(blen+1)+j] = lcs(i-1, j)
+			default:
+				dp[i*(blen+1)+j] = lcs(i, j-1)
+			}
+		}
+	}
+
+	var idx = lcs(alen, blen)
+	if getLen {
+		ctx.Conn.WriteInt64(int64(idx))
+		return
+	}
+
+	// walk back from the end of both strings, collecting the common bytes
+	// and the ranges of contiguous matches
+	type lcsMatch struct {
+		aStart, aEnd, bStart, bEnd int
+	}
+	var (
+		result                     = make([]byte, idx)
+		matches                    []lcsMatch
+		aStart, aEnd, bStart, bEnd = alen, 0, 0, 0
+		i, j                       = alen, blen
+	)
+	for i > 0 && j > 0 {
+		var emit = false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if aStart == alen {
+				aStart, aEnd = i-1, i-1
+				bStart, bEnd = j-1, j-1
+			} else if aStart == i && bStart == j {
+				aStart--
+				bStart--
+			} else {
+				emit = true
+			}
+			if aStart == 0 || bStart == 0 {
+				emit = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if lcs(i-1, j) > lcs(i, j-1) {
+				i--
+			} else {
+				j--
+			}
+			if aStart != alen {
+				emit = true
+			}
+		}
+
+		if emit {
+			if aEnd-aStart+1 >= minMatchLen {
+				matches = append(matches, lcsMatch{aStart, aEnd, bStart, bEnd})
+			}
+			aStart = alen
+		}
+	}
+
+	if !getIdx {
+		ctx.Conn.WriteBulk(result)
+		return
+	}
+
+	var fields = 2
+	if withMatchLen {
+		fields = 3
+	}
+	ctx.Conn.WriteArray(4)
+	ctx.Conn.WriteBulkString("matches")
+	ctx.Conn.WriteArray(len(matches))
+	for _, m := range matches {
+		ctx.Conn.WriteArray(fields)
+		ctx.Conn.WriteArray(2)
+		ctx.Conn.WriteInt(m.aStart)
+		ctx.Conn.WriteInt(m.aEnd)
+		ctx.Conn.WriteArray(2)
+		ctx.Conn.WriteInt(m.bStart)
+		ctx.Conn.WriteInt(m.bEnd)
+		if withMatchLen {
+			ctx.Conn.WriteInt(m.aEnd - m.aStart + 1)
+		}
+	}
+	ctx.Conn.WriteBulkString("len")
+	ctx.Conn.WriteInt64(int64(len(result)))
+}
+
+// parseStringExpire returns the TTL in seconds given by an EX, PX, EXAT or
+// PXAT option, rounding milliseconds up. It is not positive when an
+// absolute time is already past.
+func parseStringExpire(cmd, opt string, arg []byte) (int, error) {
+	v, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, errors.New(ErrValue)
+	}
+	if v <= 0 {
+		return 0, fmt.Errorf(ErrExpireTimeCmd, cmd)
+	}
+
+	switch opt {
+	case "ex":
+		return int(v), nil
+	case "px":
+		return int((v + 999) / 1000), nil
+	case "exat":
+		return int(v - time.Now().Unix()), nil
+	}
+
+	return int((v - time.Now().UnixNano()/int64(time.Millisecond) + 999) / 1000), nil
+}
+
 func typeStringGetVal(ctx Context, key []byte) ([]byte, error) {
 	val, err := ctx.db.Get(key)
 	if err != nil && err.Error() == ErrKeyNotExist {
@@ -590,3 +1074,14 @@ func typeStringGetVal(ctx Context, key []byte) ([]byte, error) {
 
 	return val, nil
 }
+
+// setKeepTTL rewrites the value of key keeping its expiration, as SET KEEPTTL
+// does, for the commands modifying a value in place.
+func setKeepTTL(ctx Context, key, value []byte) error {
+	at, err := ctx.db.ExpiresAt(key)
+	if err != nil || at == 0 {
+		return ctx.db.Set(key, value, 0)
+	}
+
+	return ctx.db.WriteBatch([]storage.Entry{{Key: key, Value: value, ExpiresAt: at}})
+}
@@ -78,3 +78,25 @@ func TestSetEX(t *testing.T) {
 		t.Error("could not read from connection")
 	}
 }
+
+func TestSetRange(t *testing.T) {
+	var c = newTestClient(t, newTestApp(t))
+
+	// offsets past the end pad the value with zero bytes
+	c.must(":8\r\n", "setrange", "r", "3", "hello")
+	c.must("$8\r\n\x00\x00\x00hello\r\n", "get", "r")
+	c.must(":8\r\n", "setrange", "r", "0", "ab")
+	c.must("$8\r\nab\x00hello\r\n", "get", "r")
+	c.must(":12\r\n", "setrange", "r", "10", "yz")
+	c.must("$12\r\nab\x00hello\x00\x00yz\r\n", "get", "r")
+	c.must(":12\r\n", "setrange", "r", "20", "")
+	c.must("$12\r\nab\x00hello\x00\x00yz\r\n", "get", "r")
+	c.must(":0\r\n", "setrange", "none", "5", "")
+	c.must(":0\r\n", "exists", "none")
+	c.must("-"+ErrOffset+"\r\n", "setrange", "r", "-1", "x")
+
+	c.must(":1\r\n", "expireat", "r", "4000000000")
+	c.must(":12\r\n", "setrange", "r", "2", "c")
+	c.expiresAt("r", testExpiresAt)
+	c.must("$12\r\nabchello\x00\x00yz\r\n", "get", "r")
+}
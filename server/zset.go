@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"github.com/qichengzx/raptor/storage/badger"
+	"github.com/qichengzx/raptor/raptor"
+	"github.com/qichengzx/raptor/storage"
+	"log"
+	"math"
 	"strconv"
 )
 
@@ -24,8 +27,18 @@ const (
 var (
 	typeZSet     = []byte("Z")
 	typeZSetSize = uint32(len(typeZSet))
+
+	// typeZSetScore prefixes the score index, whose keys embed the score
+	// encoded so that they sort numerically
+	typeZSetScore = []byte("z")
 )
 
+// zsetFormatScoreIndex is the format version kept after the size in the
+// meta of the sorted sets indexed under typeZSetScore. The ones written
+// before have no version and their index is mixed with the members, as
+// typeZSet keys made of the score string and the member, with no value.
+const zsetFormatScoreIndex = 1
+
 func zaddCommandFunc(ctx Context) {
 	if len(ctx.args) < 4 || len(ctx.args)&1 != 0 {
 		ctx.Conn.WriteError(fmt.Sprintf(ErrWrongArgs, ctx.cmd))
@@ -46,25 +59,28 @@ func zaddCommandFunc(ctx Context) {
 		zsetSize = bytesToUint32(metaValue[1:5])
 	}
 
-	var (
-		cnt uint32 = 0
-		had uint32 = 0
-	)
+	var scores []float64
 	for i := 2; i <= len(ctx.args[1:]); i += 2 {
-		member := typeZSetMarshalMember(key, ctx.args[i+1])
-		_, err := ctx.db.Get(member)
-		if err == nil {
-			had++
+		score, err := parseZSetScore(ctx.args[i])
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
 		}
-		err = ctx.db.Set(member, ctx.args[i], 0)
-		if err == nil {
+		scores = append(scores, score)
+	}
+
+	var cnt uint32 = 0
+	for i, score := range scores {
+		existed, err := typeZSetSetScore(ctx, key, ctx.args[i*2+3], score)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+		if !existed {
 			cnt++
 		}
-		score := typeZSetMarshalScore(key, ctx.args[i], ctx.args[i+1])
-		err = ctx.db.Set(score, nil, 0)
 	}
 
-	cnt -= had
 	zsetSize += cnt
 	err = typeZSetSetMeta(ctx, key, zsetSize)
 	if err != nil {
@@ -72,6 +88,7 @@ func zaddCommandFunc(ctx Context) {
 		return
 	}
 
+	ctx.notify(notifyZSet, "zadd", key)
 	ctx.Conn.WriteInt64(int64(cnt))
 }
 
@@ -108,38 +125,48 @@ func zincrbyCommandFunc(ctx Context) {
 	}
 
 	var key = ctx.args[1]
-	member := typeZSetMarshalMember(key, ctx.args[3])
-	score, err := ctx.db.Get(member)
-	scoreStr := string(score)
-	if err != nil {
-		scoreStr = "0"
+	metaValue, err := typeZSetGetMeta(ctx, key)
+	if err != nil && err.Error() != ErrKeyNotExist {
+		ctx.Conn.WriteError(err.Error())
+		return
 	}
 
-	scoreInt, err := strconv.ParseInt(scoreStr, 10, 64)
+	incr, err := parseZSetScore(ctx.args[2])
 	if err != nil {
-		ctx.Conn.WriteError(ErrValue)
+		ctx.Conn.WriteError(err.Error())
 		return
 	}
-	incr, err := strconv.ParseInt(string(ctx.args[2]), 10, 64)
+
+	score, _, err := typeZSetGetScore(ctx, key, ctx.args[3])
 	if err != nil {
-		ctx.Conn.WriteError(ErrValue)
+		ctx.Conn.WriteError(err.Error())
 		return
 	}
-	scoreInt += incr
-	scoreStr = strconv.FormatInt(scoreInt, 10)
-
-	err = ctx.db.Set(member, score, 0)
-	if err != nil {
-		ctx.Conn.WriteError(ErrValue)
+	score += incr
+	if math.IsNaN(score) {
+		ctx.Conn.WriteError(ErrScoreNaN)
 		return
 	}
-	score = typeZSetMarshalScore(key, []byte(scoreStr), ctx.args[3])
-	err = ctx.db.Set(score, nil, 0)
+
+	existed, err := typeZSetSetScore(ctx, key, ctx.args[3], score)
 	if err != nil {
-		ctx.Conn.WriteError(ErrValue)
+		ctx.Conn.WriteError(err.Error())
 		return
 	}
-	ctx.Conn.WriteBulk([]byte(scoreStr))
+	if !existed {
+		var zsetSize uint32 = 0
+		if metaValue != nil {
+			zsetSize = bytesToUint32(metaValue[1:5])
+		}
+		err = typeZSetSetMeta(ctx, key, zsetSize+1)
+		if err != nil {
+			ctx.Conn.WriteError(err.Error())
+			return
+		}
+	}
+
+	ctx.notify(notifyZSet, "zincr", key)
+	ctx.Conn.WriteBulkString(formatZSetScore(score))
 }
 
 func zcardCommandFunc(ctx Context) {
@@ -179,18 +206,21 @@ func zcountCommandFunc(ctx Context) {
 		return
 	}
 
-	var cnt = 0
-	member, score := typeZSetScan(ctx, ctx.args[1], 0)
-	if len(member) > 0 {
-		for _, c := range score {
-			if c == nil {
-				continue
-			}
-			if bytes.Compare(c, ctx.args[3]) != 1 && bytes.Compare(c, ctx.args[2]) != -1 {
-				cnt++
-			}
-		}
+	min, err := parseZSetRange(ctx.args[2], true)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
+	}
+	max, err := parseZSetRange(ctx.args[3], false)
+	if err != nil {
+		ctx.Conn.WriteError(err.Error())
+		return
 	}
+
+	var cnt = 0
+	typeZSetScanScore(ctx, key, min, max, func(score float64, member []byte) {
+		cnt++
+	})
 	ctx.Conn.WriteInt(cnt)
 }
 
@@ -216,8 +246,8 @@ func zremCommandFunc(ctx Context) {
 	var keysToDel [][]byte
 	for i := 2; i <= len(ctx.args[1:]); i++ {
 		member := typeZSetMarshalMember(key, ctx.args[i])
-		score, err := ctx.db.Get(member)
-		if err != nil {
+		score, ok, err := typeZSetGetScore(ctx, key, ctx.args[i])
+		if err != nil || !ok {
 			continue
 		}
 		scoreKey := typeZSetMarshalScore(key, score, ctx.args[i])
@@ -238,6 +268,13 @@ func zremCommandFunc(ctx Context) {
 		}
 	}
 
+	if cnt > 0 {
+		ctx.notify(notifyZSet, "zrem", key)
+		if zsetSize == 0 {
+			ctx.notify(notifyGeneric, "del", key)
+		}
+	}
+
 	ctx.Conn.WriteInt64(int64(cnt))
 }
 
@@ -255,7 +292,7 @@ func typeZSetScan(ctx Context, key []byte, cnt int64) ([][]byte, [][]byte) {
 	prefixBuff.Write(keySize)
 	prefixBuff.Write(key)
 
-	scanOpts := badger.ScannerOptions{
+	scanOpts := storage.ScannerOptions{
 		Prefix:      prefixBuff.Bytes(),
 		FetchValues: true,
 		Handler:     scanFunc,
@@ -277,18 +314,169 @@ func typeZSetMarshalMember(key, member []byte) []byte {
 	return memberBuff.Bytes()
 }
 
-func typeZSetMarshalScore(key, score, member []byte) []byte {
+// typeZSetScanScore calls fn for every member of key whose score is within
+// min and max, both inclusive, in numerical order.
+func typeZSetScanScore(ctx Context, key []byte, min, max float64, fn func(score float64, member []byte)) {
+	if min > max {
+		return
+	}
+
+	var prefix = typeZSetScorePrefix(key)
+	var scanFunc = func(k, v []byte) {
+		// the bound lets through the empty member of the next score
+		if score := bytesToZSetScore(k[len(prefix) : len(prefix)+8]); score <= max {
+			fn(score, k[len(prefix)+8:])
+		}
+	}
+
+	scanOpts := storage.ScannerOptions{
+		Prefix:      prefix,
+		Start:       append(typeZSetScorePrefix(key), zsetScoreToBytes(min)...),
+		FetchValues: false,
+		Handler:     scanFunc,
+	}
+	if !math.IsInf(max, 1) {
+		// keys with a score equal to max are longer than the bound, stop
+		// at the next representable score instead
+		scanOpts.End = append(typeZSetScorePrefix(key), zsetScoreToBytes(math.Nextafter(max, math.Inf(1)))...)
+	}
+	ctx.db.Scan(scanOpts)
+}
+
+// typeZSetGetScore returns the score of member, and whether it exists.
+func typeZSetGetScore(ctx Context, key, member []byte) (float64, bool, error) {
+	val, err := ctx.db.Get(typeZSetMarshalMember(key, member))
+	if err != nil {
+		if err.Error() == ErrKeyNotExist {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	score, err := strconv.ParseFloat(string(val), 64)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return score, true, nil
+}
+
+// typeZSetSetScore sets the score of member and moves it in the score index,
+// it returns whether the member already existed. The size kept in the meta
+// is left to the caller.
+func typeZSetSetScore(ctx Context, key, member []byte, score float64) (bool, error) {
+	old, existed, err := typeZSetGetScore(ctx, key, member)
+	if err != nil {
+		return false, err
+	}
+	if existed {
+		err = ctx.db.Del([][]byte{typeZSetMarshalScore(key, old, member)})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = ctx.db.Set(typeZSetMarshalMember(key, member), []byte(formatZSetScore(score)), 0)
+	if err != nil {
+		return false, err
+	}
+	err = ctx.db.Set(typeZSetMarshalScore(key, score, member), nil, 0)
+
+	return existed, err
+}
+
+func typeZSetScorePrefix(key []byte) []byte {
 	var keySize = uint32ToBytes(typeZSetKeySize, uint32(len(key)))
-	scoreBuff := bytes.NewBuffer([]byte{})
-	scoreBuff.Write(typeZSet)
-	scoreBuff.Write(keySize)
-	scoreBuff.Write(key)
-	scoreBuff.Write(score)
+	prefixBuff := bytes.NewBuffer([]byte{})
+	prefixBuff.Write(typeZSetScore)
+	prefixBuff.Write(keySize)
+	prefixBuff.Write(key)
+
+	return prefixBuff.Bytes()
+}
+
+func typeZSetMarshalScore(key []byte, score float64, member []byte) []byte {
+	scoreBuff := bytes.NewBuffer(typeZSetScorePrefix(key))
+	scoreBuff.Write(zsetScoreToBytes(score))
 	scoreBuff.Write(member)
 
 	return scoreBuff.Bytes()
 }
 
+// zsetScoreToBytes encodes score so that the byte order of the encodings is
+// the numerical order of the scores: the sign bit of positive numbers is
+// flipped, and every bit of negative ones.
+func zsetScoreToBytes(score float64) []byte {
+	var bits = math.Float64bits(score)
+	if bits>>63 == 0 {
+		bits |= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	return uint64ToBytes(8, bits)
+}
+
+func bytesToZSetScore(b []byte) float64 {
+	var bits = bytesToUint64(b)
+	if bits>>63 == 1 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	return math.Float64frombits(bits)
+}
+
+func parseZSetScore(arg []byte) (float64, error) {
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New(ErrFloat)
+	}
+	if score == 0 {
+		// -0 and 0 are the same score
+		score = 0
+	}
+
+	return score, nil
+}
+
+// parseZSetRange parses a min or max argument of ZCOUNT, an exclusive bound
+// prefixed by "(" is turned into the next representable score.
+func parseZSetRange(arg []byte, min bool) (float64, error) {
+	var exclusive = len(arg) > 0 && arg[0] == '('
+	if exclusive {
+		arg = arg[1:]
+	}
+
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New(ErrScoreRange)
+	}
+	if exclusive {
+		if min {
+			score = math.Nextafter(score, math.Inf(1))
+		} else {
+			score = math.Nextafter(score, math.Inf(-1))
+		}
+	}
+
+	return score, nil
+}
+
+func formatZSetScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case math.Abs(score) < 1e21:
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	}
+
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
 func typeZSetGetMeta(ctx Context, key []byte) ([]byte, error) {
 	metaValue, err := ctx.db.Get(key)
 	if err != nil && err.Error() == ErrKeyNotExist {
@@ -305,5 +493,98 @@ func typeZSetGetMeta(ctx Context, key []byte) ([]byte, error) {
 }
 
 func typeZSetSetMeta(ctx Context, key []byte, size uint32) error {
-	return ctx.db.Set(key, append(typeZSet, uint32ToBytes(typeZSetKeySize, size)...), 0)
+	return ctx.db.Set(key, typeZSetMetaVal(size), 0)
+}
+
+func typeZSetMetaVal(size uint32) []byte {
+	var meta = append(typeZSet, uint32ToBytes(typeZSetKeySize, size)...)
+	return append(meta, zsetFormatScoreIndex)
+}
+
+// typeZSetLegacy tells whether the meta value of a sorted set is the one of
+// the format before zsetFormatScoreIndex.
+func typeZSetLegacy(meta []byte) bool {
+	return len(meta) == len(typeZSet)+typeZSetKeySize && string(meta[:1]) == string(typeZSet)
+}
+
+// migrateZSets moves the sorted sets written before zsetFormatScoreIndex to
+// the numerically ordered score index, dropping their old index keys. It
+// runs when the store is opened, before any command.
+func migrateZSets(db *raptor.Raptor) error {
+	var legacy [][]byte
+	err := db.View(func(snap storage.Reader) error {
+		return typeObjectScanKeys(snap, func(k []byte) {
+			if meta, err := snap.Get(k); err == nil && typeZSetLegacy(meta) {
+				legacy = append(legacy, append([]byte{}, k...))
+			}
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range legacy {
+		if err = typeZSetMigrate(db, key); err != nil {
+			return fmt.Errorf("migrating the sorted set %q: %v", key, err)
+		}
+	}
+	if len(legacy) > 0 {
+		log.Printf("migrated the score index of %d sorted sets", len(legacy))
+	}
+
+	return nil
+}
+
+// typeZSetMigrate rewrites the legacy sorted set stored at key. The meta
+// goes last with the format version, so that an interrupted migration is
+// done again at the next start.
+func typeZSetMigrate(db *raptor.Raptor, key []byte) error {
+	var (
+		prefix  = typeObjectPrefixes(key, storage.ObjectZset)[0]
+		entries []storage.Entry
+		size    uint32
+	)
+	err := db.Scan(storage.ScannerOptions{
+		Prefix:      prefix,
+		FetchValues: true,
+		Handler: func(k, v []byte) {
+			k = append([]byte{}, k...)
+			if len(v) == 0 {
+				entries = append(entries, storage.Entry{Key: k, Delete: true})
+				return
+			}
+
+			// the scores were kept as given, the invalid ones count as 0
+			score, err := parseZSetScore(v)
+			if err != nil {
+				score = 0
+			}
+			var member = k[len(prefix):]
+			entries = append(entries,
+				storage.Entry{Key: k, Value: []byte(formatZSetScore(score))},
+				storage.Entry{Key: typeZSetMarshalScore(key, score, member)},
+			)
+			size++
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for len(entries) > 0 {
+		var n = len(entries)
+		if n > typeObjectBatchSize {
+			n = typeObjectBatchSize
+		}
+		if err = db.WriteBatch(entries[:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+
+	at, err := db.ExpiresAt(key)
+	if err != nil {
+		return err
+	}
+	return db.WriteBatch([]storage.Entry{{Key: key, Value: typeZSetMetaVal(size), ExpiresAt: at}})
 }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/qichengzx/raptor/storage"
+	"math"
+	"testing"
+)
+
+func TestZSetScoreEncoding(t *testing.T) {
+	var scores = []float64{
+		math.Inf(-1), -math.MaxFloat64, -1e21, -1.5, -math.SmallestNonzeroFloat64,
+		math.Copysign(0, -1), 0, math.SmallestNonzeroFloat64, 1, 1.5, 1e21,
+		math.MaxFloat64, math.Inf(1),
+	}
+	for i, score := range scores {
+		b := zsetScoreToBytes(score)
+		if got := bytesToZSetScore(b); got != score || math.Signbit(got) != math.Signbit(score) {
+			t.Errorf("bytesToZSetScore(zsetScoreToBytes(%v)) = %v", score, got)
+		}
+		if i > 0 && bytes.Compare(zsetScoreToBytes(scores[i-1]), b) >= 0 {
+			t.Errorf("%v does not sort before %v", scores[i-1], score)
+		}
+	}
+
+	// -0 is stored as 0
+	if score, err := parseZSetScore([]byte("-0")); err != nil || math.Signbit(score) {
+		t.Errorf("parseZSetScore(-0) = %v %v", score, err)
+	}
+}
+
+func TestZSetScanScore(t *testing.T) {
+	var (
+		app = newTestApp(t)
+		c   = newTestClient(t, app)
+		ctx = Context{app: app, db: app.db}
+	)
+	// the empty member sorts first among the ones of its score
+	var next = math.Nextafter(2, math.Inf(1))
+	c.must(":5\r\n", "zadd", "z", "-inf", "a", "-0", "b", "2", "c", formatZSetScore(next), "", "inf", "d")
+
+	for _, tc := range []struct {
+		min, max float64
+		want     string
+	}{
+		{math.Inf(-1), math.Inf(1), `["a" "b" "c" "" "d"]`},
+		{0, 2, `["b" "c"]`},
+		{math.Copysign(0, -1), 0, `["b"]`},
+		{2, 2, `["c"]`},
+		{next, next, `[""]`},
+		{math.Inf(1), math.Inf(1), `["d"]`},
+		{3, 1, `[]`},
+	} {
+		var members = []string{}
+		typeZSetScanScore(ctx, []byte("z"), tc.min, tc.max, func(score float64, member []byte) {
+			members = append(members, string(member))
+		})
+		if got := fmt.Sprintf("%q", members); got != tc.want {
+			t.Errorf("members from %v to %v = %s, want %s", tc.min, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestZSetMigrate(t *testing.T) {
+	var (
+		app = newTestApp(t)
+		c   = newTestClient(t, app)
+		key = []byte("old")
+	)
+
+	// a sorted set of the format before the score index
+	var prefix = typeObjectPrefixes(key, "Z")[0]
+	var legacy = map[string]string{"a": "10", "b": "-3", "c": "x"}
+	for member, score := range legacy {
+		app.db.Set(append(append([]byte{}, prefix...), member...), []byte(score), 0)
+		app.db.Set(append(append(append([]byte{}, prefix...), score...), member...), nil, 0)
+	}
+	app.db.Set(key, append([]byte("Z"), uint32ToBytes(typeZSetKeySize, 3)...), 0)
+	app.db.Expire(key, 100)
+
+	if err := migrateZSets(app.db); err != nil {
+		t.Fatal(err)
+	}
+	c.must(":3\r\n", "zcard", "old")
+	c.must(":3\r\n", "zcount", "old", "-inf", "+inf")
+	c.must(":2\r\n", "zcount", "old", "-5", "0")
+	c.must("$2\r\n10\r\n", "zscore", "old", "a")
+	c.must("$1\r\n0\r\n", "zscore", "old", "c")
+	if ttl, _ := app.db.TTL(key); ttl < 99 {
+		t.Errorf("TTL after the migration %d", ttl)
+	}
+
+	var keys int
+	app.db.Scan(storage.ScannerOptions{Prefix: prefix, Handler: func(k, v []byte) { keys++ }})
+	if keys != len(legacy) {
+		t.Errorf("%d keys left under the member prefix, want %d", keys, len(legacy))
+	}
+
+	// migrated once
+	meta, _ := app.db.Get(key)
+	if typeZSetLegacy(meta) {
+		t.Fatal("the meta is still legacy")
+	}
+	if err := migrateZSets(app.db); err != nil {
+		t.Fatal(err)
+	}
+	c.must(":3\r\n", "zcount", "old", "-inf", "+inf")
+}
+
+func TestGeoHash(t *testing.T) {
+	var c = newTestClient(t, newTestApp(t))
+
+	// the examples of the Redis documentation
+	c.must(":2\r\n", "geoadd", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+	c.must("$16\r\n3479099956230698\r\n", "zscore", "Sicily", "Palermo")
+	c.must("$16\r\n3479447370796909\r\n", "zscore", "Sicily", "Catania")
+	c.must("*2\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n", "geohash", "Sicily", "Palermo", "Catania")
+	c.must("$11\r\n166274.1516\r\n", "geodist", "Sicily", "Palermo", "Catania")
+
+	// the centre of the box of a position is the position, give or take
+	// the size of the box
+	for _, p := range [][2]float64{{13.361389, 38.115556}, {-180, -85.05112878}, {179.999, 85.05}, {0, 0}, {-73.9857, 40.7484}} {
+		hash := geoEncode(p[0], p[1], geoStepMax)
+		lon, lat := geoDecode(hash.bits)
+		if math.Abs(lon-p[0]) > 1e-5 || math.Abs(lat-p[1]) > 1e-5 {
+			t.Errorf("geoDecode(geoEncode(%v)) = %v %v", p, lon, lat)
+		}
+		if again := geoEncode(lon, lat, geoStepMax); again != hash {
+			t.Errorf("%v: the centre of %x encodes to %x", p, hash.bits, again.bits)
+		}
+	}
+}
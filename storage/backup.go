@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// backupMagic starts the backups written by WriteEntries.
+const backupMagic = "RAPTORKV1"
+
+var (
+	ErrBackupFormat      = errors.New("not a backup of this storage engine")
+	ErrIncrementalBackup = errors.New("incremental backups are not supported by this storage engine")
+)
+
+// WriteEntries writes every key of snap, with its value and expiration, to
+// w. It is the backup format of the engines that have none of their own,
+// which only take full backups.
+func WriteEntries(w io.Writer, snap Reader) error {
+	var (
+		bw  = bufio.NewWriter(w)
+		buf [binary.MaxVarintLen64]byte
+		err error
+	)
+	var put = func(b []byte) {
+		if err == nil {
+			_, err = bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(b)))])
+		}
+		if err == nil {
+			_, err = bw.Write(b)
+		}
+	}
+
+	_, err = bw.WriteString(backupMagic)
+	scanErr := snap.Scan(ScannerOptions{
+		FetchValues: true,
+		Handler: func(k, v []byte) {
+			at, e := snap.ExpiresAt(k)
+			if e == ErrKeyNotFound {
+				return
+			}
+			if err == nil {
+				err = e
+			}
+			put(k)
+			put(v)
+			if err == nil {
+				_, err = bw.Write(buf[:binary.PutUvarint(buf[:], at)])
+			}
+		},
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// ReadEntries reads a backup written by WriteEntries, calling fn with every
+// entry not expired yet.
+func ReadEntries(r io.Reader, fn func(key, value []byte, expiresAt uint64) error) error {
+	var br = bufio.NewReader(r)
+	var magic = make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != backupMagic {
+		return ErrBackupFormat
+	}
+
+	var get = func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		var b = make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return b, err
+	}
+
+	for {
+		key, err := get()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := get()
+		var at uint64
+		if err == nil {
+			at, err = binary.ReadUvarint(br)
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		if at > 0 && at <= uint64(time.Now().Unix()) {
+			continue
+		}
+		if err := fn(key, value, at); err != nil {
+			return err
+		}
+	}
+}
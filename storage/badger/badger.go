@@ -1,44 +1,311 @@
 package badger
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
 	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+)
+
+const (
+	// loadMaxPendingWrites bounds the writes in flight while loading a backup
+	loadMaxPendingWrites = 256
+
+	// encryptedIndexCacheSize is the index cache of the encrypted stores
+	// when not set, badger requires one
+	encryptedIndexCacheSize = 64 << 20
 )
 
 type BadgerDB struct {
 	storage *badger.DB
+
+	// the value log GC, valueDir is empty in memory
+	valueDir      string
+	numCompactors int
+	gcMu          sync.Mutex // held by a GC or a flatten
+	statsMu       sync.Mutex
+	stats         storage.GCStats
+	done          chan struct{}
+}
+
+func init() {
+	storage.Register("badger", func(conf *config.Config) (storage.DB, error) {
+		db, err := Open(conf)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+// notFound turns the error of badger for a missing key into the one of the
+// storage package.
+func notFound(err error) error {
+	if err == badger.ErrKeyNotFound {
+		return storage.ErrKeyNotFound
+	}
+
+	return err
 }
 
 func Open(conf *config.Config) (*BadgerDB, error) {
-	opts := badger.DefaultOptions(conf.Raptor.Directory)
-	bdb, err := badger.Open(opts)
+	opts, err := Options(conf)
 	if err != nil {
 		return nil, err
 	}
+	bdb, err := badger.Open(opts)
+	if err != nil {
+		return nil, openError(err, opts)
+	}
 
-	db := new(BadgerDB)
-	db.storage = bdb
-	go (func() {
-		for db.storage.RunValueLogGC(0.5) == nil {
-			// cleaning ...
-		}
-	})()
+	db := &BadgerDB{
+		storage:       bdb,
+		numCompactors: opts.NumCompactors,
+		done:          make(chan struct{}),
+	}
+	if !opts.InMemory {
+		db.valueDir = opts.ValueDir
+	}
+	var s = &conf.Storage
+	if s.GCInterval > 0 {
+		quiet, _ := parseQuietHours(s.GCQuietHours)
+		go db.scheduleGC(s.GCInterval, s.GCDiscardRatio, quiet)
+	}
 
 	return db, nil
 }
 
-// Close close the db
+var compressions = map[string]options.CompressionType{
+	"none":   options.None,
+	"snappy": options.Snappy,
+	"zstd":   options.ZSTD,
+}
+
+// Options returns the options of badger for the storage section of conf,
+// after checking them. The settings left zero are set to the defaults of
+// badger, for conf to tell the options in use.
+func Options(conf *config.Config) (badger.Options, error) {
+	var (
+		s    = &conf.Storage
+		opts = badger.DefaultOptions(conf.Raptor.Directory)
+	)
+	if s.InMemory {
+		opts = badger.DefaultOptions("").WithInMemory(true)
+	}
+	opts.SyncWrites = s.SyncWrites
+
+	var sizes = []struct {
+		name     string
+		conf     *int64
+		opt      *int64
+		min, max int64
+	}{
+		{"memtable_size", &s.MemTableSize, &opts.MemTableSize, 1 << 20, math.MaxInt64},
+		{"block_cache_size", &s.BlockCacheSize, &opts.BlockCacheSize, 1 << 20, math.MaxInt64},
+		{"index_cache_size", &s.IndexCacheSize, &opts.IndexCacheSize, 0, math.MaxInt64},
+		{"value_threshold", &s.ValueThreshold, &opts.ValueThreshold, 1, 1 << 20},
+		{"value_log_file_size", &s.ValueLogFileSize, &opts.ValueLogFileSize, 1 << 20, 2<<30 - 1},
+	}
+	for _, size := range sizes {
+		if *size.conf == 0 {
+			*size.conf = *size.opt
+		}
+		if *size.conf < size.min || *size.conf > size.max {
+			return opts, fmt.Errorf("storage %s must be between %d and %d", size.name, size.min, size.max)
+		}
+		*size.opt = *size.conf
+	}
+
+	if s.Compression == "" {
+		s.Compression = "snappy"
+	}
+	compression, ok := compressions[strings.ToLower(s.Compression)]
+	if !ok {
+		return opts, fmt.Errorf("storage compression must be none, snappy or zstd, not %q", s.Compression)
+	}
+	opts.Compression = compression
+
+	if s.ZSTDLevel == 0 {
+		s.ZSTDLevel = opts.ZSTDCompressionLevel
+	}
+	if s.ZSTDLevel < 1 || s.ZSTDLevel > 22 {
+		return opts, fmt.Errorf("storage zstd_level must be between 1 and 22")
+	}
+	opts.ZSTDCompressionLevel = s.ZSTDLevel
+
+	if s.NumCompactors == 0 {
+		s.NumCompactors = opts.NumCompactors
+	}
+	if s.NumCompactors < 2 {
+		return opts, fmt.Errorf("storage num_compactors must be at least 2")
+	}
+	opts.NumCompactors = s.NumCompactors
+
+	if s.LogLevel == "" {
+		s.LogLevel = "info"
+	}
+	switch strings.ToLower(s.LogLevel) {
+	case "debug":
+		opts = opts.WithLoggingLevel(badger.DEBUG)
+	case "info":
+		opts = opts.WithLoggingLevel(badger.INFO)
+	case "warning":
+		opts = opts.WithLoggingLevel(badger.WARNING)
+	case "error":
+		opts = opts.WithLoggingLevel(badger.ERROR)
+	default:
+		return opts, fmt.Errorf("storage log_level must be debug, info, warning or error, not %q", s.LogLevel)
+	}
+
+	key, err := EncryptionKey(s)
+	if err != nil {
+		return opts, err
+	}
+	opts.EncryptionKey = key
+	if key != nil && s.IndexCacheSize == 0 {
+		s.IndexCacheSize = encryptedIndexCacheSize
+		opts.IndexCacheSize = s.IndexCacheSize
+	}
+
+	if s.EncryptionKeyRotationDuration == 0 {
+		s.EncryptionKeyRotationDuration = opts.EncryptionKeyRotationDuration
+	}
+	if s.EncryptionKeyRotationDuration < 0 {
+		return opts, errors.New("storage encryption_key_rotation_duration must be positive")
+	}
+	opts.EncryptionKeyRotationDuration = s.EncryptionKeyRotationDuration
+
+	if _, err := gcOptions(s); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// EncryptionKey reads the master key of encryption at rest, from the file or
+// the environment variable named by s, nil when neither is set. A newline
+// ending a key one byte too long is dropped.
+func EncryptionKey(s *config.Storage) ([]byte, error) {
+	var (
+		key  []byte
+		from string
+	)
+	switch {
+	case s.EncryptionKeyFile != "" && s.EncryptionKeyEnv != "":
+		return nil, errors.New("storage encryption_key_file and encryption_key_env can't be set together")
+	case s.EncryptionKeyFile != "":
+		data, err := os.ReadFile(s.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, from = data, "file "+s.EncryptionKeyFile
+	case s.EncryptionKeyEnv != "":
+		key, from = []byte(os.Getenv(s.EncryptionKeyEnv)), "environment variable "+s.EncryptionKeyEnv
+		if len(key) == 0 {
+			return nil, fmt.Errorf("storage encryption key: %s is not set", from)
+		}
+	default:
+		return nil, nil
+	}
+
+	var valid = func(n int) bool { return n == 16 || n == 24 || n == 32 }
+	if !valid(len(key)) && valid(len(key)-1) && key[len(key)-1] == '\n' {
+		key = key[:len(key)-1]
+	}
+	if !valid(len(key)) {
+		return nil, fmt.Errorf("storage encryption key of the %s must be 16, 24 or 32 bytes, not %d", from, len(key))
+	}
+
+	return key, nil
+}
+
+// openError tells what to do when the encryption key is missing or wrong.
+func openError(err error, opts badger.Options) error {
+	if !errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return err
+	}
+	if len(opts.EncryptionKey) == 0 {
+		return fmt.Errorf("the data directory %s is encrypted, set storage encryption_key_file or encryption_key_env", opts.Dir)
+	}
+
+	return fmt.Errorf("the encryption key does not match the one of the data directory %s", opts.Dir)
+}
+
+// Rekey encrypts the data keys of the store in the directory of conf,
+// opened with the encryption key of conf, with newKey instead. The data is
+// encrypted with the data keys, only them are rewritten. A store that is
+// not encrypted yet gets encrypted from then on, the tables written before
+// staying as they are until compacted. It must run while the server is
+// stopped.
+func Rekey(conf *config.Config, newKey []byte) error {
+	if newKey == nil {
+		return errors.New("a new encryption key is needed, load a backup into an empty directory to decrypt a store")
+	}
+	opts, err := Options(conf)
+	if err != nil {
+		return err
+	}
+	if opts.InMemory {
+		return errors.New("an in-memory store has no keys to rekey")
+	}
+
+	// checks the current key, and that no server is running on the directory
+	bdb, err := badger.Open(opts)
+	if err != nil {
+		return openError(err, opts)
+	}
+	if err := bdb.Close(); err != nil {
+		return err
+	}
+
+	var kopts = badger.KeyRegistryOptions{
+		Dir:                           opts.Dir,
+		ReadOnly:                      true,
+		EncryptionKey:                 opts.EncryptionKey,
+		EncryptionKeyRotationDuration: opts.EncryptionKeyRotationDuration,
+	}
+	registry, err := badger.OpenKeyRegistry(kopts)
+	if err != nil {
+		return err
+	}
+	kopts.EncryptionKey = newKey
+	if err := badger.WriteKeyRegistry(registry, kopts); err != nil {
+		return err
+	}
+
+	opts.EncryptionKey = newKey
+	if opts.IndexCacheSize == 0 {
+		opts.IndexCacheSize = encryptedIndexCacheSize
+	}
+	bdb, err = badger.Open(opts)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Close()
+}
+
+// Close close the db, after the GC or the flatten running if any
 func (db *BadgerDB) Close() error {
+	close(db.done)
+	db.gcMu.Lock()
 	return db.storage.Close()
 }
 
 func (db *BadgerDB) Set(key, value []byte, ttl int) error {
 	return db.storage.Update(func(txn *badger.Txn) (err error) {
 		e := badger.NewEntry(key, value)
-		if ttl > 1 {
+		if ttl > 0 {
 			e.WithTTL(time.Duration(ttl) * time.Second)
 		}
 
@@ -62,7 +329,7 @@ func (db *BadgerDB) Get(key []byte) ([]byte, error) {
 		return nil
 	})
 
-	return data, err
+	return data, notFound(err)
 }
 
 func (db *BadgerDB) MSet(keys, values [][]byte) error {
@@ -79,6 +346,47 @@ func (db *BadgerDB) MSet(keys, values [][]byte) error {
 	return writer.Flush()
 }
 
+// MSetTTL is MSet with a TTL in seconds for every key, zero for none.
+func (db *BadgerDB) MSetTTL(keys, values [][]byte, ttls []int) error {
+	var err error
+	writer := db.storage.NewWriteBatch()
+	for i, key := range keys {
+		e := badger.NewEntry(key, values[i])
+		if ttls[i] > 0 {
+			e.WithTTL(time.Duration(ttls[i]) * time.Second)
+		}
+		err = writer.SetEntry(e)
+		if err != nil {
+			writer.Cancel()
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// WriteBatch makes the writes of entries in one batch, committed at once
+// unless too large for a transaction.
+func (db *BadgerDB) WriteBatch(entries []storage.Entry) error {
+	writer := db.storage.NewWriteBatch()
+	for _, entry := range entries {
+		var err error
+		if entry.Delete {
+			err = writer.Delete(entry.Key)
+		} else {
+			e := badger.NewEntry(entry.Key, entry.Value)
+			e.ExpiresAt = entry.ExpiresAt
+			err = writer.SetEntry(e)
+		}
+		if err != nil {
+			writer.Cancel()
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
 func (db *BadgerDB) MSetNX(keys, values [][]byte) error {
 	err := db.storage.Update(func(txn *badger.Txn) error {
 		writer := db.storage.NewWriteBatch()
@@ -114,7 +422,7 @@ func (db *BadgerDB) Del(key [][]byte) error {
 func (db *BadgerDB) Rename(key, newkey []byte, nx bool) error {
 	return db.storage.Update(func(txn *badger.Txn) error {
 		data, err := db.Get(key)
-		if err == badger.ErrKeyNotFound {
+		if err == storage.ErrKeyNotFound {
 			return errors.New("ERR no such key")
 		}
 
@@ -130,62 +438,89 @@ func (db *BadgerDB) Rename(key, newkey []byte, nx bool) error {
 	})
 }
 
-type ScannerOptions struct {
-	Offset      string
-	Count       int64
-	Prefix      []byte
-	FetchValues bool
-	Handler     func(k, v []byte)
+func (db *BadgerDB) Scan(scanOpts storage.ScannerOptions) error {
+	err := db.storage.View(func(txn *badger.Txn) error {
+		return scan(txn, scanOpts)
+	})
+
+	return err
 }
 
-func (db *BadgerDB) Scan(scanOpts ScannerOptions) error {
-	err := db.storage.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = scanOpts.FetchValues
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		start := func(it *badger.Iterator) {
-			if scanOpts.Offset == "" {
-				it.Rewind()
-			} else {
-				it.Seek([]byte(scanOpts.Offset))
-				if it.Valid() {
-					it.Next()
-				}
-			}
-		}
+func scan(txn *badger.Txn, scanOpts storage.ScannerOptions) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = scanOpts.FetchValues
 
-		var cnt int64 = 0
-		for start(it); it.Valid(); it.Next() {
-			if scanOpts.Prefix != nil && !it.ValidForPrefix(scanOpts.Prefix) {
-				continue
-			}
+	it := txn.NewIterator(opts)
+	defer it.Close()
 
-			var k, v []byte
+	seek, exclusive := scanOpts.Seek()
+	if seek != nil {
+		it.Seek(seek)
+	} else {
+		it.Rewind()
+	}
 
-			item := it.Item()
-			k = item.KeyCopy(nil)
+	var cnt int64 = 0
+	for ; it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if exclusive && bytes.Equal(key, seek) {
+			continue
+		}
+		match, stop := scanOpts.Match(key)
+		if stop {
+			break
+		}
+		if !match {
+			continue
+		}
 
-			if scanOpts.FetchValues {
-				v, _ = item.ValueCopy(nil)
-			}
+		var k, v []byte
 
-			if scanOpts.Handler != nil {
-				scanOpts.Handler(k, v)
-			}
+		item := it.Item()
+		k = item.KeyCopy(nil)
 
-			cnt++
-			if scanOpts.Count != 0 && cnt >= scanOpts.Count {
-				break
-			}
+		if scanOpts.FetchValues {
+			v, _ = item.ValueCopy(nil)
 		}
 
-		return nil
+		scanOpts.Visit(k, v, item.ExpiresAt())
+
+		cnt++
+		if scanOpts.Count != 0 && cnt >= scanOpts.Count {
+			break
+		}
+	}
+
+	return nil
+}
+
+// View calls fn with a point-in-time view of the store, which stays valid
+// until fn returns.
+func (db *BadgerDB) View(fn func(snap storage.Reader) error) error {
+	return db.storage.View(func(txn *badger.Txn) error {
+		return fn(&snapshot{txn: txn})
 	})
+}
 
-	return err
+type snapshot struct {
+	txn *badger.Txn
+}
+
+func (s *snapshot) Get(key []byte) ([]byte, error) {
+	item, err := s.txn.Get(key)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return item.ValueCopy(nil)
+}
+
+func (s *snapshot) Scan(opts storage.ScannerOptions) error {
+	return scan(s.txn, opts)
+}
+
+func (s *snapshot) ExpiresAt(key []byte) (uint64, error) {
+	return expiresAt(s.txn, key)
 }
 
 func (db *BadgerDB) FlushDB() error {
@@ -210,7 +545,7 @@ func (db *BadgerDB) TTL(key []byte) (int64, error) {
 		item, err := txn.Get(key)
 		if err == badger.ErrKeyNotFound {
 			ttl = -2
-			return err
+			return storage.ErrKeyNotFound
 		}
 
 		ttl = int64(item.ExpiresAt())
@@ -227,11 +562,32 @@ func (db *BadgerDB) TTL(key []byte) (int64, error) {
 	return ttl, err
 }
 
+// ExpiresAt returns the unix time in seconds at which key expires, zero for
+// keys without expiration.
+func (db *BadgerDB) ExpiresAt(key []byte) (uint64, error) {
+	var at uint64
+	err := db.storage.View(func(txn *badger.Txn) (err error) {
+		at, err = expiresAt(txn, key)
+		return err
+	})
+
+	return at, err
+}
+
+func expiresAt(txn *badger.Txn, key []byte) (uint64, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return 0, notFound(err)
+	}
+
+	return item.ExpiresAt(), nil
+}
+
 func (db *BadgerDB) Persist(key []byte) error {
 	return db.storage.Update(func(txn *badger.Txn) (err error) {
 		item, err := txn.Get(key)
 		if err == badger.ErrKeyNotFound {
-			return err
+			return storage.ErrKeyNotFound
 		}
 
 		if item.ExpiresAt() == 0 {
@@ -244,8 +600,29 @@ func (db *BadgerDB) Persist(key []byte) error {
 	})
 }
 
-func (db *BadgerDB) Sync() {
-	db.storage.Sync()
+func (db *BadgerDB) Sync() error {
+	return db.storage.Sync()
+}
+
+// Backup writes the entries changed after version since to w, all of them
+// when since is 0, and returns the since of the next incremental backup.
+func (db *BadgerDB) Backup(w io.Writer, since uint64) (uint64, error) {
+	// the iterators of badger v4 skip the versions <= since, the last
+	// version written is the next since as is
+	upto, err := db.storage.Backup(w, since)
+	if err != nil {
+		return 0, err
+	}
+	if upto < since {
+		return since, nil
+	}
+
+	return upto, nil
+}
+
+// Load applies a backup written by Backup.
+func (db *BadgerDB) Load(r io.Reader) error {
+	return db.storage.Load(r, loadMaxPendingWrites)
 }
 
 func (db *BadgerDB) ClearPrefix(prefix []byte) error {
@@ -0,0 +1,216 @@
+package badger
+
+import (
+	"fmt"
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/qichengzx/raptor/storage/storagetest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.DB {
+		var conf config.Config
+		conf.Raptor.Directory = t.TempDir()
+		db, err := Open(&conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestOptions(t *testing.T) {
+	var conf config.Config
+	conf.Raptor.Directory = "data"
+	opts, err := Options(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Storage.MemTableSize != opts.MemTableSize || conf.Storage.Compression != "snappy" ||
+		conf.Storage.NumCompactors != 4 || conf.Storage.LogLevel != "info" {
+		t.Fatalf("defaults not filled in: %+v", conf.Storage)
+	}
+
+	conf.Storage.SyncWrites = true
+	conf.Storage.Compression = "zstd"
+	conf.Storage.ZSTDLevel = 3
+	conf.Storage.ValueThreshold = 4096
+	if opts, err = Options(&conf); err != nil {
+		t.Fatal(err)
+	}
+	if !opts.SyncWrites || opts.ZSTDCompressionLevel != 3 || opts.ValueThreshold != 4096 {
+		t.Fatalf("options not applied: %+v", opts)
+	}
+
+	for _, bad := range []func(s *config.Storage){
+		func(s *config.Storage) { s.Compression = "lz4" },
+		func(s *config.Storage) { s.NumCompactors = 1 },
+		func(s *config.Storage) { s.ValueThreshold = 2 << 20 },
+		func(s *config.Storage) { s.ValueLogFileSize = 2 << 30 },
+		func(s *config.Storage) { s.MemTableSize = -1 },
+		func(s *config.Storage) { s.ZSTDLevel = 23 },
+		func(s *config.Storage) { s.LogLevel = "verbose" },
+		func(s *config.Storage) { s.GCDiscardRatio = 1 },
+		func(s *config.Storage) { s.GCQuietHours = "8-20" },
+		func(s *config.Storage) { s.GCQuietHours = "08:00-08:00" },
+	} {
+		var conf config.Config
+		bad(&conf.Storage)
+		if _, err := Options(&conf); err == nil {
+			t.Errorf("Options(%+v) succeeded", conf.Storage)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		conf config.Config
+	)
+	conf.Raptor.Directory = filepath.Join(dir, "data")
+	for name, key := range map[string]string{"old": strings.Repeat("k", 32) + "\n", "new": strings.Repeat("n", 16)} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(key), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var open = func(keyFile string) (*BadgerDB, error) {
+		conf.Storage = config.Storage{}
+		if keyFile != "" {
+			conf.Storage.EncryptionKeyFile = filepath.Join(dir, keyFile)
+		}
+		return Open(&conf)
+	}
+	var check = func(keyFile string) {
+		t.Helper()
+		db, err := open(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if v, err := db.Get([]byte("pii")); string(v) != "secret" {
+			t.Fatalf("Get = %q, %v", v, err)
+		}
+	}
+
+	// a store written in clear gets encrypted
+	db, err := open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("pii"), []byte("secret"), 0)
+	db.Close()
+	conf.Storage = config.Storage{}
+	if err := Rekey(&conf, []byte(strings.Repeat("k", 32))); err != nil {
+		t.Fatal(err)
+	}
+	check("old")
+
+	db, err = open("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("pii"), []byte("secret"), 0)
+	db.Close()
+	check("old")
+
+	if _, err := open(""); err == nil || !strings.Contains(err.Error(), "is encrypted") {
+		t.Fatalf("open without the key: %v", err)
+	}
+	if _, err := open("new"); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("open with another key: %v", err)
+	}
+
+	conf.Storage = config.Storage{EncryptionKeyFile: filepath.Join(dir, "old")}
+	if err := Rekey(&conf, []byte(strings.Repeat("n", 16))); err != nil {
+		t.Fatal(err)
+	}
+	check("new")
+	if _, err := open("old"); err == nil {
+		t.Fatal("the old key still opens the store")
+	}
+
+	conf.Storage = config.Storage{EncryptionKeyFile: filepath.Join(dir, "new")}
+	if err := Rekey(&conf, nil); err == nil {
+		t.Fatal("Rekey without a new key succeeded")
+	}
+	check("new")
+}
+
+func TestQuietHours(t *testing.T) {
+	for _, tt := range []struct {
+		window string
+		at     string
+		quiet  bool
+	}{
+		{"", "12:00", false},
+		{"08:00-20:00", "07:59", false},
+		{"08:00-20:00", "08:00", true},
+		{"08:00-20:00", "19:59", true},
+		{"08:00-20:00", "20:00", false},
+		{"22:30-06:00", "23:00", true},
+		{"22:30-06:00", "05:59", true},
+		{"22:30-06:00", "12:00", false},
+	} {
+		q, err := parseQuietHours(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at, _ := time.Parse("15:04", tt.at)
+		if q.contains(at) != tt.quiet {
+			t.Errorf("%q contains %s = %v", tt.window, tt.at, !tt.quiet)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	var conf config.Config
+	conf.Raptor.Directory = t.TempDir()
+	conf.Storage.ValueThreshold = 64
+	conf.Storage.MemTableSize = 1 << 20
+	conf.Storage.ValueLogFileSize = 1 << 20
+	conf.Storage.GCInterval = -1
+	conf.Storage.LogLevel = "error"
+	db, err := Open(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// overwritten enough for the tables to be compacted, which tells the
+	// value log which values are stale
+	var value = []byte(strings.Repeat("v", 128))
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 30000; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%d", i)), value, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Flatten(); err != nil {
+		t.Fatal(err)
+	}
+	reclaimed, err := db.GC(0.5)
+	if err != nil || reclaimed == 0 {
+		t.Fatalf("GC = %d, %v", reclaimed, err)
+	}
+
+	var st = db.GCStats()
+	if st.Runs != 1 || st.Flattens != 1 || st.Reclaimed != reclaimed || st.LastRun.IsZero() {
+		t.Fatalf("GCStats = %+v", st)
+	}
+	if v, err := db.Get([]byte("key29999")); string(v) != string(value) {
+		t.Fatalf("Get after GC = %d bytes, %v", len(v), err)
+	}
+
+	db.gcMu.Lock()
+	if _, err := db.GC(0.5); err != storage.ErrCompacting {
+		t.Fatalf("GC while running = %v", err)
+	}
+	db.gcMu.Unlock()
+}
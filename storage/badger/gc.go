@@ -0,0 +1,188 @@
+package badger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+)
+
+const (
+	// gcDefaultInterval and gcDefaultDiscardRatio are the settings of the
+	// scheduled value log GC when not set
+	gcDefaultInterval     = 10 * time.Minute
+	gcDefaultDiscardRatio = 0.5
+)
+
+// quietHours is a daily window, in minutes since midnight, that wraps
+// around midnight when from is after to.
+type quietHours struct {
+	from, to int
+}
+
+// parseQuietHours parses a window like "08:00-20:00", nil when s is empty.
+func parseQuietHours(s string) (*quietHours, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var bad = fmt.Errorf("storage gc_quiet_hours must be like 08:00-20:00, not %q", s)
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, bad
+	}
+	var q quietHours
+	for _, t := range []struct {
+		s   string
+		min *int
+	}{{from, &q.from}, {to, &q.to}} {
+		hm, err := time.Parse("15:04", strings.TrimSpace(t.s))
+		if err != nil {
+			return nil, bad
+		}
+		*t.min = hm.Hour()*60 + hm.Minute()
+	}
+	if q.from == q.to {
+		return nil, bad
+	}
+
+	return &q, nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+
+	var min = t.Hour()*60 + t.Minute()
+	if q.from < q.to {
+		return min >= q.from && min < q.to
+	}
+
+	return min >= q.from || min < q.to
+}
+
+// gcOptions checks the GC settings of s, setting the defaults of the ones
+// left zero.
+func gcOptions(s *config.Storage) (*quietHours, error) {
+	if s.GCInterval == 0 {
+		s.GCInterval = gcDefaultInterval
+	}
+	if s.GCDiscardRatio == 0 {
+		s.GCDiscardRatio = gcDefaultDiscardRatio
+	}
+	if s.GCDiscardRatio <= 0 || s.GCDiscardRatio >= 1 {
+		return nil, errors.New("storage gc_discard_ratio must be between 0 and 1, exclusive")
+	}
+
+	return parseQuietHours(s.GCQuietHours)
+}
+
+// scheduleGC runs the value log GC every interval, but in the quiet hours,
+// until the store is closed.
+func (db *BadgerDB) scheduleGC(interval time.Duration, discardRatio float64, quiet *quietHours) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case now := <-ticker.C:
+			if !quiet.contains(now) {
+				db.GC(discardRatio)
+			}
+		}
+	}
+}
+
+// GC rewrites the value log files with at least discardRatio of them stale,
+// one after another until none is left, returning the bytes reclaimed.
+func (db *BadgerDB) GC(discardRatio float64) (int64, error) {
+	if !db.gcMu.TryLock() {
+		return 0, storage.ErrCompacting
+	}
+	defer db.gcMu.Unlock()
+	db.setStats(func(st *storage.GCStats) { st.Running = true })
+
+	var before = db.valueLogSize()
+	var err error
+	for err == nil {
+		err = db.storage.RunValueLogGC(discardRatio)
+	}
+	if err == badger.ErrNoRewrite {
+		err = nil
+	}
+	var reclaimed = before - db.valueLogSize()
+	if reclaimed < 0 {
+		// written meanwhile
+		reclaimed = 0
+	}
+
+	db.setStats(func(st *storage.GCStats) {
+		st.Running = false
+		st.Runs++
+		st.Reclaimed += reclaimed
+		st.LastReclaimed = reclaimed
+		st.LastRun = time.Now()
+		st.LastErr = err
+	})
+
+	return reclaimed, err
+}
+
+// Flatten compacts every level of the tree into the last one, dropping the
+// keys deleted and expired from the tables.
+func (db *BadgerDB) Flatten() error {
+	if !db.gcMu.TryLock() {
+		return storage.ErrCompacting
+	}
+	defer db.gcMu.Unlock()
+	db.setStats(func(st *storage.GCStats) { st.Flattening = true })
+
+	err := db.storage.Flatten(db.numCompactors)
+
+	db.setStats(func(st *storage.GCStats) {
+		st.Flattening = false
+		st.Flattens++
+	})
+
+	return err
+}
+
+func (db *BadgerDB) GCStats() storage.GCStats {
+	db.statsMu.Lock()
+	defer db.statsMu.Unlock()
+
+	return db.stats
+}
+
+func (db *BadgerDB) setStats(fn func(st *storage.GCStats)) {
+	db.statsMu.Lock()
+	fn(&db.stats)
+	db.statsMu.Unlock()
+}
+
+// valueLogSize is the size of the value log files on disk. The one kept by
+// badger is only refreshed every minute.
+func (db *BadgerDB) valueLogSize() int64 {
+	if db.valueDir == "" {
+		return 0
+	}
+
+	files, _ := filepath.Glob(filepath.Join(db.valueDir, "*.vlog"))
+	var size int64
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			size += fi.Size()
+		}
+	}
+
+	return size
+}
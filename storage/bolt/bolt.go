@@ -0,0 +1,530 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// fileName is the file of the store in the data directory
+	fileName = "raptor.db"
+
+	// purgeInterval is how often the expired keys are dropped
+	purgeInterval = time.Second
+
+	// batchSize bounds the keys read by a transaction of Scan and the keys
+	// written by a transaction of Load or of the purge
+	batchSize = 1000
+)
+
+var (
+	keysBucket    = []byte("keys")
+	expiresBucket = []byte("expires")
+)
+
+// BoltDB keeps the keys in a bbolt file. The value of a key is stored after
+// its expiration, 8 bytes big endian. The keys with a TTL are also in the
+// expires bucket, as expiration and key, for the expired ones to be dropped
+// without looking at the others.
+type BoltDB struct {
+	bolt *bolt.DB
+	done chan struct{}
+}
+
+func init() {
+	storage.Register("bolt", func(conf *config.Config) (storage.DB, error) {
+		db, err := Open(conf)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+func Open(conf *config.Config) (*BoltDB, error) {
+	if err := os.MkdirAll(conf.Raptor.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	bdb, err := bolt.Open(filepath.Join(conf.Raptor.Directory, fileName), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, expiresBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+
+	db := &BoltDB{bolt: bdb, done: make(chan struct{})}
+	go db.purge()
+
+	return db, nil
+}
+
+func (db *BoltDB) Close() error {
+	close(db.done)
+	return db.bolt.Close()
+}
+
+func (db *BoltDB) purge() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+		}
+
+		for more := true; more; {
+			db.bolt.Update(func(tx *bolt.Tx) error {
+				var (
+					now     = unixNow()
+					expired [][]byte
+				)
+				c := tx.Bucket(expiresBucket).Cursor()
+				for k, _ := c.First(); k != nil && len(expired) < batchSize; k, _ = c.Next() {
+					if binary.BigEndian.Uint64(k) > now {
+						break
+					}
+					expired = append(expired, append([]byte(nil), k[8:]...))
+				}
+				for _, key := range expired {
+					remove(tx, key)
+				}
+				more = len(expired) == batchSize
+				return nil
+			})
+		}
+	}
+}
+
+func encode(value []byte, expiresAt uint64) []byte {
+	var buf = make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(buf, expiresAt)
+	copy(buf[8:], value)
+
+	return buf
+}
+
+func expiresKey(key []byte, expiresAt uint64) []byte {
+	return encode(key, expiresAt)
+}
+
+// lookup returns the value and expiration of key, a nil value if missing or
+// expired. The value is only valid during the transaction.
+func lookup(tx *bolt.Tx, key []byte) ([]byte, uint64) {
+	v := tx.Bucket(keysBucket).Get(key)
+	if v == nil {
+		return nil, 0
+	}
+	at := binary.BigEndian.Uint64(v)
+	if at > 0 && at <= unixNow() {
+		return nil, 0
+	}
+
+	return v[8:], at
+}
+
+func put(tx *bolt.Tx, key, value []byte, expiresAt uint64) error {
+	if err := remove(tx, key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(keysBucket).Put(key, encode(value, expiresAt)); err != nil {
+		return err
+	}
+	if expiresAt > 0 {
+		return tx.Bucket(expiresBucket).Put(expiresKey(key, expiresAt), nil)
+	}
+
+	return nil
+}
+
+func remove(tx *bolt.Tx, key []byte) error {
+	b := tx.Bucket(keysBucket)
+	v := b.Get(key)
+	if v == nil {
+		return nil
+	}
+	if at := binary.BigEndian.Uint64(v); at > 0 {
+		if err := tx.Bucket(expiresBucket).Delete(expiresKey(key, at)); err != nil {
+			return err
+		}
+	}
+
+	return b.Delete(key)
+}
+
+func (db *BoltDB) Set(key, value []byte, ttl int) error {
+	var at uint64
+	if ttl > 0 {
+		at = expireAt(ttl)
+	}
+
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return put(tx, key, value, at)
+	})
+}
+
+func (db *BoltDB) Get(key []byte) ([]byte, error) {
+	var data []byte
+	err := db.bolt.View(func(tx *bolt.Tx) (err error) {
+		data, err = get(tx, key)
+		return err
+	})
+
+	return data, err
+}
+
+func get(tx *bolt.Tx, key []byte) ([]byte, error) {
+	v, _ := lookup(tx, key)
+	if v == nil {
+		return nil, storage.ErrKeyNotFound
+	}
+
+	return append([]byte(nil), v...), nil
+}
+
+func (db *BoltDB) MSet(keys, values [][]byte) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		for i, key := range keys {
+			if err := put(tx, key, values[i], 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MSetTTL is MSet with a TTL in seconds for every key, zero for none.
+func (db *BoltDB) MSetTTL(keys, values [][]byte, ttls []int) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		for i, key := range keys {
+			var at uint64
+			if ttls[i] > 0 {
+				at = expireAt(ttls[i])
+			}
+			if err := put(tx, key, values[i], at); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteBatch makes the writes of entries in one transaction.
+func (db *BoltDB) WriteBatch(entries []storage.Entry) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		for _, e := range entries {
+			var err error
+			if e.Delete {
+				err = remove(tx, e.Key)
+			} else {
+				err = put(tx, e.Key, e.Value, e.ExpiresAt)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BoltDB) MSetNX(keys, values [][]byte) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if v, _ := lookup(tx, key); v != nil {
+				return errors.New("Key exists")
+			}
+		}
+		for i, key := range keys {
+			if err := put(tx, key, values[i], 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BoltDB) Del(keys [][]byte) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := remove(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BoltDB) Rename(key, newkey []byte, nx bool) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		data, err := get(tx, key)
+		if err != nil {
+			return errors.New("ERR no such key")
+		}
+		if nx {
+			if v, _ := lookup(tx, newkey); v != nil {
+				return errors.New("ERR newkey is exist")
+			}
+		}
+
+		if err := remove(tx, key); err != nil {
+			return err
+		}
+		return put(tx, newkey, data, 0)
+	})
+}
+
+// Scan reads the keys in batches, each in its own transaction, and calls
+// the handler between them, so that it may write to the store.
+func (db *BoltDB) Scan(opts storage.ScannerOptions) error {
+	var (
+		cnt       int64
+		seek, exc = opts.Seek()
+	)
+	for {
+		var limit = int64(batchSize)
+		if opts.Count != 0 && opts.Count-cnt < limit {
+			limit = opts.Count - cnt
+		}
+
+		var (
+			batch []storage.Entry
+			done  bool
+		)
+		err := db.bolt.View(func(tx *bolt.Tx) error {
+			done = scan(tx, opts, seek, exc, limit, func(k, v []byte, at uint64) {
+				batch = append(batch, storage.Entry{Key: k, Value: v, ExpiresAt: at})
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range batch {
+			opts.Visit(e.Key, e.Value, e.ExpiresAt)
+		}
+		cnt += int64(len(batch))
+		if done || (opts.Count != 0 && cnt >= opts.Count) {
+			return nil
+		}
+		seek, exc = batch[len(batch)-1].Key, true
+	}
+}
+
+// scan calls fn with at most limit keys, all of them when 0, and tells
+// whether there are no more.
+func scan(tx *bolt.Tx, opts storage.ScannerOptions, seek []byte, exclusive bool, limit int64, fn func(k, v []byte, at uint64)) bool {
+	var (
+		now = unixNow()
+		cnt int64
+		c   = tx.Bucket(keysBucket).Cursor()
+		k   []byte
+		v   []byte
+	)
+	if seek != nil {
+		k, v = c.Seek(seek)
+	} else {
+		k, v = c.First()
+	}
+	for ; k != nil; k, v = c.Next() {
+		if exclusive && bytes.Equal(k, seek) {
+			continue
+		}
+		match, stop := opts.Match(k)
+		if stop {
+			return true
+		}
+		at := binary.BigEndian.Uint64(v)
+		if !match || (at > 0 && at <= now) {
+			continue
+		}
+
+		var value []byte
+		if opts.FetchValues {
+			value = append([]byte(nil), v[8:]...)
+		}
+		fn(append([]byte(nil), k...), value, at)
+
+		cnt++
+		if limit != 0 && cnt >= limit {
+			return false
+		}
+	}
+
+	return true
+}
+
+// View calls fn with a read transaction, which stays valid until fn
+// returns.
+func (db *BoltDB) View(fn func(snap storage.Reader) error) error {
+	return db.bolt.View(func(tx *bolt.Tx) error {
+		return fn(&snapshot{tx: tx})
+	})
+}
+
+type snapshot struct {
+	tx *bolt.Tx
+}
+
+func (s *snapshot) Get(key []byte) ([]byte, error) {
+	return get(s.tx, key)
+}
+
+func (s *snapshot) Scan(opts storage.ScannerOptions) error {
+	seek, exc := opts.Seek()
+	scan(s.tx, opts, seek, exc, opts.Count, opts.Visit)
+
+	return nil
+}
+
+func (s *snapshot) ExpiresAt(key []byte) (uint64, error) {
+	return expiresAt(s.tx, key)
+}
+
+func (db *BoltDB) FlushDB() error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, expiresBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BoltDB) Expire(key []byte, seconds int) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		data, err := get(tx, key)
+		if err != nil {
+			return err
+		}
+		return put(tx, key, data, expireAt(seconds))
+	})
+}
+
+func (db *BoltDB) TTL(key []byte) (int64, error) {
+	at, err := db.ExpiresAt(key)
+	if err != nil {
+		return -2, err
+	}
+	if at == 0 {
+		return -1, nil
+	}
+
+	return int64(at) - time.Now().Unix(), nil
+}
+
+// ExpiresAt returns the unix time in seconds at which key expires, zero for
+// keys without expiration.
+func (db *BoltDB) ExpiresAt(key []byte) (uint64, error) {
+	var at uint64
+	err := db.bolt.View(func(tx *bolt.Tx) (err error) {
+		at, err = expiresAt(tx, key)
+		return err
+	})
+
+	return at, err
+}
+
+func expiresAt(tx *bolt.Tx, key []byte) (uint64, error) {
+	v, at := lookup(tx, key)
+	if v == nil {
+		return 0, storage.ErrKeyNotFound
+	}
+
+	return at, nil
+}
+
+func (db *BoltDB) Persist(key []byte) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		v, at := lookup(tx, key)
+		if v == nil {
+			return storage.ErrKeyNotFound
+		}
+		if at == 0 {
+			return errors.New("")
+		}
+		return put(tx, key, append([]byte(nil), v...), 0)
+	})
+}
+
+func (db *BoltDB) Sync() error {
+	return db.bolt.Sync()
+}
+
+// Backup writes every key to w. Incremental backups are not supported, the
+// since returned is always 0.
+func (db *BoltDB) Backup(w io.Writer, since uint64) (uint64, error) {
+	if since != 0 {
+		return 0, storage.ErrIncrementalBackup
+	}
+
+	return 0, db.View(func(snap storage.Reader) error {
+		return storage.WriteEntries(w, snap)
+	})
+}
+
+// Load applies a backup written by Backup, batchSize keys a transaction.
+func (db *BoltDB) Load(r io.Reader) error {
+	type entry struct {
+		key, value []byte
+		expiresAt  uint64
+	}
+	var batch []entry
+	var flush = func() error {
+		err := db.bolt.Update(func(tx *bolt.Tx) error {
+			for _, e := range batch {
+				if err := put(tx, e.key, e.value, e.expiresAt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	err := storage.ReadEntries(r, func(key, value []byte, expiresAt uint64) error {
+		batch = append(batch, entry{key, value, expiresAt})
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+func expireAt(seconds int) uint64 {
+	return uint64(time.Now().Unix() + int64(seconds))
+}
+
+func unixNow() uint64 {
+	return uint64(time.Now().Unix())
+}
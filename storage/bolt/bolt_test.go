@@ -0,0 +1,20 @@
+package bolt
+
+import (
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/qichengzx/raptor/storage/storagetest"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.DB {
+		var conf config.Config
+		conf.Raptor.Directory = t.TempDir()
+		db, err := Open(&conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
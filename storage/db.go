@@ -1,6 +1,19 @@
 package storage
 
-import "github.com/qichengzx/raptor/storage/badger"
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrKeyNotFound is returned by Get and the like for the keys missing, or
+// expired, in every engine.
+var ErrKeyNotFound = errors.New("Key not found")
+
+// ErrCompacting is returned by the Compactor methods while a GC or a
+// flatten is running already.
+var ErrCompacting = errors.New("a value log GC or a flatten is running already")
 
 type DB interface {
 	Close() error
@@ -10,20 +23,95 @@ type DB interface {
 	Get(key []byte) ([]byte, error)
 	MSet(keys, values [][]byte) error
 	MSetNX(keys, values [][]byte) error
+	MSetTTL(keys, values [][]byte, ttls []int) error
+	WriteBatch(entries []Entry) error
 
 	//database
 	Del(key [][]byte) error
 	Rename(key, newkey []byte, nx bool) error
-	Scan(opts badger.ScannerOptions) error
+	Scan(opts ScannerOptions) error
 	FlushDB() error
 
 	//expire
 	Expire(key []byte, seconds int) error
 	TTL(key []byte) (int64, error)
 	Persist(key []byte) error
+	ExpiresAt(key []byte) (uint64, error)
 
 	//server
-	Sync()
+	Sync() error
+	View(fn func(snap Reader) error) error
+	Backup(w io.Writer, since uint64) (uint64, error)
+	Load(r io.Reader) error
+}
+
+// Entry is a write of WriteBatch, setting Key to Value, expiring at the
+// unix time ExpiresAt in seconds if not zero, or deleting it.
+type Entry struct {
+	Key       []byte
+	Value     []byte
+	ExpiresAt uint64
+	Delete    bool
+}
+
+// Reader is the read side of the store, implemented by the store itself and
+// by the snapshots given by View.
+type Reader interface {
+	Get(key []byte) ([]byte, error)
+	Scan(opts ScannerOptions) error
+	ExpiresAt(key []byte) (uint64, error)
+}
+
+// ScannerOptions tells Scan which keys to visit, in order, and what to do
+// with them.
+type ScannerOptions struct {
+	Offset      string // start after Offset, exclusive
+	Count       int64
+	Prefix      []byte
+	Start       []byte // seek to Start, inclusive, instead of Offset
+	End         []byte // stop after the last key <= End
+	FetchValues bool
+	Handler     func(k, v []byte)
+	// EntryHandler, if set, is called instead of Handler with the
+	// expiration time of the key as well, the Delete field unset
+	EntryHandler func(e Entry)
+}
+
+// Visit passes a key to the handler of the scan.
+func (o ScannerOptions) Visit(k, v []byte, expiresAt uint64) {
+	switch {
+	case o.EntryHandler != nil:
+		o.EntryHandler(Entry{Key: k, Value: v, ExpiresAt: expiresAt})
+	case o.Handler != nil:
+		o.Handler(k, v)
+	}
+}
+
+// Seek returns the key an engine seeks to before visiting the keys, nil for
+// the first one, and whether a key equal to it is skipped.
+func (o ScannerOptions) Seek() (key []byte, exclusive bool) {
+	switch {
+	case o.Start != nil:
+		return o.Start, false
+	case o.Offset != "":
+		return []byte(o.Offset), true
+	}
+
+	return o.Prefix, false
+}
+
+// Match tells whether key, reached in order from Seek, is to be visited,
+// and stop whether no key after it can be.
+func (o ScannerOptions) Match(key []byte) (match, stop bool) {
+	if o.End != nil && bytes.Compare(key, o.End) > 0 {
+		return false, true
+	}
+	if o.Prefix != nil && !bytes.HasPrefix(key, o.Prefix) {
+		// the keys with the prefix are all in a row
+		return false, bytes.Compare(key, o.Prefix) > 0
+	}
+
+	return true, false
 }
 
 type ObjectType []byte
@@ -34,6 +122,7 @@ const (
 	ObjectHash   = "H"
 	ObjectSet    = "S"
 	ObjectZset   = "Z"
+	ObjectStream = "X"
 )
 
 var TypeName = map[string]string{
@@ -42,4 +131,29 @@ var TypeName = map[string]string{
 	ObjectHash:   "hash",
 	ObjectSet:    "set",
 	ObjectZset:   "zset",
+	ObjectStream: "stream",
+}
+
+// Compactor is implemented by the engines that reclaim the space of the
+// deleted and overwritten values in the background, badger only, for it to
+// be triggered on demand.
+type Compactor interface {
+	// GC rewrites the value log files with at least discardRatio of them
+	// stale, returning the bytes reclaimed.
+	GC(discardRatio float64) (int64, error)
+	// Flatten compacts every level of the tree into the last one.
+	Flatten() error
+	GCStats() GCStats
+}
+
+// GCStats tells what the value log GC of an engine did since it was opened.
+type GCStats struct {
+	Runs          int64
+	Reclaimed     int64 // bytes, over every run
+	LastReclaimed int64
+	LastRun       time.Time // zero when never run
+	LastErr       error
+	Running       bool
+	Flattens      int64
+	Flattening    bool
 }
@@ -0,0 +1,427 @@
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"github.com/qichengzx/raptor/config"
+	"github.com/qichengzx/raptor/storage"
+	"github.com/tidwall/btree"
+	"io"
+	"sync"
+	"time"
+)
+
+// purgeInterval is how often the expired keys are dropped
+const purgeInterval = time.Second
+
+// MemoryDB keeps the keys in an ordered tree in memory, nothing survives a
+// restart. The keys with a TTL are also in expires, ordered by expiration,
+// for the expired ones to be dropped without looking at the others.
+type MemoryDB struct {
+	mu      sync.RWMutex
+	keys    *btree.BTree
+	expires *btree.BTree
+
+	done chan struct{}
+}
+
+type item struct {
+	key       []byte
+	value     []byte
+	expiresAt uint64
+}
+
+func (it *item) expired(now uint64) bool {
+	return it.expiresAt > 0 && it.expiresAt <= now
+}
+
+func byKey(a, b interface{}) bool {
+	return bytes.Compare(a.(*item).key, b.(*item).key) < 0
+}
+
+func byExpiration(a, b interface{}) bool {
+	x, y := a.(*item), b.(*item)
+	if x.expiresAt != y.expiresAt {
+		return x.expiresAt < y.expiresAt
+	}
+
+	return bytes.Compare(x.key, y.key) < 0
+}
+
+func init() {
+	storage.Register("memory", func(conf *config.Config) (storage.DB, error) {
+		return Open(conf)
+	})
+}
+
+func Open(conf *config.Config) (*MemoryDB, error) {
+	db := &MemoryDB{
+		keys:    btree.NewNonConcurrent(byKey),
+		expires: btree.NewNonConcurrent(byExpiration),
+		done:    make(chan struct{}),
+	}
+	go db.purge()
+
+	return db, nil
+}
+
+func (db *MemoryDB) Close() error {
+	close(db.done)
+	return nil
+}
+
+func (db *MemoryDB) purge() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+		}
+
+		var now = unixNow()
+		db.mu.Lock()
+		for {
+			min, _ := db.expires.Min().(*item)
+			if min == nil || !min.expired(now) {
+				break
+			}
+			db.remove(min.key)
+		}
+		db.mu.Unlock()
+	}
+}
+
+// lookup returns the item of key, nil if missing or expired. db.mu must be
+// held.
+func (db *MemoryDB) lookup(key []byte) *item {
+	it, _ := db.keys.Get(&item{key: key}).(*item)
+	if it == nil || it.expired(unixNow()) {
+		return nil
+	}
+
+	return it
+}
+
+// put stores a new item for key, items are never changed in place as the
+// snapshots share them. db.mu must be held.
+func (db *MemoryDB) put(key, value []byte, expiresAt uint64) {
+	db.remove(key)
+
+	it := &item{
+		key:       append([]byte(nil), key...),
+		value:     append([]byte(nil), value...),
+		expiresAt: expiresAt,
+	}
+	db.keys.Set(it)
+	if expiresAt > 0 {
+		db.expires.Set(it)
+	}
+}
+
+func (db *MemoryDB) remove(key []byte) {
+	prev, _ := db.keys.Delete(&item{key: key}).(*item)
+	if prev != nil && prev.expiresAt > 0 {
+		db.expires.Delete(prev)
+	}
+}
+
+func (db *MemoryDB) Set(key, value []byte, ttl int) error {
+	var at uint64
+	if ttl > 0 {
+		at = expireAt(ttl)
+	}
+
+	db.mu.Lock()
+	db.put(key, value, at)
+	db.mu.Unlock()
+
+	return nil
+}
+
+func (db *MemoryDB) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return get(db.lookup(key))
+}
+
+func get(it *item) ([]byte, error) {
+	if it == nil {
+		return nil, storage.ErrKeyNotFound
+	}
+
+	return append([]byte(nil), it.value...), nil
+}
+
+func (db *MemoryDB) MSet(keys, values [][]byte) error {
+	db.mu.Lock()
+	for i, key := range keys {
+		db.put(key, values[i], 0)
+	}
+	db.mu.Unlock()
+
+	return nil
+}
+
+// MSetTTL is MSet with a TTL in seconds for every key, zero for none.
+func (db *MemoryDB) MSetTTL(keys, values [][]byte, ttls []int) error {
+	db.mu.Lock()
+	for i, key := range keys {
+		var at uint64
+		if ttls[i] > 0 {
+			at = expireAt(ttls[i])
+		}
+		db.put(key, values[i], at)
+	}
+	db.mu.Unlock()
+
+	return nil
+}
+
+// WriteBatch makes the writes of entries at once.
+func (db *MemoryDB) WriteBatch(entries []storage.Entry) error {
+	db.mu.Lock()
+	for _, e := range entries {
+		if e.Delete {
+			db.remove(e.Key)
+		} else {
+			db.put(e.Key, e.Value, e.ExpiresAt)
+		}
+	}
+	db.mu.Unlock()
+
+	return nil
+}
+
+func (db *MemoryDB) MSetNX(keys, values [][]byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, key := range keys {
+		if db.lookup(key) != nil {
+			return errors.New("Key exists")
+		}
+	}
+	for i, key := range keys {
+		db.put(key, values[i], 0)
+	}
+
+	return nil
+}
+
+func (db *MemoryDB) Del(keys [][]byte) error {
+	db.mu.Lock()
+	for _, key := range keys {
+		db.remove(key)
+	}
+	db.mu.Unlock()
+
+	return nil
+}
+
+func (db *MemoryDB) Rename(key, newkey []byte, nx bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	it := db.lookup(key)
+	if it == nil {
+		return errors.New("ERR no such key")
+	}
+	if nx && db.lookup(newkey) != nil {
+		return errors.New("ERR newkey is exist")
+	}
+
+	db.remove(key)
+	db.put(newkey, it.value, 0)
+
+	return nil
+}
+
+// Scan visits a copy of the tree, so that the handler may write to the
+// store.
+func (db *MemoryDB) Scan(opts storage.ScannerOptions) error {
+	db.mu.Lock()
+	keys := db.keys.Copy()
+	db.mu.Unlock()
+
+	return scan(keys, opts)
+}
+
+func scan(keys *btree.BTree, opts storage.ScannerOptions) error {
+	var (
+		now             = unixNow()
+		cnt       int64 = 0
+		seek, exc       = opts.Seek()
+		pivot     interface{}
+	)
+	if seek != nil {
+		pivot = &item{key: seek}
+	}
+
+	keys.Ascend(pivot, func(v interface{}) bool {
+		it := v.(*item)
+		if exc && bytes.Equal(it.key, seek) {
+			return true
+		}
+		match, stop := opts.Match(it.key)
+		if stop {
+			return false
+		}
+		if !match || it.expired(now) {
+			return true
+		}
+
+		var value []byte
+		if opts.FetchValues {
+			value = append([]byte(nil), it.value...)
+		}
+		opts.Visit(append([]byte(nil), it.key...), value, it.expiresAt)
+
+		cnt++
+		return opts.Count == 0 || cnt < opts.Count
+	})
+
+	return nil
+}
+
+// View calls fn with a copy of the tree, made in no time as the tree is
+// copied on write.
+func (db *MemoryDB) View(fn func(snap storage.Reader) error) error {
+	db.mu.Lock()
+	keys := db.keys.Copy()
+	db.mu.Unlock()
+
+	return fn(&snapshot{keys: keys})
+}
+
+type snapshot struct {
+	keys *btree.BTree
+}
+
+func (s *snapshot) lookup(key []byte) *item {
+	it, _ := s.keys.Get(&item{key: key}).(*item)
+	if it == nil || it.expired(unixNow()) {
+		return nil
+	}
+
+	return it
+}
+
+func (s *snapshot) Get(key []byte) ([]byte, error) {
+	return get(s.lookup(key))
+}
+
+func (s *snapshot) Scan(opts storage.ScannerOptions) error {
+	return scan(s.keys, opts)
+}
+
+func (s *snapshot) ExpiresAt(key []byte) (uint64, error) {
+	it := s.lookup(key)
+	if it == nil {
+		return 0, storage.ErrKeyNotFound
+	}
+
+	return it.expiresAt, nil
+}
+
+func (db *MemoryDB) FlushDB() error {
+	db.mu.Lock()
+	db.keys = btree.NewNonConcurrent(byKey)
+	db.expires = btree.NewNonConcurrent(byExpiration)
+	db.mu.Unlock()
+
+	return nil
+}
+
+func (db *MemoryDB) Expire(key []byte, seconds int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	it := db.lookup(key)
+	if it == nil {
+		return storage.ErrKeyNotFound
+	}
+	db.put(key, it.value, expireAt(seconds))
+
+	return nil
+}
+
+func (db *MemoryDB) TTL(key []byte) (int64, error) {
+	at, err := db.ExpiresAt(key)
+	if err != nil {
+		return -2, err
+	}
+	if at == 0 {
+		return -1, nil
+	}
+
+	return int64(at) - time.Now().Unix(), nil
+}
+
+// ExpiresAt returns the unix time in seconds at which key expires, zero for
+// keys without expiration.
+func (db *MemoryDB) ExpiresAt(key []byte) (uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	it := db.lookup(key)
+	if it == nil {
+		return 0, storage.ErrKeyNotFound
+	}
+
+	return it.expiresAt, nil
+}
+
+func (db *MemoryDB) Persist(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	it := db.lookup(key)
+	if it == nil {
+		return storage.ErrKeyNotFound
+	}
+	if it.expiresAt == 0 {
+		return errors.New("")
+	}
+	db.put(key, it.value, 0)
+
+	return nil
+}
+
+// Sync does nothing, there is nothing to write to disk.
+func (db *MemoryDB) Sync() error {
+	return nil
+}
+
+// Backup writes every key to w. Incremental backups are not supported, the
+// since returned is always 0.
+func (db *MemoryDB) Backup(w io.Writer, since uint64) (uint64, error) {
+	if since != 0 {
+		return 0, storage.ErrIncrementalBackup
+	}
+
+	return 0, db.View(func(snap storage.Reader) error {
+		return storage.WriteEntries(w, snap)
+	})
+}
+
+// Load applies a backup written by Backup.
+func (db *MemoryDB) Load(r io.Reader) error {
+	return storage.ReadEntries(r, func(key, value []byte, expiresAt uint64) error {
+		db.mu.Lock()
+		db.put(key, value, expiresAt)
+		db.mu.Unlock()
+		return nil
+	})
+}
+
+func expireAt(seconds int) uint64 {
+	return uint64(time.Now().Unix() + int64(seconds))
+}
+
+func unixNow() uint64 {
+	return uint64(time.Now().Unix())
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+var ErrOverlayUnsupported = errors.New("ERR not supported by the overlay")
+
+// Overlay is a store holding writes in memory on top of a base store, which
+// it reads through but never changes. It lets a command run and show what it
+// would write before the writes are made for real.
+type Overlay struct {
+	base    Reader
+	entries map[string]*overlayEntry
+	flushed bool
+}
+
+type overlayEntry struct {
+	value     []byte
+	deleted   bool
+	expiresAt uint64
+}
+
+func NewOverlay(base Reader) *Overlay {
+	return &Overlay{
+		base:    base,
+		entries: make(map[string]*overlayEntry),
+	}
+}
+
+func (o *Overlay) Close() error {
+	return nil
+}
+
+// lookup returns the entry of key in the overlay, nil when the base has the
+// say. Expired entries read as deleted.
+func (o *Overlay) lookup(key []byte) (*overlayEntry, bool) {
+	e, ok := o.entries[string(key)]
+	if !ok {
+		if o.flushed {
+			return &overlayEntry{deleted: true}, true
+		}
+		return nil, false
+	}
+	if e.expiresAt > 0 && e.expiresAt <= uint64(time.Now().Unix()) {
+		return &overlayEntry{deleted: true}, true
+	}
+
+	return e, true
+}
+
+func (o *Overlay) put(key, value []byte, expiresAt uint64) {
+	o.entries[string(key)] = &overlayEntry{
+		value:     append([]byte(nil), value...),
+		expiresAt: expiresAt,
+	}
+}
+
+func (o *Overlay) Get(key []byte) ([]byte, error) {
+	if e, ok := o.lookup(key); ok {
+		if e.deleted {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte(nil), e.value...), nil
+	}
+
+	return o.base.Get(key)
+}
+
+func (o *Overlay) ExpiresAt(key []byte) (uint64, error) {
+	if e, ok := o.lookup(key); ok {
+		if e.deleted {
+			return 0, ErrKeyNotFound
+		}
+		return e.expiresAt, nil
+	}
+
+	return o.base.ExpiresAt(key)
+}
+
+func (o *Overlay) TTL(key []byte) (int64, error) {
+	at, err := o.ExpiresAt(key)
+	if err != nil {
+		return -2, err
+	}
+	if at == 0 {
+		return -1, nil
+	}
+
+	return int64(at) - time.Now().Unix(), nil
+}
+
+func (o *Overlay) Set(key, value []byte, ttl int) error {
+	var at uint64
+	if ttl > 0 {
+		at = expireAt(ttl)
+	}
+	o.put(key, value, at)
+
+	return nil
+}
+
+func (o *Overlay) MSet(keys, values [][]byte) error {
+	for i, key := range keys {
+		o.put(key, values[i], 0)
+	}
+
+	return nil
+}
+
+func (o *Overlay) MSetNX(keys, values [][]byte) error {
+	for _, key := range keys {
+		if _, err := o.Get(key); err == nil {
+			return errors.New("Key exists")
+		}
+	}
+
+	return o.MSet(keys, values)
+}
+
+func (o *Overlay) MSetTTL(keys, values [][]byte, ttls []int) error {
+	for i, key := range keys {
+		var at uint64
+		if ttls[i] > 0 {
+			at = expireAt(ttls[i])
+		}
+		o.put(key, values[i], at)
+	}
+
+	return nil
+}
+
+func (o *Overlay) WriteBatch(entries []Entry) error {
+	for _, e := range entries {
+		if e.Delete {
+			o.entries[string(e.Key)] = &overlayEntry{deleted: true}
+		} else {
+			o.put(e.Key, e.Value, e.ExpiresAt)
+		}
+	}
+
+	return nil
+}
+
+// Entries returns the writes held by the overlay, in no order, and whether
+// the base is to be flushed before them.
+func (o *Overlay) Entries() (entries []Entry, flushed bool) {
+	for key, e := range o.entries {
+		entries = append(entries, Entry{
+			Key:       []byte(key),
+			Value:     e.value,
+			ExpiresAt: e.expiresAt,
+			Delete:    e.deleted,
+		})
+	}
+
+	return entries, o.flushed
+}
+
+func (o *Overlay) Del(keys [][]byte) error {
+	for _, key := range keys {
+		o.entries[string(key)] = &overlayEntry{deleted: true}
+	}
+
+	return nil
+}
+
+func (o *Overlay) Rename(key, newkey []byte, nx bool) error {
+	data, err := o.Get(key)
+	if err != nil {
+		return errors.New("ERR no such key")
+	}
+	if nx {
+		if _, err := o.Get(newkey); err == nil {
+			return errors.New("ERR newkey is exist")
+		}
+	}
+
+	o.Del([][]byte{key})
+	o.put(newkey, data, 0)
+
+	return nil
+}
+
+func (o *Overlay) FlushDB() error {
+	o.entries = make(map[string]*overlayEntry)
+	o.flushed = true
+
+	return nil
+}
+
+func (o *Overlay) Expire(key []byte, seconds int) error {
+	data, err := o.Get(key)
+	if err != nil {
+		return err
+	}
+	o.put(key, data, expireAt(seconds))
+
+	return nil
+}
+
+func (o *Overlay) Persist(key []byte) error {
+	data, err := o.Get(key)
+	if err != nil {
+		return err
+	}
+	if at, _ := o.ExpiresAt(key); at == 0 {
+		return errors.New("")
+	}
+	o.put(key, data, 0)
+
+	return nil
+}
+
+// Scan merges the keys of the overlay with the ones of the base, in order.
+// Offset is exclusive.
+func (o *Overlay) Scan(opts ScannerOptions) error {
+	var start = opts.Start
+	if start == nil && opts.Offset != "" {
+		start = []byte(opts.Offset)
+	}
+	var inRange = func(key []byte) bool {
+		if start != nil && bytes.Compare(key, start) < 0 {
+			return false
+		}
+		if opts.Start == nil && opts.Offset != "" && string(key) == opts.Offset {
+			return false
+		}
+		if opts.End != nil && bytes.Compare(key, opts.End) > 0 {
+			return false
+		}
+		return bytes.HasPrefix(key, opts.Prefix)
+	}
+
+	var base []Entry
+	if !o.flushed {
+		var baseOpts = opts
+		baseOpts.Offset, baseOpts.Start = "", start
+		if opts.Count != 0 {
+			// enough for the keys shadowed by the overlay and the offset
+			baseOpts.Count = opts.Count + int64(len(o.entries)) + 1
+		}
+		baseOpts.Handler = nil
+		baseOpts.EntryHandler = func(e Entry) {
+			if _, ok := o.entries[string(e.Key)]; !ok && inRange(e.Key) {
+				base = append(base, e)
+			}
+		}
+		if err := o.base.Scan(baseOpts); err != nil {
+			return err
+		}
+	}
+
+	var mine []Entry
+	for key := range o.entries {
+		if e, _ := o.lookup([]byte(key)); !e.deleted && inRange([]byte(key)) {
+			mine = append(mine, Entry{Key: []byte(key), Value: e.value, ExpiresAt: e.expiresAt})
+		}
+	}
+	sort.Slice(mine, func(i, j int) bool {
+		return bytes.Compare(mine[i].Key, mine[j].Key) < 0
+	})
+
+	var cnt int64
+	for len(base) > 0 || len(mine) > 0 {
+		var next Entry
+		if len(mine) == 0 || (len(base) > 0 && bytes.Compare(base[0].Key, mine[0].Key) < 0) {
+			next, base = base[0], base[1:]
+		} else {
+			next, mine = mine[0], mine[1:]
+		}
+
+		var v []byte
+		if opts.FetchValues {
+			v = append([]byte(nil), next.Value...)
+		}
+		opts.Visit(next.Key, v, next.ExpiresAt)
+
+		cnt++
+		if opts.Count != 0 && cnt >= opts.Count {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (o *Overlay) Sync() error {
+	return nil
+}
+
+// View calls fn with the overlay itself, which only changes through the
+// command running on it.
+func (o *Overlay) View(fn func(snap Reader) error) error {
+	return fn(o)
+}
+
+func (o *Overlay) Backup(w io.Writer, since uint64) (uint64, error) {
+	return 0, ErrOverlayUnsupported
+}
+
+func (o *Overlay) Load(r io.Reader) error {
+	return ErrOverlayUnsupported
+}
+
+func expireAt(seconds int) uint64 {
+	return uint64(time.Now().Unix() + int64(seconds))
+}
@@ -1,10 +1,51 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/qichengzx/raptor/config"
-	"github.com/qichengzx/raptor/storage/badger"
+	"sort"
+	"strings"
 )
 
+// DefaultEngine is the engine used when the config does not name one.
+const DefaultEngine = "badger"
+
+// Engine opens a store as configured.
+type Engine func(conf *config.Config) (DB, error)
+
+var engines = make(map[string]Engine)
+
+// Register makes an engine available to Open under name. The engines
+// register themselves from the init function of their package.
+func Register(name string, open Engine) {
+	if _, ok := engines[name]; ok {
+		panic("storage: engine " + name + " registered twice")
+	}
+	engines[name] = open
+}
+
+// Engines returns the names of the engines registered, sorted.
+func Engines() []string {
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Open opens the store with the engine named by the config.
 func Open(conf *config.Config) (DB, error) {
-	return badger.Open(conf)
+	var name = conf.Raptor.Engine
+	if name == "" {
+		name = DefaultEngine
+	}
+
+	open, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage engine %q, want one of %s", name, strings.Join(Engines(), ", "))
+	}
+
+	return open(conf)
 }
@@ -0,0 +1,419 @@
+// Package storagetest is the conformance test suite of the storage engines,
+// each engine runs it from its own tests.
+package storagetest
+
+import (
+	"bytes"
+	"github.com/qichengzx/raptor/storage"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run runs the suite, open returning an empty store each time it is called.
+// The stores are closed by the suite.
+func Run(t *testing.T, open func(t *testing.T) storage.DB) {
+	var tests = []struct {
+		name string
+		fn   func(t *testing.T, db storage.DB)
+	}{
+		{"GetSet", testGetSet},
+		{"MSet", testMSet},
+		{"WriteBatch", testWriteBatch},
+		{"Del", testDel},
+		{"Rename", testRename},
+		{"Expire", testExpire},
+		{"Scan", testScan},
+		{"ScanWrite", testScanWrite},
+		{"ScanEntries", testScanEntries},
+		{"View", testView},
+		{"FlushDB", testFlushDB},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := open(t)
+			defer db.Close()
+			test.fn(t, db)
+		})
+	}
+
+	t.Run("Backup", func(t *testing.T) {
+		src, dst := open(t), open(t)
+		defer src.Close()
+		defer dst.Close()
+		testBackup(t, src, dst)
+	})
+}
+
+func mustGet(t *testing.T, db storage.Reader, key, want string) {
+	t.Helper()
+	v, err := db.Get([]byte(key))
+	if err != nil || string(v) != want {
+		t.Fatalf("Get(%q) = %q, %v, want %q", key, v, err, want)
+	}
+}
+
+func mustMiss(t *testing.T, db storage.Reader, key string) {
+	t.Helper()
+	if v, err := db.Get([]byte(key)); err != storage.ErrKeyNotFound {
+		t.Fatalf("Get(%q) = %q, %v, want ErrKeyNotFound", key, v, err)
+	}
+	if _, err := db.ExpiresAt([]byte(key)); err != storage.ErrKeyNotFound {
+		t.Fatalf("ExpiresAt(%q) err = %v, want ErrKeyNotFound", key, err)
+	}
+}
+
+func bs(keys ...string) [][]byte {
+	var b [][]byte
+	for _, k := range keys {
+		b = append(b, []byte(k))
+	}
+
+	return b
+}
+
+func scanKeys(t *testing.T, db storage.Reader, opts storage.ScannerOptions) string {
+	t.Helper()
+	var keys []string
+	opts.Handler = func(k, v []byte) {
+		if opts.FetchValues {
+			keys = append(keys, string(k)+"="+string(v))
+		} else {
+			keys = append(keys, string(k))
+		}
+	}
+	if err := db.Scan(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Join(keys, " ")
+}
+
+func testGetSet(t *testing.T, db storage.DB) {
+	mustMiss(t, db, "a")
+	if err := db.Set([]byte("a"), []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "a", "1")
+	db.Set([]byte("a"), []byte("2"), 0)
+	mustGet(t, db, "a", "2")
+
+	db.Set([]byte("empty"), nil, 0)
+	mustGet(t, db, "empty", "")
+
+	var big = bytes.Repeat([]byte("x"), 1<<20)
+	db.Set([]byte("big"), big, 0)
+	if v, _ := db.Get([]byte("big")); !bytes.Equal(v, big) {
+		t.Fatal("big value changed")
+	}
+
+	// the value returned is the caller's
+	v, _ := db.Get([]byte("a"))
+	v[0] = 'x'
+	mustGet(t, db, "a", "2")
+}
+
+func testMSet(t *testing.T, db storage.DB) {
+	if err := db.MSet(bs("a", "b"), bs("1", "2")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "a", "1")
+	mustGet(t, db, "b", "2")
+
+	if err := db.MSetNX(bs("c", "b"), bs("3", "x")); err == nil {
+		t.Fatal("MSetNX over an existing key succeeded")
+	}
+	mustMiss(t, db, "c")
+	mustGet(t, db, "b", "2")
+	if err := db.MSetNX(bs("c", "d"), bs("3", "4")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "d", "4")
+
+	if err := db.MSetTTL(bs("e", "f"), bs("5", "6"), []int{100, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := db.TTL([]byte("e")); ttl < 98 || ttl > 100 {
+		t.Fatalf("TTL(e) = %d", ttl)
+	}
+	if ttl, _ := db.TTL([]byte("f")); ttl != -1 {
+		t.Fatalf("TTL(f) = %d", ttl)
+	}
+}
+
+func testWriteBatch(t *testing.T, db storage.DB) {
+	db.MSet(bs("a", "b"), bs("1", "2"))
+	var at = uint64(time.Now().Unix()) + 100
+	err := db.WriteBatch([]storage.Entry{
+		{Key: []byte("a"), Delete: true},
+		{Key: []byte("b"), Value: []byte("two")},
+		{Key: []byte("c"), Value: []byte("3"), ExpiresAt: at},
+		{Key: []byte("missing"), Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustMiss(t, db, "a")
+	mustGet(t, db, "b", "two")
+	mustGet(t, db, "c", "3")
+	if got, _ := db.ExpiresAt([]byte("c")); got != at {
+		t.Fatalf("ExpiresAt(c) = %d, want %d", got, at)
+	}
+}
+
+func testDel(t *testing.T, db storage.DB) {
+	db.MSet(bs("a", "b", "c"), bs("1", "2", "3"))
+	if err := db.Del(bs("a", "c", "missing")); err != nil {
+		t.Fatal(err)
+	}
+	mustMiss(t, db, "a")
+	mustGet(t, db, "b", "2")
+	mustMiss(t, db, "c")
+}
+
+func testRename(t *testing.T, db storage.DB) {
+	db.MSet(bs("a", "b"), bs("1", "2"))
+	if err := db.Rename([]byte("missing"), []byte("x"), false); err == nil {
+		t.Fatal("Rename of a missing key succeeded")
+	}
+	if err := db.Rename([]byte("a"), []byte("b"), true); err == nil {
+		t.Fatal("Rename NX over an existing key succeeded")
+	}
+	if err := db.Rename([]byte("a"), []byte("c"), true); err != nil {
+		t.Fatal(err)
+	}
+	mustMiss(t, db, "a")
+	mustGet(t, db, "c", "1")
+	if err := db.Rename([]byte("c"), []byte("b"), false); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "b", "1")
+}
+
+func testExpire(t *testing.T, db storage.DB) {
+	if ttl, err := db.TTL([]byte("a")); ttl != -2 || err == nil {
+		t.Fatalf("TTL(missing) = %d, %v", ttl, err)
+	}
+	if err := db.Expire([]byte("a"), 10); err != storage.ErrKeyNotFound {
+		t.Fatalf("Expire(missing) = %v", err)
+	}
+	if err := db.Persist([]byte("a")); err != storage.ErrKeyNotFound {
+		t.Fatalf("Persist(missing) = %v", err)
+	}
+
+	db.Set([]byte("a"), []byte("1"), 100)
+	at, err := db.ExpiresAt([]byte("a"))
+	if now := uint64(time.Now().Unix()); err != nil || at < now+98 || at > now+100 {
+		t.Fatalf("ExpiresAt(a) = %d, %v", at, err)
+	}
+	if err := db.Persist([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := db.TTL([]byte("a")); ttl != -1 {
+		t.Fatalf("TTL after Persist = %d", ttl)
+	}
+	if err := db.Persist([]byte("a")); err == nil {
+		t.Fatal("Persist of a key without TTL succeeded")
+	}
+	mustGet(t, db, "a", "1")
+
+	// the shortest TTL is kept too
+	db.Set([]byte("b"), []byte("2"), 1)
+	at, err = db.ExpiresAt([]byte("b"))
+	if now := uint64(time.Now().Unix()); err != nil || at < now || at > now+1 {
+		t.Fatalf("ExpiresAt(b) with a TTL of 1 = %d, %v", at, err)
+	}
+
+	if err := db.Expire([]byte("a"), 50); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := db.TTL([]byte("a")); ttl < 48 || ttl > 50 {
+		t.Fatalf("TTL after Expire = %d", ttl)
+	}
+	mustGet(t, db, "a", "1")
+
+	// expired keys are gone for every read
+	db.Set([]byte("b"), []byte("2"), 0)
+	db.MSet(bs("c"), bs("3"))
+	if err := db.Expire([]byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	mustMiss(t, db, "b")
+	if got := scanKeys(t, db, storage.ScannerOptions{}); got != "a c" {
+		t.Fatalf("Scan with an expired key = %q", got)
+	}
+	db.Set([]byte("b"), []byte("new"), 0)
+	mustGet(t, db, "b", "new")
+}
+
+func testScan(t *testing.T, db storage.DB) {
+	db.MSet(bs("a", "b:1", "b:2", "b:3", "c", "d"), bs("0", "1", "2", "3", "4", "5"))
+
+	for _, c := range []struct {
+		opts storage.ScannerOptions
+		want string
+	}{
+		{storage.ScannerOptions{}, "a b:1 b:2 b:3 c d"},
+		{storage.ScannerOptions{Count: 2}, "a b:1"},
+		{storage.ScannerOptions{Prefix: []byte("b:")}, "b:1 b:2 b:3"},
+		{storage.ScannerOptions{Prefix: []byte("b:"), FetchValues: true}, "b:1=1 b:2=2 b:3=3"},
+		{storage.ScannerOptions{Prefix: []byte("b:"), Count: 2}, "b:1 b:2"},
+		{storage.ScannerOptions{Offset: "b:1"}, "b:2 b:3 c d"},
+		{storage.ScannerOptions{Offset: "b:1", Prefix: []byte("b:")}, "b:2 b:3"},
+		{storage.ScannerOptions{Offset: "b:15"}, "b:2 b:3 c d"},
+		{storage.ScannerOptions{Start: []byte("b:2")}, "b:2 b:3 c d"},
+		{storage.ScannerOptions{Start: []byte("b:2"), End: []byte("c")}, "b:2 b:3 c"},
+		{storage.ScannerOptions{Start: []byte("a"), Prefix: []byte("b:"), End: []byte("b:2")}, "b:1 b:2"},
+		{storage.ScannerOptions{Prefix: []byte("x")}, ""},
+	} {
+		if got := scanKeys(t, db, c.opts); got != c.want {
+			t.Errorf("Scan(%+v) = %q, want %q", c.opts, got, c.want)
+		}
+	}
+}
+
+// testScanWrite writes from the handler, as the deletion of the members of
+// an object does.
+func testScanWrite(t *testing.T, db storage.DB) {
+	var keys, values [][]byte
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, []byte{'k', byte(i >> 8), byte(i)})
+		values = append(values, []byte("v"))
+	}
+	db.MSet(keys, values)
+
+	var seen int
+	err := db.Scan(storage.ScannerOptions{
+		Prefix: []byte("k"),
+		Handler: func(k, v []byte) {
+			seen++
+			if err := db.Del([][]byte{k}); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	if err != nil || seen != len(keys) {
+		t.Fatalf("Scan saw %d keys, %v", seen, err)
+	}
+	if got := scanKeys(t, db, storage.ScannerOptions{}); got != "" {
+		t.Fatalf("keys left: %q", got)
+	}
+}
+
+// testScanEntries scans with EntryHandler, which gets the expiration times
+// along with the keys, in the store and in a snapshot.
+func testScanEntries(t *testing.T, db storage.DB) {
+	var at = uint64(time.Now().Unix()) + 100
+	db.WriteBatch([]storage.Entry{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2"), ExpiresAt: at},
+	})
+
+	var want = []storage.Entry{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2"), ExpiresAt: at},
+	}
+	var scan = func(r storage.Reader) {
+		t.Helper()
+		var got []storage.Entry
+		err := r.Scan(storage.ScannerOptions{
+			FetchValues:  true,
+			Handler:      func(k, v []byte) { t.Error("Handler called along with EntryHandler") },
+			EntryHandler: func(e storage.Entry) { got = append(got, e) },
+		})
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("Scan = %+v, %v, want %+v", got, err, want)
+		}
+	}
+	scan(db)
+	db.View(func(snap storage.Reader) error {
+		scan(snap)
+		return nil
+	})
+}
+
+func testView(t *testing.T, db storage.DB) {
+	db.MSet(bs("a", "b"), bs("1", "2"))
+	db.Set([]byte("c"), []byte("3"), 100)
+
+	var writes = make(chan struct{})
+	var done = make(chan struct{})
+	go func() {
+		<-writes
+		db.Set([]byte("a"), []byte("changed"), 0)
+		db.Del(bs("b"))
+		db.Set([]byte("d"), []byte("4"), 0)
+		close(done)
+	}()
+
+	err := db.View(func(snap storage.Reader) error {
+		close(writes)
+		select {
+		case <-done:
+		case <-time.After(100 * time.Millisecond):
+			// an engine may hold the writes until the view is over
+		}
+
+		mustGet(t, snap, "a", "1")
+		mustGet(t, snap, "b", "2")
+		mustMiss(t, snap, "d")
+		if at, err := snap.ExpiresAt([]byte("c")); err != nil || at == 0 {
+			t.Fatalf("ExpiresAt(c) = %d, %v", at, err)
+		}
+		if got := scanKeys(t, snap, storage.ScannerOptions{FetchValues: true}); got != "a=1 b=2 c=3" {
+			t.Fatalf("Scan of the snapshot = %q", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+	mustGet(t, db, "a", "changed")
+	mustMiss(t, db, "b")
+}
+
+func testFlushDB(t *testing.T, db storage.DB) {
+	db.MSet(bs("a", "b"), bs("1", "2"))
+	db.Set([]byte("c"), []byte("3"), 100)
+	if err := db.FlushDB(); err != nil {
+		t.Fatal(err)
+	}
+	if got := scanKeys(t, db, storage.ScannerOptions{}); got != "" {
+		t.Fatalf("keys left: %q", got)
+	}
+	db.Set([]byte("a"), []byte("new"), 0)
+	mustGet(t, db, "a", "new")
+}
+
+func testBackup(t *testing.T, src, dst storage.DB) {
+	src.MSet(bs("a", "b"), bs("1", "2"))
+	src.Set([]byte("c"), []byte("3"), 100)
+	src.Set([]byte("gone"), []byte("x"), 0)
+	src.Expire([]byte("gone"), 0)
+
+	var buf bytes.Buffer
+	if _, err := src.Backup(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var want, got = map[string]string{}, map[string]string{}
+	for db, m := range map[storage.DB]map[string]string{src: want, dst: got} {
+		db.Scan(storage.ScannerOptions{FetchValues: true, Handler: func(k, v []byte) {
+			at, _ := db.ExpiresAt(k)
+			m[string(k)] = string(v)
+			if at > 0 {
+				m[string(k)] += " ttl"
+			}
+		}})
+	}
+	if !reflect.DeepEqual(got, want) || len(got) != 3 {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+}